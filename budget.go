@@ -0,0 +1,182 @@
+package tuna
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/storage"
+)
+
+const (
+	BudgetActionStop     = "stop"
+	BudgetActionThrottle = "throttle"
+	BudgetActionSwitch   = "switch"
+
+	budgetPeriodHour    = "hour"
+	budgetPeriodDay     = "day"
+	budgetPeriodSession = "session"
+
+	budgetCheckInterval = 10 * time.Second
+
+	// budgetThrottleRatio is the ratio of limit at which throttle action starts
+	// throttling, so that spend approaches limit slowly before entry is stopped
+	// at limit.
+	budgetThrottleRatio = 0.9
+)
+
+// BudgetExceededError is returned by TunaEntry.Start when the entry is stopped
+// because one of its spend limits is reached.
+type BudgetExceededError struct {
+	Period string
+	Limit  common.Fixed64
+	Spent  common.Fixed64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("spend per %s %s reached limit %s", e.Period, e.Spent.String(), e.Limit.String())
+}
+
+func (e *BudgetExceededError) Unwrap() error {
+	return ErrBudgetExceeded
+}
+
+type budgetPayment struct {
+	time   time.Time
+	amount common.Fixed64
+}
+
+// budget tracks nanopay spend in rolling hour and day windows as well as in the
+// current session, and reports when a limit is reached.
+type budget struct {
+	perHour    common.Fixed64
+	perDay     common.Fixed64
+	perSession common.Fixed64
+	action     string
+
+	lock         sync.Mutex
+	payments     []budgetPayment
+	session      time.Time
+	sessionSpent common.Fixed64
+}
+
+func newBudget(perHour, perDay, perSession, action string) (*budget, error) {
+	b := &budget{action: strings.ToLower(strings.TrimSpace(action))}
+	limits := []struct {
+		s string
+		v *common.Fixed64
+	}{{perHour, &b.perHour}, {perDay, &b.perDay}, {perSession, &b.perSession}}
+	for _, limit := range limits {
+		if len(limit.s) == 0 {
+			continue
+		}
+		v, err := common.StringToFixed64(limit.s)
+		if err != nil {
+			return nil, err
+		}
+		*limit.v = v
+	}
+
+	if b.perHour == 0 && b.perDay == 0 && b.perSession == 0 {
+		return nil, nil
+	}
+
+	switch b.action {
+	case "":
+		b.action = BudgetActionStop
+	case BudgetActionStop, BudgetActionThrottle, BudgetActionSwitch:
+	default:
+		return nil, fmt.Errorf("unknown budget action %v", action)
+	}
+
+	return b, nil
+}
+
+// load restores spend of the last day from ledger so that hour and day limits
+// survive restarts.
+func (b *budget) load(ledger *storage.Ledger) error {
+	records, err := ledger.Query(&storage.LedgerQuery{
+		From: time.Now().Add(-24 * time.Hour),
+		Role: storage.LedgerRoleSpend,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, record := range records {
+		amount, err := common.StringToFixed64(record.Amount)
+		if err != nil || amount <= 0 {
+			continue
+		}
+		b.payments = append(b.payments, budgetPayment{time: time.Unix(record.Time, 0), amount: amount})
+	}
+
+	return nil
+}
+
+func (b *budget) add(amount common.Fixed64, session time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.session.Equal(session) {
+		b.session = session
+		b.sessionSpent = 0
+	}
+	b.sessionSpent += amount
+	b.payments = append(b.payments, budgetPayment{time: time.Now(), amount: amount})
+}
+
+// check returns a *BudgetExceededError if spend plus pending (not yet paid)
+// cost reaches any limit.
+func (b *budget) check(pending common.Fixed64, session time.Time) error {
+	return b.checkRatio(pending, session, 1)
+}
+
+// checkRatio returns a *BudgetExceededError if spend plus pending cost reaches
+// ratio of any limit. Limit of the error is the scaled one.
+func (b *budget) checkRatio(pending common.Fixed64, session time.Time, ratio float64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	var hourSpent, daySpent common.Fixed64
+	i := 0
+	for ; i < len(b.payments) && now.Sub(b.payments[i].time) > 24*time.Hour; i++ {
+	}
+	b.payments = b.payments[i:]
+	for _, p := range b.payments {
+		daySpent += p.amount
+		if now.Sub(p.time) <= time.Hour {
+			hourSpent += p.amount
+		}
+	}
+
+	sessionSpent := b.sessionSpent
+	if !b.session.Equal(session) {
+		sessionSpent = 0
+	}
+
+	limits := []struct {
+		period string
+		limit  common.Fixed64
+		spent  common.Fixed64
+	}{
+		{budgetPeriodSession, b.perSession, sessionSpent},
+		{budgetPeriodHour, b.perHour, hourSpent},
+		{budgetPeriodDay, b.perDay, daySpent},
+	}
+	for _, l := range limits {
+		if l.limit <= 0 {
+			continue
+		}
+		limit := common.Fixed64(float64(l.limit) * ratio)
+		if l.spent+pending >= limit {
+			return &BudgetExceededError{Period: l.period, Limit: limit, Spent: l.spent + pending}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package tuna
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/storage"
+)
+
+func TestNewBudget(t *testing.T) {
+	b, err := newBudget("", "", "", "")
+	if err != nil || b != nil {
+		t.Fatalf("budget without limits should be nil, got %v, %v", b, err)
+	}
+
+	b, err = newBudget("1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.action != BudgetActionStop {
+		t.Fatalf("default action %q, expected %q", b.action, BudgetActionStop)
+	}
+
+	if _, err := newBudget("1", "", "", "pause"); err == nil {
+		t.Fatal("unknown action should be rejected")
+	}
+	if _, err := newBudget("abc", "", "", ""); err == nil {
+		t.Fatal("invalid limit should be rejected")
+	}
+}
+
+func TestBudgetCheck(t *testing.T) {
+	b, err := newBudget("1", "1.5", "0.5", BudgetActionThrottle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := time.Now()
+
+	expectPeriod := func(err error, period string) {
+		t.Helper()
+		if len(period) == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		var budgetErr *BudgetExceededError
+		if !errors.As(err, &budgetErr) || budgetErr.Period != period {
+			t.Fatalf("expected %s limit reached, got %v", period, err)
+		}
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("%v should wrap ErrBudgetExceeded", err)
+		}
+	}
+
+	b.add(common.Fixed64(0.4*common.StorageFactor), session)
+	expectPeriod(b.check(0, session), "")
+	expectPeriod(b.checkRatio(0, session, budgetThrottleRatio), "")
+	expectPeriod(b.checkRatio(common.Fixed64(0.05*common.StorageFactor), session, budgetThrottleRatio), budgetPeriodSession)
+	expectPeriod(b.check(common.Fixed64(0.05*common.StorageFactor), session), "")
+	expectPeriod(b.check(common.Fixed64(0.1*common.StorageFactor), session), budgetPeriodSession)
+
+	// spend of previous session doesn't count in new session, but still counts
+	// in hour and day
+	session = session.Add(time.Second)
+	expectPeriod(b.check(0, session), "")
+	b.add(common.Fixed64(0.4*common.StorageFactor), session)
+	b.add(common.Fixed64(0.2*common.StorageFactor), session.Add(time.Second))
+	expectPeriod(b.check(0, session.Add(time.Second)), budgetPeriodHour)
+
+	// payments older than an hour only count in day
+	b.lock.Lock()
+	b.perSession = 0
+	for i := range b.payments {
+		b.payments[i].time = b.payments[i].time.Add(-2 * time.Hour)
+	}
+	b.lock.Unlock()
+	expectPeriod(b.check(0, session.Add(2*time.Second)), "")
+	expectPeriod(b.check(common.Fixed64(0.6*common.StorageFactor), session.Add(2*time.Second)), budgetPeriodDay)
+
+	// payments older than a day are dropped
+	b.lock.Lock()
+	for i := range b.payments {
+		b.payments[i].time = b.payments[i].time.Add(-24 * time.Hour)
+	}
+	b.lock.Unlock()
+	expectPeriod(b.check(common.Fixed64(0.49*common.StorageFactor), session.Add(2*time.Second)), "")
+	b.lock.Lock()
+	remaining := len(b.payments)
+	b.lock.Unlock()
+	if remaining != 0 {
+		t.Fatalf("%d payments older than a day are kept", remaining)
+	}
+}
+
+func TestBudgetLoad(t *testing.T) {
+	ledger := storage.NewLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	now := time.Now()
+	records := []*storage.UsageRecord{
+		{Time: now.Add(-30 * time.Minute).Unix(), Role: storage.LedgerRoleSpend, Amount: "0.6"},
+		{Time: now.Add(-2 * time.Hour).Unix(), Role: storage.LedgerRoleSpend, Amount: "0.5"},
+		{Time: now.Add(-25 * time.Hour).Unix(), Role: storage.LedgerRoleSpend, Amount: "5"},
+		{Time: now.Add(-10 * time.Minute).Unix(), Role: storage.LedgerRoleEarn, Amount: "5"},
+	}
+	for _, r := range records {
+		if err := ledger.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := newBudget("1", "1.5", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.load(ledger); err != nil {
+		t.Fatal(err)
+	}
+
+	session := time.Now()
+	if err := b.check(common.Fixed64(0.3*common.StorageFactor), session); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = b.check(common.Fixed64(0.4*common.StorageFactor), session)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Period != budgetPeriodHour {
+		t.Fatalf("expected hour limit reached after load, got %v", err)
+	}
+	b.lock.Lock()
+	b.perHour = 0
+	b.lock.Unlock()
+	err = b.check(common.Fixed64(0.4*common.StorageFactor), session)
+	if !errors.As(err, &budgetErr) || budgetErr.Period != budgetPeriodDay {
+		t.Fatalf("expected day limit reached after load, got %v", err)
+	}
+}
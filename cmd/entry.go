@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"strings"
 
@@ -102,6 +103,10 @@ func (e *EntryCommand) Execute(args []string) error {
 							err = te.Start(false)
 							if err != nil {
 								log.Println(err)
+								if errors.Is(err, tuna.ErrBudgetExceeded) {
+									log.Println("Service", service.Name, "stopped")
+									return
+								}
 							}
 						}
 					}(service, serviceInfo)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nknorg/tuna/storage"
+)
+
+const ledgerDateFormat = "2006-01-02"
+
+type LedgerCommand struct {
+	LedgerFile string `short:"f" long:"file" description:"Ledger file path" default:"ledger.jsonl"`
+	GroupBy    string `long:"by" description:"Group records by day, peer or recipient" default:"day" choice:"day" choice:"peer" choice:"recipient"`
+	From       string `long:"from" description:"Only include records at or after this UTC date (YYYY-MM-DD)"`
+	To         string `long:"to" description:"Only include records before this UTC date (YYYY-MM-DD)"`
+	Peer       string `long:"peer" description:"Only include records of this peer public key"`
+	Service    string `long:"service" description:"Only include records of this service"`
+	Recipient  string `long:"recipient" description:"Only include records of this recipient wallet address"`
+}
+
+var ledgerCommand LedgerCommand
+
+func (l *LedgerCommand) Execute(args []string) error {
+	query := &storage.LedgerQuery{
+		PeerKey:   l.Peer,
+		Service:   l.Service,
+		Recipient: l.Recipient,
+	}
+
+	var err error
+	if len(l.From) > 0 {
+		query.From, err = time.Parse(ledgerDateFormat, l.From)
+		if err != nil {
+			log.Fatalln("Parse from date error:", err)
+		}
+	}
+	if len(l.To) > 0 {
+		query.To, err = time.Parse(ledgerDateFormat, l.To)
+		if err != nil {
+			log.Fatalln("Parse to date error:", err)
+		}
+	}
+
+	records, err := storage.NewLedger(l.LedgerFile).Query(query)
+	if err != nil {
+		log.Fatalln("Read ledger error:", err)
+	}
+
+	summaries, err := storage.Summarize(records, l.GroupBy)
+	if err != nil {
+		log.Fatalln("Summarize ledger error:", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tRECORDS\tENTRY TO EXIT (MB)\tEXIT TO ENTRY (MB)\tSPENT (NKN)\tEARNED (NKN)\tFREE (MB)\tALLOCATED (NKN)\tFORWARDED (NKN)")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%.3f\t%.3f\t%s\t%s\t%.3f\t%s\t%s\n", s.Key, s.Records, float64(s.BytesEntryToExit)/(1<<20), float64(s.BytesExitToEntry)/(1<<20), s.Spent.String(), s.Earned.String(), float64(s.FreeBytes)/(1<<20), s.Allocated.String(), s.Forwarded.String())
+	}
+	return w.Flush()
+}
+
+func init() {
+	parser.AddCommand("ledger", "Summarize usage ledger", "Summarize spend and earnings recorded in usage ledger by day or by peer", &ledgerCommand)
+}
@@ -0,0 +1,240 @@
+package tuna
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nknorg/tuna/pb"
+)
+
+const (
+	snappyMaxBlockSize = 64 << 10
+	zstdWindowSize     = 1 << 20
+)
+
+var compressionAlgoMap = map[string]pb.CompressionAlgo{
+	"none":   pb.CompressionAlgo_COMPRESSION_ALGO_NONE,
+	"snappy": pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY,
+	"zstd":   pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD,
+}
+
+func ParseCompressionAlgo(compressionAlgoStr string) (pb.CompressionAlgo, error) {
+	if compressionAlgo, ok := compressionAlgoMap[strings.ToLower(strings.TrimSpace(compressionAlgoStr))]; ok {
+		return compressionAlgo, nil
+	}
+	return 0, fmt.Errorf("unknown compression algo %v", compressionAlgoStr)
+}
+
+func supportedCompressionAlgos() []pb.CompressionAlgo {
+	return []pb.CompressionAlgo{
+		pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD,
+		pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY,
+	}
+}
+
+func isCompressionAlgoSupported(algo pb.CompressionAlgo, algos []pb.CompressionAlgo) bool {
+	for _, a := range algos {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// getStreamCompressionAlgo returns the compression algo of service streams to
+// server, which is none if server doesn't support the one of service.
+func (c *Common) getStreamCompressionAlgo() pb.CompressionAlgo {
+	c.RLock()
+	defer c.RUnlock()
+	if !isCompressionAlgoSupported(c.compressionAlgo, c.remoteCompressionAlgos) {
+		return pb.CompressionAlgo_COMPRESSION_ALGO_NONE
+	}
+	return c.compressionAlgo
+}
+
+// wireReader and wireWriter are implemented by streams that transform data,
+// so that traffic is counted by bytes on wire instead of bytes piped.
+type wireReader interface {
+	wireBytesRead() uint64
+}
+
+type wireWriter interface {
+	wireBytesWritten() uint64
+}
+
+// wireBytesOf returns the bytes on wire counter of dest or src, or nil if
+// neither of them transforms data.
+func wireBytesOf(dest io.Writer, src io.Reader) func() uint64 {
+	if w, ok := dest.(wireWriter); ok {
+		return w.wireBytesWritten
+	}
+	if r, ok := src.(wireReader); ok {
+		return r.wireBytesRead
+	}
+	return nil
+}
+
+type countingReader struct {
+	io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddUint64(&r.n, uint64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddUint64(&w.n, uint64(n))
+	return n, err
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressedStream compresses data written to a stream and decompresses data
+// read from it. Data is flushed on every write so that interactive protocols
+// are not delayed.
+type compressedStream struct {
+	algo       pb.CompressionAlgo
+	reader     io.ReadCloser
+	writer     io.WriteCloser
+	wireReader *countingReader
+	wireWriter *countingWriter
+
+	readLock      sync.Mutex
+	decompressor  io.Reader
+	writeLock     sync.Mutex
+	compressor    compressWriter
+	isWriteClosed bool
+}
+
+// newCompressedStream returns a stream that reads compressed data from reader
+// and writes compressed data to writer, which are usually both directions of
+// the same stream.
+func newCompressedStream(reader io.ReadCloser, writer io.WriteCloser, algo pb.CompressionAlgo) (*compressedStream, error) {
+	s := &compressedStream{
+		algo:       algo,
+		reader:     reader,
+		writer:     writer,
+		wireReader: &countingReader{Reader: reader},
+		wireWriter: &countingWriter{Writer: writer},
+	}
+	switch algo {
+	case pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY:
+		s.compressor = s2.NewWriter(s.wireWriter, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+	case pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD:
+		compressor, err := zstd.NewWriter(
+			s.wireWriter,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithWindowSize(zstdWindowSize),
+		)
+		if err != nil {
+			return nil, err
+		}
+		s.compressor = compressor
+	default:
+		return nil, fmt.Errorf("unsupported compression algo %v", algo)
+	}
+	return s, nil
+}
+
+// Read lazily creates decompressor, as zstd decoder reads header of stream
+// when it's created.
+func (s *compressedStream) Read(b []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	if s.decompressor == nil {
+		switch s.algo {
+		case pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY:
+			s.decompressor = s2.NewReader(s.wireReader, s2.ReaderMaxBlockSize(snappyMaxBlockSize))
+		case pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD:
+			decompressor, err := zstd.NewReader(
+				s.wireReader,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderLowmem(true),
+				zstd.WithDecoderMaxWindow(zstdWindowSize),
+			)
+			if err != nil {
+				return 0, err
+			}
+			s.decompressor = decompressor.IOReadCloser()
+		}
+	}
+	return s.decompressor.Read(b)
+}
+
+func (s *compressedStream) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isWriteClosed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := s.compressor.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, s.compressor.Flush()
+}
+
+// Close writes the end of compressed data and closes both directions. The end
+// is skipped if a write is blocked, which is unblocked by closing the stream.
+func (s *compressedStream) Close() error {
+	if s.writeLock.TryLock() {
+		if !s.isWriteClosed {
+			s.isWriteClosed = true
+			s.compressor.Close()
+		}
+		s.writeLock.Unlock()
+	}
+
+	err := s.writer.Close()
+	s.reader.Close()
+	return err
+}
+
+// CloseWrite writes the end of compressed data and closes the write direction
+// of writer.
+func (s *compressedStream) CloseWrite() error {
+	w, ok := s.writer.(closeWriter)
+	if !ok {
+		return errors.New("stream doesn't support half-close")
+	}
+
+	s.writeLock.Lock()
+	if !s.isWriteClosed {
+		s.isWriteClosed = true
+		err := s.compressor.Close()
+		if err != nil {
+			s.writeLock.Unlock()
+			return err
+		}
+	}
+	s.writeLock.Unlock()
+
+	return w.CloseWrite()
+}
+
+func (s *compressedStream) wireBytesRead() uint64 {
+	return atomic.LoadUint64(&s.wireReader.n)
+}
+
+func (s *compressedStream) wireBytesWritten() uint64 {
+	return atomic.LoadUint64(&s.wireWriter.n)
+}
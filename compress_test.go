@@ -0,0 +1,152 @@
+package tuna
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+// newTestCompressedStreamPair returns compressed streams on both ends of a
+// loopback TCP conn.
+func newTestCompressedStreamPair(t *testing.T, algo pb.CompressionAlgo) (*compressedStream, *compressedStream) {
+	conn1, conn2 := newTestConnPair(t)
+	s1, err := newCompressedStream(conn1, conn1, algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newCompressedStream(conn2, conn2, algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s1.Close()
+		s2.Close()
+	})
+	return s1, s2
+}
+
+func TestCompressedStreamRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("tuna compressed stream "), 4096)
+	for _, algo := range supportedCompressionAlgos() {
+		s1, s2 := newTestCompressedStreamPair(t, algo)
+
+		// each write is flushed, so that it can be read before the next one
+		if _, err := s1.Write([]byte("hello")); err != nil {
+			t.Fatal(algo, err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(s2, b); err != nil {
+			t.Fatal(algo, err)
+		}
+		if !bytes.Equal(b, []byte("hello")) {
+			t.Fatalf("%v got %q, expected hello", algo, b)
+		}
+
+		go func() {
+			s1.Write(data)
+			s1.CloseWrite()
+		}()
+		b, err := io.ReadAll(s2)
+		if err != nil {
+			t.Fatal(algo, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%v got %d bytes, expected %d bytes", algo, len(b), len(data))
+		}
+
+		// reverse direction still works after close write
+		if _, err := s2.Write([]byte("world")); err != nil {
+			t.Fatal(algo, err)
+		}
+		if _, err := io.ReadFull(s1, b[:5]); err != nil {
+			t.Fatal(algo, err)
+		}
+		if !bytes.Equal(b[:5], []byte("world")) {
+			t.Fatalf("%v got %q, expected world", algo, b[:5])
+		}
+
+		if s1.wireBytesWritten() >= uint64(len(data)) {
+			t.Fatalf("%v wrote %d bytes on wire for %d bytes", algo, s1.wireBytesWritten(), len(data))
+		}
+		if s2.wireBytesRead() != s1.wireBytesWritten() {
+			t.Fatalf("%v read %d bytes on wire, expected %d", algo, s2.wireBytesRead(), s1.wireBytesWritten())
+		}
+	}
+
+	if _, err := newCompressedStream(nil, nil, pb.CompressionAlgo_COMPRESSION_ALGO_NONE); err == nil {
+		t.Fatal("compressed stream without compression algo should be rejected")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		algo        pb.CompressionAlgo
+		remoteAlgos []pb.CompressionAlgo
+		expected    pb.CompressionAlgo
+	}{
+		{pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD, supportedCompressionAlgos(), pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD},
+		{pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY, supportedCompressionAlgos(), pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY},
+		// server of old version doesn't send compression algos
+		{pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD, nil, pb.CompressionAlgo_COMPRESSION_ALGO_NONE},
+		{pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD, []pb.CompressionAlgo{pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY}, pb.CompressionAlgo_COMPRESSION_ALGO_NONE},
+		{pb.CompressionAlgo_COMPRESSION_ALGO_NONE, supportedCompressionAlgos(), pb.CompressionAlgo_COMPRESSION_ALGO_NONE},
+	} {
+		c := newTestCommon(t)
+		c.compressionAlgo = tc.algo
+		c.remoteCompressionAlgos = tc.remoteAlgos
+		if algo := c.getStreamCompressionAlgo(); algo != tc.expected {
+			t.Fatalf("%v with remote algos %v got %v, expected %v", tc.algo, tc.remoteAlgos, algo, tc.expected)
+		}
+	}
+
+	for s, expected := range map[string]pb.CompressionAlgo{
+		"zstd":    pb.CompressionAlgo_COMPRESSION_ALGO_ZSTD,
+		" Snappy": pb.CompressionAlgo_COMPRESSION_ALGO_SNAPPY,
+		"none":    pb.CompressionAlgo_COMPRESSION_ALGO_NONE,
+	} {
+		algo, err := ParseCompressionAlgo(s)
+		if err != nil || algo != expected {
+			t.Fatalf("%q is parsed as %v, %v, expected %v", s, algo, err, expected)
+		}
+	}
+	if _, err := ParseCompressionAlgo("gzip"); err == nil {
+		t.Fatal("unknown compression algo should be rejected")
+	}
+}
+
+func TestCopyCountsCompressedBytes(t *testing.T) {
+	data := bytes.Repeat([]byte("tuna compressed stream "), 4096)
+	for _, algo := range supportedCompressionAlgos() {
+		s1, s2 := newTestCompressedStreamPair(t, algo)
+
+		var written, read uint64
+		errChan := make(chan error, 1)
+		go func() {
+			err := Copy(s1, bytes.NewReader(data), &written)
+			s1.CloseWrite()
+			errChan <- err
+		}()
+		var b bytes.Buffer
+		if err := Copy(&b, s2, &read); err != nil {
+			t.Fatal(algo, err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatal(algo, err)
+		}
+		if !bytes.Equal(b.Bytes(), data) {
+			t.Fatalf("%v got %d bytes, expected %d bytes", algo, b.Len(), len(data))
+		}
+
+		if written >= uint64(len(data)) {
+			t.Fatalf("%v counted %d bytes written for %d bytes", algo, written, len(data))
+		}
+		// end of compressed data is written by close write and read with EOF,
+		// which is counted by neither side
+		if written != read || written > s1.wireBytesWritten() || read > s2.wireBytesRead() {
+			t.Fatalf("%v counted %d bytes written and %d bytes read, expected %d and %d bytes on wire",
+				algo, written, read, s1.wireBytesWritten(), s2.wireBytesRead())
+		}
+	}
+}
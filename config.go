@@ -35,7 +35,16 @@ const (
 	maxMeasureBandwidthTimeout               = 30 * time.Second
 	nanoPayClaimerLinger                     = 24 * time.Hour
 	maxCheckSubscribeInterval                = time.Hour
-	defaultMinBalance                        = "0.0" // default minimum wallet balance for use tuna service
+	defaultMinBalance                        = "0.0"    // default minimum wallet balance for use tuna service
+	defaultBudgetThrottleRate                = 64 << 10 // byte per second
+	defaultPaymentThrottleRate               = 16 << 10 // byte per second
+	defaultUsageStatementInterval            = 60       // second
+	defaultUsageStatementTolerance           = 0.05
+	defaultRevenueForwardInterval            = 3600 // second
+	defaultRekeyBytes                        = 1 << 30
+	defaultRekeyInterval                     = 3600 // second
+	defaultMinRevenueForwardAmount           = "0.1"
+	defaultMetadataMaxAge                    = 86400 // second
 )
 
 type EntryConfiguration struct {
@@ -74,6 +83,26 @@ type EntryConfiguration struct {
 	HttpDialContext                  func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	WsDialContext                    func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	MinBalance                       string                                                            `json:"minBalance"`
+	LedgerPath                       string                                                            `json:"ledgerPath"`
+	NanoPayStatePath                 string                                                            `json:"nanoPayStatePath"`
+	MaxSpendPerHour                  string                                                            `json:"maxSpendPerHour"`
+	MaxSpendPerDay                   string                                                            `json:"maxSpendPerDay"`
+	MaxSpendPerSession               string                                                            `json:"maxSpendPerSession"`
+	BudgetAction                     string                                                            `json:"budgetAction"`
+	BudgetThrottleRate               int32                                                             `json:"budgetThrottleRate"`
+	UsageStatementInterval           int32                                                             `json:"usageStatementInterval"`
+	UsageStatementTolerance          float64                                                           `json:"usageStatementTolerance"`
+	UsageStatementPath               string                                                            `json:"usageStatementPath"`
+	RequireEphemeralKey              bool                                                              `json:"requireEphemeralKey"`
+	RekeyBytes                       int64                                                             `json:"rekeyBytes"`
+	RekeyInterval                    int32                                                             `json:"rekeyInterval"`
+	StrictMetadata                   bool                                                              `json:"strictMetadata"`
+	MetadataMaxAge                   int32                                                             `json:"metadataMaxAge"`
+	UDPQueueSize                     int32                                                             `json:"udpQueueSize"`
+	UDPDropPolicy                    string                                                            `json:"udpDropPolicy"`
+	Mux                              MuxConfig                                                         `json:"mux"`
+	DisableQUIC                      bool                                                              `json:"disableQUIC"`
+	Transport                        string                                                            `json:"transport"`
 }
 
 var defaultEntryConfiguration = EntryConfiguration{
@@ -88,6 +117,17 @@ var defaultEntryConfiguration = EntryConfiguration{
 	ReverseMinFlushAmount:          defaultNanoPayMinFlushAmount,
 	ReverseServiceListenIP:         defaultReverseServiceListenIP,
 	MinBalance:                     defaultMinBalance,
+	BudgetAction:                   BudgetActionStop,
+	BudgetThrottleRate:             defaultBudgetThrottleRate,
+	UsageStatementInterval:         defaultUsageStatementInterval,
+	UsageStatementTolerance:        defaultUsageStatementTolerance,
+	RekeyBytes:                     defaultRekeyBytes,
+	RekeyInterval:                  defaultRekeyInterval,
+	MetadataMaxAge:                 defaultMetadataMaxAge,
+	UDPQueueSize:                   defaultUDPQueueSize,
+	UDPDropPolicy:                  UDPDropTail,
+	Mux:                            defaultMuxConfig,
+	Transport:                      TransportTCP,
 }
 
 func DefaultEntryConfig() *EntryConfiguration {
@@ -100,6 +140,8 @@ type ExitConfiguration struct {
 	BeneficiaryAddr                string                                                            `json:"beneficiaryAddr"`
 	ListenTCP                      int32                                                             `json:"listenTCP"`
 	ListenUDP                      int32                                                             `json:"listenUDP"`
+	ListenQUIC                     int32                                                             `json:"listenQUIC"`
+	ListenTLS                      int32                                                             `json:"listenTLS"`
 	DialTimeout                    int32                                                             `json:"dialTimeout"`
 	UDPTimeout                     int32                                                             `json:"udpTimeout"`
 	SubscriptionPrefix             string                                                            `json:"subscriptionPrefix"`
@@ -134,6 +176,29 @@ type ExitConfiguration struct {
 	HttpDialContext                func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	WsDialContext                  func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	ReverseMinBalance              string                                                            `json:"reverseMinBalance"`
+	LedgerPath                     string                                                            `json:"ledgerPath"`
+	NanoPayStatePath               string                                                            `json:"nanoPayStatePath"`
+	ClientLimits                   ClientLimits                                                      `json:"clientLimits"`
+	ClientLimitsByPubKey           map[string]ClientLimits                                           `json:"clientLimitsByPubKey"`
+	FreeAccessPubKeys              []string                                                          `json:"freeAccessPubKeys"`
+	FreeAccessNknFilter            *filter.NknFilter                                                 `json:"freeAccessNknFilter"`
+	PaymentPolicy                  PaymentPolicy                                                     `json:"paymentPolicy"`
+	UsageStatementInterval         int32                                                             `json:"usageStatementInterval"`
+	UsageStatementTolerance        float64                                                           `json:"usageStatementTolerance"`
+	UsageStatementPath             string                                                            `json:"usageStatementPath"`
+	Beneficiaries                  []Beneficiary                                                     `json:"beneficiaries"`
+	ForwardRevenue                 bool                                                              `json:"forwardRevenue"`
+	RevenueForwardInterval         int32                                                             `json:"revenueForwardInterval"`
+	MinRevenueForwardAmount        string                                                            `json:"minRevenueForwardAmount"`
+	RevenueForwardFee              string                                                            `json:"revenueForwardFee"`
+	RequireEphemeralKey            bool                                                              `json:"requireEphemeralKey"`
+	RekeyBytes                     int64                                                             `json:"rekeyBytes"`
+	RekeyInterval                  int32                                                             `json:"rekeyInterval"`
+	ReverseStrictMetadata          bool                                                              `json:"reverseStrictMetadata"`
+	MetadataMaxAge                 int32                                                             `json:"metadataMaxAge"`
+	UDPQueueSize                   int32                                                             `json:"udpQueueSize"`
+	UDPDropPolicy                  string                                                            `json:"udpDropPolicy"`
+	Mux                            MuxConfig                                                         `json:"mux"`
 }
 
 var defaultExitConfiguration = ExitConfiguration{
@@ -147,6 +212,15 @@ var defaultExitConfiguration = ExitConfiguration{
 	ReverseSubscriptionPrefix:      DefaultSubscriptionPrefix,
 	ReverseServiceName:             DefaultReverseServiceName,
 	ReverseMinBalance:              defaultMinBalance,
+	UsageStatementTolerance:        defaultUsageStatementTolerance,
+	RevenueForwardInterval:         defaultRevenueForwardInterval,
+	MinRevenueForwardAmount:        defaultMinRevenueForwardAmount,
+	RekeyBytes:                     defaultRekeyBytes,
+	RekeyInterval:                  defaultRekeyInterval,
+	MetadataMaxAge:                 defaultMetadataMaxAge,
+	UDPQueueSize:                   defaultUDPQueueSize,
+	UDPDropPolicy:                  UDPDropTail,
+	Mux:                            defaultMuxConfig,
 }
 
 func DefaultExitConfig() *ExitConfiguration {
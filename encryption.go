@@ -1,12 +1,20 @@
 package tuna
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"runtime"
+	"strings"
 
 	stream "github.com/nknorg/encrypted-stream"
+	"github.com/nknorg/nkn/v2/crypto"
 	"github.com/nknorg/tuna/pb"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/sys/cpu"
 )
 
 const (
@@ -15,32 +23,226 @@ const (
 	encryptKeySize = 32
 )
 
+// EncryptionAuto as service encryption picks the encryption algo supported by
+// both sides that is fast on both CPUs.
+const EncryptionAuto = "auto"
+
+// ephemeralKeySignPrefix is prepended to handshake transcript before it's
+// signed by wallet key, so that the signature can't be used for other purpose.
+const ephemeralKeySignPrefix = "tuna-ephemeral-key"
+
+// Signer of handshake transcript, so that the signature of one side can't be
+// reflected back as the one of the other side.
+const (
+	ephemeralKeySignerInitiator byte = 1
+	ephemeralKeySignerResponder byte = 2
+)
+
 func computeEncryptKey(connNonce []byte, sharedKey []byte) *[encryptKeySize]byte {
 	encryptKey := sha256.Sum256(append(connNonce, sharedKey...))
 	return &encryptKey
 }
 
-func encryptConn(conn net.Conn, encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, initiator bool) (net.Conn, error) {
-	var cipher stream.Cipher
-	var err error
+// ephemeralKey is a X25519 key pair generated for one connection. Mixing its
+// shared secret into encrypt key keeps recorded traffic safe even if wallet key
+// is leaked later.
+type ephemeralKey struct {
+	publicKey  []byte
+	privateKey []byte
+}
+
+func newEphemeralKey() (*ephemeralKey, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeralKey{publicKey: publicKey, privateKey: privateKey}, nil
+}
+
+// sharedKey computes the shared secret with remote ephemeral public key. The
+// private key is erased afterwards as it should only be used once.
+func (k *ephemeralKey) sharedKey(remoteEphemeralPublicKey []byte) ([]byte, error) {
+	defer func() {
+		for i := range k.privateKey {
+			k.privateKey[i] = 0
+		}
+	}()
+	return curve25519.X25519(k.privateKey, remoteEphemeralPublicKey)
+}
+
+// ephemeralKeyTranscript returns the handshake transcript signed by signer. It
+// covers conn nonce, wallet public keys, capabilities, encryption algos and
+// ephemeral public keys of both sides, as well as the encryption algo selected
+// from them, so that none of them can be replaced or stripped without breaking
+// the signature.
+func ephemeralKeyTranscript(signer byte, connNonce []byte, initiator, responder *pb.ConnectionMetadata, encryptionAlgo pb.EncryptionAlgo) []byte {
+	b := append([]byte(ephemeralKeySignPrefix), signer)
+	appendBytes := func(v []byte) {
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	appendAlgos := func(algos []pb.EncryptionAlgo) {
+		b = binary.AppendUvarint(b, uint64(len(algos)))
+		for _, algo := range algos {
+			b = binary.AppendUvarint(b, uint64(algo))
+		}
+	}
+	appendBytes(connNonce)
+	appendBytes(initiator.PublicKey)
+	appendBytes(responder.PublicKey)
+	b = binary.BigEndian.AppendUint64(b, initiator.Capabilities)
+	b = binary.BigEndian.AppendUint64(b, responder.Capabilities)
+	appendBytes(initiator.EphemeralPublicKey)
+	appendBytes(responder.EphemeralPublicKey)
+	b = binary.AppendUvarint(b, uint64(initiator.EncryptionAlgo))
+	appendAlgos(initiator.EncryptionAlgos)
+	appendAlgos(responder.EncryptionAlgos)
+	b = binary.AppendUvarint(b, uint64(encryptionAlgo))
+	return b
+}
+
+func signEphemeralKey(seed, transcript []byte) ([]byte, error) {
+	return crypto.Sign(crypto.GetPrivateKeyFromSeed(seed), transcript)
+}
+
+func verifyEphemeralKey(publicKey, ephemeralPublicKey, transcript, signature []byte) error {
+	if len(ephemeralPublicKey) != curve25519.PointSize {
+		return fmt.Errorf("invalid ephemeral key size %d", len(ephemeralPublicKey))
+	}
+	err := crypto.Verify(publicKey, transcript, signature)
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral key signature: %v", err)
+	}
+	return nil
+}
+
+// newCipher returns the cipher of encryption algo, or nil if algo is none.
+func newCipher(encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo) (stream.Cipher, error) {
 	switch encryptionAlgo {
 	case pb.EncryptionAlgo_ENCRYPTION_NONE:
-		return conn, nil
+		return nil, nil
 	case pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305:
-		cipher = stream.NewXSalsa20Poly1305Cipher(encryptKey)
+		return stream.NewXSalsa20Poly1305Cipher(encryptKey), nil
 	case pb.EncryptionAlgo_ENCRYPTION_AES_GCM:
-		cipher, err = stream.NewAESGCMCipher(encryptKey[:])
+		return stream.NewAESGCMCipher(encryptKey[:])
+	case pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305:
+		aead, err := chacha20poly1305.New(encryptKey[:])
+		if err != nil {
+			return nil, err
+		}
+		return stream.NewCryptoAEADCipher(aead), nil
+	case pb.EncryptionAlgo_ENCRYPTION_XCHACHA20_POLY1305:
+		aead, err := chacha20poly1305.NewX(encryptKey[:])
 		if err != nil {
 			return nil, err
 		}
+		return stream.NewCryptoAEADCipher(aead), nil
 	default:
 		return nil, fmt.Errorf("unsupported encryption algo %v", encryptionAlgo)
 	}
+}
+
+// newConnCipher returns a rekeyCipher if rekey is not nil, or the plain cipher
+// of encryption algo otherwise.
+func newConnCipher(encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, rekey *RekeyPolicy) (stream.Cipher, error) {
+	if rekey != nil {
+		return newRekeyCipher(encryptKey, encryptionAlgo, *rekey)
+	}
+	return newCipher(encryptKey, encryptionAlgo)
+}
+
+// hasAESHardware returns whether CPU has AES and carry-less multiplication
+// instructions, without which AES-GCM is much slower than ChaCha20-Poly1305.
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	default:
+		return false
+	}
+}
+
+// supportedEncryptionAlgos returns the encryption algos supported by this
+// version, in the order of preference on current CPU. No encryption is never
+// negotiated, and is only used when client requests it explicitly.
+func supportedEncryptionAlgos() []pb.EncryptionAlgo {
+	if hasAESHardware() {
+		return []pb.EncryptionAlgo{
+			pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+			pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305,
+			pb.EncryptionAlgo_ENCRYPTION_XCHACHA20_POLY1305,
+			pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305,
+		}
+	}
+	return []pb.EncryptionAlgo{
+		pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305,
+		pb.EncryptionAlgo_ENCRYPTION_XCHACHA20_POLY1305,
+		pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+		pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305,
+	}
+}
+
+// parseServiceEncryption returns the algo requested by client and the algos
+// it advertises for negotiation. With auto encryption, the requested algo is
+// AES-GCM regardless of CPU, as it's the one used with peers that don't
+// negotiate cipher and is supported by all of them. Only negotiation may pick
+// ChaCha20-Poly1305.
+func parseServiceEncryption(encryption string) (pb.EncryptionAlgo, []pb.EncryptionAlgo, error) {
+	if strings.ToLower(strings.TrimSpace(encryption)) == EncryptionAuto {
+		return pb.EncryptionAlgo_ENCRYPTION_AES_GCM, supportedEncryptionAlgos(), nil
+	}
+	encryptionAlgo, err := ParseEncryptionAlgo(encryption)
+	if err != nil {
+		return 0, nil, err
+	}
+	return encryptionAlgo, nil, nil
+}
+
+// negotiateEncryptionAlgo picks the algo supported by both sides that has the
+// lowest sum of preference ranks of client and server, so that an algo slow on
+// either side is avoided. Ties are broken by server preference. If there is no
+// common algo, fallback (algo requested by client) is returned.
+func negotiateEncryptionAlgo(clientAlgos, serverAlgos []pb.EncryptionAlgo, fallback pb.EncryptionAlgo) pb.EncryptionAlgo {
+	best, bestRank := fallback, -1
+	for serverRank, algo := range serverAlgos {
+		for clientRank, clientAlgo := range clientAlgos {
+			if clientAlgo != algo {
+				continue
+			}
+			if bestRank < 0 || clientRank+serverRank < bestRank {
+				best, bestRank = algo, clientRank+serverRank
+			}
+			break
+		}
+	}
+	return best
+}
+
+// encryptConn wraps conn with encrypted stream. If rekey is not nil, the key is
+// ratcheted forward by rekey policy, which should only be used when peer
+// supports it.
+func encryptConn(conn net.Conn, encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, initiator, verifyNonce bool, rekey *RekeyPolicy) (net.Conn, error) {
+	cipher, err := newConnCipher(encryptKey, encryptionAlgo, rekey)
+	if err != nil {
+		return nil, err
+	}
+	if cipher == nil {
+		return conn, nil
+	}
 	config := &stream.Config{
 		Cipher:                   cipher,
 		Initiator:                initiator,
 		SequentialNonce:          true,
-		DisableNonceVerification: true, // for compatibility with old version, will be removed in the future
+		DisableNonceVerification: !verifyNonce, // old version peers don't send verifiable nonce
 	}
 	return stream.NewEncryptedStream(conn, config)
 }
@@ -0,0 +1,168 @@
+package tuna
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestWrapConnEphemeralKey(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	conn, exitConn, remoteMetadata := newTestWrappedConnPair(t, entry, exit)
+	if !hasCapability(negotiateCapabilities(remoteMetadata), CapabilityEphemeralKey) {
+		t.Fatal("ephemeral key should be negotiated")
+	}
+
+	go conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(exitConn, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("hello")) {
+		t.Fatalf("got %q, expected hello", b)
+	}
+}
+
+func TestEphemeralKeyTranscript(t *testing.T) {
+	c := newTestCommon(t)
+	ephemeral, err := newEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := []byte("nonce")
+	algo := pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305
+	initiator := &pb.ConnectionMetadata{PublicKey: c.Wallet.PubKey(), Capabilities: LocalCapabilities, EphemeralPublicKey: ephemeral.publicKey, EncryptionAlgos: supportedEncryptionAlgos()}
+	responder := &pb.ConnectionMetadata{PublicKey: []byte("responder"), Capabilities: LocalCapabilities, EphemeralPublicKey: ephemeral.publicKey, EncryptionAlgos: supportedEncryptionAlgos()}
+
+	signature, err := signEphemeralKey(c.Wallet.Seed(), ephemeralKeyTranscript(ephemeralKeySignerInitiator, nonce, initiator, responder, algo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(signer byte, nonce []byte, responder *pb.ConnectionMetadata, algo pb.EncryptionAlgo) error {
+		return verifyEphemeralKey(initiator.PublicKey, initiator.EphemeralPublicKey, ephemeralKeyTranscript(signer, nonce, initiator, responder, algo), signature)
+	}
+	if err := verify(ephemeralKeySignerInitiator, nonce, responder, algo); err != nil {
+		t.Fatal(err)
+	}
+	if verify(ephemeralKeySignerResponder, nonce, responder, algo) == nil {
+		t.Fatal("signature should not be valid for the other signer")
+	}
+	if verify(ephemeralKeySignerInitiator, []byte("other"), responder, algo) == nil {
+		t.Fatal("signature should not be valid for another nonce")
+	}
+	downgraded := &pb.ConnectionMetadata{PublicKey: responder.PublicKey, Capabilities: CapabilityNonceVerification, EphemeralPublicKey: responder.EphemeralPublicKey, EncryptionAlgos: responder.EncryptionAlgos}
+	if verify(ephemeralKeySignerInitiator, nonce, downgraded, algo) == nil {
+		t.Fatal("signature should not be valid for stripped capabilities")
+	}
+	stripped := &pb.ConnectionMetadata{PublicKey: responder.PublicKey, Capabilities: responder.Capabilities, EphemeralPublicKey: responder.EphemeralPublicKey, EncryptionAlgos: []pb.EncryptionAlgo{pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305}}
+	if verify(ephemeralKeySignerInitiator, nonce, stripped, pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305) == nil {
+		t.Fatal("signature should not be valid for stripped encryption algos")
+	}
+	if verify(ephemeralKeySignerInitiator, nonce, responder, pb.EncryptionAlgo_ENCRYPTION_AES_GCM) == nil {
+		t.Fatal("signature should not be valid for another selected encryption algo")
+	}
+}
+
+func TestWrapConnRequireEphemeralKey(t *testing.T) {
+	exit := newTestCommon(t)
+	exit.requireEphemeralKey = true
+	oldEntry := newTestCommon(t)
+	entryConn, exitConn := newTestConnPair(t)
+	defer entryConn.Close()
+	defer exitConn.Close()
+
+	results := acceptTestConn(exit, exitConn)
+
+	// entry of an older version without ephemeral key exchange
+	if _, err := readConnMetadata(entryConn); err != nil {
+		t.Fatal(err)
+	}
+	err := writeConnMetadata(entryConn, &pb.ConnectionMetadata{
+		EncryptionAlgo:  pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+		PublicKey:       oldEntry.Wallet.PubKey(),
+		ProtocolVersion: ephemeralKeyProtocolVersion - 1,
+		Capabilities:    CapabilityNonceVerification,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := <-results; result.err == nil {
+		t.Fatal("peer without ephemeral key should be refused")
+	}
+}
+
+func TestWrapConnEphemeralKeyDowngrade(t *testing.T) {
+	for _, tc := range []struct {
+		protocolVersion uint32
+		refused         bool
+	}{
+		{0, false},
+		{ephemeralKeyProtocolVersion - 1, false},
+		// capability is stripped from a peer that always supports it
+		{ephemeralKeyProtocolVersion, true},
+		{ProtocolVersion, true},
+	} {
+		exit, entry := newTestCommon(t), newTestCommon(t)
+		entryConn, exitConn := newTestConnPair(t)
+
+		results := acceptTestConn(exit, exitConn)
+		if _, err := readConnMetadata(entryConn); err != nil {
+			t.Fatal(err)
+		}
+		err := writeConnMetadata(entryConn, &pb.ConnectionMetadata{
+			EncryptionAlgo:  pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+			PublicKey:       entry.Wallet.PubKey(),
+			ProtocolVersion: tc.protocolVersion,
+			Capabilities:    LocalCapabilities &^ CapabilityEphemeralKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := <-results; (result.err != nil) != tc.refused {
+			t.Fatalf("peer of protocol version %d without ephemeral key got %v, expected refused %v", tc.protocolVersion, result.err, tc.refused)
+		}
+		entryConn.Close()
+		exitConn.Close()
+	}
+}
+
+func TestAutoEncryptionFallback(t *testing.T) {
+	algo, algos, err := parseServiceEncryption("Auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != pb.EncryptionAlgo_ENCRYPTION_AES_GCM {
+		t.Fatalf("auto encryption requests %v, expected AES-GCM", algo)
+	}
+
+	// peer that doesn't negotiate cipher gets the requested algo
+	if got := negotiateEncryptionAlgo(algos, nil, algo); got != pb.EncryptionAlgo_ENCRYPTION_AES_GCM {
+		t.Fatalf("fallback algo %v, expected AES-GCM", got)
+	}
+
+	// no encryption is never negotiated, even if client prefers it
+	noneFirst := append([]pb.EncryptionAlgo{pb.EncryptionAlgo_ENCRYPTION_NONE}, algos...)
+	if got := negotiateEncryptionAlgo(noneFirst, supportedEncryptionAlgos(), algo); got == pb.EncryptionAlgo_ENCRYPTION_NONE {
+		t.Fatal("no encryption should not be negotiated")
+	}
+	// but client may still request it explicitly
+	if got := negotiateEncryptionAlgo(nil, supportedEncryptionAlgos(), pb.EncryptionAlgo_ENCRYPTION_NONE); got != pb.EncryptionAlgo_ENCRYPTION_NONE {
+		t.Fatalf("requested no encryption got %v", got)
+	}
+
+	// negotiation picks ChaCha20-Poly1305 when both sides prefer it
+	chachaFirst := []pb.EncryptionAlgo{pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305, pb.EncryptionAlgo_ENCRYPTION_AES_GCM}
+	if got := negotiateEncryptionAlgo(chachaFirst, chachaFirst, algo); got != pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305 {
+		t.Fatalf("negotiated algo %v, expected ChaCha20-Poly1305", got)
+	}
+
+	algo, algos, err = parseServiceEncryption("xsalsa20-poly1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305 || algos != nil {
+		t.Fatalf("unexpected fixed algo %v %v", algo, algos)
+	}
+}
@@ -2,8 +2,10 @@ package tuna
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -15,10 +17,9 @@ import (
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/nkn/v2/common"
 	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
 	"github.com/nknorg/tuna/util"
-	"github.com/patrickmn/go-cache"
 	"github.com/rdegges/go-ipify"
-	"github.com/xtaci/smux"
 )
 
 type TunaEntry struct {
@@ -35,13 +36,17 @@ type TunaEntry struct {
 	config             *EntryConfiguration
 	tcpListeners       map[byte]*net.TCPListener
 	serviceConn        map[byte]*net.UDPConn
-	clientAddr         *cache.Cache
-	session            *smux.Session
-	paymentStream      *smux.Stream
+	udpFlows           *udpFlowTable
+	session            Session
+	paymentStream      Stream
 	reverseBeneficiary common.Uint160
 	sessionLock        sync.Mutex
 	tcpPorts           []uint32
 	udpPorts           []uint32
+	budgetErr          error
+	switchingExit      bool
+	udpStopChan        chan struct{} // closed to stop goroutines of current UDP conn
+	exitCapabilities   uint64        // capabilities negotiated with exit in reverse mode
 }
 
 func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet, client *nkn.MultiClient, config *EntryConfiguration) (*TunaEntry, error) {
@@ -85,18 +90,63 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 		config.SortMeasuredNodes,
 		nil,
 		config.MinBalance,
+		config.LedgerPath,
+		config.NanoPayStatePath,
+		config.UsageStatementPath,
+		config.RekeyBytes,
+		config.RekeyInterval,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	c.requireEphemeralKey = config.RequireEphemeralKey
+	c.strictMetadata = config.StrictMetadata
+	c.metadataMaxAge = serviceMetadataMaxAge(config.MetadataMaxAge)
+	err = config.Mux.verify()
+	if err != nil {
+		return nil, fmt.Errorf("invalid mux config: %v", err)
+	}
+	c.muxConfig = config.Mux
+	err = verifyTransport(config.Transport)
+	if err != nil {
+		return nil, err
+	}
+
 	te := &TunaEntry{
 		Common:       c,
 		config:       config,
 		tcpListeners: make(map[byte]*net.TCPListener),
 		serviceConn:  make(map[byte]*net.UDPConn),
-		clientAddr:   cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+		udpFlows:     newUDPFlowTable(time.Duration(config.UDPTimeout)*time.Second, maxEntryUDPFlowID),
+	}
+
+	if !config.Reverse {
+		b, err := newBudget(config.MaxSpendPerHour, config.MaxSpendPerDay, config.MaxSpendPerSession, config.BudgetAction)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			if c.ledger != nil {
+				err = b.load(c.ledger)
+				if err != nil {
+					log.Println("Couldn't load spend from ledger:", err)
+				}
+			}
+			c.budget = b
+			c.rateLimiter = util.NewRateLimiter(0)
+			c.onBudget = te.handleBudget
+		}
+		c.udpFallback = new(udpFallback)
+		c.preferQUIC = !config.DisableQUIC && config.Transport == TransportTCP
+		c.transport = config.Transport
+	}
+
+	c.udpQueues, err = newUDPQueues(int(config.UDPQueueSize), config.UDPDropPolicy, time.Duration(config.UDPTimeout)*time.Second, te.writeUDPToClient)
+	if err != nil {
+		return nil, err
 	}
+
 	return te, nil
 }
 
@@ -140,10 +190,7 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		if te.udpConn != nil {
-			te.startUDPReaderWriter(te.udpConn, nil, &te.bytesExitToEntry, &te.bytesEntryToExit)
-			go sendPingMsg(te.udpConn, te.udpCloseChan)
-		}
+		te.startUDP()
 		go func() {
 			for {
 				session, err := te.getSession()
@@ -155,7 +202,7 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 				if err != nil {
 					log.Println("Close connection:", err)
 					session.Close()
-					if !shouldReconnect {
+					if !shouldReconnect && !te.isSwitchingExit() {
 						te.Close()
 						return
 					}
@@ -163,7 +210,7 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 			}
 		}()
 
-		getPaymentStreamRecipient := func() (*smux.Stream, string, error) {
+		getPaymentStreamRecipient := func() (Stream, string, error) {
 			ps, err := te.getPaymentStream()
 			return ps, te.GetPaymentReceiver(), err
 		}
@@ -188,10 +235,156 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 
 	<-te.closeChan
 
+	te.RLock()
+	defer te.RUnlock()
+	return te.budgetErr
+}
+
+// handleBudget is called periodically by payment with cost not yet paid in
+// session, and applies the configured budget action. Throttle action starts
+// throttling at budgetThrottleRatio of a limit, and stops entry like stop
+// action if spend still reaches the limit.
+func (te *TunaEntry) handleBudget(pending common.Fixed64, session time.Time) {
+	err := te.budget.check(pending, session)
+
+	if te.budget.action == BudgetActionThrottle {
+		if err != nil {
+			te.stopWithBudgetError(err)
+			return
+		}
+		softErr := te.budget.checkRatio(pending, session, budgetThrottleRatio)
+		if softErr == nil {
+			if te.rateLimiter.Rate() > 0 {
+				log.Println("Spend is within budget again, stop throttling")
+				te.rateLimiter.SetRate(0)
+			}
+		} else if te.rateLimiter.Rate() == 0 {
+			log.Printf("%v, throttle to %d bytes/s", softErr, te.config.BudgetThrottleRate)
+			te.rateLimiter.SetRate(int(te.config.BudgetThrottleRate))
+		}
+		return
+	}
+
+	if err == nil {
+		return
+	}
+
+	switch te.budget.action {
+	case BudgetActionSwitch:
+		te.Lock()
+		if te.switchingExit || te.isClosed {
+			te.Unlock()
+			return
+		}
+		te.switchingExit = true
+		te.Unlock()
+		go func() {
+			switchErr := te.switchToCheaperExit()
+			if switchErr != nil {
+				log.Printf("%v, couldn't switch to cheaper exit: %v", err, switchErr)
+				te.stopWithBudgetError(err)
+			}
+			time.Sleep(budgetCheckInterval)
+			te.Lock()
+			te.switchingExit = false
+			te.Unlock()
+		}()
+	default:
+		te.stopWithBudgetError(err)
+	}
+}
+
+func (te *TunaEntry) stopWithBudgetError(err error) {
+	te.Lock()
+	if te.budgetErr != nil || te.isClosed {
+		te.Unlock()
+		return
+	}
+	te.budgetErr = err
+	te.Unlock()
+	log.Printf("%v, stop entry", err)
+	go te.Close()
+}
+
+func (te *TunaEntry) isSwitchingExit() bool {
+	te.RLock()
+	defer te.RUnlock()
+	return te.switchingExit
+}
+
+// switchToCheaperExit reconnects to an exit cheaper than current one, with
+// price ceiling lowered below the price of current exit while selecting it.
+// Price ceiling is restored afterwards, so that repeated switches don't lower
+// it further and later reconnects select from all exits within max price. It
+// returns error if there is no cheaper exit.
+func (te *TunaEntry) switchToCheaperExit() error {
+	entryToExitPrice, exitToEntryPrice := te.GetPrice()
+	if entryToExitPrice == 0 && exitToEntryPrice == 0 {
+		return errors.New("current exit is free")
+	}
+	if entryToExitPrice > 0 {
+		entryToExitPrice--
+	}
+	if exitToEntryPrice > 0 {
+		exitToEntryPrice--
+	}
+	defer te.setPriceCeiling(te.getPriceCeiling())
+	te.SetPriceCeiling(entryToExitPrice, exitToEntryPrice)
+
+	nodes, err := te.GetTopPerformanceNodes(false, 1)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("no exit with lower price")
+	}
+
+	log.Printf("Switching to exit with price no more than %s,%s", entryToExitPrice.String(), exitToEntryPrice.String())
+	err = te.CreateServerConn(true)
+	if err != nil {
+		return err
+	}
+
+	te.sessionLock.Lock()
+	if te.session != nil {
+		te.session.Close()
+	}
+	te.sessionLock.Unlock()
+
+	te.startUDP()
+
 	return nil
 }
 
-func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.ConnectionMetadata) error {
+// startUDP stops goroutines of previous UDP conn, and starts reading and
+// writing UDP packets over current UDP conn, or QUIC datagrams if connected
+// over QUIC.
+func (te *TunaEntry) startUDP() {
+	te.Lock()
+	if te.udpStopChan != nil {
+		close(te.udpStopChan)
+		te.udpStopChan = nil
+	}
+	if te.isClosed {
+		te.Unlock()
+		return
+	}
+	stopChan := make(chan struct{})
+	te.udpStopChan = stopChan
+	te.Unlock()
+
+	if udpConn := te.GetUDPConn(); udpConn != nil {
+		te.startUDPReaderWriter(udpConn, nil, &te.bytesExitToEntry, &te.bytesEntryToExit, stopChan)
+		go sendPingMsg(udpConn, stopChan)
+		if te.RemoteHasCapability(CapabilityUDPOverTCP) {
+			go te.monitorUDP(udpConn)
+		}
+	} else if quicConn := te.GetQUICConn(); quicConn != nil && len(te.Service.UDP) > 0 {
+		te.startQUICDatagrams(quicConn, te.getQUICEncryption(), stopChan)
+	}
+}
+
+func (te *TunaEntry) StartReverse(stream Stream, connMetadata *pb.ConnectionMetadata) error {
 	defer te.Close()
 
 	metadata := te.GetMetadata()
@@ -237,19 +430,25 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 		return err
 	}
 
-	npc, err := te.Client.NewNanoPayClaimer(te.config.ReverseBeneficiaryAddr, int32(claimInterval/time.Millisecond), int32(nanoPayClaimerLinger/time.Millisecond), te.config.ReverseMinFlushAmount, onErr)
+	beneficiaryAddr := te.config.ReverseBeneficiaryAddr
+	if len(beneficiaryAddr) == 0 {
+		beneficiaryAddr = te.Wallet.Address()
+	}
+	npc, err := nkn.NewNanoPayClaimer(&claimFlushRecorder{MultiClient: te.Client, c: te.Common}, beneficiaryAddr, int32(claimInterval/time.Millisecond), int32(nanoPayClaimerLinger/time.Millisecond), te.config.ReverseMinFlushAmount, onErr)
 	if err != nil {
 		return err
 	}
 
 	defer npc.Close()
+	claims := te.newNanoPayClaims()
 	k := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
 
 	getTotalCost := func() (common.Fixed64, common.Fixed64) {
 		cost, totalBytes := common.Fixed64(0), common.Fixed64(0)
-		for i := range te.Common.reverseBytesEntryToExit[k] {
-			entryToExit := common.Fixed64(atomic.LoadUint64(&te.Common.reverseBytesEntryToExit[k][i]))
-			exitToEntry := common.Fixed64(atomic.LoadUint64(&te.Common.reverseBytesExitToEntry[k][i]))
+		bytesEntryToExit, bytesExitToEntry, _ := te.getSessionBytes(k)
+		for i := range bytesEntryToExit {
+			entryToExit := common.Fixed64(atomic.LoadUint64(&bytesEntryToExit[i]))
+			exitToEntry := common.Fixed64(atomic.LoadUint64(&bytesExitToEntry[i]))
 			if entryToExit == 0 && exitToEntry == 0 {
 				continue
 			}
@@ -263,9 +462,26 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 		return cost, totalBytes
 	}
 
+	recordClaim := te.newClaimRecorder(storage.LedgerRoleEarn, hex.EncodeToString(connMetadata.PublicKey), func() []serviceUsage {
+		usage := serviceUsage{service: te.config.ReverseServiceName, price: te.config.ReversePrice}
+		bytesEntryToExit, bytesExitToEntry, _ := te.getSessionBytes(k)
+		for i := range bytesEntryToExit {
+			usage.bytesEntryToExit += atomic.LoadUint64(&bytesEntryToExit[i])
+			usage.bytesExitToEntry += atomic.LoadUint64(&bytesExitToEntry[i])
+		}
+		usage.bytesEntryToExit += atomic.LoadUint64(&te.reverseBytesEntryToExit)
+		usage.bytesExitToEntry += atomic.LoadUint64(&te.reverseBytesExitToEntry)
+		usage.cost = entryToExitPrice*common.Fixed64(usage.bytesEntryToExit)/TrafficUnit + exitToEntryPrice*common.Fixed64(usage.bytesExitToEntry)/TrafficUnit
+		return []serviceUsage{usage}
+	}, nil)
+	defer func() {
+		recordClaim(lastPaymentAmount, "", "")
+	}()
+
 	go checkNanoPayClaim(session, npc, onErr, &isClosed)
 
-	go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+	paymentPolicy := DefaultPaymentPolicy()
+	go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost, func() *PaymentPolicy { return paymentPolicy }, nil)
 
 	for {
 		if te.IsClosed() {
@@ -278,7 +494,7 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 			break
 		}
 
-		go func(stream *smux.Stream) {
+		go func(stream Stream) {
 			err := func() error {
 				streamMetadata, err := readStreamMetadata(stream)
 				if err != nil {
@@ -286,7 +502,7 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 				}
 
 				if streamMetadata.IsPayment {
-					return handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+					return handlePaymentStream(stream, npc, claims, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost, recordClaim, nil)
 				}
 				return nil
 			}()
@@ -321,15 +537,23 @@ func (te *TunaEntry) Close() {
 	te.isClosed = true
 	close(te.closeChan)
 	close(te.udpCloseChan)
+	if te.udpStopChan != nil {
+		close(te.udpStopChan)
+		te.udpStopChan = nil
+	}
 	for _, listener := range te.tcpListeners {
 		Close(listener)
 	}
 	for _, conn := range te.serviceConn {
 		Close(conn)
 	}
+	te.udpQueues.close()
 	if te.session != nil {
 		te.session.Close()
 	}
+	if te.quicConn != nil {
+		te.quicConn.CloseWithError(0, "")
+	}
 	te.OnConnect.close()
 }
 
@@ -339,15 +563,23 @@ func (te *TunaEntry) IsClosed() bool {
 	return te.isClosed
 }
 
-func (te *TunaEntry) createSession(force bool) (*smux.Session, *smux.Stream, error) {
-	conn, err := te.GetServerTCPConn(force)
+func (te *TunaEntry) createSession(force bool) (Session, Stream, error) {
+	var session Session
+	err := te.CreateServerConn(force)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	session, err := smux.Client(conn, nil)
-	if err != nil {
-		return nil, nil, err
+	if quicConn := te.GetQUICConn(); quicConn != nil {
+		session = newQUICSession(quicConn, te.getQUICEncryption())
+	} else {
+		conn, err := te.GetServerTCPConn(false)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err = newSmuxSession(conn, te.getServerSessionConfig(), true)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	paymentStream, err := openPaymentStream(session)
@@ -355,10 +587,68 @@ func (te *TunaEntry) createSession(force bool) (*smux.Session, *smux.Stream, err
 		return nil, nil, err
 	}
 
+	statements := te.newSessionUsageStatements(paymentStream)
+	if te.config.UsageStatementInterval > 0 && te.RemoteHasCapability(CapabilityControlMessages) {
+		go statements.start(time.Duration(te.config.UsageStatementInterval)*time.Second, session.IsClosed)
+	}
+
+	go te.handleControlStream(paymentStream, statements)
+
 	return session, paymentStream, nil
 }
 
-func (te *TunaEntry) getSession() (*smux.Session, error) {
+// newSessionUsageStatements returns usage statements of traffic sent over a
+// new session, which are sent to exit on payment stream.
+func (te *TunaEntry) newSessionUsageStatements(paymentStream Stream) *usageStatements {
+	baseEntryToExit := atomic.LoadUint64(&te.bytesEntryToExit)
+	baseExitToEntry := atomic.LoadUint64(&te.bytesExitToEntry)
+	getUsages := func() []*pb.ServiceUsage {
+		usage := &pb.ServiceUsage{
+			BytesEntryToExit: atomic.LoadUint64(&te.bytesEntryToExit) - baseEntryToExit,
+			BytesExitToEntry: atomic.LoadUint64(&te.bytesExitToEntry) - baseExitToEntry,
+		}
+		if metadata := te.GetMetadata(); metadata != nil {
+			usage.ServiceId = metadata.ServiceId
+		}
+		return []*pb.ServiceUsage{usage}
+	}
+	send := func(msg *pb.ControlMessage) error {
+		te.paymentStreamLock.Lock()
+		defer te.paymentStreamLock.Unlock()
+		return writePaymentControlMessage(paymentStream, msg)
+	}
+	peerKey := func() string {
+		return peerKeyFromClientAddr(te.GetRemoteNknAddress())
+	}
+	return te.newUsageStatements(true, peerKey, te.config.UsageStatementTolerance, getUsages, send)
+}
+
+// handleControlStream reads control messages sent by exit on payment stream
+// until the stream is closed.
+func (te *TunaEntry) handleControlStream(stream Stream, statements *usageStatements) {
+	for {
+		msg, err := readControlMessage(stream)
+		if err != nil {
+			return
+		}
+		if statements.handle(msg) {
+			continue
+		}
+		switch m := msg.Message.(type) {
+		case *pb.ControlMessage_LimitNotice:
+			log.Printf("Exit reports %s limit %d reached of service %q", m.LimitNotice.LimitType.String(), m.LimitNotice.Limit, m.LimitNotice.Service)
+		case *pb.ControlMessage_PaymentNotice:
+			log.Printf("Exit reports %s: %s", m.PaymentNotice.Action.String(), m.PaymentNotice.Reason)
+		case *pb.ControlMessage_FreeAccessNotice:
+			if !te.isServedFree() {
+				log.Println("Exit serves this entry without payment")
+				te.setServedFree(true)
+			}
+		}
+	}
+}
+
+func (te *TunaEntry) getSession() (Session, error) {
 	te.sessionLock.Lock()
 	defer te.sessionLock.Unlock()
 
@@ -382,7 +672,7 @@ func (te *TunaEntry) getSession() (*smux.Session, error) {
 	return te.session, nil
 }
 
-func (te *TunaEntry) getPaymentStream() (*smux.Stream, error) {
+func (te *TunaEntry) getPaymentStream() (Stream, error) {
 	_, err := te.getSession()
 	if err != nil {
 		return nil, err
@@ -394,7 +684,18 @@ func (te *TunaEntry) getPaymentStream() (*smux.Stream, error) {
 	return paymentStream, nil
 }
 
-func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
+// exitHasCapability returns whether the capability is supported by both this
+// entry and exit, which connects to this entry in reverse mode.
+func (te *TunaEntry) exitHasCapability(capability uint64) bool {
+	if te.config.Reverse {
+		return hasCapability(te.exitCapabilities, capability)
+	}
+	return te.RemoteHasCapability(capability)
+}
+
+// openServiceStream opens a stream to service port of exit, which is
+// compressed if both sides support compression algo of service.
+func (te *TunaEntry) openServiceStream(portID byte, halfClose bool) (io.ReadWriteCloser, error) {
 	session, err := te.getSession()
 	if err != nil {
 		return nil, err
@@ -407,9 +708,10 @@ func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
 	}
 
 	streamMetadata := &pb.StreamMetadata{
-		ServiceId: te.GetMetadata().ServiceId,
-		PortId:    uint32(portID),
-		IsPayment: false,
+		ServiceId:       te.GetMetadata().ServiceId,
+		PortId:          uint32(portID),
+		IsPayment:       false,
+		CompressionAlgo: te.getStreamCompressionAlgo(),
 	}
 
 	err = writeStreamMetadata(stream, streamMetadata)
@@ -417,8 +719,19 @@ func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
 		stream.Close()
 		return nil, err
 	}
+	stream = wrapHalfClose(stream, halfClose)
+
+	if streamMetadata.CompressionAlgo == pb.CompressionAlgo_COMPRESSION_ALGO_NONE {
+		return stream, nil
+	}
+
+	compressedStream, err := newCompressedStream(stream, stream, streamMetadata.CompressionAlgo)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
 
-	return stream, nil
+	return compressedStream, nil
 }
 
 func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
@@ -462,19 +775,21 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 					if te.IsClosed() {
 						return
 					}
-					stream, err := te.openServiceStream(portID)
+					halfClose := te.exitHasCapability(CapabilityHalfClose)
+					stream, err := te.openServiceStream(portID, halfClose)
 					if err != nil {
 						log.Println("Couldn't open stream:", err)
 						Close(conn)
 						return
 					}
 
+					closer := newPipeCloser(halfClose, stream, conn)
 					if te.config.Reverse {
-						go te.pipe(stream, conn, &te.reverseBytesEntryToExit)
-						go te.pipe(conn, stream, &te.reverseBytesExitToEntry)
+						go te.pipe(stream, conn, &te.reverseBytesEntryToExit, closer)
+						go te.pipe(conn, stream, &te.reverseBytesExitToEntry, closer)
 					} else {
-						go te.pipe(stream, conn, &te.bytesEntryToExit)
-						go te.pipe(conn, stream, &te.bytesExitToEntry)
+						go te.pipe(stream, conn, &te.bytesEntryToExit, closer)
+						go te.pipe(conn, stream, &te.bytesExitToEntry, closer)
 					}
 				}()
 			}
@@ -504,33 +819,12 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 
 			data := <-serverReadChan
 
-			if len(data) < PrefixLen {
+			if len(data) < udpHeaderSize {
 				log.Println("empty udp packet received")
 				te.Close()
 				return
 			}
-			portID := data[3]
-			port := ConnIDToPort(data)
-			connID := strconv.Itoa(int(port))
-
-			var serviceConn *net.UDPConn
-			var ok bool
-			if serviceConn, ok = te.serviceConn[portID]; !ok {
-				log.Println("Couldn't get service conn for portId:", portID)
-				continue
-			}
-
-			var x interface{}
-			if x, ok = te.clientAddr.Get(connID); !ok {
-				log.Println("Couldn't get client address for:", connID)
-				continue
-			}
-			clientAddr := x.(*net.UDPAddr)
-
-			_, _, err = serviceConn.WriteMsgUDP(data[PrefixLen:], nil, clientAddr)
-			if err != nil {
-				log.Println("Couldn't send data to client:", err)
-			}
+			te.udpQueues.push(data)
 		}
 	}()
 
@@ -568,17 +862,21 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 					return
 				}
 
-				connKey := strconv.Itoa(addr.Port)
-				te.clientAddr.Set(connKey, addr, cache.DefaultExpiration)
+				flow, err := te.udpFlows.getOrCreate(udpFlowKey(addr, portID), func(flow *udpFlow) {
+					flow.addr = addr
+				})
+				if err != nil {
+					log.Println("Couldn't allocate udp flow:", err)
+					continue
+				}
 
 				serverWriteChan, err := te.GetServerUDPWriteChan(false)
 				if err != nil {
 					log.Println("Couldn't get remote connection:", err)
 					continue
 				}
-				connID := PortToConnID(uint16(addr.Port))
 				serviceID := te.GetMetadata().ServiceId
-				serverWriteChan <- append([]byte{connID[0], connID[1], byte(serviceID), portID}, localBuffer[:n]...)
+				te.udpQueues.forward(serverWriteChan, newUDPPacket(flow.id, byte(serviceID), portID, localBuffer[:n]))
 			}
 		}()
 	}
@@ -586,6 +884,25 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 	return assignedPorts, nil
 }
 
+// writeUDPToClient delivers an internal packet received from exit to the
+// local client of its flow.
+func (te *TunaEntry) writeUDPToClient(b []byte) error {
+	portID := b[3]
+	serviceConn, ok := te.serviceConn[portID]
+	if !ok {
+		return fmt.Errorf("couldn't get service conn for portId %d", portID)
+	}
+
+	flowID := udpPacketFlowID(b)
+	flow, ok := te.udpFlows.get(flowID)
+	if !ok {
+		return fmt.Errorf("couldn't get client address for flow %d", flowID)
+	}
+
+	_, _, err := serviceConn.WriteMsgUDP(udpPacketPayload(b), nil, flow.addr)
+	return err
+}
+
 func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 	config, err := MergedEntryConfig(config)
 	if err != nil {
@@ -613,8 +930,74 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 	if err != nil {
 		return err
 	}
+
+	nanoPayStorage, err := storage.OpenNanoPayStorage(config.NanoPayStatePath)
+	if err != nil {
+		return err
+	}
+	// closed when reverse entry stops accepting connections
+	stopChan := make(chan struct{})
+	go startFlushPendingClaims(wallet, nanoPayStorage, stopChan)
 	encConn := NewEncryptUDPConn(uConn)
 	var encKeys, udpEntrys, tcpEntrys, tcpReady, udpReady, addrToKey, keyToAddr sync.Map
+	// bind handles the UDP metadata that exit sends to bind its UDP conn from
+	// addr, after TCP handshake of the conn is finished.
+	bind := func(from *net.UDPAddr, connMetadata *pb.ConnectionMetadata, k string) {
+		encryptKey, ok := encKeys.Load(k)
+		if !ok {
+			log.Println("no encrypt key found")
+			return
+		}
+		key := encryptKey.(*[encryptKeySize]byte)
+
+		te, ok := tcpEntrys.Load(k)
+		if !ok {
+			log.Println("no encrypt key found from tcp conn")
+			return
+		}
+		t := te.(*TunaEntry)
+		encryptionAlgo, ok := t.getConnEncryptionAlgo(k)
+		if !ok {
+			log.Println("no encryption algo found")
+			return
+		}
+		if connMetadata.EncryptionAlgo != encryptionAlgo {
+			log.Println("Couldn't bind udp conn from", from, "error:", errUDPEncryptionAlgo)
+			return
+		}
+		capabilities := t.getConnCapabilities(k)
+		replayProtection := hasCapability(capabilities, CapabilityUDPReplayProtection)
+		if replayProtection {
+			if len(connMetadata.UdpBindChallenge) == 0 {
+				replyUDPBindChallenge(encConn, t.udpBinder, from, k)
+				return
+			}
+			err := t.udpBinder.verify(from, k, key, encryptionAlgo, connMetadata.UdpBindSequence, connMetadata.UdpBindChallenge, connMetadata.UdpBindProof)
+			if err == errInvalidUDPBindChallenge {
+				replyUDPBindChallenge(encConn, t.udpBinder, from, k)
+				return
+			}
+			if err != nil {
+				log.Println("Couldn't bind udp conn from", from, "error:", err)
+				return
+			}
+		}
+		err := encConn.AddCodec(from, key, encryptionAlgo, false, t.getRekeyPolicy(capabilities), replayProtection)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		t.setSessionBytes(k, make([]uint64, 256), make([]uint64, 256))
+		udpEntrys.Store(from.String(), te)
+		addrToKey.Store(from.String(), k)
+		keyToAddr.Store(k, from.String())
+
+		if c, ok := udpReady.Load(k); ok {
+			closeChan(c.(chan struct{}))
+		}
+	}
+	pendingBinds := make(chan struct{}, maxPendingUDPBinds)
 	go func() {
 		if encConn.IsClosed() {
 			return
@@ -636,37 +1019,35 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 					continue
 				}
 				k := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
-				readyChan, _ := tcpReady.LoadOrStore(k, make(chan struct{}))
-				<-readyChan.(chan struct{})
-
-				encryptKey, ok := encKeys.Load(k)
-				if !ok {
-					log.Println("no encrypt key found")
+				rc, _ := tcpReady.LoadOrStore(k, make(chan struct{}))
+				readyChan := rc.(chan struct{})
+				select {
+				case <-readyChan:
+					bind(from, connMetadata, k)
 					continue
+				default:
 				}
-				key := encryptKey.(*[encryptKeySize]byte)
-				err = encConn.AddCodec(from, key, connMetadata.EncryptionAlgo, false)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				te, ok := tcpEntrys.Load(k)
-				if !ok {
-					log.Println("no encrypt key found from tcp conn")
+				// TCP handshake of conn is not finished yet, wait for it
+				// without blocking packets of other conns
+				select {
+				case pendingBinds <- struct{}{}:
+				default:
+					log.Println("Too many pending udp binds, dropping udp metadata from", from)
 					continue
 				}
-				t := te.(*TunaEntry)
-				t.Common.reverseBytesEntryToExit[k] = make([]uint64, 256)
-				t.Common.reverseBytesExitToEntry[k] = make([]uint64, 256)
-				udpEntrys.Store(from.String(), te)
-				addrToKey.Store(from.String(), k)
-				keyToAddr.Store(k, from.String())
-
-				if c, ok := udpReady.Load(k); ok {
-					closeChan(c.(chan struct{}))
-				}
-
+				go func(from *net.UDPAddr, connMetadata *pb.ConnectionMetadata, k string) {
+					defer func() { <-pendingBinds }()
+					timer := time.NewTimer(udpBindReadyTimeout)
+					defer timer.Stop()
+					select {
+					case <-readyChan:
+						bind(from, connMetadata, k)
+					case <-timer.C:
+						if _, ok := encKeys.Load(k); !ok {
+							tcpReady.CompareAndDelete(k, rc)
+						}
+					}
+				}(from, connMetadata, k)
 				continue
 			}
 			if !encrypted {
@@ -692,8 +1073,13 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 				}
 				b := make([]byte, n)
 				copy(b, buffer[:n])
+				b, err = udpPacketFromWire(b, udpHeaderVersionOf(te.getConnCapabilities(k.(string))))
+				if err != nil {
+					log.Println("Couldn't read udp packet:", err)
+					continue
+				}
 				udpReadchan <- b
-				atomic.AddUint64(&te.Common.reverseBytesEntryToExit[k.(string)][b[2]], uint64(n))
+				te.addSessionBytes(k.(string), b[2], n, true)
 			}
 		}
 	}()
@@ -711,6 +1097,7 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 	}
 
 	go func() {
+		defer close(stopChan)
 		for {
 			tcpConn, err := listener.Accept()
 			if c, ok := tcpConn.(*net.TCPConn); ok {
@@ -741,6 +1128,8 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 						return fmt.Errorf("wrap conn error: %v", err)
 					}
 
+					te.exitCapabilities = negotiateCapabilities(connMetadata)
+
 					connKey := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
 					tcpEntrys.Store(connKey, te)
 					k, _ := te.encryptKeys.Load(connKey)
@@ -771,7 +1160,7 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 						return nil
 					}
 
-					te.session, err = smux.Server(encryptedConn, nil)
+					te.session, err = newSmuxSession(encryptedConn, te.getSessionConfig(connMetadata), false)
 					if err != nil {
 						return fmt.Errorf("create session error: %v", err)
 					}
@@ -834,6 +1223,11 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 								}
 								select {
 								case data := <-te.udpWriteChan:
+									if len(data) < udpHeaderSize {
+										log.Println("empty udp packet to send")
+										continue
+									}
+									data = udpPacketToWire(data, udpHeaderVersionOf(te.getConnCapabilities(connKey)))
 									n, _, err := encConn.WriteMsgUDP(data, nil, &udpAddr)
 									if err != nil {
 										log.Println("couldn't send udp data to server:", err)
@@ -844,7 +1238,7 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 										log.Println("no key found from this udp addr:", udpAddr.String())
 										continue
 									}
-									atomic.AddUint64(&te.Common.reverseBytesExitToEntry[key.(string)][data[2]], uint64(n))
+									te.addSessionBytes(key.(string), data[2], n, false)
 								case <-te.udpCloseChan:
 									return
 								}
@@ -869,20 +1263,20 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 	}()
 
 	for _, rsn := range strings.Split(config.ReverseServiceName, ",") {
-		UpdateMetadata(
+		updateMetadata(
 			strings.Trim(rsn, " "),
-			0,
-			nil,
-			nil,
-			ip,
-			uint32(config.ReverseTCP),
-			uint32(config.ReverseUDP),
-			config.ReversePrice,
-			config.ReverseBeneficiaryAddr,
+			&pb.ServiceMetadata{
+				Ip:              ip,
+				TcpPort:         uint32(config.ReverseTCP),
+				UdpPort:         uint32(config.ReverseUDP),
+				Price:           config.ReversePrice,
+				BeneficiaryAddr: config.ReverseBeneficiaryAddr,
+			},
 			config.ReverseSubscriptionPrefix,
 			uint32(config.ReverseSubscriptionDuration),
 			config.ReverseSubscriptionFee,
 			config.ReverseSubscriptionReplaceTxPool,
+			serviceMetadataMaxAge(config.MetadataMaxAge),
 			client,
 			make(chan struct{}),
 		)
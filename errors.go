@@ -3,5 +3,6 @@ package tuna
 import "errors"
 
 var (
-	ErrClosed = errors.New("closed")
+	ErrClosed         = errors.New("closed")
+	ErrBudgetExceeded = errors.New("budget exceeded")
 )
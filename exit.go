@@ -1,8 +1,11 @@
 package tuna
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -16,14 +19,34 @@ import (
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/nkn/v2/common"
 	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
 	"github.com/nknorg/tuna/util"
 	"github.com/patrickmn/go-cache"
-	"github.com/xtaci/smux"
+	"github.com/quic-go/quic-go"
 )
 
 type ExitServiceInfo struct {
-	Address string `json:"address"`
-	Price   string `json:"price"`
+	Address        string          `json:"address"`
+	Price          string          `json:"price"`
+	PricePerMinute string          `json:"pricePerMinute"`
+	FreeBytes      uint64          `json:"freeBytes"`
+	PriceTiers     []ExitPriceTier `json:"priceTiers"`
+	ClientLimits   ClientLimits    `json:"clientLimits"`
+	PaymentPolicy  *PaymentPolicy  `json:"paymentPolicy"`
+	Beneficiaries  []Beneficiary   `json:"beneficiaries"`
+}
+
+type ExitPriceTier struct {
+	ThresholdBytes uint64 `json:"thresholdBytes"`
+	Price          string `json:"price"`
+}
+
+func (si *ExitServiceInfo) metadataPriceTiers() []*pb.PriceTier {
+	tiers := make([]*pb.PriceTier, 0, len(si.PriceTiers))
+	for _, tier := range si.PriceTiers {
+		tiers = append(tiers, &pb.PriceTier{ThresholdBytes: tier.ThresholdBytes, Price: tier.Price})
+	}
+	return tiers
 }
 
 type TunaExit struct {
@@ -35,14 +58,23 @@ type TunaExit struct {
 	reverseBytesExitToEntryPaid uint64
 
 	*Common
-	OnConnect   *OnConnect // override Common.OnConnect
-	config      *ExitConfiguration
-	services    []Service
-	serviceConn *cache.Cache
-	tcpListener net.Listener
-	reverseIP   net.IP
-	reverseTCP  []uint32
-	reverseUDP  []uint32
+	OnConnect    *OnConnect // override Common.OnConnect
+	config       *ExitConfiguration
+	services     []Service
+	pricing      map[string]*PricingModel
+	policies     map[string]*PaymentPolicy
+	serviceConn  *cache.Cache
+	tcpListener  net.Listener
+	quicListener *quic.Listener
+	tlsListener  net.Listener
+	reverseIP    net.IP
+	reverseTCP   []uint32
+	reverseUDP   []uint32
+
+	clientLimitersLock      sync.Mutex
+	clientLimiters          map[string]*clientLimiter
+	clientLimitersExpiredAt time.Time
+	defaultPolicy           *PaymentPolicy
 }
 
 func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient, config *ExitConfiguration) (*TunaExit, error) {
@@ -92,6 +124,49 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient
 		subscriptionPrefix = config.SubscriptionPrefix
 	}
 
+	pricing := make(map[string]*PricingModel, len(config.Services))
+	policies := make(map[string]*PaymentPolicy, len(config.Services))
+	for serviceName, serviceInfo := range config.Services {
+		pricing[serviceName], err = NewPricingModel(serviceInfo.Price, serviceInfo.PricePerMinute, serviceInfo.FreeBytes, serviceInfo.metadataPriceTiers())
+		if err != nil {
+			return nil, fmt.Errorf("parse pricing of service %s error: %v", serviceName, err)
+		}
+		policies[serviceName], err = MergedPaymentPolicy(&config.PaymentPolicy, serviceInfo.PaymentPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("parse payment policy of service %s error: %v", serviceName, err)
+		}
+		err = validateBeneficiaries(serviceInfo.Beneficiaries)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", serviceName, err)
+		}
+	}
+	err = validateBeneficiaries(config.Beneficiaries)
+	if err != nil {
+		return nil, err
+	}
+	if config.ForwardRevenue {
+		if len(config.LedgerPath) == 0 {
+			return nil, errors.New("forwarding revenue requires ledger")
+		}
+		if len(config.BeneficiaryAddr) > 0 && config.BeneficiaryAddr != wallet.Address() {
+			return nil, errors.New("forwarding revenue requires payment to exit wallet, beneficiaryAddr should be empty")
+		}
+		_, err = common.StringToFixed64(config.MinRevenueForwardAmount)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.RevenueForwardFee) > 0 {
+			_, err = common.StringToFixed64(config.RevenueForwardFee)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	defaultPolicy, err := MergedPaymentPolicy(&config.PaymentPolicy, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := NewCommon(
 		service,
 		serviceInfo,
@@ -117,22 +192,90 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient
 		config.SortMeasuredNodes,
 		reverseMetadata,
 		config.ReverseMinBalance,
+		config.LedgerPath,
+		config.NanoPayStatePath,
+		config.UsageStatementPath,
+		config.RekeyBytes,
+		config.RekeyInterval,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	c.requireEphemeralKey = config.RequireEphemeralKey
+	c.strictMetadata = config.ReverseStrictMetadata
+	c.metadataMaxAge = serviceMetadataMaxAge(config.MetadataMaxAge)
+	err = config.Mux.verify()
+	if err != nil {
+		return nil, fmt.Errorf("invalid mux config: %v", err)
+	}
+	c.muxConfig = config.Mux
+	if !config.Reverse {
+		c.udpFlows = newUDPFlowTable(time.Duration(config.UDPTimeout)*time.Second, maxExitUDPFlowID)
+	}
+
 	te := &TunaExit{
 		Common:      c,
 		OnConnect:   NewOnConnect(1, nil),
 		config:      config,
 		services:    services,
+		pricing:     pricing,
+		policies:    policies,
 		serviceConn: cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+
+		clientLimiters: make(map[string]*clientLimiter),
+		defaultPolicy:  defaultPolicy,
+	}
+
+	c.udpQueues, err = newUDPQueues(int(config.UDPQueueSize), config.UDPDropPolicy, time.Duration(config.UDPTimeout)*time.Second, te.writeUDPToService)
+	if err != nil {
+		return nil, err
 	}
 
 	return te, nil
 }
 
+// isFreeAccess returns whether the entry with given public key should be served
+// without payment. Entries in FreeAccessNknFilter are only served for free if
+// they are explicitly allowed and not disallowed, by NKN address or public key
+// (hex).
+func (te *TunaExit) isFreeAccess(pubKey []byte) bool {
+	key := hex.EncodeToString(pubKey)
+	for _, k := range te.config.FreeAccessPubKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	f := te.config.FreeAccessNknFilter
+	if f == nil {
+		return false
+	}
+	for _, d := range f.Disallow {
+		if nknAddressHasPubKey(d.Address, pubKey) {
+			return false
+		}
+	}
+	for _, a := range f.Allow {
+		if nknAddressHasPubKey(a.Address, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// nknAddressHasPubKey returns whether address is an NKN client address or
+// public key (hex) of pubKey.
+func nknAddressHasPubKey(address string, pubKey []byte) bool {
+	if len(address) == 0 {
+		return false
+	}
+	addrPubKey, err := nkn.ClientAddrToPubKey(address)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(addrPubKey, pubKey)
+}
+
 func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
 	for i, service := range te.services {
 		if service.Name == serviceName {
@@ -143,29 +286,38 @@ func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
 	return 0, errors.New("Service " + serviceName + " not found")
 }
 
-func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.ConnectionMetadata) {
+// handleSession serves streams of session, and charges for them since
+// sessionStart, which is when the conn of session is accepted.
+func (te *TunaExit) handleSession(session Session, connMetadata *pb.ConnectionMetadata, sessionStart time.Time) {
 	bytesEntryToExit := make([]uint64, 256)
 	bytesExitToEntry := make([]uint64, 256)
 	var k string
 
 	var npc *nkn.NanoPayClaimer
+	var claims *nanoPayClaims
 	var lastPaymentAmount, bytesPaid common.Fixed64
 	var err error
 	claimInterval := time.Duration(te.config.ClaimInterval) * time.Second
 	onErr := nkn.NewOnError(1, nil)
 	lastPaymentTime := time.Now()
 	isClosed := false
+	freeAccess := false
+	// In reverse mode, capabilities are negotiated with reverse entry when
+	// connecting to it.
+	capabilities := te.getRemoteCapabilities()
 	if connMetadata != nil {
+		capabilities = negotiateCapabilities(connMetadata)
+		freeAccess = !te.config.Reverse && te.isFreeAccess(connMetadata.PublicKey)
 		k = string(append(connMetadata.PublicKey, connMetadata.Nonce...))
-		te.Common.reverseBytesEntryToExit[k] = bytesEntryToExit
-		te.Common.reverseBytesExitToEntry[k] = bytesExitToEntry
+		te.setSessionBytes(k, bytesEntryToExit, bytesExitToEntry)
 	}
 
 	getTotalCost := func() (common.Fixed64, common.Fixed64) {
 		cost, totalBytes := common.Fixed64(0), common.Fixed64(0)
+		duration := time.Since(sessionStart)
 		for i := range bytesEntryToExit {
-			entryToExit := common.Fixed64(atomic.LoadUint64(&bytesEntryToExit[i]))
-			exitToEntry := common.Fixed64(atomic.LoadUint64(&bytesExitToEntry[i]))
+			entryToExit := atomic.LoadUint64(&bytesEntryToExit[i])
+			exitToEntry := atomic.LoadUint64(&bytesExitToEntry[i])
 			if entryToExit == 0 && exitToEntry == 0 {
 				continue
 			}
@@ -173,28 +325,152 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 			if err != nil {
 				continue
 			}
-			serviceInfo := te.config.Services[service.Name]
-			entryToExitPrice, exitToEntryPrice, err := ParsePrice(serviceInfo.Price)
-			if err != nil {
+			pricing, ok := te.pricing[service.Name]
+			if !ok {
 				continue
 			}
-			cost += entryToExitPrice*entryToExit/TrafficUnit + exitToEntryPrice*exitToEntry/TrafficUnit
-			totalBytes += entryToExit + exitToEntry
+			cost += pricing.Cost(entryToExit, exitToEntry, duration)
+			totalBytes += common.Fixed64(entryToExit + exitToEntry)
 		}
 		return cost, totalBytes
 	}
 
-	if !te.config.Reverse {
-		npc, err = te.Client.NewNanoPayClaimer(te.config.BeneficiaryAddr, int32(claimInterval/time.Millisecond), int32(nanoPayClaimerLinger/time.Millisecond), te.config.MinFlushAmount, onErr)
+	// Entry of old version doesn't read control messages, which would block
+	// the session once stream buffer is full.
+	controlMessages := hasCapability(negotiateCapabilities(connMetadata), CapabilityControlMessages)
+	var controlStreamLock sync.Mutex
+	var controlStream Stream
+	sendControlMessage := func(msg *pb.ControlMessage) {
+		controlStreamLock.Lock()
+		defer controlStreamLock.Unlock()
+		if controlStream == nil || !controlMessages {
+			return
+		}
+		err := writeControlMessage(controlStream, msg)
+		if err != nil {
+			log.Println("Couldn't send control message:", err)
+		}
+	}
+
+	// Payment policy of a session is the one of the first service (by service
+	// ID) that the session uses.
+	getPolicy := func() *PaymentPolicy {
+		for i := range bytesEntryToExit {
+			if atomic.LoadUint64(&bytesEntryToExit[i]) == 0 && atomic.LoadUint64(&bytesExitToEntry[i]) == 0 {
+				continue
+			}
+			service, err := te.getService(byte(i))
+			if err != nil {
+				continue
+			}
+			if policy, ok := te.policies[service.Name]; ok {
+				return policy
+			}
+		}
+		return te.defaultPolicy
+	}
+	throttle := util.NewRateLimiter(0)
+
+	var limiter *clientLimiter
+	if connMetadata != nil && !te.config.Reverse {
+		limiter = te.getClientLimiter(connMetadata.PublicKey)
+		if limiter != nil {
+			removeNoticeHandler := limiter.addNoticeHandler(func(notice *pb.LimitNotice) {
+				sendControlMessage(&pb.ControlMessage{Message: &pb.ControlMessage_LimitNotice{LimitNotice: notice}})
+			})
+			defer removeNoticeHandler()
+		}
+	}
+
+	var handleControlMessage func(*pb.ControlMessage)
+	if connMetadata != nil && !te.config.Reverse {
+		peerKey := hex.EncodeToString(connMetadata.PublicKey)
+		statements := te.newUsageStatements(false, func() string { return peerKey }, te.config.UsageStatementTolerance, func() []*pb.ServiceUsage {
+			var usages []*pb.ServiceUsage
+			for i := range bytesEntryToExit {
+				entryToExit := atomic.LoadUint64(&bytesEntryToExit[i])
+				exitToEntry := atomic.LoadUint64(&bytesExitToEntry[i])
+				if entryToExit == 0 && exitToEntry == 0 {
+					continue
+				}
+				usages = append(usages, &pb.ServiceUsage{ServiceId: uint32(i), BytesEntryToExit: entryToExit, BytesExitToEntry: exitToEntry})
+			}
+			return usages
+		}, func(msg *pb.ControlMessage) error {
+			sendControlMessage(msg)
+			return nil
+		})
+		handleControlMessage = func(msg *pb.ControlMessage) {
+			statements.handle(msg)
+		}
+		if te.config.UsageStatementInterval > 0 && controlMessages {
+			go statements.start(time.Duration(te.config.UsageStatementInterval)*time.Second, func() bool { return isClosed })
+		}
+	}
+
+	var recordClaim func(common.Fixed64, string, string)
+	if connMetadata != nil {
+		role := storage.LedgerRoleEarn
+		if freeAccess {
+			role = storage.LedgerRoleFree
+		}
+		recordClaim = te.newClaimRecorder(role, hex.EncodeToString(connMetadata.PublicKey), func() []serviceUsage {
+			var usages []serviceUsage
+			duration := time.Since(sessionStart)
+			for i := range bytesEntryToExit {
+				entryToExit := atomic.LoadUint64(&bytesEntryToExit[i])
+				exitToEntry := atomic.LoadUint64(&bytesExitToEntry[i])
+				if entryToExit == 0 && exitToEntry == 0 {
+					continue
+				}
+				service, err := te.getService(byte(i))
+				if err != nil {
+					continue
+				}
+				usage := serviceUsage{
+					service:          service.Name,
+					price:            te.config.Services[service.Name].Price,
+					bytesEntryToExit: entryToExit,
+					bytesExitToEntry: exitToEntry,
+				}
+				if pricing, ok := te.pricing[service.Name]; ok {
+					usage.cost = pricing.Cost(entryToExit, exitToEntry, duration)
+				}
+				usages = append(usages, usage)
+			}
+			return usages
+		}, te.getBeneficiaries)
+	}
+
+	if freeAccess {
+		if recordClaim != nil {
+			defer recordClaim(0, "", "")
+		}
+	} else if !te.config.Reverse {
+		claims = te.newNanoPayClaims()
+		beneficiaryAddr := te.config.BeneficiaryAddr
+		if len(beneficiaryAddr) == 0 {
+			beneficiaryAddr = te.Wallet.Address()
+		}
+		npc, err = nkn.NewNanoPayClaimer(&claimFlushRecorder{MultiClient: te.Client, c: te.Common}, beneficiaryAddr, int32(claimInterval/time.Millisecond), int32(nanoPayClaimerLinger/time.Millisecond), te.config.MinFlushAmount, onErr)
 		if err != nil {
 			log.Fatalln(err)
 		}
 
 		defer npc.Close()
 
+		if recordClaim != nil {
+			defer func() {
+				recordClaim(lastPaymentAmount, "", "")
+			}()
+		}
+
 		go checkNanoPayClaim(session, npc, onErr, &isClosed)
 
-		go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+		go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost, getPolicy, func(notice *pb.PaymentNotice) {
+			throttle.SetRate(int(notice.ThrottleRate))
+			sendControlMessage(&pb.ControlMessage{Message: &pb.ControlMessage_PaymentNotice{PaymentNotice: notice}})
+		})
 	}
 
 	for {
@@ -213,7 +489,18 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 				}
 
 				if streamMetadata.IsPayment {
-					return handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+					controlStreamLock.Lock()
+					controlStream = stream
+					controlStreamLock.Unlock()
+					if freeAccess {
+						sendControlMessage(&pb.ControlMessage{Message: &pb.ControlMessage_FreeAccessNotice{FreeAccessNotice: &pb.FreeAccessNotice{}}})
+						return discardPaymentStream(stream, handleControlMessage)
+					}
+					return handlePaymentStream(stream, npc, claims, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost, recordClaim, handleControlMessage)
+				}
+
+				if streamMetadata.IsUdp {
+					return te.handleUDPStream(stream, k)
 				}
 
 				serviceID := byte(streamMetadata.ServiceId)
@@ -223,6 +510,7 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 				if err != nil {
 					return err
 				}
+
 				tcpPortsCount := len(service.TCP)
 				udpPortsCount := len(service.UDP)
 				var protocol string
@@ -238,20 +526,54 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 					return fmt.Errorf("invalid portId: %d", portID)
 				}
 
+				compressionAlgo := streamMetadata.CompressionAlgo
+				if compressionAlgo != pb.CompressionAlgo_COMPRESSION_ALGO_NONE && !isCompressionAlgoSupported(compressionAlgo, supportedCompressionAlgos()) {
+					return fmt.Errorf("unsupported compression algo %v", compressionAlgo)
+				}
+
 				serviceInfo := te.config.Services[service.Name]
+				if limiter != nil && !limiter.openStream(service.Name, serviceInfo.ClientLimits) {
+					return fmt.Errorf("client %x reached limit of service %s", connMetadata.PublicKey, service.Name)
+				}
+
 				host := serviceInfo.Address + ":" + strconv.Itoa(port)
 
 				conn, err := net.DialTimeout(protocol, host, time.Duration(te.config.DialTimeout)*time.Second)
 				if err != nil {
+					if limiter != nil {
+						limiter.closeStream(service.Name)
+					}
 					return err
 				}
 
+				halfClose := hasCapability(capabilities, CapabilityHalfClose)
+				serviceStream := wrapHalfClose(stream, halfClose)
+
+				var streamReader, connReader io.ReadCloser = serviceStream, conn
+				if limiter != nil {
+					streamReader, connReader = limiter.limitStream(serviceStream, conn, service.Name)
+				}
+
+				var streamWriter io.WriteCloser = serviceStream
+				if compressionAlgo != pb.CompressionAlgo_COMPRESSION_ALGO_NONE {
+					compressedStream, err := newCompressedStream(streamReader, serviceStream, compressionAlgo)
+					if err != nil {
+						Close(conn)
+						if limiter != nil {
+							limiter.closeStream(service.Name)
+						}
+						return err
+					}
+					streamReader, streamWriter = compressedStream, compressedStream
+				}
+
+				closer := newPipeCloser(halfClose, streamWriter, streamReader, conn, connReader)
 				if te.config.Reverse {
-					go te.pipe(conn, stream, &te.reverseBytesEntryToExit)
-					go te.pipe(stream, conn, &te.reverseBytesExitToEntry)
+					go te.pipe(conn, streamReader, &te.reverseBytesEntryToExit, closer)
+					go te.pipe(streamWriter, connReader, &te.reverseBytesExitToEntry, closer)
 				} else {
-					go te.pipe(conn, stream, &te.Common.reverseBytesEntryToExit[k][serviceID])
-					go te.pipe(stream, conn, &te.Common.reverseBytesExitToEntry[k][serviceID])
+					go te.pipe(conn, streamReader, &bytesEntryToExit[serviceID], closer, throttle)
+					go te.pipe(streamWriter, connReader, &bytesExitToEntry[serviceID], closer, throttle)
 				}
 
 				return nil
@@ -292,33 +614,7 @@ func (te *TunaExit) listenTCP(port int) error {
 			}
 
 			go func() {
-				err := func() error {
-					defer Close(conn)
-
-					encryptedConn, connMetadata, err := te.wrapConn(conn, nil, nil)
-					if err != nil {
-						return fmt.Errorf("wrap conn error: %v", err)
-					}
-
-					defer Close(encryptedConn)
-
-					if connMetadata.IsMeasurement {
-						err = util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), maxMeasureBandwidthTimeout)
-						if err != nil {
-							return fmt.Errorf("bandwidth measurement server error: %v", err)
-						}
-						return nil
-					}
-
-					session, err := smux.Server(encryptedConn, nil)
-					if err != nil {
-						return fmt.Errorf("create session error: %v", err)
-					}
-
-					te.handleSession(session, connMetadata)
-
-					return nil
-				}()
+				err := te.handleConn(conn)
 				if err != nil {
 					log.Println(err)
 				}
@@ -329,6 +625,37 @@ func (te *TunaExit) listenTCP(port int) error {
 	return nil
 }
 
+// handleConn handles a conn from entry, which is either a TCP conn or a
+// camouflaged one.
+func (te *TunaExit) handleConn(conn net.Conn) error {
+	sessionStart := time.Now()
+	defer Close(conn)
+
+	encryptedConn, connMetadata, err := te.wrapConn(conn, nil, nil)
+	if err != nil {
+		return fmt.Errorf("wrap conn error: %v", err)
+	}
+
+	defer Close(encryptedConn)
+
+	if connMetadata.IsMeasurement {
+		err = util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), maxMeasureBandwidthTimeout)
+		if err != nil {
+			return fmt.Errorf("bandwidth measurement server error: %v", err)
+		}
+		return nil
+	}
+
+	session, err := newSmuxSession(encryptedConn, te.getSessionConfig(connMetadata), false)
+	if err != nil {
+		return fmt.Errorf("create session error: %v", err)
+	}
+
+	te.handleSession(session, connMetadata, sessionStart)
+
+	return nil
+}
+
 func (te *TunaExit) getService(serviceID byte) (*Service, error) {
 	if int(serviceID) >= len(te.services) {
 		return nil, errors.New("Wrong serviceId: " + strconv.Itoa(int(serviceID)))
@@ -336,8 +663,8 @@ func (te *TunaExit) getService(serviceID byte) (*Service, error) {
 	return &te.services[serviceID], nil
 }
 
-func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (*net.UDPConn, error) {
-	connKey := strconv.Itoa(int(ConnIDToPort(connID)))
+func (te *TunaExit) getServiceConn(flowID uint32, serviceID byte, portID byte) (*net.UDPConn, error) {
+	connKey := strconv.FormatUint(uint64(flowID), 10)
 	var conn *net.UDPConn
 	var x interface{}
 	var ok bool
@@ -368,7 +695,6 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 
 		te.serviceConn.Set(connKey, conn, cache.DefaultExpiration)
 
-		prefix := []byte{connID[0], connID[1], serviceID, portID}
 		go func() {
 			defer te.serviceConn.Delete(connKey)
 			serviceBuffer := make([]byte, service.UDPBufferSize)
@@ -381,7 +707,7 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 					break
 				}
 
-				te.udpWriteChan <- append(prefix, serviceBuffer[:n]...)
+				te.udpQueues.forward(te.udpWriteChan, newUDPPacket(flowID, serviceID, portID, serviceBuffer[:n]))
 			}
 		}()
 	} else {
@@ -398,12 +724,12 @@ func (te *TunaExit) listenUDP(port int) error {
 		return err
 	}
 	encConn := NewEncryptUDPConn(conn)
-	udpConn, err := te.wrapUDPConn(encConn, nil, nil, nil)
+	udpConn, err := te.wrapUDPConn(encConn, nil, nil, nil, 0)
 	if err != nil {
 		log.Println("wrap udp conn err:", err)
 		return err
 	}
-	te.startUDPReaderWriter(udpConn, nil, nil, nil)
+	te.startUDPReaderWriter(udpConn, nil, nil, nil, nil)
 	te.udpConn = udpConn
 	te.readUDP()
 	return nil
@@ -421,45 +747,55 @@ func (te *TunaExit) readUDP() {
 				continue
 			}
 			data := <-serverReadChan
-			if len(data) < PrefixLen {
+			if len(data) < udpHeaderSize {
 				log.Println("empty udp packet received")
 				te.Close()
 				return
 			}
 
-			serviceConn, err := te.getServiceConn(data[0:2], data[2], data[3])
-			if err != nil {
-				log.Println("get service conn error:", err)
-				continue
-			}
-			_, _, err = serviceConn.WriteMsgUDP(data[PrefixLen:], nil, nil)
-			if err != nil {
-				log.Println("Couldn't send data to service:", err)
-			}
+			te.udpQueues.push(data)
 		}
 	}()
 }
 
+// writeUDPToService delivers an internal packet received from entry to the
+// service port of its flow.
+func (te *TunaExit) writeUDPToService(b []byte) error {
+	serviceConn, err := te.getServiceConn(udpPacketFlowID(b), b[2], b[3])
+	if err != nil {
+		return err
+	}
+	_, _, err = serviceConn.WriteMsgUDP(udpPacketPayload(b), nil, nil)
+	return err
+}
+
 func (te *TunaExit) updateAllMetadata(ip string, tcpPort, udpPort uint32) error {
 	for serviceName, serviceInfo := range te.config.Services {
 		serviceID, err := te.getServiceID(serviceName)
 		if err != nil {
 			return err
 		}
-		UpdateMetadata(
+		metadata := &pb.ServiceMetadata{
+			Ip:              ip,
+			TcpPort:         tcpPort,
+			UdpPort:         udpPort,
+			ServiceId:       uint32(serviceID),
+			Price:           serviceInfo.Price,
+			BeneficiaryAddr: te.config.BeneficiaryAddr,
+			PricePerMinute:  serviceInfo.PricePerMinute,
+			FreeBytes:       serviceInfo.FreeBytes,
+			PriceTiers:      serviceInfo.metadataPriceTiers(),
+			QuicPort:        uint32(te.config.ListenQUIC),
+			TlsPort:         uint32(te.config.ListenTLS),
+		}
+		updateMetadata(
 			serviceName,
-			serviceID,
-			nil,
-			nil,
-			ip,
-			tcpPort,
-			udpPort,
-			serviceInfo.Price,
-			te.config.BeneficiaryAddr,
+			metadata,
 			te.config.SubscriptionPrefix,
 			uint32(te.config.SubscriptionDuration),
 			te.config.SubscriptionFee,
 			te.config.SubscriptionReplaceTxPool,
+			te.metadataMaxAge,
 			te.Client,
 			te.closeChan,
 		)
@@ -483,6 +819,26 @@ func (te *TunaExit) Start() error {
 		return err
 	}
 
+	if te.config.ListenTLS > 0 {
+		err = te.listenTLS(int(te.config.ListenTLS))
+		if err != nil {
+			return err
+		}
+	}
+
+	if te.config.ListenQUIC > 0 {
+		err = te.listenQUIC(int(te.config.ListenQUIC))
+		if err != nil {
+			return err
+		}
+	}
+
+	go startFlushPendingClaims(&claimFlushRecorder{MultiClient: te.Client, c: te.Common}, te.nanoPayStorage, te.closeChan)
+
+	if te.config.ForwardRevenue {
+		go te.startForwardRevenue()
+	}
+
 	return te.updateAllMetadata(ip, uint32(te.config.ListenTCP), uint32(te.config.ListenUDP))
 }
 
@@ -501,9 +857,9 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 		return err
 	}
 
-	var paymentStream *smux.Stream
+	var paymentStream Stream
 	var recipient string
-	getPaymentStreamRecipient := func() (*smux.Stream, string, error) {
+	getPaymentStreamRecipient := func() (Stream, string, error) {
 		return paymentStream, recipient, nil
 	}
 
@@ -523,7 +879,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			continue
 		}
 		if te.udpConn != nil {
-			te.startUDPReaderWriter(te.udpConn, nil, &te.reverseBytesEntryToExit, &te.reverseBytesExitToEntry)
+			te.startUDPReaderWriter(te.udpConn, nil, &te.reverseBytesEntryToExit, &te.reverseBytesExitToEntry, nil)
 		}
 
 		var udpConn UDPConn
@@ -565,7 +921,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			continue
 		}
 
-		session, err := smux.Client(tcpConn, nil)
+		session, err := newSmuxSession(tcpConn, te.getServerSessionConfig(), true)
 		if err != nil {
 			log.Println(err)
 			time.Sleep(1 * time.Second)
@@ -660,7 +1016,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			)
 		})
 
-		te.handleSession(session, nil)
+		te.handleSession(session, nil, time.Now())
 
 		Close(tcpConn)
 		Close(udpConn)
@@ -708,10 +1064,13 @@ func (te *TunaExit) Close() {
 	close(te.closeChan)
 	close(te.udpCloseChan)
 	Close(te.tcpListener)
+	Close(te.quicListener)
+	Close(te.tlsListener)
 	Close(te.udpConn)
 	Close(te.tcpConn)
 
 	te.CloseUDPConn()
+	te.udpQueues.close()
 	te.OnConnect.close()
 }
 
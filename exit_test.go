@@ -0,0 +1,68 @@
+package tuna
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/filter"
+)
+
+func TestIsFreeAccess(t *testing.T) {
+	var pubKeys [3][]byte
+	for i := range pubKeys {
+		account, err := nkn.NewAccount(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys[i] = account.PubKey()
+	}
+	key := func(i int) string {
+		return hex.EncodeToString(pubKeys[i])
+	}
+
+	tests := []struct {
+		name       string
+		pubKeys    []string
+		filter     *filter.NknFilter
+		freeAccess [3]bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:       "pubkeys",
+			pubKeys:    []string{key(0)},
+			freeAccess: [3]bool{true, false, false},
+		},
+		{
+			name:   "disallow only",
+			filter: &filter.NknFilter{Disallow: []filter.NknClient{{Address: key(0)}}},
+		},
+		{
+			name:       "allow by pubkey and address",
+			filter:     &filter.NknFilter{Allow: []filter.NknClient{{Address: key(0)}, {Address: "client." + key(1)}}},
+			freeAccess: [3]bool{true, true, false},
+		},
+		{
+			name: "disallow overrides allow",
+			filter: &filter.NknFilter{
+				Allow:    []filter.NknClient{{Address: key(0)}, {Address: key(1)}},
+				Disallow: []filter.NknClient{{Address: "client." + key(1)}},
+			},
+			freeAccess: [3]bool{true, false, false},
+		},
+	}
+
+	for _, test := range tests {
+		te := &TunaExit{config: &ExitConfiguration{
+			FreeAccessPubKeys:   test.pubKeys,
+			FreeAccessNknFilter: test.filter,
+		}}
+		for i, pubKey := range pubKeys {
+			if te.isFreeAccess(pubKey) != test.freeAccess[i] {
+				t.Errorf("%s: free access of key %d should be %v", test.name, i, test.freeAccess[i])
+			}
+		}
+	}
+}
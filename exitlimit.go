@@ -0,0 +1,401 @@
+package tuna
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
+	"github.com/nknorg/tuna/util"
+)
+
+const (
+	limitNoticeInterval = time.Minute
+
+	// clientLimiterIdleTimeout is how long a client limiter is kept after the
+	// client has no session or stream.
+	clientLimiterIdleTimeout = 10 * time.Minute
+)
+
+var errDailyQuotaReached = errors.New("daily quota reached")
+
+// ClientLimits limits the resources one entry (identified by its public key)
+// can use on an exit. Zero value means unlimited. Limits apply to TCP streams
+// only, UDP packets are not limited.
+type ClientLimits struct {
+	MaxStreams int    `json:"maxStreams"` // max concurrent streams
+	Bandwidth  int    `json:"bandwidth"`  // bytes per second of each direction
+	DailyQuota uint64 `json:"dailyQuota"` // bytes per UTC day of both directions
+}
+
+func (l ClientLimits) isEmpty() bool {
+	return l.MaxStreams == 0 && l.Bandwidth == 0 && l.DailyQuota == 0
+}
+
+// trafficUsage is the streams and traffic of one client, either in total or
+// within one service.
+type trafficUsage struct {
+	limits             ClientLimits
+	streams            int
+	day                string
+	bytes              uint64
+	entryToExitLimiter *util.RateLimiter
+	exitToEntryLimiter *util.RateLimiter
+}
+
+func newTrafficUsage(limits ClientLimits) *trafficUsage {
+	return &trafficUsage{
+		limits:             limits,
+		entryToExitLimiter: util.NewRateLimiter(limits.Bandwidth),
+		exitToEntryLimiter: util.NewRateLimiter(limits.Bandwidth),
+	}
+}
+
+// clientLimiter enforces ClientLimits of one client across all its sessions.
+type clientLimiter struct {
+	lock        sync.Mutex
+	total       *trafficUsage
+	services    map[string]*trafficUsage
+	lastNotice  map[string]time.Time
+	sendNotices map[int]func(*pb.LimitNotice) // one for each session
+	nextID      int
+	lastActive  time.Time
+}
+
+// getClientLimiter returns the limiter of the client with given public key, or
+// nil if no limit applies to the client.
+func (te *TunaExit) getClientLimiter(pubKey []byte) *clientLimiter {
+	key := hex.EncodeToString(pubKey)
+	limits, ok := te.config.ClientLimitsByPubKey[key]
+	if !ok {
+		limits = te.config.ClientLimits
+	}
+
+	hasServiceLimits := false
+	for _, serviceInfo := range te.config.Services {
+		if !serviceInfo.ClientLimits.isEmpty() {
+			hasServiceLimits = true
+			break
+		}
+	}
+	if limits.isEmpty() && !hasServiceLimits {
+		return nil
+	}
+
+	te.clientLimitersLock.Lock()
+	defer te.clientLimitersLock.Unlock()
+	te.expireClientLimiters()
+	cl, ok := te.clientLimiters[key]
+	if !ok {
+		cl = &clientLimiter{
+			total:       newTrafficUsage(limits),
+			services:    make(map[string]*trafficUsage),
+			lastNotice:  make(map[string]time.Time),
+			sendNotices: make(map[int]func(*pb.LimitNotice)),
+			lastActive:  time.Now(),
+		}
+		if te.ledger != nil {
+			err := te.loadClientUsage(cl, key)
+			if err != nil {
+				log.Println("Couldn't load client usage from ledger:", err)
+			}
+		}
+		te.clientLimiters[key] = cl
+	}
+	return cl
+}
+
+// expireClientLimiters removes limiters of clients that are idle for
+// clientLimiterIdleTimeout. Without ledger, limiters that have used daily
+// quota today are kept until the next day, as quota usage couldn't be
+// restored. Should be called with clientLimitersLock held.
+func (te *TunaExit) expireClientLimiters() {
+	if time.Since(te.clientLimitersExpiredAt) < clientLimiterIdleTimeout {
+		return
+	}
+	te.clientLimitersExpiredAt = time.Now()
+	for key, cl := range te.clientLimiters {
+		if cl.isIdle(te.ledger != nil) {
+			delete(te.clientLimiters, key)
+		}
+	}
+}
+
+// loadClientUsage restores traffic of the current UTC day of a client from
+// ledger, so that daily quota survives restarts and limiter expiration.
+func (te *TunaExit) loadClientUsage(cl *clientLimiter, key string) error {
+	now := time.Now().UTC()
+	records, err := te.ledger.Query(&storage.LedgerQuery{
+		From:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+		PeerKey: key,
+	})
+	if err != nil {
+		return err
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	for _, record := range records {
+		if record.Role != storage.LedgerRoleEarn && record.Role != storage.LedgerRoleFree {
+			continue
+		}
+		n := record.BytesEntryToExit + record.BytesExitToEntry
+		cl.total.addBytes(n)
+		if len(record.Service) > 0 {
+			cl.serviceUsage(record.Service, te.config.Services[record.Service].ClientLimits).addBytes(n)
+		}
+	}
+
+	return nil
+}
+
+// isIdle returns whether the client has no session or stream for
+// clientLimiterIdleTimeout, and the limiter can be removed.
+func (cl *clientLimiter) isIdle(canRestore bool) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if len(cl.sendNotices) > 0 || cl.total.streams > 0 || time.Since(cl.lastActive) < clientLimiterIdleTimeout {
+		return false
+	}
+	if canRestore {
+		return true
+	}
+	for _, usage := range append([]*trafficUsage{cl.total}, cl.servicesUsage()...) {
+		if usage.limits.DailyQuota > 0 && !usage.quotaReset() {
+			return false
+		}
+	}
+	return true
+}
+
+func (cl *clientLimiter) servicesUsage() []*trafficUsage {
+	usages := make([]*trafficUsage, 0, len(cl.services))
+	for _, usage := range cl.services {
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+// addNoticeHandler registers a function to report limits to one session of
+// the client, and returns a function to unregister it.
+func (cl *clientLimiter) addNoticeHandler(sendNotice func(*pb.LimitNotice)) func() {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	id := cl.nextID
+	cl.nextID++
+	cl.sendNotices[id] = sendNotice
+	return func() {
+		cl.lock.Lock()
+		defer cl.lock.Unlock()
+		delete(cl.sendNotices, id)
+		cl.lastActive = time.Now()
+	}
+}
+
+// notify reports a limit to the client at most once per limitNoticeInterval
+// for each limit. Should be called with lock held.
+func (cl *clientLimiter) notify(limitType pb.LimitType, service string, limit uint64) {
+	key := limitType.String() + "/" + service
+	if time.Since(cl.lastNotice[key]) < limitNoticeInterval {
+		return
+	}
+	cl.lastNotice[key] = time.Now()
+
+	log.Printf("Client reached %s limit %d of service %q", limitType.String(), limit, service)
+
+	notice := &pb.LimitNotice{
+		LimitType: limitType,
+		Service:   service,
+		Limit:     limit,
+	}
+	for _, sendNotice := range cl.sendNotices {
+		go sendNotice(notice)
+	}
+}
+
+func (cl *clientLimiter) serviceUsage(service string, limits ClientLimits) *trafficUsage {
+	usage, ok := cl.services[service]
+	if !ok {
+		usage = newTrafficUsage(limits)
+		cl.services[service] = usage
+	}
+	return usage
+}
+
+// openStream reserves a stream of a service for the client, and returns false
+// if the client already reaches max concurrent streams or daily quota.
+func (cl *clientLimiter) openStream(service string, limits ClientLimits) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	serviceUsage := cl.serviceUsage(service, limits)
+	for _, u := range []struct {
+		usage   *trafficUsage
+		service string
+	}{{cl.total, ""}, {serviceUsage, service}} {
+		if u.usage.limits.MaxStreams > 0 && u.usage.streams >= u.usage.limits.MaxStreams {
+			cl.notify(pb.LimitType_LIMIT_MAX_STREAMS, u.service, uint64(u.usage.limits.MaxStreams))
+			return false
+		}
+		if u.usage.quotaReached() {
+			cl.notify(pb.LimitType_LIMIT_DAILY_QUOTA, u.service, u.usage.limits.DailyQuota)
+			return false
+		}
+	}
+
+	cl.total.streams++
+	serviceUsage.streams++
+	return true
+}
+
+func (cl *clientLimiter) closeStream(service string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.total.streams--
+	if usage, ok := cl.services[service]; ok {
+		usage.streams--
+	}
+	cl.lastActive = time.Now()
+}
+
+// addBytes accounts traffic of a service and returns errDailyQuotaReached if
+// the client reaches daily quota.
+func (cl *clientLimiter) addBytes(service string, n int) error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	for _, u := range []struct {
+		usage   *trafficUsage
+		service string
+	}{{cl.total, ""}, {cl.services[service], service}} {
+		u.usage.addBytes(uint64(n))
+		if u.usage.quotaReached() {
+			cl.notify(pb.LimitType_LIMIT_DAILY_QUOTA, u.service, u.usage.limits.DailyQuota)
+			return errDailyQuotaReached
+		}
+	}
+
+	return nil
+}
+
+// wait blocks until n bytes of a service are allowed to pass by bandwidth
+// limits.
+func (cl *clientLimiter) wait(service string, n int, isEntryToExit bool) {
+	cl.lock.Lock()
+	usages := []*trafficUsage{cl.total, cl.services[service]}
+	cl.lock.Unlock()
+
+	for i, usage := range usages {
+		limiter := usage.exitToEntryLimiter
+		if isEntryToExit {
+			limiter = usage.entryToExitLimiter
+		}
+		if limiter.Wait(n) > 0 {
+			var s string
+			if i > 0 {
+				s = service
+			}
+			cl.lock.Lock()
+			cl.notify(pb.LimitType_LIMIT_BANDWIDTH, s, uint64(usage.limits.Bandwidth))
+			cl.lock.Unlock()
+		}
+	}
+}
+
+func (u *trafficUsage) rotate() {
+	day := time.Now().UTC().Format("2006-01-02")
+	if u.day != day {
+		u.day = day
+		u.bytes = 0
+	}
+}
+
+func (u *trafficUsage) addBytes(n uint64) {
+	u.rotate()
+	u.bytes += n
+}
+
+func (u *trafficUsage) quotaReached() bool {
+	u.rotate()
+	return u.limits.DailyQuota > 0 && u.bytes >= u.limits.DailyQuota
+}
+
+// quotaReset returns whether there is no traffic in the current UTC day.
+func (u *trafficUsage) quotaReset() bool {
+	u.rotate()
+	return u.bytes == 0
+}
+
+// limitedStream wraps one direction of a stream of a client so that bandwidth
+// and daily quota limits are enforced when it's read from.
+type limitedStream struct {
+	io.ReadCloser
+	limiter       *clientLimiter
+	service       string
+	isEntryToExit bool
+	onClose       func()
+}
+
+func (s *limitedStream) Read(b []byte) (int, error) {
+	n, err := s.ReadCloser.Read(b)
+	if quotaErr := s.account(n); quotaErr != nil && err == nil {
+		err = quotaErr
+	}
+	return n, err
+}
+
+// WriteTo writes data of stream to w without a buffer if stream implements
+// io.WriterTo, and enforces limits on each write.
+func (s *limitedStream) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := s.ReadCloser.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{s})
+	}
+	return wt.WriteTo(&limitedWriter{writer: w, stream: s})
+}
+
+// account waits for bandwidth limit of n bytes read from stream, and returns
+// error if daily quota is reached.
+func (s *limitedStream) account(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	s.limiter.wait(s.service, n, s.isEntryToExit)
+	return s.limiter.addBytes(s.service, n)
+}
+
+// limitedWriter enforces limits of stream on data written by WriteTo of it.
+type limitedWriter struct {
+	writer io.Writer
+	stream *limitedStream
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	if quotaErr := w.stream.account(n); quotaErr != nil && err == nil {
+		err = quotaErr
+	}
+	return n, err
+}
+
+func (s *limitedStream) Close() error {
+	s.onClose()
+	return s.ReadCloser.Close()
+}
+
+// limitStream wraps both directions of a client stream of a service. Streams
+// count is released when either direction is closed.
+func (cl *clientLimiter) limitStream(stream io.ReadCloser, conn io.ReadCloser, service string) (io.ReadCloser, io.ReadCloser) {
+	var once sync.Once
+	onClose := func() {
+		once.Do(func() {
+			cl.closeStream(service)
+		})
+	}
+	return &limitedStream{ReadCloser: stream, limiter: cl, service: service, isEntryToExit: true, onClose: onClose},
+		&limitedStream{ReadCloser: conn, limiter: cl, service: service, isEntryToExit: false, onClose: onClose}
+}
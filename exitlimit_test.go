@@ -0,0 +1,176 @@
+package tuna
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
+)
+
+func newTestExitWithLimits(limits ClientLimits, serviceLimits ClientLimits, ledger *storage.Ledger) *TunaExit {
+	return &TunaExit{
+		Common: &Common{ledger: ledger},
+		config: &ExitConfiguration{
+			ClientLimits: limits,
+			Services: map[string]ExitServiceInfo{
+				"web": {ClientLimits: serviceLimits},
+			},
+		},
+		clientLimiters: make(map[string]*clientLimiter),
+	}
+}
+
+func TestClientLimiterStreams(t *testing.T) {
+	te := newTestExitWithLimits(ClientLimits{MaxStreams: 2}, ClientLimits{MaxStreams: 1}, nil)
+	cl := te.getClientLimiter([]byte{1})
+	if cl == nil {
+		t.Fatal("limiter should be created")
+	}
+	if te.getClientLimiter([]byte{1}) != cl {
+		t.Fatal("limiter should be shared by sessions of a client")
+	}
+
+	var notices []*pb.LimitNotice
+	notified := make(chan struct{}, 10)
+	remove := cl.addNoticeHandler(func(notice *pb.LimitNotice) {
+		notices = append(notices, notice)
+		notified <- struct{}{}
+	})
+	defer remove()
+
+	if !cl.openStream("web", te.config.Services["web"].ClientLimits) {
+		t.Fatal("first stream should be allowed")
+	}
+	if cl.openStream("web", te.config.Services["web"].ClientLimits) {
+		t.Fatal("second stream of service should be rejected")
+	}
+	<-notified
+	if notices[0].LimitType != pb.LimitType_LIMIT_MAX_STREAMS || notices[0].Service != "web" {
+		t.Fatalf("unexpected notice %v", notices[0])
+	}
+	if !cl.openStream("other", ClientLimits{}) {
+		t.Fatal("stream of other service should be allowed")
+	}
+	if cl.openStream("other", ClientLimits{}) {
+		t.Fatal("total streams should be limited")
+	}
+	cl.closeStream("web")
+	if !cl.openStream("web", te.config.Services["web"].ClientLimits) {
+		t.Fatal("stream should be allowed after one is closed")
+	}
+}
+
+func TestClientLimiterDailyQuota(t *testing.T) {
+	te := newTestExitWithLimits(ClientLimits{DailyQuota: 100}, ClientLimits{}, nil)
+	cl := te.getClientLimiter([]byte{1})
+	if !cl.openStream("web", ClientLimits{}) {
+		t.Fatal("stream should be allowed")
+	}
+	if err := cl.addBytes("web", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.addBytes("web", 40); err != errDailyQuotaReached {
+		t.Fatalf("expected quota reached, got %v", err)
+	}
+	if cl.openStream("web", ClientLimits{}) {
+		t.Fatal("stream should be rejected after quota is reached")
+	}
+
+	cl.lock.Lock()
+	cl.total.day = "2000-01-01"
+	cl.lock.Unlock()
+	if !cl.openStream("web", ClientLimits{}) {
+		t.Fatal("quota should be reset on a new day")
+	}
+}
+
+func TestClientLimiterExpire(t *testing.T) {
+	te := newTestExitWithLimits(ClientLimits{MaxStreams: 1, DailyQuota: 100}, ClientLimits{}, nil)
+	active := te.getClientLimiter([]byte{1})
+	used := te.getClientLimiter([]byte{2})
+	idle := te.getClientLimiter([]byte{3})
+	remove := active.addNoticeHandler(func(*pb.LimitNotice) {})
+	defer remove()
+	used.openStream("web", ClientLimits{})
+	used.addBytes("web", 10)
+	used.closeStream("web")
+
+	for _, cl := range te.clientLimiters {
+		cl.lastActive = time.Now().Add(-2 * clientLimiterIdleTimeout)
+	}
+	te.clientLimitersExpiredAt = time.Time{}
+	te.getClientLimiter([]byte{4})
+
+	if _, ok := te.clientLimiters[hex.EncodeToString([]byte{1})]; !ok {
+		t.Fatal("limiter of client with session should be kept")
+	}
+	if _, ok := te.clientLimiters[hex.EncodeToString([]byte{2})]; !ok {
+		t.Fatal("limiter with quota usage should be kept without ledger")
+	}
+	if te.getClientLimiter([]byte{3}) == idle {
+		t.Fatal("idle limiter should be expired")
+	}
+}
+
+func TestClientLimiterLoad(t *testing.T) {
+	ledger := storage.NewLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	key := hex.EncodeToString([]byte{1})
+	records := []*storage.UsageRecord{
+		{Role: storage.LedgerRoleEarn, PeerKey: key, Service: "web", BytesEntryToExit: 30, BytesExitToEntry: 20},
+		{Role: storage.LedgerRoleFree, PeerKey: key, Service: "web", BytesEntryToExit: 10},
+		{Role: storage.LedgerRoleShare, PeerKey: key, Service: "web", BytesEntryToExit: 1000},
+		{Role: storage.LedgerRoleEarn, PeerKey: "other", Service: "web", BytesEntryToExit: 1000},
+		{Time: time.Now().Add(-48 * time.Hour).Unix(), Role: storage.LedgerRoleEarn, PeerKey: key, Service: "web", BytesEntryToExit: 1000},
+	}
+	for _, r := range records {
+		if err := ledger.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	te := newTestExitWithLimits(ClientLimits{DailyQuota: 100}, ClientLimits{DailyQuota: 70}, ledger)
+	cl := te.getClientLimiter([]byte{1})
+	if cl.total.bytes != 60 || cl.services["web"].bytes != 60 {
+		t.Fatalf("loaded %d bytes in total and %d bytes of service, expected 60", cl.total.bytes, cl.services["web"].bytes)
+	}
+	if err := cl.addBytes("web", 10); err != errDailyQuotaReached {
+		t.Fatalf("expected quota of service reached, got %v", err)
+	}
+
+	// limiter is restored from ledger after it expires
+	cl.lastActive = time.Now().Add(-2 * clientLimiterIdleTimeout)
+	te.clientLimitersExpiredAt = time.Time{}
+	if te.getClientLimiter([]byte{1}) == cl {
+		t.Fatal("idle limiter should be expired with ledger")
+	}
+}
+
+func TestLimitedStreamWriteTo(t *testing.T) {
+	te := newTestExitWithLimits(ClientLimits{DailyQuota: 100}, ClientLimits{}, nil)
+	cl := te.getClientLimiter([]byte{1})
+	if !cl.openStream("web", ClientLimits{}) {
+		t.Fatal("stream should be allowed")
+	}
+	data := bytes.Repeat([]byte{1}, 150)
+	stream, _ := cl.limitStream(io.NopCloser(bytes.NewReader(data)), io.NopCloser(nil), "web")
+
+	if _, ok := writerTo(stream); !ok {
+		t.Fatal("limited stream should be copied by WriteTo of the stream it wraps")
+	}
+	var buf bytes.Buffer
+	var written uint64
+	if err := Copy(&buf, stream, &written); err != errDailyQuotaReached {
+		t.Fatalf("copy should stop at daily quota, got %v", err)
+	}
+	if written != 150 || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("%d bytes written, expected 150", written)
+	}
+	if !cl.total.quotaReached() {
+		t.Fatal("bytes written by WriteTo should count towards quota")
+	}
+}
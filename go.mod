@@ -3,31 +3,41 @@ module github.com/nknorg/tuna
 go 1.20
 
 require (
+	github.com/gorilla/websocket v1.5.0
 	github.com/imdario/mergo v0.3.13
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.17.4
 	github.com/nknorg/encrypted-stream v1.0.2-0.20230320101720-9891f770de86
 	github.com/nknorg/nkn-sdk-go v1.4.8-0.20240427043332-a40386d2b50a
 	github.com/nknorg/nkn/v2 v2.2.0
 	github.com/oschwald/geoip2-golang v1.4.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/quic-go/quic-go v0.40.1
 	github.com/rdegges/go-ipify v0.0.0-20150526035502-2d94a6a86c40
-	github.com/xtaci/smux v2.0.1+incompatible
+	github.com/xtaci/smux v1.5.24
 	golang.org/x/crypto v0.17.0
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c
+	golang.org/x/net v0.19.0
+	golang.org/x/sys v0.15.0
 	google.golang.org/protobuf v1.33.0
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/itchyny/base58-go v0.2.1 // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/nknorg/ncp-go v1.0.5 // indirect
 	github.com/nknorg/nkngomobile v0.0.0-20220615081414-671ad1afdfa9 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/oschwald/maxminddb-golang v1.6.0 // indirect
 	github.com/pbnjay/memory v0.0.0-20210728143218-7b4eea64cf58 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.15.0 // indirect
+	github.com/quic-go/qtls-go1-20 v0.4.1 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 )
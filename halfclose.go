@@ -0,0 +1,262 @@
+package tuna
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const halfCloseFrameHeaderSize = 4
+
+var (
+	errWriteClosed      = errors.New("write direction is closed")
+	errReadClosed       = errors.New("data after half-close")
+	errHalfCloseReached = errors.New("half-close reached")
+)
+
+// closeWriter is implemented by conns and streams that can close the write
+// direction only, such as TCP conns.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfCloseStream carries a half-close over a stream that doesn't support it,
+// as smux streams are closed in both directions. Data is sent as length-
+// prefixed frames, and a zero length frame tells peer that no more data will
+// be written, so peer reads EOF while it can still write.
+type halfCloseStream struct {
+	Stream
+
+	readLock      sync.Mutex
+	readRemaining uint32
+	readHeader    [halfCloseFrameHeaderSize]byte
+	readHeaderLen int
+	isReadClosed  bool
+
+	writeLock     sync.Mutex
+	writeBuf      []byte
+	isWriteClosed bool
+}
+
+func newHalfCloseStream(stream Stream) *halfCloseStream {
+	return &halfCloseStream{Stream: stream}
+}
+
+func (s *halfCloseStream) Read(b []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for s.readRemaining == 0 {
+		if s.isReadClosed {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.Stream, s.readHeader[s.readHeaderLen:])
+		s.readHeaderLen += n
+		if err != nil {
+			if err == io.EOF && s.readHeaderLen == 0 {
+				return 0, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		s.readFrameHeader()
+	}
+
+	if uint32(len(b)) > s.readRemaining {
+		b = b[:s.readRemaining]
+	}
+	n, err := s.Stream.Read(b)
+	s.readRemaining -= uint32(n)
+	if err == io.EOF && s.readRemaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *halfCloseStream) readFrameHeader() {
+	s.readHeaderLen = 0
+	s.readRemaining = binary.LittleEndian.Uint32(s.readHeader[:])
+	if s.readRemaining == 0 {
+		s.isReadClosed = true
+	}
+}
+
+// WriteTo writes data of frames to w until a zero length frame. If stream
+// implements io.WriterTo, data is written to w without being copied to a
+// buffer.
+func (s *halfCloseStream) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := s.Stream.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{s})
+	}
+
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	if s.isReadClosed && s.readRemaining == 0 {
+		return 0, nil
+	}
+
+	fw := &halfCloseFrameWriter{stream: s, writer: w}
+	_, err := wt.WriteTo(fw)
+	if err == errHalfCloseReached || (err == io.EOF && s.readRemaining == 0 && s.readHeaderLen == 0) {
+		return fw.n, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fw.n, err
+}
+
+// halfCloseFrameWriter parses frames written to it and writes their data to
+// writer.
+type halfCloseFrameWriter struct {
+	stream *halfCloseStream
+	writer io.Writer
+	n      int64
+}
+
+func (fw *halfCloseFrameWriter) Write(b []byte) (int, error) {
+	s := fw.stream
+	consumed := 0
+	for len(b) > 0 {
+		if s.readRemaining == 0 {
+			if s.isReadClosed {
+				return consumed, errReadClosed
+			}
+			n := copy(s.readHeader[s.readHeaderLen:], b)
+			s.readHeaderLen += n
+			consumed += n
+			b = b[n:]
+			if s.readHeaderLen < halfCloseFrameHeaderSize {
+				continue
+			}
+			s.readFrameHeader()
+			if s.isReadClosed {
+				if len(b) > 0 {
+					return consumed, errReadClosed
+				}
+				return consumed, errHalfCloseReached
+			}
+			continue
+		}
+
+		data := b
+		if uint32(len(data)) > s.readRemaining {
+			data = data[:s.readRemaining]
+		}
+		n, err := fw.writer.Write(data)
+		fw.n += int64(n)
+		s.readRemaining -= uint32(n)
+		consumed += n
+		b = b[n:]
+		if err != nil {
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+// Write sends b as one frame, so that header and data are written to stream
+// together.
+func (s *halfCloseStream) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.isWriteClosed {
+		return 0, errWriteClosed
+	}
+
+	size := halfCloseFrameHeaderSize + len(b)
+	if cap(s.writeBuf) < size {
+		s.writeBuf = make([]byte, size)
+	}
+	buf := s.writeBuf[:size]
+	binary.LittleEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[halfCloseFrameHeaderSize:], b)
+
+	n, err := s.Stream.Write(buf)
+	n -= halfCloseFrameHeaderSize
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// CloseWrite sends a zero length frame. Peer reads EOF after reading data
+// written before it.
+func (s *halfCloseStream) CloseWrite() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.isWriteClosed {
+		return nil
+	}
+	s.isWriteClosed = true
+
+	_, err := s.Stream.Write(make([]byte, halfCloseFrameHeaderSize))
+	return err
+}
+
+// pipeCloser closes the conns of a pair of pipes in opposite directions. When
+// half-close is enabled, a direction that ends with EOF only closes the write
+// direction of its dest, and conns are closed after both directions end.
+// Otherwise, or if a direction ends with error, conns are closed when either
+// direction ends.
+type pipeCloser struct {
+	halfClose bool
+	closers   []io.Closer
+	remaining int32
+	closeOnce sync.Once
+}
+
+func newPipeCloser(halfClose bool, closers ...io.Closer) *pipeCloser {
+	return &pipeCloser{
+		halfClose: halfClose,
+		closers:   closers,
+		remaining: 2,
+	}
+}
+
+// done is called when the pipe to dest ends with err.
+func (pc *pipeCloser) done(dest io.Writer, err error) {
+	remaining := atomic.AddInt32(&pc.remaining, -1)
+	if pc.halfClose && err == nil && remaining > 0 {
+		if w, ok := dest.(closeWriter); ok && w.CloseWrite() == nil {
+			return
+		}
+	}
+	pc.close()
+}
+
+func (pc *pipeCloser) close() {
+	pc.closeOnce.Do(func() {
+		for _, closer := range pc.closers {
+			closer.Close()
+		}
+	})
+}
+
+// wrapHalfClose wraps stream to carry half-close if half-close is negotiated
+// and stream can't close write direction by itself.
+func wrapHalfClose(stream Stream, halfClose bool) Stream {
+	if !halfClose {
+		return stream
+	}
+	if _, ok := stream.(closeWriter); ok {
+		return stream
+	}
+	return newHalfCloseStream(stream)
+}
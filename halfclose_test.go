@@ -0,0 +1,122 @@
+package tuna
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHalfCloseStream(t *testing.T) {
+	for _, useWriteTo := range []bool{false, true} {
+		stream1, stream2 := newTestStreamPair(t)
+		s1, s2 := newHalfCloseStream(stream1), newHalfCloseStream(stream2)
+
+		request := bytes.Repeat([]byte("request"), 10000)
+		go func() {
+			s1.Write(request)
+			s1.CloseWrite()
+		}()
+
+		var b bytes.Buffer
+		var err error
+		if useWriteTo {
+			_, err = s2.WriteTo(&b)
+		} else {
+			_, err = io.Copy(&b, struct{ io.Reader }{s2})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), request) {
+			t.Fatalf("got %d bytes before EOF, expected %d bytes", b.Len(), len(request))
+		}
+
+		// reverse direction keeps flowing after peer closed write
+		if _, err := s1.Write([]byte("x")); err != errWriteClosed {
+			t.Fatalf("write after close write got %v, expected %v", err, errWriteClosed)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := s2.Write([]byte("response")); err != nil {
+				t.Fatal(err)
+			}
+			response := make([]byte, 8)
+			if _, err := io.ReadFull(s1, response); err != nil {
+				t.Fatal(err)
+			}
+			if string(response) != "response" {
+				t.Fatalf("got %q, expected response", response)
+			}
+		}
+		s2.CloseWrite()
+		if n, err := s1.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Fatalf("read after peer closed write got %d, %v, expected EOF", n, err)
+		}
+	}
+}
+
+func TestHalfCloseStreamPeerWithoutHalfClose(t *testing.T) {
+	stream1, stream2 := newTestStreamPair(t)
+
+	// streams are not wrapped if half-close is not negotiated with peer
+	if s := wrapHalfClose(stream1, false); s != stream1 {
+		t.Fatal("stream should not be wrapped without half-close")
+	}
+	// conns that close write direction by themselves are not wrapped
+	conn1, _ := newTestConnPair(t)
+	if s := wrapHalfClose(conn1, true); s != conn1 {
+		t.Fatal("tcp conn should not be wrapped")
+	}
+	if _, ok := wrapHalfClose(stream1, true).(*halfCloseStream); !ok {
+		t.Fatal("smux stream should be wrapped with half-close")
+	}
+
+	// without half-close, pipes close conns in both directions when either
+	// direction ends, as before
+	closed := make(chan struct{})
+	closer := newPipeCloser(false, stream2, closerFunc(func() error {
+		close(closed)
+		return nil
+	}))
+	closer.done(stream2, nil)
+	select {
+	case <-closed:
+	default:
+		t.Fatal("conns should be closed when a direction ends without half-close")
+	}
+	if _, err := stream1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("peer should read error after stream is closed")
+	}
+}
+
+func TestPipeCloserHalfClose(t *testing.T) {
+	conn1, conn2 := newTestConnPair(t)
+	closer := newPipeCloser(true, conn1)
+
+	// first direction to end only closes write direction of its dest
+	closer.done(conn1, nil)
+	if n, err := conn2.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("got %d, %v, expected EOF", n, err)
+	}
+	if _, err := conn2.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(conn1, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// conns are closed after both directions end
+	closer.done(conn2, nil)
+	if _, err := conn1.Write([]byte("x")); err == nil {
+		t.Fatal("conn should be closed after both directions end")
+	}
+
+	// a direction that ends with error closes conns
+	conn3, _ := newTestConnPair(t)
+	closer = newPipeCloser(true, conn3)
+	closer.done(conn3, net.ErrClosed)
+	if _, err := conn3.Write([]byte("x")); err == nil {
+		t.Fatal("conn should be closed after a direction ends with error")
+	}
+}
@@ -0,0 +1,138 @@
+package tuna
+
+import (
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/storage"
+)
+
+// serviceUsage is the cumulative traffic and cost of one service within a
+// session.
+type serviceUsage struct {
+	service          string
+	price            string
+	bytesEntryToExit uint64
+	bytesExitToEntry uint64
+	cost             common.Fixed64
+}
+
+func (c *Common) appendLedger(record *storage.UsageRecord) {
+	if c.ledger == nil {
+		return
+	}
+	err := c.ledger.Append(record)
+	if err != nil {
+		log.Println("Couldn't append ledger record:", err)
+	}
+}
+
+// GetLedger returns the usage ledger, or nil if ledger is not enabled.
+func (c *Common) GetLedger() *storage.Ledger {
+	return c.ledger
+}
+
+// newClaimRecorder returns a function that should be called with the
+// cumulative claimed amount every time a payment is claimed. It writes one
+// ledger record with given role per service that has new traffic since the
+// previous call, and allocates the newly claimed amount across services by
+// their traffic cost. If getBeneficiaries is not nil, the portion of each
+// beneficiary of a service is recorded as well.
+func (c *Common) newClaimRecorder(role, peerKey string, getUsage func() []serviceUsage, getBeneficiaries func(service string) []Beneficiary) func(claimed common.Fixed64, txnID, channel string) {
+	var lock sync.Mutex
+	var lastClaimed common.Fixed64
+	recorded := make(map[string]serviceUsage)
+	sessionStart := time.Now().Unix()
+
+	appendRecord := func(record *storage.UsageRecord) {
+		c.appendLedger(record)
+		if getBeneficiaries == nil || record.Role != storage.LedgerRoleEarn {
+			return
+		}
+		if beneficiaries := getBeneficiaries(record.Service); len(beneficiaries) > 0 {
+			c.appendShares(record, beneficiaries)
+		}
+	}
+
+	return func(claimed common.Fixed64, txnID, channel string) {
+		if c.ledger == nil {
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		usages := getUsage()
+		deltas := make([]serviceUsage, 0, len(usages))
+		costs := make([]common.Fixed64, 0, len(usages))
+		var totalCost common.Fixed64
+		for _, usage := range usages {
+			prev := recorded[usage.service]
+			delta := serviceUsage{
+				service:          usage.service,
+				price:            usage.price,
+				bytesEntryToExit: usage.bytesEntryToExit - prev.bytesEntryToExit,
+				bytesExitToEntry: usage.bytesExitToEntry - prev.bytesExitToEntry,
+			}
+			if delta.bytesEntryToExit == 0 && delta.bytesExitToEntry == 0 {
+				continue
+			}
+			cost := usage.cost - prev.cost
+			deltas = append(deltas, delta)
+			costs = append(costs, cost)
+			totalCost += cost
+			recorded[usage.service] = usage
+		}
+
+		amount := claimed - lastClaimed
+		if amount < 0 {
+			amount = 0
+		}
+		lastClaimed = claimed
+
+		if len(deltas) == 0 {
+			if amount > 0 {
+				appendRecord(&storage.UsageRecord{
+					SessionStart: sessionStart,
+					Role:         role,
+					PeerKey:      peerKey,
+					Amount:       amount.String(),
+					TxnID:        txnID,
+					Channel:      channel,
+				})
+			}
+			return
+		}
+
+		for i, delta := range deltas {
+			share := amount / common.Fixed64(len(deltas))
+			if totalCost > 0 {
+				share = common.Fixed64(float64(amount) * float64(costs[i]) / float64(totalCost))
+			}
+			appendRecord(&storage.UsageRecord{
+				SessionStart:     sessionStart,
+				Role:             role,
+				PeerKey:          peerKey,
+				Service:          delta.service,
+				BytesEntryToExit: delta.bytesEntryToExit,
+				BytesExitToEntry: delta.bytesExitToEntry,
+				Price:            delta.price,
+				Amount:           share.String(),
+				TxnID:            txnID,
+				Channel:          channel,
+			})
+		}
+	}
+}
+
+func peerKeyFromClientAddr(clientAddr string) string {
+	pubKey, err := nkn.ClientAddrToPubKey(clientAddr)
+	if err != nil {
+		return clientAddr
+	}
+	return hex.EncodeToString(pubKey)
+}
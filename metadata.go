@@ -0,0 +1,173 @@
+package tuna
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/crypto"
+	"github.com/nknorg/tuna/pb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// serviceMetadataSignPrefix is prepended to metadata before it's signed, so
+// that the signature can't be used for other purpose.
+const serviceMetadataSignPrefix = "tuna-service-metadata"
+
+// serviceMetadataSignatureField is the field number of signature in serialized
+// service metadata.
+const serviceMetadataSignatureField = 12
+
+// maxServiceMetadataClockSkew is how far issue time of metadata may be ahead of
+// local clock.
+const maxServiceMetadataClockSkew = 10 * time.Minute
+
+var errUnsignedMetadata = errors.New("service metadata is not signed")
+
+// serviceMetadataMaxAge returns how long signed metadata is accepted after it's
+// issued, so that stale metadata can't be replayed by RPC node, from config in
+// seconds. Subscriber signs and subscribes its metadata again after half of
+// it. Zero means age is not checked and metadata is not signed again.
+func serviceMetadataMaxAge(seconds int32) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SignServiceMetadata returns the serialized metadata subscribed to topic,
+// issued now and signed with the key of seed, which should be the key of
+// subscriber. Signature covers the exact bytes before it, and is appended as
+// the signature field.
+func SignServiceMetadata(metadata *pb.ServiceMetadata, topic string, seed []byte) ([]byte, error) {
+	return signServiceMetadata(metadata, topic, seed, time.Now())
+}
+
+func signServiceMetadata(metadata *pb.ServiceMetadata, topic string, seed []byte, issuedAt time.Time) ([]byte, error) {
+	unsigned := proto.Clone(metadata).(*pb.ServiceMetadata)
+	unsigned.Signature = nil
+	unsigned.IssuedAt = issuedAt.Unix()
+	b, err := proto.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(crypto.GetPrivateKeyFromSeed(seed), serviceMetadataSigningBytes(b, topic))
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, serviceMetadataSignatureField, protowire.BytesType)
+	return protowire.AppendBytes(b, signature), nil
+}
+
+// VerifyServiceMetadata checks that serialized service metadata of topic is
+// signed by subscriber, so that it's not altered by RPC node that returns it,
+// and that it's not older than maxAge if maxAge is positive. Signature is
+// verified against the bytes received rather than metadata encoded again, and
+// decoded metadata is returned.
+func VerifyServiceMetadata(metadataRaw []byte, topic, subscriber string, maxAge time.Duration) (*pb.ServiceMetadata, error) {
+	unsigned, signature, err := splitServiceMetadataSignature(metadataRaw)
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) == 0 {
+		return nil, errUnsignedMetadata
+	}
+	pubKey, err := nkn.ClientAddrToPubKey(subscriber)
+	if err != nil {
+		return nil, err
+	}
+	err = crypto.Verify(pubKey, serviceMetadataSigningBytes(unsigned, topic), signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata signature of %s: %v", subscriber, err)
+	}
+
+	metadata := &pb.ServiceMetadata{}
+	err = proto.Unmarshal(metadataRaw, metadata)
+	if err != nil {
+		return nil, err
+	}
+	issuedAt := time.Unix(metadata.IssuedAt, 0)
+	if maxAge > 0 && time.Since(issuedAt) > maxAge {
+		return nil, fmt.Errorf("metadata of %s issued at %v is too old", subscriber, issuedAt)
+	}
+	if time.Until(issuedAt) > maxServiceMetadataClockSkew {
+		return nil, fmt.Errorf("metadata of %s issued at %v is in the future", subscriber, issuedAt)
+	}
+	return metadata, nil
+}
+
+// splitServiceMetadataSignature returns serialized metadata with signature
+// field removed, and the signature. Other fields are kept as is, in the same
+// order.
+func splitServiceMetadataSignature(metadataRaw []byte) ([]byte, []byte, error) {
+	unsigned := make([]byte, 0, len(metadataRaw))
+	var signature []byte
+	for b := metadataRaw; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return nil, nil, protowire.ParseError(m)
+		}
+		if num == serviceMetadataSignatureField && typ == protowire.BytesType {
+			signature, _ = protowire.ConsumeBytes(b[n:])
+		} else {
+			unsigned = append(unsigned, b[:n+m]...)
+		}
+		b = b[n+m:]
+	}
+	return unsigned, signature, nil
+}
+
+// serviceMetadataSigningBytes prepends topic to serialized metadata without
+// signature, so that metadata can't be moved to another service of the same
+// subscriber.
+func serviceMetadataSigningBytes(unsigned []byte, topic string) []byte {
+	return append([]byte(serviceMetadataSignPrefix+topic+"\x00"), unsigned...)
+}
+
+// isSubscribedMetadataFresh returns whether metadata subscribed to topic has
+// the same content as metadata, a valid signature of subscriber, and doesn't
+// need to be signed again yet, which is after half of maxAge.
+func isSubscribedMetadataFresh(metadataString string, metadata *pb.ServiceMetadata, topic, subscriber string, maxAge time.Duration) bool {
+	metadataRaw, err := base64.StdEncoding.DecodeString(metadataString)
+	if err != nil {
+		return false
+	}
+	subscribed, err := VerifyServiceMetadata(metadataRaw, topic, subscriber, maxAge)
+	if err != nil {
+		return false
+	}
+	if maxAge > 0 && time.Since(time.Unix(subscribed.IssuedAt, 0)) > maxAge/2 {
+		return false
+	}
+	subscribed.Signature, subscribed.IssuedAt = nil, 0
+	expected := proto.Clone(metadata).(*pb.ServiceMetadata)
+	expected.Signature, expected.IssuedAt = nil, 0
+	return proto.Equal(subscribed, expected)
+}
+
+// readSubscriberMetadata decodes metadata got from RPC node and checks its
+// signature and age. Unsigned metadata from exits of old version is only
+// accepted if strict metadata is not enabled, in which case RPC node may still
+// forge it.
+func (c *Common) readSubscriberMetadata(metadataString, subscriber string) (*pb.ServiceMetadata, error) {
+	metadataRaw, err := base64.StdEncoding.DecodeString(metadataString)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := VerifyServiceMetadata(metadataRaw, c.SubscriptionPrefix+c.Service.Name, subscriber, c.metadataMaxAge)
+	if err == errUnsignedMetadata && !c.strictMetadata {
+		metadata = &pb.ServiceMetadata{}
+		err = proto.Unmarshal(metadataRaw, metadata)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
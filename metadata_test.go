@@ -0,0 +1,86 @@
+package tuna
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn/v2/crypto"
+	"github.com/nknorg/tuna/pb"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestServiceMetadataAge(t *testing.T) {
+	c := newTestCommon(t)
+	subscriber := hex.EncodeToString(c.Wallet.PubKey())
+	topic := DefaultSubscriptionPrefix + "httpproxy"
+	metadata := &pb.ServiceMetadata{Ip: "127.0.0.1", TcpPort: 30020}
+
+	maxAge := serviceMetadataMaxAge(defaultMetadataMaxAge)
+	if maxAge != 24*time.Hour {
+		t.Fatalf("default max age is %v, expected 24h", maxAge)
+	}
+	for _, tc := range []struct {
+		issuedAt time.Time
+		maxAge   time.Duration
+		valid    bool
+		fresh    bool
+	}{
+		{time.Now().Add(-maxAge / 4), maxAge, true, true},
+		{time.Now().Add(-maxAge * 3 / 4), maxAge, true, false},
+		{time.Now().Add(-maxAge - time.Minute), maxAge, false, false},
+		{time.Now().Add(maxServiceMetadataClockSkew / 2), maxAge, true, true},
+		{time.Now().Add(2 * maxServiceMetadataClockSkew), maxAge, false, false},
+		// age is not checked and metadata is not signed again if disabled
+		{time.Now().Add(-10 * maxAge), serviceMetadataMaxAge(-1), true, true},
+	} {
+		metadataRaw, err := signServiceMetadata(metadata, topic, c.Wallet.Seed(), tc.issuedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyServiceMetadata(metadataRaw, topic, subscriber, tc.maxAge)
+		if (err == nil) != tc.valid {
+			t.Fatalf("metadata issued at %v: got error %v, expected valid %v", tc.issuedAt, err, tc.valid)
+		}
+		if fresh := isSubscribedMetadataFresh(base64.StdEncoding.EncodeToString(metadataRaw), metadata, topic, subscriber, tc.maxAge); fresh != tc.fresh {
+			t.Fatalf("metadata issued at %v: got fresh %v, expected %v", tc.issuedAt, fresh, tc.fresh)
+		}
+	}
+}
+
+func TestServiceMetadataRawBytes(t *testing.T) {
+	c := newTestCommon(t)
+	subscriber := hex.EncodeToString(c.Wallet.PubKey())
+	topic := DefaultSubscriptionPrefix + "httpproxy"
+
+	// fields not in canonical order, which is changed by marshaling again
+	var b []byte
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 30020)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "127.0.0.1")
+	b = protowire.AppendTag(b, 15, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(time.Now().Unix()))
+	signature, err := crypto.Sign(crypto.GetPrivateKeyFromSeed(c.Wallet.Seed()), serviceMetadataSigningBytes(b, topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = protowire.AppendTag(b, serviceMetadataSignatureField, protowire.BytesType)
+	b = protowire.AppendBytes(b, signature)
+
+	metadata, err := VerifyServiceMetadata(b, topic, subscriber, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Ip != "127.0.0.1" || metadata.TcpPort != 30020 {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+
+	if !isSubscribedMetadataFresh(base64.StdEncoding.EncodeToString(b), &pb.ServiceMetadata{Ip: "127.0.0.1", TcpPort: 30020}, topic, subscriber, time.Hour) {
+		t.Fatal("subscribed metadata with the same content should be fresh")
+	}
+	if isSubscribedMetadataFresh(base64.StdEncoding.EncodeToString(b), &pb.ServiceMetadata{Ip: "127.0.0.1", TcpPort: 30021}, topic, subscriber, time.Hour) {
+		t.Fatal("subscribed metadata with different content should not be fresh")
+	}
+}
@@ -0,0 +1,114 @@
+package tuna
+
+import (
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+// MuxConfig is the config of stream multiplexer (smux) session between entry
+// and exit. Version, keep-alive and frame size are negotiated with peer, while
+// buffers only apply locally.
+type MuxConfig struct {
+	Version           int32 `json:"version"`           // max smux version, 2 has per-stream flow control
+	KeepAliveInterval int32 `json:"keepAliveInterval"` // seconds between keep-alive frames
+	KeepAliveTimeout  int32 `json:"keepAliveTimeout"`  // seconds without data before session is closed
+	MaxFrameSize      int32 `json:"maxFrameSize"`      // max bytes of a frame
+	MaxReceiveBuffer  int32 `json:"maxReceiveBuffer"`  // max bytes buffered of a session
+	MaxStreamBuffer   int32 `json:"maxStreamBuffer"`   // max bytes buffered of a stream in version 2
+}
+
+const legacyMaxFrameSize = 4096
+
+var defaultMuxConfig = MuxConfig{
+	Version:           2,
+	KeepAliveInterval: 10,
+	KeepAliveTimeout:  30,
+	MaxFrameSize:      32768,
+	MaxReceiveBuffer:  4 << 20,
+	MaxStreamBuffer:   64 << 10,
+}
+
+func DefaultMuxConfig() *MuxConfig {
+	conf := defaultMuxConfig
+	return &conf
+}
+
+func (m *MuxConfig) verify() error {
+	return smux.VerifyConfig(m.sessionConfig(m.metadata()))
+}
+
+// metadata is the part of config sent to peer in connection handshake.
+func (m *MuxConfig) metadata() *pb.MuxConfig {
+	return &pb.MuxConfig{
+		Version:           uint32(m.Version),
+		KeepAliveInterval: uint32(m.KeepAliveInterval),
+		KeepAliveTimeout:  uint32(m.KeepAliveTimeout),
+		MaxFrameSize:      uint32(m.MaxFrameSize),
+	}
+}
+
+// sessionConfig returns the smux config negotiated with remote config of peer.
+// Version 2 is only used when both sides allow it. Both sides send keep-alive
+// at the shorter interval and close session after the longer timeout, and
+// frames are no larger than either side allows. If peer doesn't negotiate mux
+// config, version 1 and local config are used.
+func (m *MuxConfig) sessionConfig(remote *pb.MuxConfig) *smux.Config {
+	conf := &smux.Config{
+		Version:           1,
+		KeepAliveInterval: time.Duration(m.KeepAliveInterval) * time.Second,
+		KeepAliveTimeout:  time.Duration(m.KeepAliveTimeout) * time.Second,
+		MaxFrameSize:      int(m.MaxFrameSize),
+		MaxReceiveBuffer:  int(m.MaxReceiveBuffer),
+		MaxStreamBuffer:   int(m.MaxStreamBuffer),
+	}
+	if conf.MaxStreamBuffer > conf.MaxReceiveBuffer {
+		conf.MaxStreamBuffer = conf.MaxReceiveBuffer
+	}
+	if remote == nil {
+		// Peers that don't negotiate mux config may use c++ smux, which
+		// doesn't accept frames larger than 4096 bytes.
+		if conf.MaxFrameSize > legacyMaxFrameSize {
+			conf.MaxFrameSize = legacyMaxFrameSize
+		}
+		return conf
+	}
+
+	if m.Version >= 2 && remote.Version >= 2 {
+		conf.Version = 2
+	}
+	if interval := time.Duration(remote.KeepAliveInterval) * time.Second; interval > 0 && interval < conf.KeepAliveInterval {
+		conf.KeepAliveInterval = interval
+	}
+	if timeout := time.Duration(remote.KeepAliveTimeout) * time.Second; timeout > conf.KeepAliveTimeout {
+		conf.KeepAliveTimeout = timeout
+	}
+	if remote.MaxFrameSize > 0 && int(remote.MaxFrameSize) < conf.MaxFrameSize {
+		conf.MaxFrameSize = int(remote.MaxFrameSize)
+	}
+	return conf
+}
+
+// remoteMuxConfig returns the mux config of peer, or nil if peer doesn't
+// negotiate it.
+func remoteMuxConfig(remoteConnMetadata *pb.ConnectionMetadata) *pb.MuxConfig {
+	if !hasCapability(negotiateCapabilities(remoteConnMetadata), CapabilityMuxNegotiation) {
+		return nil
+	}
+	return remoteConnMetadata.MuxConfig
+}
+
+// getSessionConfig returns the smux config of session over a conn accepted
+// from peer of remoteConnMetadata.
+func (c *Common) getSessionConfig(remoteConnMetadata *pb.ConnectionMetadata) *smux.Config {
+	return c.muxConfig.sessionConfig(remoteMuxConfig(remoteConnMetadata))
+}
+
+// getServerSessionConfig returns the smux config of session over the conn to
+// server.
+func (c *Common) getServerSessionConfig() *smux.Config {
+	c.RLock()
+	defer c.RUnlock()
+	return c.muxConfig.sessionConfig(c.remoteMuxConfig)
+}
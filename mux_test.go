@@ -0,0 +1,111 @@
+package tuna
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+// newMuxConnMetadata returns connection metadata of a peer of this version
+// with mux config.
+func newMuxConnMetadata(muxConfig *pb.MuxConfig) *pb.ConnectionMetadata {
+	connMetadata := &pb.ConnectionMetadata{MuxConfig: muxConfig}
+	setProtocol(connMetadata)
+	return connMetadata
+}
+
+func TestMuxConfigNegotiation(t *testing.T) {
+	c := newTestCommon(t)
+
+	// both sides new
+	remote := defaultMuxConfig
+	remote.KeepAliveInterval = 5
+	remote.KeepAliveTimeout = 60
+	remote.MaxFrameSize = 16384
+	conf := c.getSessionConfig(newMuxConnMetadata(remote.metadata()))
+	if conf.Version != 2 || conf.KeepAliveInterval != 5*time.Second || conf.KeepAliveTimeout != 60*time.Second || conf.MaxFrameSize != 16384 {
+		t.Fatalf("got %+v, expected version 2, shorter interval, longer timeout and smaller frame", conf)
+	}
+	if conf.MaxReceiveBuffer != int(defaultMuxConfig.MaxReceiveBuffer) || conf.MaxStreamBuffer != int(defaultMuxConfig.MaxStreamBuffer) {
+		t.Fatalf("got %+v, expected local buffers", conf)
+	}
+
+	// version 2 is only used when both sides allow it
+	remote = defaultMuxConfig
+	remote.Version = 1
+	if conf := c.getSessionConfig(newMuxConnMetadata(remote.metadata())); conf.Version != 1 {
+		t.Fatalf("got version %d, expected 1", conf.Version)
+	}
+	c.muxConfig.Version = 1
+	if conf := c.getSessionConfig(newMuxConnMetadata(defaultMuxConfig.metadata())); conf.Version != 1 {
+		t.Fatalf("got version %d, expected 1", conf.Version)
+	}
+	c.muxConfig.Version = defaultMuxConfig.Version
+
+	// one side old: no version or capability, or mux config is ignored
+	for _, remoteConnMetadata := range []*pb.ConnectionMetadata{
+		nil,
+		{},
+		{ProtocolVersion: ProtocolVersion, Capabilities: LocalCapabilities &^ CapabilityMuxNegotiation, MuxConfig: defaultMuxConfig.metadata()},
+		newMuxConnMetadata(nil),
+	} {
+		conf := c.getSessionConfig(remoteConnMetadata)
+		if conf.Version != 1 || conf.MaxFrameSize != legacyMaxFrameSize {
+			t.Fatalf("peer %v got %+v, expected version 1 and legacy frame size", remoteConnMetadata, conf)
+		}
+		if conf.KeepAliveInterval != 10*time.Second || conf.KeepAliveTimeout != 30*time.Second {
+			t.Fatalf("peer %v got %+v, expected local keep-alive", remoteConnMetadata, conf)
+		}
+	}
+}
+
+func TestMuxConfigOutOfRange(t *testing.T) {
+	c := newTestCommon(t)
+
+	// zero, too large and unknown values of peer never make an invalid config
+	for _, remote := range []*pb.MuxConfig{
+		{},
+		{Version: 3},
+		{Version: math.MaxUint32, KeepAliveInterval: math.MaxUint32, KeepAliveTimeout: math.MaxUint32, MaxFrameSize: math.MaxUint32},
+		{Version: 2, KeepAliveInterval: 60, KeepAliveTimeout: 1, MaxFrameSize: 1 << 20},
+		{Version: 2, KeepAliveInterval: 1, KeepAliveTimeout: 1, MaxFrameSize: 1},
+	} {
+		conf := c.getSessionConfig(newMuxConnMetadata(remote))
+		if err := smux.VerifyConfig(conf); err != nil {
+			t.Fatalf("remote %v got invalid config %+v: %v", remote, conf, err)
+		}
+		if conf.Version != 1 && conf.Version != 2 {
+			t.Fatalf("remote %v got version %d", remote, conf.Version)
+		}
+		if conf.KeepAliveInterval > 10*time.Second || conf.KeepAliveTimeout < 30*time.Second || conf.MaxFrameSize > int(defaultMuxConfig.MaxFrameSize) {
+			t.Fatalf("remote %v got %+v beyond local config", remote, conf)
+		}
+	}
+
+	// invalid local config is rejected
+	for _, update := range []func(*MuxConfig){
+		func(m *MuxConfig) { m.KeepAliveInterval = 0 },
+		func(m *MuxConfig) { m.KeepAliveTimeout = m.KeepAliveInterval - 1 },
+		func(m *MuxConfig) { m.MaxFrameSize = 0 },
+		func(m *MuxConfig) { m.MaxFrameSize = 1 << 20 },
+		func(m *MuxConfig) { m.MaxReceiveBuffer = 0 },
+	} {
+		m := DefaultMuxConfig()
+		update(m)
+		if err := m.verify(); err == nil {
+			t.Fatalf("invalid mux config %+v should be rejected", m)
+		}
+	}
+	if err := DefaultMuxConfig().verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// version is the max version, so a newer one is negotiated down
+	c.muxConfig.Version = 3
+	if conf := c.getSessionConfig(newMuxConnMetadata(defaultMuxConfig.metadata())); conf.Version != 2 {
+		t.Fatalf("got version %d, expected 2", conf.Version)
+	}
+}
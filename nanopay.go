@@ -0,0 +1,380 @@
+package tuna
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	nknPb "github.com/nknorg/nkn/v2/pb"
+	"github.com/nknorg/nkn/v2/transaction"
+	"github.com/nknorg/tuna/storage"
+)
+
+const (
+	// A nanopay channel is renewed (replaced by a new one) when it's less than
+	// this number of blocks until expiration, and pending claims are sent to
+	// chain when they are this close to expiration.
+	nanoPayRenewBlocks = 4320
+
+	// Same as the receiver expiration delta of nanopay claimer.
+	nanoPayReceiverExpirationDelta = 3
+
+	nanoPayClaimsCheckInterval = 10 * time.Minute
+)
+
+var (
+	// Payer channels are shared in the same process so that the same channel is
+	// never incremented by two tuna instances at the same time.
+	nanoPaysLock sync.Mutex
+	nanoPays     = make(map[*storage.NanoPayStorage]map[string]*nanoPay)
+)
+
+// nanoPay is the payer side of a nanopay channel. Unlike nkn.NanoPay, its state
+// is persisted to storage after each update so that the channel can be resumed
+// after restart.
+type nanoPay struct {
+	client               *nkn.MultiClient
+	wallet               *nkn.Wallet
+	storage              *storage.NanoPayStorage
+	service              string
+	recipientAddress     string
+	recipientProgramHash common.Uint160
+	fee                  common.Fixed64
+	duration             uint32
+
+	lock       sync.Mutex
+	amount     common.Fixed64
+	expiration uint32
+	id         uint64
+}
+
+// getNanoPay returns the channel of this service to recipient, which is
+// resumed from storage if exists.
+func (c *Common) getNanoPay(recipientAddress, fee string, duration int) (*nanoPay, error) {
+	var service string
+	if c.Service != nil {
+		service = c.Service.Name
+	}
+
+	nanoPaysLock.Lock()
+	defer nanoPaysLock.Unlock()
+
+	if nanoPays[c.nanoPayStorage] == nil {
+		nanoPays[c.nanoPayStorage] = make(map[string]*nanoPay)
+	}
+	key := c.Wallet.Address() + "/" + service + "/" + recipientAddress
+	if np, ok := nanoPays[c.nanoPayStorage][key]; ok {
+		np.lock.Lock()
+		np.client = c.Client
+		np.lock.Unlock()
+		return np, nil
+	}
+
+	programHash, err := common.ToScriptHash(recipientAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	feeFixed64, err := common.StringToFixed64(fee)
+	if err != nil {
+		return nil, err
+	}
+
+	np := &nanoPay{
+		client:               c.Client,
+		wallet:               c.Wallet,
+		storage:              c.nanoPayStorage,
+		service:              service,
+		recipientAddress:     recipientAddress,
+		recipientProgramHash: programHash,
+		fee:                  feeFixed64,
+		duration:             uint32(duration),
+	}
+
+	if ch := np.storage.GetPayerChannel(service, recipientAddress); ch != nil && ch.Sender == c.Wallet.Address() {
+		amount, err := common.StringToFixed64(ch.Amount)
+		if err == nil {
+			np.id, np.amount, np.expiration = ch.ID, amount, ch.Expiration
+			log.Printf("Resume nanopay channel to %s with amount %s", recipientAddress, ch.Amount)
+		}
+	}
+	nanoPays[c.nanoPayStorage][key] = np
+
+	return np, nil
+}
+
+func (np *nanoPay) Recipient() string {
+	return np.recipientAddress
+}
+
+// IncrementAmount increments the channel amount by delta and returns the signed
+// nanopay txn. A new channel is created if the current one is about to expire.
+// If length of fee is greater than zero, it will be used as txn fee instead of
+// the default one.
+func (np *nanoPay) IncrementAmount(delta, fee string) (*transaction.Transaction, error) {
+	np.lock.Lock()
+	defer np.lock.Unlock()
+
+	height, err := np.client.GetHeight()
+
+	if err != nil {
+		log.Printf("Get height error: %v", err)
+		if np.expiration == 0 {
+			return nil, err
+		}
+	}
+
+	if np.expiration == 0 || (err == nil && np.expiration <= uint32(height)+nanoPayRenewBlocks) {
+		id, err := randomNanoPayID()
+		if err != nil {
+			return nil, err
+		}
+		if np.expiration > 0 {
+			log.Printf("Renew nanopay channel to %s", np.recipientAddress)
+		}
+		np.id = id
+		np.expiration = uint32(height) + np.duration
+		np.amount = 0
+	}
+
+	deltaValue, err := common.StringToFixed64(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := np.amount + deltaValue
+	tx, err := transaction.NewNanoPayTransaction(np.wallet.ProgramHash(), np.recipientProgramHash, np.id, amount, np.expiration, np.expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fee) > 0 {
+		feeFixed64, err := common.StringToFixed64(fee)
+		if err != nil {
+			return nil, err
+		}
+		tx.UnsignedTx.Fee = int64(feeFixed64)
+	} else {
+		tx.UnsignedTx.Fee = int64(np.fee)
+	}
+
+	err = np.wallet.SignTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	np.amount = amount
+	err = np.storage.SetPayerChannel(&storage.PayerChannel{
+		Sender:     np.wallet.Address(),
+		Service:    np.service,
+		Recipient:  np.recipientAddress,
+		ID:         np.id,
+		Amount:     np.amount.String(),
+		Expiration: np.expiration,
+	})
+	if err != nil {
+		log.Println("Couldn't save nanopay channel:", err)
+	}
+
+	return tx, nil
+}
+
+func randomNanoPayID() (uint64, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// nanoPayClaims tracks nanopay channels claimed within one session. Channels
+// may be resumed by payer across sessions, so the amount claimed on a channel
+// before this session is excluded from the amount paid in this session.
+type nanoPayClaims struct {
+	storage *storage.NanoPayStorage
+
+	lock     sync.Mutex
+	baseByID map[uint64]common.Fixed64
+	base     common.Fixed64
+}
+
+func (c *Common) newNanoPayClaims() *nanoPayClaims {
+	return &nanoPayClaims{
+		storage:  c.nanoPayStorage,
+		baseByID: make(map[uint64]common.Fixed64),
+	}
+}
+
+// nanoPayChannel returns the key of nanopay channel of sender with id.
+func nanoPayChannel(sender string, id uint64) string {
+	return sender + "/" + strconv.FormatUint(id, 10)
+}
+
+// nanoPayPayload returns the payload of a nanopay txn, or nil if txn is not
+// nanopay.
+func nanoPayPayload(tx *transaction.Transaction) *nknPb.NanoPay {
+	if tx.UnsignedTx == nil {
+		return nil
+	}
+	payload, err := transaction.Unpack(tx.UnsignedTx.Payload)
+	if err != nil {
+		return nil
+	}
+	npPayload, ok := payload.(*nknPb.NanoPay)
+	if !ok {
+		return nil
+	}
+	return npPayload
+}
+
+// claimFlushRecorder is the RPC client of nanopay claimer that records each
+// nanopay txn sent to chain. The pending claim of txn is marked as flushed so
+// it's not sent again, and a flushed record is written to ledger so that
+// revenue of the claims it covers is forwarded once it's on chain.
+type claimFlushRecorder struct {
+	*nkn.MultiClient
+	c *Common
+}
+
+func (r *claimFlushRecorder) SendRawTransaction(txn *transaction.Transaction) (string, error) {
+	txnID, err := r.MultiClient.SendRawTransaction(txn)
+	if err != nil {
+		return txnID, err
+	}
+	npPayload := nanoPayPayload(txn)
+	if npPayload == nil {
+		return txnID, nil
+	}
+	sender := hex.EncodeToString(npPayload.Sender)
+	err = r.c.nanoPayStorage.SetClaimFlushed(sender, npPayload.Id, common.Fixed64(npPayload.Amount).String())
+	if err != nil {
+		log.Println("Couldn't save pending claim:", err)
+	}
+	txHash := txn.Hash()
+	r.c.appendLedger(&storage.UsageRecord{
+		Role:    storage.LedgerRoleFlushed,
+		TxnID:   txHash.ToHexString(),
+		Channel: nanoPayChannel(sender, npPayload.Id),
+	})
+	return txnID, nil
+}
+
+// add saves a claimed txn as pending claim, and returns the amount paid in
+// this session given the cumulative amount returned by nanopay claimer, and
+// the channel of txn.
+func (nc *nanoPayClaims) add(tx *transaction.Transaction, claimed common.Fixed64) (common.Fixed64, string) {
+	payload, err := transaction.Unpack(tx.UnsignedTx.Payload)
+	if err != nil {
+		return claimed, ""
+	}
+	npPayload, ok := payload.(*nknPb.NanoPay)
+	if !ok {
+		return claimed, ""
+	}
+	sender := hex.EncodeToString(npPayload.Sender)
+
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if _, ok := nc.baseByID[npPayload.Id]; !ok {
+		var base common.Fixed64
+		if claim := nc.storage.GetClaim(sender, npPayload.Id); claim != nil {
+			base, _ = common.StringToFixed64(claim.Amount)
+		}
+		nc.baseByID[npPayload.Id] = base
+		nc.base += base
+	}
+
+	txBytes, err := tx.Marshal()
+	if err == nil {
+		err = nc.storage.SetClaim(&storage.PendingClaim{
+			Sender:     sender,
+			ID:         npPayload.Id,
+			Amount:     common.Fixed64(npPayload.Amount).String(),
+			Expiration: npPayload.NanoPayExpiration,
+			Txn:        hex.EncodeToString(txBytes),
+		})
+	}
+	if err != nil {
+		log.Println("Couldn't save pending claim:", err)
+	}
+
+	return claimed - nc.base, nanoPayChannel(sender, npPayload.Id)
+}
+
+type nanoPayRPCClient interface {
+	GetHeight() (int32, error)
+	SendRawTransaction(txn *transaction.Transaction) (string, error)
+}
+
+// startFlushPendingClaims sends pending claims left by previous run to chain,
+// and keeps sending the ones that are about to expire before they do, until
+// closeChan is closed.
+func startFlushPendingClaims(rpcClient nanoPayRPCClient, nanoPayStorage *storage.NanoPayStorage, closeChan chan struct{}) {
+	flushed := false
+	for {
+		height, err := rpcClient.GetHeight()
+		if err != nil {
+			log.Println("Get height error:", err)
+		} else {
+			flushPendingClaims(rpcClient, nanoPayStorage, uint32(height), !flushed)
+			flushed = true
+		}
+
+		select {
+		case <-time.After(nanoPayClaimsCheckInterval):
+		case <-closeChan:
+			return
+		}
+	}
+}
+
+func flushPendingClaims(rpcClient nanoPayRPCClient, nanoPayStorage *storage.NanoPayStorage, height uint32, all bool) {
+	for _, claim := range nanoPayStorage.GetClaims() {
+		if claim.Flushed || claim.Expiration <= height+nanoPayReceiverExpirationDelta {
+			continue
+		}
+		if !all && claim.Expiration > height+nanoPayRenewBlocks {
+			continue
+		}
+		err := sendPendingClaim(rpcClient, claim)
+		if err != nil {
+			log.Printf("Couldn't send pending claim of channel %d: %v", claim.ID, err)
+			continue
+		}
+		err = nanoPayStorage.SetClaimFlushed(claim.Sender, claim.ID, claim.Amount)
+		if err != nil {
+			log.Println("Couldn't save pending claim:", err)
+		}
+	}
+
+	err := nanoPayStorage.ClearExpired(height)
+	if err != nil {
+		log.Println("Couldn't clear expired nanopay state:", err)
+	}
+}
+
+func sendPendingClaim(rpcClient nanoPayRPCClient, claim *storage.PendingClaim) error {
+	txBytes, err := hex.DecodeString(claim.Txn)
+	if err != nil {
+		return err
+	}
+	tx := &transaction.Transaction{}
+	err = tx.Unmarshal(txBytes)
+	if err != nil {
+		return err
+	}
+	if tx.UnsignedTx == nil {
+		return errors.New("nil txn body")
+	}
+	_, err = rpcClient.SendRawTransaction(tx)
+	return err
+}
@@ -0,0 +1,126 @@
+package tuna
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+)
+
+var defaultPaymentPolicy = struct {
+	trafficDelay       int32
+	maxTrafficUnpaid   float64
+	minTrafficCoverage float64
+	maxNanoPayDelay    int32
+	escalationInterval int32
+	gracePeriod        int32
+	throttleRate       int32
+}{
+	trafficDelay:       int32(trafficDelay / time.Second),
+	maxTrafficUnpaid:   maxTrafficUnpaid,
+	minTrafficCoverage: minTrafficCoverage,
+	maxNanoPayDelay:    int32(maxNanoPayDelay / time.Second),
+	escalationInterval: int32(paymentEscalationInterval / time.Second),
+	throttleRate:       defaultPaymentThrottleRate,
+}
+
+// PaymentPolicy is how an exit enforces payment of a session. When payment
+// lags behind for MaxNanoPayDelay, a warning is sent to the entry, then
+// traffic is throttled to ThrottleRate after EscalationInterval, and the
+// session is closed after another EscalationInterval, so a session that stops
+// paying is closed MaxNanoPayDelay + 2 * EscalationInterval after payment
+// lags. Escalation is reset once payment catches up. Fields are pointers so that zero values can
+// be configured, and nil fields are set from base policy when merged.
+type PaymentPolicy struct {
+	TrafficDelay       *int32   `json:"trafficDelay"`       // seconds of traffic not yet expected to be paid
+	MaxTrafficUnpaid   *float64 `json:"maxTrafficUnpaid"`   // unpaid traffic allowed, in TrafficUnit
+	MinTrafficCoverage *float64 `json:"minTrafficCoverage"` // ratio of cost that should be paid
+	MaxNanoPayDelay    *int32   `json:"maxNanoPayDelay"`    // seconds between payment checks
+	EscalationInterval *int32   `json:"escalationInterval"` // seconds between escalation steps
+	GracePeriod        *int32   `json:"gracePeriod"`        // seconds since session start without payment check
+	ThrottleRate       *int32   `json:"throttleRate"`       // bytes per second when throttled
+}
+
+func DefaultPaymentPolicy() *PaymentPolicy {
+	policy := defaultPaymentPolicy
+	return &PaymentPolicy{
+		TrafficDelay:       &policy.trafficDelay,
+		MaxTrafficUnpaid:   &policy.maxTrafficUnpaid,
+		MinTrafficCoverage: &policy.minTrafficCoverage,
+		MaxNanoPayDelay:    &policy.maxNanoPayDelay,
+		EscalationInterval: &policy.escalationInterval,
+		GracePeriod:        &policy.gracePeriod,
+		ThrottleRate:       &policy.throttleRate,
+	}
+}
+
+// MergedPaymentPolicy returns default policy overridden by non-nil fields of
+// base, and then of policy. Traffic coverage and unpaid traffic should not be
+// negative.
+func MergedPaymentPolicy(base, policy *PaymentPolicy) (*PaymentPolicy, error) {
+	merged := DefaultPaymentPolicy()
+	for _, p := range []*PaymentPolicy{base, policy} {
+		if p == nil {
+			continue
+		}
+		if p.TrafficDelay != nil {
+			merged.TrafficDelay = p.TrafficDelay
+		}
+		if p.MaxTrafficUnpaid != nil {
+			merged.MaxTrafficUnpaid = p.MaxTrafficUnpaid
+		}
+		if p.MinTrafficCoverage != nil {
+			merged.MinTrafficCoverage = p.MinTrafficCoverage
+		}
+		if p.MaxNanoPayDelay != nil {
+			merged.MaxNanoPayDelay = p.MaxNanoPayDelay
+		}
+		if p.EscalationInterval != nil {
+			merged.EscalationInterval = p.EscalationInterval
+		}
+		if p.GracePeriod != nil {
+			merged.GracePeriod = p.GracePeriod
+		}
+		if p.ThrottleRate != nil {
+			merged.ThrottleRate = p.ThrottleRate
+		}
+	}
+	if *merged.MaxTrafficUnpaid < 0 {
+		return nil, errors.New("maxTrafficUnpaid should not be negative")
+	}
+	if *merged.MinTrafficCoverage < 0 {
+		return nil, errors.New("minTrafficCoverage should not be negative")
+	}
+	return merged, nil
+}
+
+func (p *PaymentPolicy) trafficDelay() time.Duration {
+	return time.Duration(*p.TrafficDelay) * time.Second
+}
+
+func (p *PaymentPolicy) maxNanoPayDelay() time.Duration {
+	return time.Duration(*p.MaxNanoPayDelay) * time.Second
+}
+
+func (p *PaymentPolicy) escalationInterval() time.Duration {
+	return time.Duration(*p.EscalationInterval) * time.Second
+}
+
+func (p *PaymentPolicy) gracePeriod() time.Duration {
+	return time.Duration(*p.GracePeriod) * time.Second
+}
+
+// isUnderpaid returns whether paid is less than MinTrafficCoverage of total
+// cost, and the cost unpaid is more than MaxTrafficUnpaid traffic units at the
+// average price of session traffic. Without traffic, e.g. when session is only
+// charged by time, cost can't be converted to traffic, so the cost not
+// required by MinTrafficCoverage is allowed to be unpaid.
+func (p *PaymentPolicy) isUnderpaid(paid, totalCost, totalBytes common.Fixed64) bool {
+	if paid >= common.Fixed64(*p.MinTrafficCoverage*float64(totalCost)) {
+		return false
+	}
+	if totalBytes <= 0 {
+		return true
+	}
+	return totalCost-paid > common.Fixed64(*p.MaxTrafficUnpaid*TrafficUnit*float64(totalCost)/float64(totalBytes))
+}
@@ -0,0 +1,126 @@
+package tuna
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestMergedPaymentPolicy(t *testing.T) {
+	conf := &ExitConfiguration{}
+	err := json.Unmarshal([]byte(`{
+		"paymentPolicy": {"gracePeriod": 30, "maxTrafficUnpaid": 0},
+		"services": {"web": {"paymentPolicy": {"gracePeriod": 0, "throttleRate": 1024}}}
+	}`), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err = MergedExitConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := MergedPaymentPolicy(&conf.PaymentPolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *base.GracePeriod != 30 || *base.MaxTrafficUnpaid != 0 {
+		t.Fatalf("grace period %d and max traffic unpaid %v, expected 30 and 0", *base.GracePeriod, *base.MaxTrafficUnpaid)
+	}
+	if *base.MinTrafficCoverage != minTrafficCoverage || *base.ThrottleRate != defaultPaymentThrottleRate {
+		t.Fatal("fields not configured should be default")
+	}
+
+	service, err := MergedPaymentPolicy(&conf.PaymentPolicy, conf.Services["web"].PaymentPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *service.GracePeriod != 0 || *service.MaxTrafficUnpaid != 0 || *service.ThrottleRate != 1024 {
+		t.Fatalf("service policy %d %v %d, expected 0 0 1024", *service.GracePeriod, *service.MaxTrafficUnpaid, *service.ThrottleRate)
+	}
+
+	if *DefaultPaymentPolicy().GracePeriod != 0 || *DefaultPaymentPolicy().MaxTrafficUnpaid != maxTrafficUnpaid {
+		t.Fatal("default policy is modified by merging")
+	}
+}
+
+func TestCheckPaymentEscalation(t *testing.T) {
+	escalationInterval := int32(1)
+	policy, err := MergedPaymentPolicy(&PaymentPolicy{
+		TrafficDelay:       new(int32),
+		MaxNanoPayDelay:    new(int32),
+		EscalationInterval: &escalationInterval,
+		MaxTrafficUnpaid:   new(float64),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := &testSession{}
+	lastPaymentTime := time.Now()
+	var lastPaymentAmount, bytesPaid common.Fixed64
+	isClosed := false
+	getTotalCost := func() (common.Fixed64, common.Fixed64) {
+		return common.Fixed64(common.StorageFactor), common.Fixed64(2 * trafficPaymentThreshold * TrafficUnit)
+	}
+	notices := make(chan *pb.PaymentNotice, 10)
+	go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost, func() *PaymentPolicy { return policy }, func(notice *pb.PaymentNotice) {
+		notices <- notice
+	})
+
+	var lastNotice time.Time
+	for _, action := range []pb.PaymentAction{pb.PaymentAction_PAYMENT_WARN, pb.PaymentAction_PAYMENT_THROTTLE, pb.PaymentAction_PAYMENT_CLOSE} {
+		select {
+		case notice := <-notices:
+			if action != pb.PaymentAction_PAYMENT_WARN && time.Since(lastNotice) < time.Second {
+				t.Fatalf("%v after %v, expected escalation interval", action, time.Since(lastNotice))
+			}
+			lastNotice = time.Now()
+			if notice.Action != action {
+				t.Fatalf("got action %v, expected %v", notice.Action, action)
+			}
+			if action == pb.PaymentAction_PAYMENT_THROTTLE && notice.ThrottleRate != defaultPaymentThrottleRate {
+				t.Fatalf("throttle rate %d, expected %d", notice.ThrottleRate, defaultPaymentThrottleRate)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v", action)
+		}
+	}
+	if !session.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestMergedPaymentPolicyNegative(t *testing.T) {
+	negative := -1.0
+	if _, err := MergedPaymentPolicy(&PaymentPolicy{MaxTrafficUnpaid: &negative}, nil); err == nil {
+		t.Fatal("negative max traffic unpaid should be rejected")
+	}
+	if _, err := MergedPaymentPolicy(nil, &PaymentPolicy{MinTrafficCoverage: &negative}); err == nil {
+		t.Fatal("negative min traffic coverage should be rejected")
+	}
+}
+
+func TestPaymentPolicyIsUnderpaid(t *testing.T) {
+	policy := DefaultPaymentPolicy()
+	cost := common.Fixed64(100 * common.StorageFactor)
+
+	// session only charged by time has no traffic
+	if !policy.isUnderpaid(0, cost, 0) {
+		t.Fatal("session without traffic should be underpaid if cost is not covered")
+	}
+	if policy.isUnderpaid(common.Fixed64(*policy.MinTrafficCoverage*float64(cost)), cost, 0) {
+		t.Fatal("session without traffic should not be underpaid if cost is covered")
+	}
+
+	// unpaid cost within max traffic unpaid is allowed
+	if policy.isUnderpaid(cost/2, cost, TrafficUnit) {
+		t.Fatal("unpaid cost of half traffic unit should be allowed")
+	}
+	if !policy.isUnderpaid(cost/2, cost, 100*TrafficUnit) {
+		t.Fatal("unpaid cost of 50 traffic units should not be allowed")
+	}
+}
@@ -23,9 +23,11 @@ const (
 type EncryptionAlgo int32
 
 const (
-	EncryptionAlgo_ENCRYPTION_NONE              EncryptionAlgo = 0
-	EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305 EncryptionAlgo = 1
-	EncryptionAlgo_ENCRYPTION_AES_GCM           EncryptionAlgo = 2
+	EncryptionAlgo_ENCRYPTION_NONE               EncryptionAlgo = 0
+	EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305  EncryptionAlgo = 1
+	EncryptionAlgo_ENCRYPTION_AES_GCM            EncryptionAlgo = 2
+	EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305  EncryptionAlgo = 3
+	EncryptionAlgo_ENCRYPTION_XCHACHA20_POLY1305 EncryptionAlgo = 4
 )
 
 // Enum value maps for EncryptionAlgo.
@@ -34,11 +36,15 @@ var (
 		0: "ENCRYPTION_NONE",
 		1: "ENCRYPTION_XSALSA20_POLY1305",
 		2: "ENCRYPTION_AES_GCM",
+		3: "ENCRYPTION_CHACHA20_POLY1305",
+		4: "ENCRYPTION_XCHACHA20_POLY1305",
 	}
 	EncryptionAlgo_value = map[string]int32{
-		"ENCRYPTION_NONE":              0,
-		"ENCRYPTION_XSALSA20_POLY1305": 1,
-		"ENCRYPTION_AES_GCM":           2,
+		"ENCRYPTION_NONE":               0,
+		"ENCRYPTION_XSALSA20_POLY1305":  1,
+		"ENCRYPTION_AES_GCM":            2,
+		"ENCRYPTION_CHACHA20_POLY1305":  3,
+		"ENCRYPTION_XCHACHA20_POLY1305": 4,
 	}
 )
 
@@ -69,36 +75,921 @@ func (EncryptionAlgo) EnumDescriptor() ([]byte, []int) {
 	return file_pb_tuna_proto_rawDescGZIP(), []int{0}
 }
 
+type CompressionAlgo int32
+
+const (
+	CompressionAlgo_COMPRESSION_ALGO_NONE   CompressionAlgo = 0
+	CompressionAlgo_COMPRESSION_ALGO_SNAPPY CompressionAlgo = 1
+	CompressionAlgo_COMPRESSION_ALGO_ZSTD   CompressionAlgo = 2
+)
+
+// Enum value maps for CompressionAlgo.
+var (
+	CompressionAlgo_name = map[int32]string{
+		0: "COMPRESSION_ALGO_NONE",
+		1: "COMPRESSION_ALGO_SNAPPY",
+		2: "COMPRESSION_ALGO_ZSTD",
+	}
+	CompressionAlgo_value = map[string]int32{
+		"COMPRESSION_ALGO_NONE":   0,
+		"COMPRESSION_ALGO_SNAPPY": 1,
+		"COMPRESSION_ALGO_ZSTD":   2,
+	}
+)
+
+func (x CompressionAlgo) Enum() *CompressionAlgo {
+	p := new(CompressionAlgo)
+	*p = x
+	return p
+}
+
+func (x CompressionAlgo) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CompressionAlgo) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_tuna_proto_enumTypes[1].Descriptor()
+}
+
+func (CompressionAlgo) Type() protoreflect.EnumType {
+	return &file_pb_tuna_proto_enumTypes[1]
+}
+
+func (x CompressionAlgo) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CompressionAlgo.Descriptor instead.
+func (CompressionAlgo) EnumDescriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{1}
+}
+
+type LimitType int32
+
+const (
+	LimitType_LIMIT_MAX_STREAMS LimitType = 0
+	LimitType_LIMIT_BANDWIDTH   LimitType = 1
+	LimitType_LIMIT_DAILY_QUOTA LimitType = 2
+)
+
+// Enum value maps for LimitType.
+var (
+	LimitType_name = map[int32]string{
+		0: "LIMIT_MAX_STREAMS",
+		1: "LIMIT_BANDWIDTH",
+		2: "LIMIT_DAILY_QUOTA",
+	}
+	LimitType_value = map[string]int32{
+		"LIMIT_MAX_STREAMS": 0,
+		"LIMIT_BANDWIDTH":   1,
+		"LIMIT_DAILY_QUOTA": 2,
+	}
+)
+
+func (x LimitType) Enum() *LimitType {
+	p := new(LimitType)
+	*p = x
+	return p
+}
+
+func (x LimitType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (LimitType) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_tuna_proto_enumTypes[2].Descriptor()
+}
+
+func (LimitType) Type() protoreflect.EnumType {
+	return &file_pb_tuna_proto_enumTypes[2]
+}
+
+func (x LimitType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use LimitType.Descriptor instead.
+func (LimitType) EnumDescriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{2}
+}
+
+type PaymentAction int32
+
+const (
+	PaymentAction_PAYMENT_OK       PaymentAction = 0
+	PaymentAction_PAYMENT_WARN     PaymentAction = 1
+	PaymentAction_PAYMENT_THROTTLE PaymentAction = 2
+	PaymentAction_PAYMENT_CLOSE    PaymentAction = 3
+)
+
+// Enum value maps for PaymentAction.
+var (
+	PaymentAction_name = map[int32]string{
+		0: "PAYMENT_OK",
+		1: "PAYMENT_WARN",
+		2: "PAYMENT_THROTTLE",
+		3: "PAYMENT_CLOSE",
+	}
+	PaymentAction_value = map[string]int32{
+		"PAYMENT_OK":       0,
+		"PAYMENT_WARN":     1,
+		"PAYMENT_THROTTLE": 2,
+		"PAYMENT_CLOSE":    3,
+	}
+)
+
+func (x PaymentAction) Enum() *PaymentAction {
+	p := new(PaymentAction)
+	*p = x
+	return p
+}
+
+func (x PaymentAction) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PaymentAction) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_tuna_proto_enumTypes[3].Descriptor()
+}
+
+func (PaymentAction) Type() protoreflect.EnumType {
+	return &file_pb_tuna_proto_enumTypes[3]
+}
+
+func (x PaymentAction) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PaymentAction.Descriptor instead.
+func (PaymentAction) EnumDescriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{3}
+}
+
 type ConnectionMetadata struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	EncryptionAlgo           EncryptionAlgo `protobuf:"varint,1,opt,name=encryption_algo,json=encryptionAlgo,proto3,enum=pb.EncryptionAlgo" json:"encryption_algo,omitempty"`
-	PublicKey                []byte         `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
-	Nonce                    []byte         `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
-	IsMeasurement            bool           `protobuf:"varint,4,opt,name=is_measurement,json=isMeasurement,proto3" json:"is_measurement,omitempty"`
-	MeasurementBytesDownlink uint32         `protobuf:"varint,5,opt,name=measurement_bytes_downlink,json=measurementBytesDownlink,proto3" json:"measurement_bytes_downlink,omitempty"`
-	IsPing                   bool           `protobuf:"varint,6,opt,name=is_ping,json=isPing,proto3" json:"is_ping,omitempty"`
+	EncryptionAlgo           EncryptionAlgo    `protobuf:"varint,1,opt,name=encryption_algo,json=encryptionAlgo,proto3,enum=pb.EncryptionAlgo" json:"encryption_algo,omitempty"`
+	PublicKey                []byte            `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	Nonce                    []byte            `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	IsMeasurement            bool              `protobuf:"varint,4,opt,name=is_measurement,json=isMeasurement,proto3" json:"is_measurement,omitempty"`
+	MeasurementBytesDownlink uint32            `protobuf:"varint,5,opt,name=measurement_bytes_downlink,json=measurementBytesDownlink,proto3" json:"measurement_bytes_downlink,omitempty"`
+	IsPing                   bool              `protobuf:"varint,6,opt,name=is_ping,json=isPing,proto3" json:"is_ping,omitempty"`
+	ProtocolVersion          uint32            `protobuf:"varint,7,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	Capabilities             uint64            `protobuf:"varint,8,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
+	EphemeralPublicKey       []byte            `protobuf:"bytes,9,opt,name=ephemeral_public_key,json=ephemeralPublicKey,proto3" json:"ephemeral_public_key,omitempty"`
+	EphemeralSignature       []byte            `protobuf:"bytes,10,opt,name=ephemeral_signature,json=ephemeralSignature,proto3" json:"ephemeral_signature,omitempty"`
+	EncryptionAlgos          []EncryptionAlgo  `protobuf:"varint,11,rep,packed,name=encryption_algos,json=encryptionAlgos,proto3,enum=pb.EncryptionAlgo" json:"encryption_algos,omitempty"`
+	UdpBindSequence          uint64            `protobuf:"varint,12,opt,name=udp_bind_sequence,json=udpBindSequence,proto3" json:"udp_bind_sequence,omitempty"`
+	UdpBindProof             []byte            `protobuf:"bytes,13,opt,name=udp_bind_proof,json=udpBindProof,proto3" json:"udp_bind_proof,omitempty"`
+	MuxConfig                *MuxConfig        `protobuf:"bytes,14,opt,name=mux_config,json=muxConfig,proto3" json:"mux_config,omitempty"`
+	CompressionAlgos         []CompressionAlgo `protobuf:"varint,15,rep,packed,name=compression_algos,json=compressionAlgos,proto3,enum=pb.CompressionAlgo" json:"compression_algos,omitempty"`
+	UdpBindChallenge         []byte            `protobuf:"bytes,16,opt,name=udp_bind_challenge,json=udpBindChallenge,proto3" json:"udp_bind_challenge,omitempty"`
+}
+
+func (x *ConnectionMetadata) Reset() {
+	*x = ConnectionMetadata{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ConnectionMetadata) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectionMetadata) ProtoMessage() {}
+
+func (x *ConnectionMetadata) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectionMetadata.ProtoReflect.Descriptor instead.
+func (*ConnectionMetadata) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ConnectionMetadata) GetEncryptionAlgo() EncryptionAlgo {
+	if x != nil {
+		return x.EncryptionAlgo
+	}
+	return EncryptionAlgo_ENCRYPTION_NONE
+}
+
+func (x *ConnectionMetadata) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetIsMeasurement() bool {
+	if x != nil {
+		return x.IsMeasurement
+	}
+	return false
+}
+
+func (x *ConnectionMetadata) GetMeasurementBytesDownlink() uint32 {
+	if x != nil {
+		return x.MeasurementBytesDownlink
+	}
+	return 0
+}
+
+func (x *ConnectionMetadata) GetIsPing() bool {
+	if x != nil {
+		return x.IsPing
+	}
+	return false
+}
+
+func (x *ConnectionMetadata) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *ConnectionMetadata) GetCapabilities() uint64 {
+	if x != nil {
+		return x.Capabilities
+	}
+	return 0
+}
+
+func (x *ConnectionMetadata) GetEphemeralPublicKey() []byte {
+	if x != nil {
+		return x.EphemeralPublicKey
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetEphemeralSignature() []byte {
+	if x != nil {
+		return x.EphemeralSignature
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetEncryptionAlgos() []EncryptionAlgo {
+	if x != nil {
+		return x.EncryptionAlgos
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetUdpBindSequence() uint64 {
+	if x != nil {
+		return x.UdpBindSequence
+	}
+	return 0
+}
+
+func (x *ConnectionMetadata) GetUdpBindProof() []byte {
+	if x != nil {
+		return x.UdpBindProof
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetMuxConfig() *MuxConfig {
+	if x != nil {
+		return x.MuxConfig
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetCompressionAlgos() []CompressionAlgo {
+	if x != nil {
+		return x.CompressionAlgos
+	}
+	return nil
+}
+
+func (x *ConnectionMetadata) GetUdpBindChallenge() []byte {
+	if x != nil {
+		return x.UdpBindChallenge
+	}
+	return nil
+}
+
+type MuxConfig struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version           uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	KeepAliveInterval uint32 `protobuf:"varint,2,opt,name=keep_alive_interval,json=keepAliveInterval,proto3" json:"keep_alive_interval,omitempty"`
+	KeepAliveTimeout  uint32 `protobuf:"varint,3,opt,name=keep_alive_timeout,json=keepAliveTimeout,proto3" json:"keep_alive_timeout,omitempty"`
+	MaxFrameSize      uint32 `protobuf:"varint,4,opt,name=max_frame_size,json=maxFrameSize,proto3" json:"max_frame_size,omitempty"`
+}
+
+func (x *MuxConfig) Reset() {
+	*x = MuxConfig{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MuxConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MuxConfig) ProtoMessage() {}
+
+func (x *MuxConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MuxConfig.ProtoReflect.Descriptor instead.
+func (*MuxConfig) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *MuxConfig) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *MuxConfig) GetKeepAliveInterval() uint32 {
+	if x != nil {
+		return x.KeepAliveInterval
+	}
+	return 0
+}
+
+func (x *MuxConfig) GetKeepAliveTimeout() uint32 {
+	if x != nil {
+		return x.KeepAliveTimeout
+	}
+	return 0
+}
+
+func (x *MuxConfig) GetMaxFrameSize() uint32 {
+	if x != nil {
+		return x.MaxFrameSize
+	}
+	return 0
+}
+
+type PriceTier struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ThresholdBytes uint64 `protobuf:"varint,1,opt,name=threshold_bytes,json=thresholdBytes,proto3" json:"threshold_bytes,omitempty"`
+	Price          string `protobuf:"bytes,2,opt,name=price,proto3" json:"price,omitempty"`
+}
+
+func (x *PriceTier) Reset() {
+	*x = PriceTier{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PriceTier) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PriceTier) ProtoMessage() {}
+
+func (x *PriceTier) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PriceTier.ProtoReflect.Descriptor instead.
+func (*PriceTier) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PriceTier) GetThresholdBytes() uint64 {
+	if x != nil {
+		return x.ThresholdBytes
+	}
+	return 0
+}
+
+func (x *PriceTier) GetPrice() string {
+	if x != nil {
+		return x.Price
+	}
+	return ""
+}
+
+type ServiceMetadata struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Ip              string       `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	TcpPort         uint32       `protobuf:"varint,2,opt,name=tcp_port,json=tcpPort,proto3" json:"tcp_port,omitempty"`
+	UdpPort         uint32       `protobuf:"varint,3,opt,name=udp_port,json=udpPort,proto3" json:"udp_port,omitempty"`
+	ServiceId       uint32       `protobuf:"varint,4,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	ServiceTcp      []uint32     `protobuf:"varint,5,rep,packed,name=service_tcp,json=serviceTcp,proto3" json:"service_tcp,omitempty"`
+	ServiceUdp      []uint32     `protobuf:"varint,6,rep,packed,name=service_udp,json=serviceUdp,proto3" json:"service_udp,omitempty"`
+	Price           string       `protobuf:"bytes,7,opt,name=price,proto3" json:"price,omitempty"`
+	BeneficiaryAddr string       `protobuf:"bytes,8,opt,name=beneficiary_addr,json=beneficiaryAddr,proto3" json:"beneficiary_addr,omitempty"`
+	PricePerMinute  string       `protobuf:"bytes,9,opt,name=price_per_minute,json=pricePerMinute,proto3" json:"price_per_minute,omitempty"`
+	FreeBytes       uint64       `protobuf:"varint,10,opt,name=free_bytes,json=freeBytes,proto3" json:"free_bytes,omitempty"`
+	PriceTiers      []*PriceTier `protobuf:"bytes,11,rep,name=price_tiers,json=priceTiers,proto3" json:"price_tiers,omitempty"`
+	Signature       []byte       `protobuf:"bytes,12,opt,name=signature,proto3" json:"signature,omitempty"`
+	QuicPort        uint32       `protobuf:"varint,13,opt,name=quic_port,json=quicPort,proto3" json:"quic_port,omitempty"`
+	TlsPort         uint32       `protobuf:"varint,14,opt,name=tls_port,json=tlsPort,proto3" json:"tls_port,omitempty"`
+	IssuedAt        int64        `protobuf:"varint,15,opt,name=issued_at,json=issuedAt,proto3" json:"issued_at,omitempty"`
+}
+
+func (x *ServiceMetadata) Reset() {
+	*x = ServiceMetadata{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ServiceMetadata) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceMetadata) ProtoMessage() {}
+
+func (x *ServiceMetadata) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceMetadata.ProtoReflect.Descriptor instead.
+func (*ServiceMetadata) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ServiceMetadata) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *ServiceMetadata) GetTcpPort() uint32 {
+	if x != nil {
+		return x.TcpPort
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetUdpPort() uint32 {
+	if x != nil {
+		return x.UdpPort
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetServiceId() uint32 {
+	if x != nil {
+		return x.ServiceId
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetServiceTcp() []uint32 {
+	if x != nil {
+		return x.ServiceTcp
+	}
+	return nil
+}
+
+func (x *ServiceMetadata) GetServiceUdp() []uint32 {
+	if x != nil {
+		return x.ServiceUdp
+	}
+	return nil
+}
+
+func (x *ServiceMetadata) GetPrice() string {
+	if x != nil {
+		return x.Price
+	}
+	return ""
+}
+
+func (x *ServiceMetadata) GetBeneficiaryAddr() string {
+	if x != nil {
+		return x.BeneficiaryAddr
+	}
+	return ""
+}
+
+func (x *ServiceMetadata) GetPricePerMinute() string {
+	if x != nil {
+		return x.PricePerMinute
+	}
+	return ""
+}
+
+func (x *ServiceMetadata) GetFreeBytes() uint64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetPriceTiers() []*PriceTier {
+	if x != nil {
+		return x.PriceTiers
+	}
+	return nil
+}
+
+func (x *ServiceMetadata) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *ServiceMetadata) GetQuicPort() uint32 {
+	if x != nil {
+		return x.QuicPort
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetTlsPort() uint32 {
+	if x != nil {
+		return x.TlsPort
+	}
+	return 0
+}
+
+func (x *ServiceMetadata) GetIssuedAt() int64 {
+	if x != nil {
+		return x.IssuedAt
+	}
+	return 0
+}
+
+type StreamMetadata struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ServiceId       uint32          `protobuf:"varint,1,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	PortId          uint32          `protobuf:"varint,2,opt,name=port_id,json=portId,proto3" json:"port_id,omitempty"`
+	IsPayment       bool            `protobuf:"varint,3,opt,name=is_payment,json=isPayment,proto3" json:"is_payment,omitempty"`
+	IsUdp           bool            `protobuf:"varint,4,opt,name=is_udp,json=isUdp,proto3" json:"is_udp,omitempty"`
+	CompressionAlgo CompressionAlgo `protobuf:"varint,5,opt,name=compression_algo,json=compressionAlgo,proto3,enum=pb.CompressionAlgo" json:"compression_algo,omitempty"`
+}
+
+func (x *StreamMetadata) Reset() {
+	*x = StreamMetadata{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StreamMetadata) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamMetadata) ProtoMessage() {}
+
+func (x *StreamMetadata) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamMetadata.ProtoReflect.Descriptor instead.
+func (*StreamMetadata) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *StreamMetadata) GetServiceId() uint32 {
+	if x != nil {
+		return x.ServiceId
+	}
+	return 0
+}
+
+func (x *StreamMetadata) GetPortId() uint32 {
+	if x != nil {
+		return x.PortId
+	}
+	return 0
+}
+
+func (x *StreamMetadata) GetIsPayment() bool {
+	if x != nil {
+		return x.IsPayment
+	}
+	return false
+}
+
+func (x *StreamMetadata) GetIsUdp() bool {
+	if x != nil {
+		return x.IsUdp
+	}
+	return false
+}
+
+func (x *StreamMetadata) GetCompressionAlgo() CompressionAlgo {
+	if x != nil {
+		return x.CompressionAlgo
+	}
+	return CompressionAlgo_COMPRESSION_ALGO_NONE
+}
+
+type LimitNotice struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LimitType LimitType `protobuf:"varint,1,opt,name=limit_type,json=limitType,proto3,enum=pb.LimitType" json:"limit_type,omitempty"`
+	Service   string    `protobuf:"bytes,2,opt,name=service,proto3" json:"service,omitempty"`
+	Limit     uint64    `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (x *LimitNotice) Reset() {
+	*x = LimitNotice{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LimitNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LimitNotice) ProtoMessage() {}
+
+func (x *LimitNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LimitNotice.ProtoReflect.Descriptor instead.
+func (*LimitNotice) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *LimitNotice) GetLimitType() LimitType {
+	if x != nil {
+		return x.LimitType
+	}
+	return LimitType_LIMIT_MAX_STREAMS
+}
+
+func (x *LimitNotice) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *LimitNotice) GetLimit() uint64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type PaymentNotice struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Action       PaymentAction `protobuf:"varint,1,opt,name=action,proto3,enum=pb.PaymentAction" json:"action,omitempty"`
+	Reason       string        `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	Paid         string        `protobuf:"bytes,3,opt,name=paid,proto3" json:"paid,omitempty"`
+	Expected     string        `protobuf:"bytes,4,opt,name=expected,proto3" json:"expected,omitempty"`
+	ThrottleRate uint32        `protobuf:"varint,5,opt,name=throttle_rate,json=throttleRate,proto3" json:"throttle_rate,omitempty"`
+}
+
+func (x *PaymentNotice) Reset() {
+	*x = PaymentNotice{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PaymentNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentNotice) ProtoMessage() {}
+
+func (x *PaymentNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentNotice.ProtoReflect.Descriptor instead.
+func (*PaymentNotice) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PaymentNotice) GetAction() PaymentAction {
+	if x != nil {
+		return x.Action
+	}
+	return PaymentAction_PAYMENT_OK
+}
+
+func (x *PaymentNotice) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *PaymentNotice) GetPaid() string {
+	if x != nil {
+		return x.Paid
+	}
+	return ""
+}
+
+func (x *PaymentNotice) GetExpected() string {
+	if x != nil {
+		return x.Expected
+	}
+	return ""
+}
+
+func (x *PaymentNotice) GetThrottleRate() uint32 {
+	if x != nil {
+		return x.ThrottleRate
+	}
+	return 0
+}
+
+type ServiceUsage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ServiceId        uint32 `protobuf:"varint,1,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	BytesEntryToExit uint64 `protobuf:"varint,2,opt,name=bytes_entry_to_exit,json=bytesEntryToExit,proto3" json:"bytes_entry_to_exit,omitempty"`
+	BytesExitToEntry uint64 `protobuf:"varint,3,opt,name=bytes_exit_to_entry,json=bytesExitToEntry,proto3" json:"bytes_exit_to_entry,omitempty"`
+}
+
+func (x *ServiceUsage) Reset() {
+	*x = ServiceUsage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ServiceUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceUsage) ProtoMessage() {}
+
+func (x *ServiceUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceUsage.ProtoReflect.Descriptor instead.
+func (*ServiceUsage) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServiceUsage) GetServiceId() uint32 {
+	if x != nil {
+		return x.ServiceId
+	}
+	return 0
+}
+
+func (x *ServiceUsage) GetBytesEntryToExit() uint64 {
+	if x != nil {
+		return x.BytesEntryToExit
+	}
+	return 0
+}
+
+func (x *ServiceUsage) GetBytesExitToEntry() uint64 {
+	if x != nil {
+		return x.BytesExitToEntry
+	}
+	return 0
+}
+
+type UsageStatement struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	PublicKey []byte          `protobuf:"bytes,1,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	Timestamp int64           `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	IsEntry   bool            `protobuf:"varint,3,opt,name=is_entry,json=isEntry,proto3" json:"is_entry,omitempty"`
+	Usages    []*ServiceUsage `protobuf:"bytes,4,rep,name=usages,proto3" json:"usages,omitempty"`
+	Signature []byte          `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
 }
 
-func (x *ConnectionMetadata) Reset() {
-	*x = ConnectionMetadata{}
+func (x *UsageStatement) Reset() {
+	*x = UsageStatement{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_tuna_proto_msgTypes[0]
+		mi := &file_pb_tuna_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *ConnectionMetadata) String() string {
+func (x *UsageStatement) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ConnectionMetadata) ProtoMessage() {}
+func (*UsageStatement) ProtoMessage() {}
 
-func (x *ConnectionMetadata) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_tuna_proto_msgTypes[0]
+func (x *UsageStatement) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -109,85 +1000,73 @@ func (x *ConnectionMetadata) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ConnectionMetadata.ProtoReflect.Descriptor instead.
-func (*ConnectionMetadata) Descriptor() ([]byte, []int) {
-	return file_pb_tuna_proto_rawDescGZIP(), []int{0}
-}
-
-func (x *ConnectionMetadata) GetEncryptionAlgo() EncryptionAlgo {
-	if x != nil {
-		return x.EncryptionAlgo
-	}
-	return EncryptionAlgo_ENCRYPTION_NONE
+// Deprecated: Use UsageStatement.ProtoReflect.Descriptor instead.
+func (*UsageStatement) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *ConnectionMetadata) GetPublicKey() []byte {
+func (x *UsageStatement) GetPublicKey() []byte {
 	if x != nil {
 		return x.PublicKey
 	}
 	return nil
 }
 
-func (x *ConnectionMetadata) GetNonce() []byte {
+func (x *UsageStatement) GetTimestamp() int64 {
 	if x != nil {
-		return x.Nonce
+		return x.Timestamp
 	}
-	return nil
+	return 0
 }
 
-func (x *ConnectionMetadata) GetIsMeasurement() bool {
+func (x *UsageStatement) GetIsEntry() bool {
 	if x != nil {
-		return x.IsMeasurement
+		return x.IsEntry
 	}
 	return false
 }
 
-func (x *ConnectionMetadata) GetMeasurementBytesDownlink() uint32 {
+func (x *UsageStatement) GetUsages() []*ServiceUsage {
 	if x != nil {
-		return x.MeasurementBytesDownlink
+		return x.Usages
 	}
-	return 0
+	return nil
 }
 
-func (x *ConnectionMetadata) GetIsPing() bool {
+func (x *UsageStatement) GetSignature() []byte {
 	if x != nil {
-		return x.IsPing
+		return x.Signature
 	}
-	return false
+	return nil
 }
 
-type ServiceMetadata struct {
+type UsageStatementAck struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Ip              string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
-	TcpPort         uint32   `protobuf:"varint,2,opt,name=tcp_port,json=tcpPort,proto3" json:"tcp_port,omitempty"`
-	UdpPort         uint32   `protobuf:"varint,3,opt,name=udp_port,json=udpPort,proto3" json:"udp_port,omitempty"`
-	ServiceId       uint32   `protobuf:"varint,4,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
-	ServiceTcp      []uint32 `protobuf:"varint,5,rep,packed,name=service_tcp,json=serviceTcp,proto3" json:"service_tcp,omitempty"`
-	ServiceUdp      []uint32 `protobuf:"varint,6,rep,packed,name=service_udp,json=serviceUdp,proto3" json:"service_udp,omitempty"`
-	Price           string   `protobuf:"bytes,7,opt,name=price,proto3" json:"price,omitempty"`
-	BeneficiaryAddr string   `protobuf:"bytes,8,opt,name=beneficiary_addr,json=beneficiaryAddr,proto3" json:"beneficiary_addr,omitempty"`
+	StatementHash []byte          `protobuf:"bytes,1,opt,name=statement_hash,json=statementHash,proto3" json:"statement_hash,omitempty"`
+	Agreed        bool            `protobuf:"varint,2,opt,name=agreed,proto3" json:"agreed,omitempty"`
+	Statement     *UsageStatement `protobuf:"bytes,3,opt,name=statement,proto3" json:"statement,omitempty"`
 }
 
-func (x *ServiceMetadata) Reset() {
-	*x = ServiceMetadata{}
+func (x *UsageStatementAck) Reset() {
+	*x = UsageStatementAck{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_tuna_proto_msgTypes[1]
+		mi := &file_pb_tuna_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *ServiceMetadata) String() string {
+func (x *UsageStatementAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ServiceMetadata) ProtoMessage() {}
+func (*UsageStatementAck) ProtoMessage() {}
 
-func (x *ServiceMetadata) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_tuna_proto_msgTypes[1]
+func (x *UsageStatementAck) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -198,94 +1077,101 @@ func (x *ServiceMetadata) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ServiceMetadata.ProtoReflect.Descriptor instead.
-func (*ServiceMetadata) Descriptor() ([]byte, []int) {
-	return file_pb_tuna_proto_rawDescGZIP(), []int{1}
+// Deprecated: Use UsageStatementAck.ProtoReflect.Descriptor instead.
+func (*UsageStatementAck) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{9}
 }
 
-func (x *ServiceMetadata) GetIp() string {
+func (x *UsageStatementAck) GetStatementHash() []byte {
 	if x != nil {
-		return x.Ip
+		return x.StatementHash
 	}
-	return ""
+	return nil
 }
 
-func (x *ServiceMetadata) GetTcpPort() uint32 {
+func (x *UsageStatementAck) GetAgreed() bool {
 	if x != nil {
-		return x.TcpPort
+		return x.Agreed
 	}
-	return 0
+	return false
 }
 
-func (x *ServiceMetadata) GetUdpPort() uint32 {
+func (x *UsageStatementAck) GetStatement() *UsageStatement {
 	if x != nil {
-		return x.UdpPort
+		return x.Statement
 	}
-	return 0
+	return nil
 }
 
-func (x *ServiceMetadata) GetServiceId() uint32 {
-	if x != nil {
-		return x.ServiceId
-	}
-	return 0
+type FreeAccessNotice struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 }
 
-func (x *ServiceMetadata) GetServiceTcp() []uint32 {
-	if x != nil {
-		return x.ServiceTcp
+func (x *FreeAccessNotice) Reset() {
+	*x = FreeAccessNotice{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_tuna_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
 	}
-	return nil
 }
 
-func (x *ServiceMetadata) GetServiceUdp() []uint32 {
-	if x != nil {
-		return x.ServiceUdp
-	}
-	return nil
+func (x *FreeAccessNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-func (x *ServiceMetadata) GetPrice() string {
-	if x != nil {
-		return x.Price
+func (*FreeAccessNotice) ProtoMessage() {}
+
+func (x *FreeAccessNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
 	}
-	return ""
+	return mi.MessageOf(x)
 }
 
-func (x *ServiceMetadata) GetBeneficiaryAddr() string {
-	if x != nil {
-		return x.BeneficiaryAddr
-	}
-	return ""
+// Deprecated: Use FreeAccessNotice.ProtoReflect.Descriptor instead.
+func (*FreeAccessNotice) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{10}
 }
 
-type StreamMetadata struct {
+type ControlMessage struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ServiceId uint32 `protobuf:"varint,1,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
-	PortId    uint32 `protobuf:"varint,2,opt,name=port_id,json=portId,proto3" json:"port_id,omitempty"`
-	IsPayment bool   `protobuf:"varint,3,opt,name=is_payment,json=isPayment,proto3" json:"is_payment,omitempty"`
+	// Types that are assignable to Message:
+	//	*ControlMessage_LimitNotice
+	//	*ControlMessage_PaymentNotice
+	//	*ControlMessage_UsageStatement
+	//	*ControlMessage_UsageStatementAck
+	//	*ControlMessage_FreeAccessNotice
+	Message isControlMessage_Message `protobuf_oneof:"message"`
 }
 
-func (x *StreamMetadata) Reset() {
-	*x = StreamMetadata{}
+func (x *ControlMessage) Reset() {
+	*x = ControlMessage{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_tuna_proto_msgTypes[2]
+		mi := &file_pb_tuna_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *StreamMetadata) String() string {
+func (x *ControlMessage) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*StreamMetadata) ProtoMessage() {}
+func (*ControlMessage) ProtoMessage() {}
 
-func (x *StreamMetadata) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_tuna_proto_msgTypes[2]
+func (x *ControlMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_tuna_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -296,37 +1182,92 @@ func (x *StreamMetadata) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use StreamMetadata.ProtoReflect.Descriptor instead.
-func (*StreamMetadata) Descriptor() ([]byte, []int) {
-	return file_pb_tuna_proto_rawDescGZIP(), []int{2}
+// Deprecated: Use ControlMessage.ProtoReflect.Descriptor instead.
+func (*ControlMessage) Descriptor() ([]byte, []int) {
+	return file_pb_tuna_proto_rawDescGZIP(), []int{11}
 }
 
-func (x *StreamMetadata) GetServiceId() uint32 {
-	if x != nil {
-		return x.ServiceId
+func (m *ControlMessage) GetMessage() isControlMessage_Message {
+	if m != nil {
+		return m.Message
 	}
-	return 0
+	return nil
 }
 
-func (x *StreamMetadata) GetPortId() uint32 {
-	if x != nil {
-		return x.PortId
+func (x *ControlMessage) GetLimitNotice() *LimitNotice {
+	if x, ok := x.GetMessage().(*ControlMessage_LimitNotice); ok {
+		return x.LimitNotice
 	}
-	return 0
+	return nil
 }
 
-func (x *StreamMetadata) GetIsPayment() bool {
-	if x != nil {
-		return x.IsPayment
+func (x *ControlMessage) GetPaymentNotice() *PaymentNotice {
+	if x, ok := x.GetMessage().(*ControlMessage_PaymentNotice); ok {
+		return x.PaymentNotice
 	}
-	return false
+	return nil
+}
+
+func (x *ControlMessage) GetUsageStatement() *UsageStatement {
+	if x, ok := x.GetMessage().(*ControlMessage_UsageStatement); ok {
+		return x.UsageStatement
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetUsageStatementAck() *UsageStatementAck {
+	if x, ok := x.GetMessage().(*ControlMessage_UsageStatementAck); ok {
+		return x.UsageStatementAck
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetFreeAccessNotice() *FreeAccessNotice {
+	if x, ok := x.GetMessage().(*ControlMessage_FreeAccessNotice); ok {
+		return x.FreeAccessNotice
+	}
+	return nil
+}
+
+type isControlMessage_Message interface {
+	isControlMessage_Message()
+}
+
+type ControlMessage_LimitNotice struct {
+	LimitNotice *LimitNotice `protobuf:"bytes,1,opt,name=limit_notice,json=limitNotice,proto3,oneof"`
+}
+
+type ControlMessage_PaymentNotice struct {
+	PaymentNotice *PaymentNotice `protobuf:"bytes,2,opt,name=payment_notice,json=paymentNotice,proto3,oneof"`
 }
 
+type ControlMessage_UsageStatement struct {
+	UsageStatement *UsageStatement `protobuf:"bytes,3,opt,name=usage_statement,json=usageStatement,proto3,oneof"`
+}
+
+type ControlMessage_UsageStatementAck struct {
+	UsageStatementAck *UsageStatementAck `protobuf:"bytes,4,opt,name=usage_statement_ack,json=usageStatementAck,proto3,oneof"`
+}
+
+type ControlMessage_FreeAccessNotice struct {
+	FreeAccessNotice *FreeAccessNotice `protobuf:"bytes,5,opt,name=free_access_notice,json=freeAccessNotice,proto3,oneof"`
+}
+
+func (*ControlMessage_LimitNotice) isControlMessage_Message() {}
+
+func (*ControlMessage_PaymentNotice) isControlMessage_Message() {}
+
+func (*ControlMessage_UsageStatement) isControlMessage_Message() {}
+
+func (*ControlMessage_UsageStatementAck) isControlMessage_Message() {}
+
+func (*ControlMessage_FreeAccessNotice) isControlMessage_Message() {}
+
 var File_pb_tuna_proto protoreflect.FileDescriptor
 
 var file_pb_tuna_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x70, 0x62, 0x2f, 0x74, 0x75, 0x6e, 0x61, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x02, 0x70, 0x62, 0x22, 0x84, 0x02, 0x0a, 0x12, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69,
+	0x02, 0x70, 0x62, 0x22, 0xe5, 0x05, 0x0a, 0x12, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69,
 	0x6f, 0x6e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x3b, 0x0a, 0x0f, 0x65, 0x6e,
 	0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x18, 0x01, 0x20,
 	0x01, 0x28, 0x0e, 0x32, 0x12, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74,
@@ -342,36 +1283,193 @@ var file_pb_tuna_proto_rawDesc = []byte{
 	0x6b, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x18, 0x6d, 0x65, 0x61, 0x73, 0x75, 0x72, 0x65,
 	0x6d, 0x65, 0x6e, 0x74, 0x42, 0x79, 0x74, 0x65, 0x73, 0x44, 0x6f, 0x77, 0x6e, 0x6c, 0x69, 0x6e,
 	0x6b, 0x12, 0x17, 0x0a, 0x07, 0x69, 0x73, 0x5f, 0x70, 0x69, 0x6e, 0x67, 0x18, 0x06, 0x20, 0x01,
-	0x28, 0x08, 0x52, 0x06, 0x69, 0x73, 0x50, 0x69, 0x6e, 0x67, 0x22, 0xf9, 0x01, 0x0a, 0x0f, 0x53,
-	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x0e,
-	0x0a, 0x02, 0x69, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x70, 0x12, 0x19,
-	0x0a, 0x08, 0x74, 0x63, 0x70, 0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
-	0x52, 0x07, 0x74, 0x63, 0x70, 0x50, 0x6f, 0x72, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x75, 0x64, 0x70,
-	0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x75, 0x64, 0x70,
-	0x50, 0x6f, 0x72, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f,
-	0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
-	0x65, 0x49, 0x64, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x74,
-	0x63, 0x70, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
-	0x65, 0x54, 0x63, 0x70, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f,
-	0x75, 0x64, 0x70, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69,
-	0x63, 0x65, 0x55, 0x64, 0x70, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x72, 0x69, 0x63, 0x65, 0x18, 0x07,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70, 0x72, 0x69, 0x63, 0x65, 0x12, 0x29, 0x0a, 0x10, 0x62,
-	0x65, 0x6e, 0x65, 0x66, 0x69, 0x63, 0x69, 0x61, 0x72, 0x79, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x18,
-	0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x62, 0x65, 0x6e, 0x65, 0x66, 0x69, 0x63, 0x69, 0x61,
-	0x72, 0x79, 0x41, 0x64, 0x64, 0x72, 0x22, 0x67, 0x0a, 0x0e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
-	0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76,
-	0x69, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09, 0x73, 0x65,
-	0x72, 0x76, 0x69, 0x63, 0x65, 0x49, 0x64, 0x12, 0x17, 0x0a, 0x07, 0x70, 0x6f, 0x72, 0x74, 0x5f,
-	0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x70, 0x6f, 0x72, 0x74, 0x49, 0x64,
-	0x12, 0x1d, 0x0a, 0x0a, 0x69, 0x73, 0x5f, 0x70, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x69, 0x73, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x2a,
-	0x5f, 0x0a, 0x0e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67,
-	0x6f, 0x12, 0x13, 0x0a, 0x0f, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f,
-	0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x20, 0x0a, 0x1c, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50,
-	0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x58, 0x53, 0x41, 0x4c, 0x53, 0x41, 0x32, 0x30, 0x5f, 0x50, 0x4f,
-	0x4c, 0x59, 0x31, 0x33, 0x30, 0x35, 0x10, 0x01, 0x12, 0x16, 0x0a, 0x12, 0x45, 0x4e, 0x43, 0x52,
-	0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x41, 0x45, 0x53, 0x5f, 0x47, 0x43, 0x4d, 0x10, 0x02,
-	0x42, 0x06, 0x5a, 0x04, 0x2e, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x28, 0x08, 0x52, 0x06, 0x69, 0x73, 0x50, 0x69, 0x6e, 0x67, 0x12, 0x29, 0x0a, 0x10, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x0f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x22, 0x0a, 0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c,
+	0x69, 0x74, 0x69, 0x65, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x63, 0x61, 0x70,
+	0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x12, 0x30, 0x0a, 0x14, 0x65, 0x70, 0x68,
+	0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x5f, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x5f, 0x6b, 0x65,
+	0x79, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x12, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72,
+	0x61, 0x6c, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x2f, 0x0a, 0x13, 0x65,
+	0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x5f, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x12, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65,
+	0x72, 0x61, 0x6c, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x3d, 0x0a, 0x10,
+	0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x73,
+	0x18, 0x0b, 0x20, 0x03, 0x28, 0x0e, 0x32, 0x12, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x6e, 0x63, 0x72,
+	0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x52, 0x0f, 0x65, 0x6e, 0x63, 0x72,
+	0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x73, 0x12, 0x2a, 0x0a, 0x11, 0x75,
+	0x64, 0x70, 0x5f, 0x62, 0x69, 0x6e, 0x64, 0x5f, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65,
+	0x18, 0x0c, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0f, 0x75, 0x64, 0x70, 0x42, 0x69, 0x6e, 0x64, 0x53,
+	0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x24, 0x0a, 0x0e, 0x75, 0x64, 0x70, 0x5f, 0x62,
+	0x69, 0x6e, 0x64, 0x5f, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x0c, 0x75, 0x64, 0x70, 0x42, 0x69, 0x6e, 0x64, 0x50, 0x72, 0x6f, 0x6f, 0x66, 0x12, 0x2c, 0x0a,
+	0x0a, 0x6d, 0x75, 0x78, 0x5f, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x18, 0x0e, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x0d, 0x2e, 0x70, 0x62, 0x2e, 0x4d, 0x75, 0x78, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67,
+	0x52, 0x09, 0x6d, 0x75, 0x78, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x40, 0x0a, 0x11, 0x63,
+	0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x73,
+	0x18, 0x0f, 0x20, 0x03, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x70, 0x62, 0x2e, 0x43, 0x6f, 0x6d, 0x70,
+	0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x52, 0x10, 0x63, 0x6f, 0x6d,
+	0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x73, 0x12, 0x2c, 0x0a,
+	0x12, 0x75, 0x64, 0x70, 0x5f, 0x62, 0x69, 0x6e, 0x64, 0x5f, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65,
+	0x6e, 0x67, 0x65, 0x18, 0x10, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x10, 0x75, 0x64, 0x70, 0x42, 0x69,
+	0x6e, 0x64, 0x43, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x22, 0xa9, 0x01, 0x0a, 0x09,
+	0x4d, 0x75, 0x78, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x12, 0x2e, 0x0a, 0x13, 0x6b, 0x65, 0x65, 0x70, 0x5f, 0x61, 0x6c, 0x69, 0x76,
+	0x65, 0x5f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x11, 0x6b, 0x65, 0x65, 0x70, 0x41, 0x6c, 0x69, 0x76, 0x65, 0x49, 0x6e, 0x74, 0x65, 0x72,
+	0x76, 0x61, 0x6c, 0x12, 0x2c, 0x0a, 0x12, 0x6b, 0x65, 0x65, 0x70, 0x5f, 0x61, 0x6c, 0x69, 0x76,
+	0x65, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x10, 0x6b, 0x65, 0x65, 0x70, 0x41, 0x6c, 0x69, 0x76, 0x65, 0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75,
+	0x74, 0x12, 0x24, 0x0a, 0x0e, 0x6d, 0x61, 0x78, 0x5f, 0x66, 0x72, 0x61, 0x6d, 0x65, 0x5f, 0x73,
+	0x69, 0x7a, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0c, 0x6d, 0x61, 0x78, 0x46, 0x72,
+	0x61, 0x6d, 0x65, 0x53, 0x69, 0x7a, 0x65, 0x22, 0x4a, 0x0a, 0x09, 0x50, 0x72, 0x69, 0x63, 0x65,
+	0x54, 0x69, 0x65, 0x72, 0x12, 0x27, 0x0a, 0x0f, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c,
+	0x64, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0e, 0x74,
+	0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x14, 0x0a,
+	0x05, 0x70, 0x72, 0x69, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70, 0x72,
+	0x69, 0x63, 0x65, 0x22, 0xe5, 0x03, 0x0a, 0x0f, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x4d,
+	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x70, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x70, 0x12, 0x19, 0x0a, 0x08, 0x74, 0x63, 0x70, 0x5f, 0x70,
+	0x6f, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x74, 0x63, 0x70, 0x50, 0x6f,
+	0x72, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x75, 0x64, 0x70, 0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x75, 0x64, 0x70, 0x50, 0x6f, 0x72, 0x74, 0x12, 0x1d, 0x0a,
+	0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x09, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x49, 0x64, 0x12, 0x1f, 0x0a, 0x0b,
+	0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x74, 0x63, 0x70, 0x18, 0x05, 0x20, 0x03, 0x28,
+	0x0d, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x54, 0x63, 0x70, 0x12, 0x1f, 0x0a,
+	0x0b, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x75, 0x64, 0x70, 0x18, 0x06, 0x20, 0x03,
+	0x28, 0x0d, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x55, 0x64, 0x70, 0x12, 0x14,
+	0x0a, 0x05, 0x70, 0x72, 0x69, 0x63, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x70,
+	0x72, 0x69, 0x63, 0x65, 0x12, 0x29, 0x0a, 0x10, 0x62, 0x65, 0x6e, 0x65, 0x66, 0x69, 0x63, 0x69,
+	0x61, 0x72, 0x79, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f,
+	0x62, 0x65, 0x6e, 0x65, 0x66, 0x69, 0x63, 0x69, 0x61, 0x72, 0x79, 0x41, 0x64, 0x64, 0x72, 0x12,
+	0x28, 0x0a, 0x10, 0x70, 0x72, 0x69, 0x63, 0x65, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x6d, 0x69, 0x6e,
+	0x75, 0x74, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x70, 0x72, 0x69, 0x63, 0x65,
+	0x50, 0x65, 0x72, 0x4d, 0x69, 0x6e, 0x75, 0x74, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x72, 0x65,
+	0x65, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x66,
+	0x72, 0x65, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x2e, 0x0a, 0x0b, 0x70, 0x72, 0x69, 0x63,
+	0x65, 0x5f, 0x74, 0x69, 0x65, 0x72, 0x73, 0x18, 0x0b, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e,
+	0x70, 0x62, 0x2e, 0x50, 0x72, 0x69, 0x63, 0x65, 0x54, 0x69, 0x65, 0x72, 0x52, 0x0a, 0x70, 0x72,
+	0x69, 0x63, 0x65, 0x54, 0x69, 0x65, 0x72, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e,
+	0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67,
+	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x71, 0x75, 0x69, 0x63, 0x5f, 0x70,
+	0x6f, 0x72, 0x74, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x71, 0x75, 0x69, 0x63, 0x50,
+	0x6f, 0x72, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x74, 0x6c, 0x73, 0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18,
+	0x0e, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x74, 0x6c, 0x73, 0x50, 0x6f, 0x72, 0x74, 0x12, 0x1b,
+	0x0a, 0x09, 0x69, 0x73, 0x73, 0x75, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x0f, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x08, 0x69, 0x73, 0x73, 0x75, 0x65, 0x64, 0x41, 0x74, 0x22, 0xbe, 0x01, 0x0a, 0x0e,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1d,
+	0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x09, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x49, 0x64, 0x12, 0x17, 0x0a,
+	0x07, 0x70, 0x6f, 0x72, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06,
+	0x70, 0x6f, 0x72, 0x74, 0x49, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x69, 0x73, 0x5f, 0x70, 0x61, 0x79,
+	0x6d, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x69, 0x73, 0x50, 0x61,
+	0x79, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x15, 0x0a, 0x06, 0x69, 0x73, 0x5f, 0x75, 0x64, 0x70, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x69, 0x73, 0x55, 0x64, 0x70, 0x12, 0x3e, 0x0a, 0x10,
+	0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x61, 0x6c, 0x67, 0x6f,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x70, 0x62, 0x2e, 0x43, 0x6f, 0x6d, 0x70,
+	0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x52, 0x0f, 0x63, 0x6f, 0x6d,
+	0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x22, 0x6b, 0x0a, 0x0b,
+	0x4c, 0x69, 0x6d, 0x69, 0x74, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x12, 0x2c, 0x0a, 0x0a, 0x6c,
+	0x69, 0x6d, 0x69, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x0d, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x09,
+	0x6c, 0x69, 0x6d, 0x69, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72,
+	0x76, 0x69, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76,
+	0x69, 0x63, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0xa7, 0x01, 0x0a, 0x0d, 0x50, 0x61,
+	0x79, 0x6d, 0x65, 0x6e, 0x74, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x12, 0x29, 0x0a, 0x06, 0x61,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x70, 0x62,
+	0x2e, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x06,
+	0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x12,
+	0x0a, 0x04, 0x70, 0x61, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61,
+	0x69, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64, 0x12, 0x23,
+	0x0a, 0x0d, 0x74, 0x68, 0x72, 0x6f, 0x74, 0x74, 0x6c, 0x65, 0x5f, 0x72, 0x61, 0x74, 0x65, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0c, 0x74, 0x68, 0x72, 0x6f, 0x74, 0x74, 0x6c, 0x65, 0x52,
+	0x61, 0x74, 0x65, 0x22, 0x8b, 0x01, 0x0a, 0x0c, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x55,
+	0x73, 0x61, 0x67, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x5f,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x49, 0x64, 0x12, 0x2d, 0x0a, 0x13, 0x62, 0x79, 0x74, 0x65, 0x73, 0x5f, 0x65, 0x6e, 0x74,
+	0x72, 0x79, 0x5f, 0x74, 0x6f, 0x5f, 0x65, 0x78, 0x69, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x10, 0x62, 0x79, 0x74, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x54, 0x6f, 0x45, 0x78,
+	0x69, 0x74, 0x12, 0x2d, 0x0a, 0x13, 0x62, 0x79, 0x74, 0x65, 0x73, 0x5f, 0x65, 0x78, 0x69, 0x74,
+	0x5f, 0x74, 0x6f, 0x5f, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x10, 0x62, 0x79, 0x74, 0x65, 0x73, 0x45, 0x78, 0x69, 0x74, 0x54, 0x6f, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x22, 0xb0, 0x01, 0x0a, 0x0e, 0x55, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65,
+	0x6d, 0x65, 0x6e, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x5f, 0x6b,
+	0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63,
+	0x4b, 0x65, 0x79, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x12, 0x19, 0x0a, 0x08, 0x69, 0x73, 0x5f, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x07, 0x69, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x28, 0x0a, 0x06,
+	0x75, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70,
+	0x62, 0x2e, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x06,
+	0x75, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61,
+	0x74, 0x75, 0x72, 0x65, 0x22, 0x84, 0x01, 0x0a, 0x11, 0x55, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74,
+	0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x41, 0x63, 0x6b, 0x12, 0x25, 0x0a, 0x0e, 0x73, 0x74,
+	0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x0d, 0x73, 0x74, 0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x48, 0x61, 0x73,
+	0x68, 0x12, 0x16, 0x0a, 0x06, 0x61, 0x67, 0x72, 0x65, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x06, 0x61, 0x67, 0x72, 0x65, 0x65, 0x64, 0x12, 0x30, 0x0a, 0x09, 0x73, 0x74, 0x61,
+	0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x70,
+	0x62, 0x2e, 0x55, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74,
+	0x52, 0x09, 0x73, 0x74, 0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x22, 0x12, 0x0a, 0x10, 0x46,
+	0x72, 0x65, 0x65, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x22,
+	0xdb, 0x02, 0x0a, 0x0e, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x4d, 0x65, 0x73, 0x73, 0x61,
+	0x67, 0x65, 0x12, 0x34, 0x0a, 0x0c, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x5f, 0x6e, 0x6f, 0x74, 0x69,
+	0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x69,
+	0x6d, 0x69, 0x74, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x48, 0x00, 0x52, 0x0b, 0x6c, 0x69, 0x6d,
+	0x69, 0x74, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x12, 0x3a, 0x0a, 0x0e, 0x70, 0x61, 0x79, 0x6d,
+	0x65, 0x6e, 0x74, 0x5f, 0x6e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x11, 0x2e, 0x70, 0x62, 0x2e, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x4e, 0x6f, 0x74,
+	0x69, 0x63, 0x65, 0x48, 0x00, 0x52, 0x0d, 0x70, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x4e, 0x6f,
+	0x74, 0x69, 0x63, 0x65, 0x12, 0x3d, 0x0a, 0x0f, 0x75, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x73, 0x74,
+	0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e,
+	0x70, 0x62, 0x2e, 0x55, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e,
+	0x74, 0x48, 0x00, 0x52, 0x0e, 0x75, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x6d,
+	0x65, 0x6e, 0x74, 0x12, 0x47, 0x0a, 0x13, 0x75, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x73, 0x74, 0x61,
+	0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x5f, 0x61, 0x63, 0x6b, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x15, 0x2e, 0x70, 0x62, 0x2e, 0x55, 0x73, 0x61, 0x67, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65,
+	0x6d, 0x65, 0x6e, 0x74, 0x41, 0x63, 0x6b, 0x48, 0x00, 0x52, 0x11, 0x75, 0x73, 0x61, 0x67, 0x65,
+	0x53, 0x74, 0x61, 0x74, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x41, 0x63, 0x6b, 0x12, 0x44, 0x0a, 0x12,
+	0x66, 0x72, 0x65, 0x65, 0x5f, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x5f, 0x6e, 0x6f, 0x74, 0x69,
+	0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x70, 0x62, 0x2e, 0x46, 0x72,
+	0x65, 0x65, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x4e, 0x6f, 0x74, 0x69, 0x63, 0x65, 0x48, 0x00,
+	0x52, 0x10, 0x66, 0x72, 0x65, 0x65, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x4e, 0x6f, 0x74, 0x69,
+	0x63, 0x65, 0x42, 0x09, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2a, 0xa4, 0x01,
+	0x0a, 0x0e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f,
+	0x12, 0x13, 0x0a, 0x0f, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x4e,
+	0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x20, 0x0a, 0x1c, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54,
+	0x49, 0x4f, 0x4e, 0x5f, 0x58, 0x53, 0x41, 0x4c, 0x53, 0x41, 0x32, 0x30, 0x5f, 0x50, 0x4f, 0x4c,
+	0x59, 0x31, 0x33, 0x30, 0x35, 0x10, 0x01, 0x12, 0x16, 0x0a, 0x12, 0x45, 0x4e, 0x43, 0x52, 0x59,
+	0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x41, 0x45, 0x53, 0x5f, 0x47, 0x43, 0x4d, 0x10, 0x02, 0x12,
+	0x20, 0x0a, 0x1c, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x43, 0x48,
+	0x41, 0x43, 0x48, 0x41, 0x32, 0x30, 0x5f, 0x50, 0x4f, 0x4c, 0x59, 0x31, 0x33, 0x30, 0x35, 0x10,
+	0x03, 0x12, 0x21, 0x0a, 0x1d, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f,
+	0x58, 0x43, 0x48, 0x41, 0x43, 0x48, 0x41, 0x32, 0x30, 0x5f, 0x50, 0x4f, 0x4c, 0x59, 0x31, 0x33,
+	0x30, 0x35, 0x10, 0x04, 0x2a, 0x64, 0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x41, 0x6c, 0x67, 0x6f, 0x12, 0x19, 0x0a, 0x15, 0x43, 0x4f, 0x4d, 0x50, 0x52,
+	0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x41, 0x4c, 0x47, 0x4f, 0x5f, 0x4e, 0x4f, 0x4e, 0x45,
+	0x10, 0x00, 0x12, 0x1b, 0x0a, 0x17, 0x43, 0x4f, 0x4d, 0x50, 0x52, 0x45, 0x53, 0x53, 0x49, 0x4f,
+	0x4e, 0x5f, 0x41, 0x4c, 0x47, 0x4f, 0x5f, 0x53, 0x4e, 0x41, 0x50, 0x50, 0x59, 0x10, 0x01, 0x12,
+	0x19, 0x0a, 0x15, 0x43, 0x4f, 0x4d, 0x50, 0x52, 0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x41,
+	0x4c, 0x47, 0x4f, 0x5f, 0x5a, 0x53, 0x54, 0x44, 0x10, 0x02, 0x2a, 0x4e, 0x0a, 0x09, 0x4c, 0x69,
+	0x6d, 0x69, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x15, 0x0a, 0x11, 0x4c, 0x49, 0x4d, 0x49, 0x54,
+	0x5f, 0x4d, 0x41, 0x58, 0x5f, 0x53, 0x54, 0x52, 0x45, 0x41, 0x4d, 0x53, 0x10, 0x00, 0x12, 0x13,
+	0x0a, 0x0f, 0x4c, 0x49, 0x4d, 0x49, 0x54, 0x5f, 0x42, 0x41, 0x4e, 0x44, 0x57, 0x49, 0x44, 0x54,
+	0x48, 0x10, 0x01, 0x12, 0x15, 0x0a, 0x11, 0x4c, 0x49, 0x4d, 0x49, 0x54, 0x5f, 0x44, 0x41, 0x49,
+	0x4c, 0x59, 0x5f, 0x51, 0x55, 0x4f, 0x54, 0x41, 0x10, 0x02, 0x2a, 0x5a, 0x0a, 0x0d, 0x50, 0x61,
+	0x79, 0x6d, 0x65, 0x6e, 0x74, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x0e, 0x0a, 0x0a, 0x50,
+	0x41, 0x59, 0x4d, 0x45, 0x4e, 0x54, 0x5f, 0x4f, 0x4b, 0x10, 0x00, 0x12, 0x10, 0x0a, 0x0c, 0x50,
+	0x41, 0x59, 0x4d, 0x45, 0x4e, 0x54, 0x5f, 0x57, 0x41, 0x52, 0x4e, 0x10, 0x01, 0x12, 0x14, 0x0a,
+	0x10, 0x50, 0x41, 0x59, 0x4d, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x48, 0x52, 0x4f, 0x54, 0x54, 0x4c,
+	0x45, 0x10, 0x02, 0x12, 0x11, 0x0a, 0x0d, 0x50, 0x41, 0x59, 0x4d, 0x45, 0x4e, 0x54, 0x5f, 0x43,
+	0x4c, 0x4f, 0x53, 0x45, 0x10, 0x03, 0x42, 0x06, 0x5a, 0x04, 0x2e, 0x2f, 0x70, 0x62, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -386,21 +1484,47 @@ func file_pb_tuna_proto_rawDescGZIP() []byte {
 	return file_pb_tuna_proto_rawDescData
 }
 
-var file_pb_tuna_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_pb_tuna_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_pb_tuna_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_pb_tuna_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
 var file_pb_tuna_proto_goTypes = []interface{}{
 	(EncryptionAlgo)(0),        // 0: pb.EncryptionAlgo
-	(*ConnectionMetadata)(nil), // 1: pb.ConnectionMetadata
-	(*ServiceMetadata)(nil),    // 2: pb.ServiceMetadata
-	(*StreamMetadata)(nil),     // 3: pb.StreamMetadata
+	(CompressionAlgo)(0),       // 1: pb.CompressionAlgo
+	(LimitType)(0),             // 2: pb.LimitType
+	(PaymentAction)(0),         // 3: pb.PaymentAction
+	(*ConnectionMetadata)(nil), // 4: pb.ConnectionMetadata
+	(*MuxConfig)(nil),          // 5: pb.MuxConfig
+	(*PriceTier)(nil),          // 6: pb.PriceTier
+	(*ServiceMetadata)(nil),    // 7: pb.ServiceMetadata
+	(*StreamMetadata)(nil),     // 8: pb.StreamMetadata
+	(*LimitNotice)(nil),        // 9: pb.LimitNotice
+	(*PaymentNotice)(nil),      // 10: pb.PaymentNotice
+	(*ServiceUsage)(nil),       // 11: pb.ServiceUsage
+	(*UsageStatement)(nil),     // 12: pb.UsageStatement
+	(*UsageStatementAck)(nil),  // 13: pb.UsageStatementAck
+	(*FreeAccessNotice)(nil),   // 14: pb.FreeAccessNotice
+	(*ControlMessage)(nil),     // 15: pb.ControlMessage
 }
 var file_pb_tuna_proto_depIdxs = []int32{
-	0, // 0: pb.ConnectionMetadata.encryption_algo:type_name -> pb.EncryptionAlgo
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	0,  // 0: pb.ConnectionMetadata.encryption_algo:type_name -> pb.EncryptionAlgo
+	0,  // 1: pb.ConnectionMetadata.encryption_algos:type_name -> pb.EncryptionAlgo
+	5,  // 2: pb.ConnectionMetadata.mux_config:type_name -> pb.MuxConfig
+	1,  // 3: pb.ConnectionMetadata.compression_algos:type_name -> pb.CompressionAlgo
+	6,  // 4: pb.ServiceMetadata.price_tiers:type_name -> pb.PriceTier
+	1,  // 5: pb.StreamMetadata.compression_algo:type_name -> pb.CompressionAlgo
+	2,  // 6: pb.LimitNotice.limit_type:type_name -> pb.LimitType
+	3,  // 7: pb.PaymentNotice.action:type_name -> pb.PaymentAction
+	11, // 8: pb.UsageStatement.usages:type_name -> pb.ServiceUsage
+	12, // 9: pb.UsageStatementAck.statement:type_name -> pb.UsageStatement
+	9,  // 10: pb.ControlMessage.limit_notice:type_name -> pb.LimitNotice
+	10, // 11: pb.ControlMessage.payment_notice:type_name -> pb.PaymentNotice
+	12, // 12: pb.ControlMessage.usage_statement:type_name -> pb.UsageStatement
+	13, // 13: pb.ControlMessage.usage_statement_ack:type_name -> pb.UsageStatementAck
+	14, // 14: pb.ControlMessage.free_access_notice:type_name -> pb.FreeAccessNotice
+	15, // [15:15] is the sub-list for method output_type
+	15, // [15:15] is the sub-list for method input_type
+	15, // [15:15] is the sub-list for extension type_name
+	15, // [15:15] is the sub-list for extension extendee
+	0,  // [0:15] is the sub-list for field type_name
 }
 
 func init() { file_pb_tuna_proto_init() }
@@ -422,7 +1546,7 @@ func file_pb_tuna_proto_init() {
 			}
 		}
 		file_pb_tuna_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ServiceMetadata); i {
+			switch v := v.(*MuxConfig); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -434,6 +1558,30 @@ func file_pb_tuna_proto_init() {
 			}
 		}
 		file_pb_tuna_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PriceTier); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ServiceMetadata); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*StreamMetadata); i {
 			case 0:
 				return &v.state
@@ -445,14 +1593,105 @@ func file_pb_tuna_proto_init() {
 				return nil
 			}
 		}
+		file_pb_tuna_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LimitNotice); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PaymentNotice); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ServiceUsage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UsageStatement); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UsageStatementAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FreeAccessNotice); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_tuna_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ControlMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_pb_tuna_proto_msgTypes[11].OneofWrappers = []interface{}{
+		(*ControlMessage_LimitNotice)(nil),
+		(*ControlMessage_PaymentNotice)(nil),
+		(*ControlMessage_UsageStatement)(nil),
+		(*ControlMessage_UsageStatementAck)(nil),
+		(*ControlMessage_FreeAccessNotice)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pb_tuna_proto_rawDesc,
-			NumEnums:      1,
-			NumMessages:   3,
+			NumEnums:      4,
+			NumMessages:   12,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,114 @@
+package tuna
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	tunaUtil "github.com/nknorg/tuna/util"
+)
+
+const pipeBufferSize = 32 << 10
+
+var pipeBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, pipeBufferSize)
+		return &b
+	},
+}
+
+// meteredWriter waits for limiters before writing to writer, and counts bytes
+// written, or bytes on wire if dest or src transforms data.
+type meteredWriter struct {
+	writer      io.Writer
+	written     *uint64
+	wireBytes   func() uint64
+	wireWritten uint64
+	limiters    []*tunaUtil.RateLimiter
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	for _, limiter := range w.limiters {
+		limiter.Wait(len(b))
+	}
+	n, err := w.writer.Write(b)
+	w.count(n)
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (w *meteredWriter) count(n int) {
+	if n <= 0 || w.written == nil {
+		return
+	}
+	if w.wireBytes != nil {
+		wireWritten := w.wireBytes()
+		atomic.AddUint64(w.written, wireWritten-w.wireWritten)
+		w.wireWritten = wireWritten
+		return
+	}
+	atomic.AddUint64(w.written, uint64(n))
+}
+
+// Copy copies from src to dest until EOF, waits for limiters and adds bytes
+// written to written. Data is written without an intermediate buffer if src
+// writes it directly, such as streams of session. Otherwise a pooled buffer is
+// used.
+func Copy(dest io.Writer, src io.Reader, written *uint64, limiters ...*tunaUtil.RateLimiter) error {
+	w := &meteredWriter{
+		writer:    dest,
+		written:   written,
+		wireBytes: wireBytesOf(dest, src),
+		limiters:  limiters,
+	}
+
+	if wt, ok := writerTo(src); ok {
+		_, err := wt.WriteTo(w)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	bufPtr := pipeBufferPool.Get().(*[]byte)
+	defer pipeBufferPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			_, err := w.Write(buf[:nr])
+			if err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// writerTo returns src as io.WriterTo if it writes data without a buffer, such
+// as streams of session, or wrappers of half-close and client limits on them.
+func writerTo(src io.Reader) (io.WriterTo, bool) {
+	switch s := src.(type) {
+	case *net.TCPConn:
+		// TCP conns implement io.WriterTo by a buffer that is not pooled.
+		return nil, false
+	case *limitedStream:
+		if _, ok := writerTo(s.ReadCloser); !ok {
+			return nil, false
+		}
+	case *halfCloseStream:
+		if _, ok := writerTo(s.Stream); !ok {
+			return nil, false
+		}
+	}
+	wt, ok := src.(io.WriterTo)
+	return wt, ok
+}
@@ -0,0 +1,122 @@
+package tuna
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/pb"
+)
+
+// PriceTier is the per TrafficUnit price for session traffic above
+// ThresholdBytes (both directions combined).
+type PriceTier struct {
+	ThresholdBytes   uint64
+	EntryToExitPrice common.Fixed64
+	ExitToEntryPrice common.Fixed64
+}
+
+// PricingModel is how a service provider charges a session: a per TrafficUnit
+// price in each direction, optional volume tiers, a free allowance at the
+// beginning of each session and a session fee per minute.
+type PricingModel struct {
+	EntryToExitPrice common.Fixed64
+	ExitToEntryPrice common.Fixed64
+	PricePerMinute   common.Fixed64
+	FreeBytes        uint64
+	Tiers            []PriceTier
+}
+
+func NewPricingModel(price, pricePerMinute string, freeBytes uint64, tiers []*pb.PriceTier) (*PricingModel, error) {
+	entryToExitPrice, exitToEntryPrice, err := ParsePrice(price)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &PricingModel{
+		EntryToExitPrice: entryToExitPrice,
+		ExitToEntryPrice: exitToEntryPrice,
+		FreeBytes:        freeBytes,
+		Tiers:            make([]PriceTier, 0, len(tiers)),
+	}
+
+	if len(pricePerMinute) > 0 {
+		m.PricePerMinute, err = common.StringToFixed64(pricePerMinute)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tier := range tiers {
+		entryToExitPrice, exitToEntryPrice, err := ParsePrice(tier.Price)
+		if err != nil {
+			return nil, err
+		}
+		m.Tiers = append(m.Tiers, PriceTier{
+			ThresholdBytes:   tier.ThresholdBytes,
+			EntryToExitPrice: entryToExitPrice,
+			ExitToEntryPrice: exitToEntryPrice,
+		})
+	}
+	sort.Slice(m.Tiers, func(i, j int) bool {
+		return m.Tiers[i].ThresholdBytes < m.Tiers[j].ThresholdBytes
+	})
+
+	return m, nil
+}
+
+// ParsePricingModel reads pricing model from service metadata.
+func ParsePricingModel(metadata *pb.ServiceMetadata) (*PricingModel, error) {
+	return NewPricingModel(metadata.Price, metadata.PricePerMinute, metadata.FreeBytes, metadata.PriceTiers)
+}
+
+// Cost returns the total cost of a session with given traffic and duration.
+// Volume is split into bands by free allowance and tier thresholds, and each
+// band is charged in proportion to the traffic of each direction.
+func (m *PricingModel) Cost(bytesEntryToExit, bytesExitToEntry uint64, duration time.Duration) common.Fixed64 {
+	cost := common.Fixed64(float64(m.PricePerMinute) * duration.Minutes())
+
+	total := bytesEntryToExit + bytesExitToEntry
+	if total <= m.FreeBytes {
+		return cost
+	}
+	ratio := float64(bytesEntryToExit) / float64(total)
+
+	bands := append([]PriceTier{{
+		ThresholdBytes:   m.FreeBytes,
+		EntryToExitPrice: m.EntryToExitPrice,
+		ExitToEntryPrice: m.ExitToEntryPrice,
+	}}, m.Tiers...)
+	for i, band := range bands {
+		start := band.ThresholdBytes
+		if start < m.FreeBytes {
+			start = m.FreeBytes
+		}
+		end := total
+		if i+1 < len(bands) && bands[i+1].ThresholdBytes < end {
+			end = bands[i+1].ThresholdBytes
+		}
+		if end <= start {
+			continue
+		}
+		n := float64(end - start)
+		cost += common.Fixed64((n*ratio*float64(band.EntryToExitPrice) + n*(1-ratio)*float64(band.ExitToEntryPrice)) / TrafficUnit)
+	}
+
+	return cost
+}
+
+// MaxTrafficPrice returns the highest per TrafficUnit price in each direction
+// among base price and tiers.
+func (m *PricingModel) MaxTrafficPrice() (common.Fixed64, common.Fixed64) {
+	entryToExitPrice, exitToEntryPrice := m.EntryToExitPrice, m.ExitToEntryPrice
+	for _, tier := range m.Tiers {
+		if tier.EntryToExitPrice > entryToExitPrice {
+			entryToExitPrice = tier.EntryToExitPrice
+		}
+		if tier.ExitToEntryPrice > exitToEntryPrice {
+			exitToEntryPrice = tier.ExitToEntryPrice
+		}
+	}
+	return entryToExitPrice, exitToEntryPrice
+}
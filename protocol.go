@@ -0,0 +1,68 @@
+package tuna
+
+import (
+	"github.com/nknorg/tuna/pb"
+)
+
+// ProtocolVersion is the version of tuna protocol sent in connection handshake.
+// Peers that don't send a version are version 0 and support no capability.
+const ProtocolVersion = 2
+
+// ephemeralKeyProtocolVersion is the protocol version since which peers always
+// support ephemeral key exchange. As capabilities are not authenticated
+// before it, a peer of this version without it is refused as downgraded.
+const ephemeralKeyProtocolVersion = 2
+
+// Capabilities are bit flags sent in connection handshake. A feature is only
+// used on a connection when both peers support it, so that peers of different
+// versions still interoperate.
+const (
+	// Encrypted stream verifies the sequential nonce of each frame.
+	CapabilityNonceVerification uint64 = 1 << iota
+	// Control messages are read on payment stream in both directions.
+	CapabilityControlMessages
+	// Encrypt key is derived from an ephemeral key exchange signed by wallet
+	// keys in addition to wallet keys.
+	CapabilityEphemeralKey
+	// Encryption algo is picked from the ones supported by both sides.
+	CapabilityCipherNegotiation
+	// Encrypted frames and UDP packets carry the epoch of a key that is
+	// periodically ratcheted forward.
+	CapabilityRekey
+	// UDP packets have sequential nonces checked against a replay window, and
+	// UDP conn is bound to an address by a proof of encrypt key.
+	CapabilityUDPReplayProtection
+	// UDP packets have versioned header with flow ID allocated by entry.
+	CapabilityUDPFlowID
+	// Exit replies to encrypted UDP pings, and accepts UDP packets over a UDP
+	// stream of the TCP session when UDP is unreachable.
+	CapabilityUDPOverTCP
+	// Stream multiplexer version, keep-alive and frame size are negotiated.
+	CapabilityMuxNegotiation
+	// Service streams carry half-close, so that a TCP conn that closes its
+	// write direction still receives the response.
+	CapabilityHalfClose
+)
+
+// LocalCapabilities are the capabilities supported by this version.
+const LocalCapabilities = CapabilityNonceVerification | CapabilityControlMessages | CapabilityEphemeralKey | CapabilityCipherNegotiation | CapabilityRekey | CapabilityUDPReplayProtection | CapabilityUDPFlowID | CapabilityUDPOverTCP | CapabilityMuxNegotiation | CapabilityHalfClose
+
+// setProtocol sets protocol version and capabilities of local connection
+// metadata.
+func setProtocol(connMetadata *pb.ConnectionMetadata) {
+	connMetadata.ProtocolVersion = ProtocolVersion
+	connMetadata.Capabilities = LocalCapabilities
+}
+
+// negotiateCapabilities returns the capabilities supported by both local and
+// remote peer.
+func negotiateCapabilities(remoteConnMetadata *pb.ConnectionMetadata) uint64 {
+	if remoteConnMetadata == nil || remoteConnMetadata.ProtocolVersion == 0 {
+		return 0
+	}
+	return LocalCapabilities & remoteConnMetadata.Capabilities
+}
+
+func hasCapability(capabilities, capability uint64) bool {
+	return capabilities&capability != 0
+}
@@ -0,0 +1,109 @@
+package tuna
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	local := &pb.ConnectionMetadata{}
+	setProtocol(local)
+	if local.ProtocolVersion != ProtocolVersion || local.Capabilities != LocalCapabilities {
+		t.Fatalf("got version %d and capabilities %b", local.ProtocolVersion, local.Capabilities)
+	}
+
+	for _, tc := range []struct {
+		remote   *pb.ConnectionMetadata
+		expected uint64
+	}{
+		{nil, 0},
+		// old version peers send neither version nor capabilities
+		{&pb.ConnectionMetadata{}, 0},
+		// capabilities are ignored without version
+		{&pb.ConnectionMetadata{Capabilities: LocalCapabilities}, 0},
+		{local, LocalCapabilities},
+		{&pb.ConnectionMetadata{ProtocolVersion: ProtocolVersion, Capabilities: CapabilityNonceVerification | CapabilityHalfClose}, CapabilityNonceVerification | CapabilityHalfClose},
+		// unknown capabilities of newer peers are not used
+		{&pb.ConnectionMetadata{ProtocolVersion: ProtocolVersion + 1, Capabilities: 1<<63 | CapabilityRekey}, CapabilityRekey},
+	} {
+		if capabilities := negotiateCapabilities(tc.remote); capabilities != tc.expected {
+			t.Fatalf("remote %v got capabilities %b, expected %b", tc.remote, capabilities, tc.expected)
+		}
+	}
+}
+
+// testEncryptedRoundTrip writes to conn1 and conn2 and reads from the other.
+func testEncryptedRoundTrip(t *testing.T, conn1, conn2 net.Conn) {
+	for _, conns := range [][]net.Conn{{conn1, conn2}, {conn2, conn1}} {
+		go conns[0].Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conns[1], b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, []byte("hello")) {
+			t.Fatalf("got %q, expected hello", b)
+		}
+	}
+}
+
+func TestWrapConnProtocolNegotiation(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	conn, exitConn, remoteMetadata := newTestWrappedConnPair(t, entry, exit)
+
+	// nonce verification is enabled when both peers support it
+	connKey := string(append(exit.Wallet.PubKey(), remoteMetadata.Nonce...))
+	if capabilities := entry.getConnCapabilities(connKey); capabilities != LocalCapabilities {
+		t.Fatalf("got capabilities %b, expected %b", capabilities, LocalCapabilities)
+	}
+	connKey = string(append(entry.Wallet.PubKey(), remoteMetadata.Nonce...))
+	if capabilities := exit.getConnCapabilities(connKey); capabilities != LocalCapabilities {
+		t.Fatalf("got capabilities %b, expected %b", capabilities, LocalCapabilities)
+	}
+	testEncryptedRoundTrip(t, conn, exitConn)
+}
+
+func TestWrapConnOldPeer(t *testing.T) {
+	exit, oldEntry := newTestCommon(t), newTestCommon(t)
+	entryConn, exitConn := newTestConnPair(t)
+	defer entryConn.Close()
+	defer exitConn.Close()
+
+	results := acceptTestConn(exit, exitConn)
+
+	// entry of old version sends bare metadata, derives key from wallet keys
+	// only and doesn't verify nonce
+	remoteMetadata, err := readConnMetadata(entryConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeConnMetadata(entryConn, &pb.ConnectionMetadata{
+		EncryptionAlgo: pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+		PublicKey:      oldEntry.Wallet.PubKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedKey, err := oldEntry.getOrComputeSharedKey(exit.Wallet.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptKey := computeEncryptKey(remoteMetadata.Nonce, sharedKey[:])
+	conn, err := encryptConn(entryConn, encryptKey, pb.EncryptionAlgo_ENCRYPTION_AES_GCM, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	connKey := string(append(oldEntry.Wallet.PubKey(), remoteMetadata.Nonce...))
+	if capabilities := exit.getConnCapabilities(connKey); capabilities != 0 {
+		t.Fatalf("got capabilities %b with old peer, expected none", capabilities)
+	}
+	testEncryptedRoundTrip(t, conn, result.conn)
+}
@@ -0,0 +1,502 @@
+package tuna
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	stream "github.com/nknorg/encrypted-stream"
+	"github.com/nknorg/tuna/pb"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicALPN             = "tuna"
+	quicHandshakeTimeout = 10 * time.Second
+)
+
+// quicTLSConfig returns the TLS config of QUIC connection. Peer should have a
+// certificate of remotePublicKey if it's not empty, or any wallet key if it is.
+func (c *Common) quicTLSConfig(remotePublicKey []byte) (*tls.Config, error) {
+	cert, err := walletCertificate(c.Wallet.Seed())
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			publicKey, err := peerPublicKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if len(remotePublicKey) > 0 && !bytes.Equal(publicKey, remotePublicKey) {
+				return errPublicKeyMismatch
+			}
+			return nil
+		},
+	}, nil
+}
+
+// quicConfig returns the QUIC config with keep-alive of mux config.
+func (c *Common) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		MaxIdleTimeout:       time.Duration(c.muxConfig.KeepAliveTimeout) * time.Second,
+		KeepAlivePeriod:      time.Duration(c.muxConfig.KeepAliveInterval) * time.Second,
+		EnableDatagrams:      true,
+	}
+}
+
+// quicEncryption is the encryption and UDP header version negotiated in the
+// handshake of QUIC connection as over TCP. Streams and datagrams are
+// encrypted with it on top of TLS, so that service encryption is honored the
+// same as over TCP and UDP. Each stream and datagrams use keys derived from
+// the encrypt key, so that their nonces don't collide.
+type quicEncryption struct {
+	encryptKey       *[encryptKeySize]byte
+	encryptionAlgo   pb.EncryptionAlgo
+	verifyNonce      bool
+	rekey            *RekeyPolicy
+	udpHeaderVersion byte
+
+	overhead   int
+	encodeLock sync.Mutex
+	encoder    *stream.Encoder
+	decoder    *stream.Decoder
+}
+
+// newQUICEncryption returns the encryption of QUIC connection. Initiator is
+// whether local side dials the connection.
+func newQUICEncryption(encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, initiator bool, capabilities uint64, rekey *RekeyPolicy) (*quicEncryption, error) {
+	e := &quicEncryption{
+		encryptKey:       encryptKey,
+		encryptionAlgo:   encryptionAlgo,
+		verifyNonce:      hasCapability(capabilities, CapabilityNonceVerification),
+		rekey:            rekey,
+		udpHeaderVersion: udpHeaderVersionOf(capabilities),
+	}
+	cipher, err := newConnCipher(quicKey(encryptKey, "datagram", 0), encryptionAlgo, rekey)
+	if err != nil || cipher == nil {
+		return e, err
+	}
+	// QUIC drops replayed packets, so datagrams don't need a replay window
+	e.encoder, err = stream.NewEncoder(cipher, initiator, true)
+	if err != nil {
+		return nil, err
+	}
+	e.decoder, err = stream.NewDecoder(cipher, initiator, false, false)
+	if err != nil {
+		return nil, err
+	}
+	e.overhead = cipher.NonceSize() + cipher.MaxOverhead()
+	return e, nil
+}
+
+// quicKey derives the key of a stream or datagrams from encrypt key.
+func quicKey(encryptKey *[encryptKeySize]byte, label string, id uint64) *[encryptKeySize]byte {
+	b := make([]byte, 0, encryptKeySize+len(label)+8)
+	b = append(b, encryptKey[:]...)
+	b = append(b, label...)
+	b = binary.BigEndian.AppendUint64(b, id)
+	key := sha256.Sum256(b)
+	return &key
+}
+
+// wrapStream returns the stream of conn encrypted by its own key. Opener is
+// whether local side opens the stream.
+func (e *quicEncryption) wrapStream(s quic.Stream, conn quic.Connection, opener bool) (Stream, error) {
+	qs := &quicStream{Stream: s, conn: conn}
+	if e == nil || e.encryptionAlgo == pb.EncryptionAlgo_ENCRYPTION_NONE {
+		return qs, nil
+	}
+	return encryptConn(qs, quicKey(e.encryptKey, "stream", uint64(s.StreamID())), e.encryptionAlgo, opener, e.verifyNonce, e.rekey)
+}
+
+// encodeDatagram encrypts a UDP packet in wire format to be sent as datagram.
+func (e *quicEncryption) encodeDatagram(b []byte) ([]byte, error) {
+	if e == nil || e.encoder == nil {
+		return b, nil
+	}
+	e.encodeLock.Lock()
+	defer e.encodeLock.Unlock()
+	return e.encoder.Encode(make([]byte, len(b)+e.overhead), b)
+}
+
+// decodeDatagram decrypts a datagram into UDP packet in wire format. Datagrams
+// are received by one goroutine, so it's not locked.
+func (e *quicEncryption) decodeDatagram(b []byte) ([]byte, error) {
+	if e == nil || e.decoder == nil {
+		return b, nil
+	}
+	return e.decoder.Decode(make([]byte, len(b)), b)
+}
+
+// quicSession is a Session of QUIC connection, whose streams are QUIC streams.
+type quicSession struct {
+	conn       quic.Connection
+	encryption *quicEncryption
+	lock       sync.RWMutex
+	deadline   time.Time
+}
+
+func newQUICSession(conn quic.Connection, encryption *quicEncryption) *quicSession {
+	return &quicSession{conn: conn, encryption: encryption}
+}
+
+func (s *quicSession) context() (context.Context, context.CancelFunc) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), s.deadline)
+}
+
+func (s *quicSession) OpenStream() (Stream, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryption.wrapStream(stream, s.conn, true)
+}
+
+func (s *quicSession) AcceptStream() (Stream, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryption.wrapStream(stream, s.conn, false)
+}
+
+// SetDeadline sets the deadline of opening and accepting streams.
+func (s *quicSession) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.deadline = t
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *quicSession) IsClosed() bool {
+	select {
+	case <-s.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *quicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// quicStream is a QUIC stream that implements net.Conn.
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes both directions of stream, as Close of QUIC stream only closes
+// the write direction.
+func (s *quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// CloseWrite closes the write direction of stream only.
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// quicDatagramWriter sends UDP packets as QUIC datagrams.
+type quicDatagramWriter struct {
+	conn       quic.Connection
+	encryption *quicEncryption
+}
+
+func (w quicDatagramWriter) writeUDPPacket(b []byte) error {
+	b, err := w.encryption.encodeDatagram(b)
+	if err != nil {
+		return err
+	}
+	return w.conn.SendDatagram(b)
+}
+
+// quicHandshake exchanges connection metadata on the first stream of conn as
+// TCP conn does, and returns the metadata of peer and the encryption
+// negotiated for streams and datagrams of conn.
+func (c *Common) quicHandshake(conn quic.Connection, remotePublicKey []byte) (*pb.ConnectionMetadata, *quicEncryption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+
+	initiator := len(remotePublicKey) > 0
+	var stream quic.Stream
+	var err error
+	if initiator {
+		stream, err = conn.OpenStreamSync(ctx)
+	} else {
+		stream, err = conn.AcceptStream(ctx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedConn, connMetadata, err := c.wrapConn(&quicStream{Stream: stream, conn: conn}, remotePublicKey, nil)
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, nil, err
+	}
+	encryptedConn.Close()
+
+	connKey := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
+	encryptKey, ok := c.encryptKeys.Load(connKey)
+	if !ok {
+		return nil, nil, errors.New("no encrypt key of quic connection")
+	}
+	encryptionAlgo, _ := c.getConnEncryptionAlgo(connKey)
+	capabilities := c.getConnCapabilities(connKey)
+	encryption, err := newQUICEncryption(encryptKey.(*[encryptKeySize]byte), encryptionAlgo, initiator, capabilities, c.getRekeyPolicy(capabilities))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return connMetadata, encryption, nil
+}
+
+// GetQUICConn returns the QUIC connection to exit, or nil if it's not used.
+func (c *Common) GetQUICConn() quic.Connection {
+	c.RLock()
+	defer c.RUnlock()
+	return c.quicConn
+}
+
+func (c *Common) getQUICEncryption() *quicEncryption {
+	c.RLock()
+	defer c.RUnlock()
+	return c.quicEncryption
+}
+
+func (c *Common) setQUICConn(conn quic.Connection, encryption *quicEncryption) {
+	c.Lock()
+	defer c.Unlock()
+	c.quicConn = conn
+	c.quicEncryption = encryption
+}
+
+// dialQUIC connects to exit of metadata over QUIC, and closes TCP and UDP
+// conns to previous exit.
+func (c *Common) dialQUIC(metadata *pb.ServiceMetadata, remotePublicKey []byte) (*pb.ConnectionMetadata, error) {
+	tlsConfig, err := c.quicTLSConfig(remotePublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.QuicPort))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.DialTimeout)*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, c.quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	remoteMetadata, encryption, err := c.quicHandshake(conn, remotePublicKey)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	Close(c.GetUDPConn())
+	c.SetServerUDPConn(nil)
+	c.SetServerTCPConn(nil)
+	c.setQUICConn(conn, encryption)
+
+	log.Println("Connected to QUIC at", addr)
+
+	return remoteMetadata, nil
+}
+
+// closeQUICConn closes the QUIC connection to previous exit.
+func (c *Common) closeQUICConn() {
+	if conn := c.GetQUICConn(); conn != nil {
+		conn.CloseWithError(0, "")
+		c.setQUICConn(nil, nil)
+	}
+}
+
+// startQUICDatagrams sends and receives UDP packets as datagrams of conn, until
+// conn is closed or stopChan is closed.
+func (te *TunaEntry) startQUICDatagrams(conn quic.Connection, encryption *quicEncryption, stopChan <-chan struct{}) {
+	go func() {
+		for {
+			b, err := conn.ReceiveDatagram(conn.Context())
+			if err != nil {
+				return
+			}
+			n := len(b)
+			b, err = encryption.decodeDatagram(b)
+			if err == nil {
+				b, err = udpPacketFromWire(b, encryption.udpHeaderVersion)
+			}
+			if err != nil {
+				log.Println("Couldn't read udp packet:", err)
+				continue
+			}
+			te.udpReadChan <- b
+			atomic.AddUint64(&te.bytesExitToEntry, uint64(n))
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case data := <-te.udpWriteChan:
+				if len(data) < udpHeaderSize {
+					log.Println("empty udp packet to send")
+					continue
+				}
+				data, err := encryption.encodeDatagram(udpPacketToWire(data, encryption.udpHeaderVersion))
+				if err != nil {
+					log.Println("Couldn't encrypt udp packet:", err)
+					continue
+				}
+				te.rateLimiter.Wait(len(data))
+				err = conn.SendDatagram(data)
+				if err != nil {
+					log.Println("Couldn't send data to server:", err)
+					if conn.Context().Err() != nil {
+						return
+					}
+					continue
+				}
+				atomic.AddUint64(&te.bytesEntryToExit, uint64(len(data)))
+			case <-conn.Context().Done():
+				return
+			case <-te.udpCloseChan:
+				return
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// listenQUIC accepts QUIC connections from entries. Streams are handled as
+// those of TCP session, and datagrams as UDP packets.
+func (te *TunaExit) listenQUIC(port int) error {
+	tlsConfig, err := te.quicTLSConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	listener, err := quic.ListenAddr(":"+strconv.Itoa(port), tlsConfig, te.quicConfig())
+	if err != nil {
+		log.Println("Couldn't bind quic listener:", err)
+		return err
+	}
+	te.quicListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if te.IsClosed() {
+				return
+			}
+			if err != nil {
+				if errors.Is(err, quic.ErrServerClosed) {
+					te.Close()
+					return
+				}
+				log.Println("Couldn't accept quic connection:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			go func() {
+				err := te.handleQUICConn(conn)
+				if err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+func (te *TunaExit) handleQUICConn(conn quic.Connection) error {
+	sessionStart := time.Now()
+	defer conn.CloseWithError(0, "")
+
+	var rawCerts [][]byte
+	for _, cert := range conn.ConnectionState().TLS.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+	publicKey, err := peerPublicKey(rawCerts)
+	if err != nil {
+		return err
+	}
+
+	connMetadata, encryption, err := te.quicHandshake(conn, nil)
+	if err != nil {
+		return fmt.Errorf("quic handshake error: %v", err)
+	}
+	if !bytes.Equal(connMetadata.PublicKey, publicKey) {
+		return errPublicKeyMismatch
+	}
+
+	if te.udpFlows != nil {
+		go te.readQUICDatagrams(conn, encryption, string(append(connMetadata.PublicKey, connMetadata.Nonce...)))
+	}
+
+	te.handleSession(newQUICSession(conn, encryption), connMetadata, sessionStart)
+
+	return nil
+}
+
+// readQUICDatagrams reads UDP packets sent by entry of connKey as datagrams,
+// and sends packets of the same flows back as datagrams.
+func (te *TunaExit) readQUICDatagrams(conn quic.Connection, encryption *quicEncryption, connKey string) {
+	for {
+		b, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		n := len(b)
+		b, err = encryption.decodeDatagram(b)
+		if err == nil {
+			b, err = te.mapUDPFlow(b, connKey, encryption.udpHeaderVersion, nil, quicDatagramWriter{conn, encryption})
+		}
+		if err != nil {
+			log.Println("Couldn't read udp packet:", err)
+			continue
+		}
+		te.addSessionBytes(connKey, b[2], n, true)
+		te.udpReadChan <- b
+	}
+}
@@ -0,0 +1,197 @@
+package tuna
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/quic-go/quic-go"
+)
+
+type quicHandshakeResult struct {
+	conn       quic.Connection
+	encryption *quicEncryption
+	err        error
+}
+
+func TestQUICStreamAndDatagram(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	entry.DialTimeout = 5
+
+	tlsConfig, err := exit.quicTLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, exit.quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	results := make(chan quicHandshakeResult, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			results <- quicHandshakeResult{err: err}
+			return
+		}
+		_, encryption, err := exit.quicHandshake(conn, nil)
+		results <- quicHandshakeResult{conn, encryption, err}
+	}()
+
+	metadata := &pb.ServiceMetadata{Ip: "127.0.0.1", QuicPort: uint32(listener.Addr().(*net.UDPAddr).Port)}
+	if _, err := entry.dialQUIC(metadata, exit.Wallet.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+	defer entry.closeQUICConn()
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	defer result.conn.CloseWithError(0, "")
+	if result.encryption.encryptionAlgo != pb.EncryptionAlgo_ENCRYPTION_AES_GCM || result.encryption.udpHeaderVersion != udpHeaderVersion {
+		t.Fatalf("unexpected quic encryption %v with udp header version %d", result.encryption.encryptionAlgo, result.encryption.udpHeaderVersion)
+	}
+
+	// streams
+	entrySession := newQUICSession(entry.GetQUICConn(), entry.getQUICEncryption())
+	exitSession := newQUICSession(result.conn, result.encryption)
+	for i := 0; i < 2; i++ {
+		entryStream, err := entrySession.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := entryStream.(*quicStream); ok {
+			t.Fatal("stream should be encrypted by negotiated encryption algo")
+		}
+		if _, err := entryStream.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		exitStream, err := exitSession.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(exitStream, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, []byte("hello")) {
+			t.Fatalf("got %q, expected hello", b)
+		}
+		if _, err := exitStream.Write([]byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(entryStream, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, []byte("world")) {
+			t.Fatalf("got %q, expected world", b)
+		}
+		entryStream.Close()
+		exitStream.Close()
+	}
+
+	// datagrams
+	te := &TunaEntry{Common: entry}
+	te.udpReadChan = make(chan []byte, 1)
+	te.udpWriteChan = make(chan []byte, 1)
+	te.udpCloseChan = make(chan struct{})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	te.startQUICDatagrams(entry.GetQUICConn(), entry.getQUICEncryption(), stopChan)
+
+	exitTE := &TunaExit{Common: exit}
+	exitTE.udpFlows = newUDPFlowTable(time.Minute, maxExitUDPFlowID)
+	exitTE.udpReadChan = make(chan []byte, 1)
+	connKey := string(append(entry.Wallet.PubKey(), []byte("nonce")...))
+	go exitTE.readQUICDatagrams(result.conn, result.encryption, connKey)
+
+	te.udpWriteChan <- newUDPPacket(7, 0, 0, []byte("ping"))
+	var packet []byte
+	select {
+	case packet = <-exitTE.udpReadChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit should receive datagram")
+	}
+	if !bytes.Equal(udpPacketPayload(packet), []byte("ping")) {
+		t.Fatalf("got %q, expected ping", udpPacketPayload(packet))
+	}
+
+	// exit replies by the writer of flow, as UDP writer does
+	flow, ok := exitTE.udpFlows.get(udpPacketFlowID(packet))
+	if !ok {
+		t.Fatal("exit should map flow of datagram")
+	}
+	_, writer := flow.path()
+	reply := newUDPPacket(udpPacketFlowID(packet), 0, 0, []byte("pong"))
+	setUDPPacketFlowID(reply, flow.remoteID)
+	if err := writer.writeUDPPacket(udpPacketToWire(reply, flow.version)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case packet = <-te.udpReadChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("entry should receive datagram")
+	}
+	if udpPacketFlowID(packet) != 7 || !bytes.Equal(udpPacketPayload(packet), []byte("pong")) {
+		t.Fatalf("got flow %d payload %q, expected flow 7 payload pong", udpPacketFlowID(packet), udpPacketPayload(packet))
+	}
+}
+
+func TestQUICFallbackToTCP(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	entry.DialTimeout = 1
+	entry.preferQUIC = true
+	entry.OnConnect = NewOnConnect(1, nil)
+	entry.Service = &Service{}
+
+	// nothing listens on QUIC port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quicPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+	udpConn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	results := make(chan wrapConnResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			results <- wrapConnResult{nil, err}
+			return
+		}
+		conn, _, err = exit.wrapConn(conn, nil, nil)
+		results <- wrapConnResult{conn, err}
+	}()
+
+	entry.SetMetadata(&pb.ServiceMetadata{
+		Ip:       "127.0.0.1",
+		TcpPort:  uint32(listener.Addr().(*net.TCPAddr).Port),
+		QuicPort: uint32(quicPort),
+	})
+	if err := entry.UpdateServerConn(exit.Wallet.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	defer result.conn.Close()
+	defer Close(entry.GetTCPConn())
+
+	if entry.GetQUICConn() != nil {
+		t.Fatal("quic conn should not be used when quic is unreachable")
+	}
+	if entry.GetTCPConn() == nil {
+		t.Fatal("entry should fall back to tcp")
+	}
+}
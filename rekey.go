@@ -0,0 +1,227 @@
+package tuna
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	stream "github.com/nknorg/encrypted-stream"
+	"github.com/nknorg/tuna/pb"
+)
+
+const (
+	rekeyEpochSize = 4
+	// maxRekeySkip is the max number of epochs a receiver ratchets forward at
+	// once, in case all packets of some epochs are lost.
+	maxRekeySkip = 16
+	// rekeyRatchetPrefix is hashed with the key of an epoch to derive the key
+	// of the next epoch.
+	rekeyRatchetPrefix = "tuna-rekey"
+)
+
+var errRekeyEpoch = errors.New("invalid rekey epoch")
+
+// RekeyPolicy decides when the sender of an encrypted conn switches to the key
+// of next epoch. Zero values disable the corresponding trigger.
+type RekeyPolicy struct {
+	Bytes    uint64        // rekey after this many plaintext bytes are sent
+	Interval time.Duration // rekey after this much time since last rekey
+}
+
+func newRekeyPolicy(bytes int64, interval int32) RekeyPolicy {
+	policy := RekeyPolicy{}
+	if bytes > 0 {
+		policy.Bytes = uint64(bytes)
+	}
+	if interval > 0 {
+		policy.Interval = time.Duration(interval) * time.Second
+	}
+	return policy
+}
+
+// nextEpochKey derives the key of next epoch. Keys can only be derived forward,
+// so an old key can't be recovered from a leaked newer one.
+func nextEpochKey(key *[encryptKeySize]byte) *[encryptKeySize]byte {
+	next := sha256.Sum256(append([]byte(rekeyRatchetPrefix), key[:]...))
+	return &next
+}
+
+func clearKey(key *[encryptKeySize]byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+// rekeyCipher wraps the cipher of an encryption algo and prefixes each
+// ciphertext with the epoch of key used to encrypt it. Each direction starts
+// from the negotiated encrypt key and ratchets forward independently. The
+// receiver keeps the key of previous epoch, so that packets sent before a
+// switch but delivered after it can still be decrypted.
+type rekeyCipher struct {
+	algo   pb.EncryptionAlgo
+	policy RekeyPolicy
+
+	sendLock   sync.Mutex
+	sendEpoch  uint32
+	sendKey    *[encryptKeySize]byte
+	sendCipher stream.Cipher
+	sentBytes  uint64
+	sendSince  time.Time
+
+	recvLock       sync.Mutex
+	recvEpoch      uint32
+	recvKey        *[encryptKeySize]byte
+	recvCipher     stream.Cipher
+	prevRecvKey    *[encryptKeySize]byte
+	prevRecvCipher stream.Cipher
+}
+
+// newRekeyCipher returns a rekeyCipher of encryption algo, or nil if algo is
+// none.
+func newRekeyCipher(encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, policy RekeyPolicy) (stream.Cipher, error) {
+	sendKey, recvKey := new([encryptKeySize]byte), new([encryptKeySize]byte)
+	*sendKey, *recvKey = *encryptKey, *encryptKey
+	sendCipher, err := newCipher(sendKey, encryptionAlgo)
+	if err != nil || sendCipher == nil {
+		return nil, err
+	}
+	recvCipher, err := newCipher(recvKey, encryptionAlgo)
+	if err != nil {
+		return nil, err
+	}
+	return &rekeyCipher{
+		algo:       encryptionAlgo,
+		policy:     policy,
+		sendKey:    sendKey,
+		sendCipher: sendCipher,
+		sendSince:  time.Now(),
+		recvKey:    recvKey,
+		recvCipher: recvCipher,
+	}, nil
+}
+
+func (c *rekeyCipher) shouldRekey() bool {
+	if c.policy.Bytes > 0 && c.sentBytes >= c.policy.Bytes {
+		return true
+	}
+	if c.policy.Interval > 0 && time.Since(c.sendSince) >= c.policy.Interval {
+		return true
+	}
+	return false
+}
+
+// rekeySend switches sender to the key of next epoch. Should be called with
+// sendLock held.
+func (c *rekeyCipher) rekeySend() error {
+	key := nextEpochKey(c.sendKey)
+	cipher, err := newCipher(key, c.algo)
+	if err != nil {
+		return err
+	}
+	clearKey(c.sendKey)
+	c.sendEpoch++
+	c.sendKey = key
+	c.sendCipher = cipher
+	c.sentBytes = 0
+	c.sendSince = time.Now()
+	return nil
+}
+
+// Encrypt implements stream.Cipher.
+func (c *rekeyCipher) Encrypt(ciphertext, plaintext, nonce []byte) ([]byte, error) {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	if c.shouldRekey() {
+		if err := c.rekeySend(); err != nil {
+			return nil, err
+		}
+	}
+
+	binary.BigEndian.PutUint32(ciphertext[:rekeyEpochSize], c.sendEpoch)
+	encrypted, err := c.sendCipher.Encrypt(ciphertext[rekeyEpochSize:], plaintext, nonce)
+	if err != nil {
+		return nil, err
+	}
+	c.sentBytes += uint64(len(plaintext))
+
+	return ciphertext[:rekeyEpochSize+len(encrypted)], nil
+}
+
+// Decrypt implements stream.Cipher.
+func (c *rekeyCipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte, error) {
+	if len(ciphertext) < rekeyEpochSize {
+		return nil, fmt.Errorf("invalid ciphertext size %d", len(ciphertext))
+	}
+	epoch := binary.BigEndian.Uint32(ciphertext[:rekeyEpochSize])
+	ciphertext = ciphertext[rekeyEpochSize:]
+
+	c.recvLock.Lock()
+	defer c.recvLock.Unlock()
+
+	switch {
+	case epoch == c.recvEpoch:
+		return c.recvCipher.Decrypt(plaintext, ciphertext, nonce)
+	case epoch+1 == c.recvEpoch && c.prevRecvCipher != nil:
+		return c.prevRecvCipher.Decrypt(plaintext, ciphertext, nonce)
+	case epoch > c.recvEpoch && epoch-c.recvEpoch <= maxRekeySkip:
+	default:
+		return nil, errRekeyEpoch
+	}
+
+	// Ratchet forward tentatively, and only commit if the packet is
+	// authenticated by the new key, so that forged epochs can't desync us.
+	prevKey, prevCipher := c.recvKey, c.recvCipher
+	key := c.recvKey
+	var derived []*[encryptKeySize]byte
+	for e := c.recvEpoch; e < epoch; e++ {
+		key = nextEpochKey(key)
+		derived = append(derived, key)
+	}
+	cipher, err := newCipher(key, c.algo)
+	if err != nil {
+		return nil, err
+	}
+	if len(derived) > 1 {
+		prevKey = derived[len(derived)-2]
+		prevCipher, err = newCipher(prevKey, c.algo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err = cipher.Decrypt(plaintext, ciphertext, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range derived[:len(derived)-1] {
+		if k != prevKey {
+			clearKey(k)
+		}
+	}
+	if c.prevRecvKey != nil {
+		clearKey(c.prevRecvKey)
+	}
+	if prevKey != c.recvKey {
+		clearKey(c.recvKey)
+	}
+	c.prevRecvKey, c.prevRecvCipher = prevKey, prevCipher
+	c.recvKey, c.recvCipher = key, cipher
+	c.recvEpoch = epoch
+
+	return plaintext, nil
+}
+
+// MaxOverhead implements stream.Cipher.
+func (c *rekeyCipher) MaxOverhead() int {
+	return rekeyEpochSize + c.sendCipher.MaxOverhead()
+}
+
+// NonceSize implements stream.Cipher.
+func (c *rekeyCipher) NonceSize() int {
+	return c.sendCipher.NonceSize()
+}
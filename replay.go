@@ -0,0 +1,243 @@
+package tuna
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn/v2/util"
+	"github.com/nknorg/tuna/pb"
+	"github.com/patrickmn/go-cache"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// replayWindowSize is the number of packets before the highest one
+	// received that are still accepted if they arrive out of order.
+	replayWindowSize = 1024
+	// udpBindPrefix is prepended to the message of UDP bind proof, so that the
+	// proof can't be used for other purpose.
+	udpBindPrefix = "tuna-udp-bind"
+	// udpBindChallengeInterval is how often UDP bind challenges change, a
+	// challenge is accepted until the end of next interval.
+	udpBindChallengeInterval = time.Minute
+	udpBindChallengeSize     = 16
+	// udpBindSequenceTTL is how long the sequence of the latest UDP bind of a
+	// conn is kept. A bind packet replayed after it fails challenge check, as
+	// challenge has expired.
+	udpBindSequenceTTL = 2 * udpBindChallengeInterval
+	// udpBindReadyTimeout is how long UDP metadata waits for TCP handshake of
+	// its conn to finish before it's dropped.
+	udpBindReadyTimeout = 10 * time.Second
+	// maxPendingUDPBinds is the max number of UDP metadata waiting for TCP
+	// handshake of their conns at the same time.
+	maxPendingUDPBinds = 64
+)
+
+var (
+	errReplayedPacket          = errors.New("replayed udp packet")
+	errInvalidUDPBind          = errors.New("invalid udp bind proof")
+	errInvalidUDPBindChallenge = errors.New("invalid udp bind challenge")
+	errUDPEncryptionAlgo       = errors.New("udp encryption algo differs from the negotiated one")
+)
+
+// replayWindow is a sliding window of sequence numbers of received packets. A
+// packet is rejected if its sequence is received before or is too old to be
+// tracked by window.
+type replayWindow struct {
+	lock    sync.Mutex
+	highest uint64
+	started bool
+	bitmap  [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) bit(seq uint64) (int, uint64) {
+	i := seq % replayWindowSize
+	return int(i / 64), 1 << (i % 64)
+}
+
+// check returns whether seq has not been received and marks it as received.
+// It should only be called after the packet is authenticated.
+func (w *replayWindow) check(seq uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.started || seq > w.highest {
+		if !w.started || seq-w.highest >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for s := w.highest + 1; s < seq; s++ {
+				i, mask := w.bit(s)
+				w.bitmap[i] &^= mask
+			}
+		}
+		w.highest = seq
+		w.started = true
+		i, mask := w.bit(seq)
+		w.bitmap[i] |= mask
+		return true
+	}
+
+	if w.highest-seq >= replayWindowSize {
+		return false
+	}
+	i, mask := w.bit(seq)
+	if w.bitmap[i]&mask != 0 {
+		return false
+	}
+	w.bitmap[i] |= mask
+	return true
+}
+
+// nonceSequence returns the sequence number of a sequential nonce, which is
+// stored in its last 8 bytes.
+func nonceSequence(nonce []byte) uint64 {
+	if len(nonce) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+}
+
+// computeUDPBindProof proves that the sender of UDP metadata has the encrypt
+// key of conn, and receives packets at the address that challenge is sent to.
+// Sequence should increase every time a UDP conn is bound, so that a captured
+// metadata packet can't be replayed, and challenge is bound to the observed
+// source address, so that the proof is useless from another address. The
+// encryption algo is covered so that it can't be changed on the way.
+func computeUDPBindProof(encryptKey *[encryptKeySize]byte, connKey string, encryptionAlgo pb.EncryptionAlgo, sequence uint64, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, encryptKey[:])
+	mac.Write([]byte(udpBindPrefix))
+	mac.Write([]byte(connKey))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(encryptionAlgo))
+	mac.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], sequence)
+	mac.Write(b[:])
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// udpBinder issues challenges of UDP bind and tracks the latest UDP bind
+// sequence accepted for each conn until challenges it could be replayed with
+// expire. Challenges are derived from a random secret so that they don't need
+// to be stored.
+type udpBinder struct {
+	secret []byte
+
+	lock      sync.Mutex
+	sequences *cache.Cache
+}
+
+func newUDPBinder() *udpBinder {
+	return &udpBinder{
+		secret:    util.RandomBytes(sha256.Size),
+		sequences: cache.New(udpBindSequenceTTL, udpBindChallengeInterval),
+	}
+}
+
+func (b *udpBinder) challengeAt(addr *net.UDPAddr, connKey string, epoch int64) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(addr.String()))
+	mac.Write([]byte(connKey))
+	var e [8]byte
+	binary.BigEndian.PutUint64(e[:], uint64(epoch))
+	mac.Write(e[:])
+	return mac.Sum(nil)[:udpBindChallengeSize]
+}
+
+// challenge returns the challenge of UDP bind from addr for conn, which
+// changes every udpBindChallengeInterval.
+func (b *udpBinder) challenge(addr *net.UDPAddr, connKey string) []byte {
+	return b.challengeAt(addr, connKey, time.Now().Unix()/int64(udpBindChallengeInterval/time.Second))
+}
+
+// checkChallenge returns whether challenge is issued to addr for conn within
+// the current or previous interval.
+func (b *udpBinder) checkChallenge(addr *net.UDPAddr, connKey string, challenge []byte) bool {
+	epoch := time.Now().Unix() / int64(udpBindChallengeInterval/time.Second)
+	return hmac.Equal(challenge, b.challengeAt(addr, connKey, epoch)) || hmac.Equal(challenge, b.challengeAt(addr, connKey, epoch-1))
+}
+
+// verify checks the challenge and bind proof of UDP metadata from addr, and
+// that its sequence is newer than the one accepted last time for the same
+// conn. Encryption algo should be the one negotiated in TCP handshake.
+func (b *udpBinder) verify(addr *net.UDPAddr, connKey string, encryptKey *[encryptKeySize]byte, encryptionAlgo pb.EncryptionAlgo, sequence uint64, challenge, proof []byte) error {
+	if !b.checkChallenge(addr, connKey, challenge) {
+		return errInvalidUDPBindChallenge
+	}
+	if !hmac.Equal(proof, computeUDPBindProof(encryptKey, connKey, encryptionAlgo, sequence, challenge)) {
+		return errInvalidUDPBind
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if last, ok := b.sequences.Get(connKey); ok && sequence <= last.(uint64) {
+		return errReplayedPacket
+	}
+	b.sequences.SetDefault(connKey, sequence)
+	return nil
+}
+
+// udpBindRequest is the UDP metadata client sends to bind its UDP conn, which
+// is sent again with proof when server replies with a challenge. Challenge is
+// only sent by server with replay protection.
+type udpBindRequest struct {
+	conn       UDPConn // raw conn, as metadata is not encrypted
+	metadata   *pb.ConnectionMetadata
+	encryptKey *[encryptKeySize]byte
+	connKey    string
+}
+
+// isUDPConnMetadata returns whether b is unencrypted UDP metadata, such as UDP
+// bind metadata and challenge.
+func isUDPConnMetadata(b []byte) bool {
+	if len(b) <= PrefixLen || !bytes.Equal(b[:PrefixLen], []byte{PrefixLen - 1: 0}) {
+		return false
+	}
+	_, err := parseUDPConnMetadata(b[PrefixLen:])
+	return err == nil
+}
+
+// isUDPBindChallenge returns the challenge if b is a UDP bind challenge from
+// server.
+func isUDPBindChallenge(b []byte) []byte {
+	if len(b) <= PrefixLen || !bytes.Equal(b[:PrefixLen], []byte{PrefixLen - 1: 0}) {
+		return nil
+	}
+	connMetadata, err := parseUDPConnMetadata(b[PrefixLen:])
+	if err != nil || len(connMetadata.PublicKey) > 0 {
+		return nil
+	}
+	return connMetadata.UdpBindChallenge
+}
+
+// send sends bind metadata without proof, which starts bind handshake.
+func (r *udpBindRequest) send() error {
+	return writeUDPConnMetadata(r.conn, nil, r.metadata)
+}
+
+// answer sends bind metadata again with a new sequence and the proof over
+// challenge.
+func (r *udpBindRequest) answer(challenge []byte) error {
+	metadata := proto.Clone(r.metadata).(*pb.ConnectionMetadata)
+	metadata.UdpBindSequence = uint64(time.Now().UnixNano())
+	metadata.UdpBindChallenge = challenge
+	metadata.UdpBindProof = computeUDPBindProof(r.encryptKey, r.connKey, metadata.EncryptionAlgo, metadata.UdpBindSequence, challenge)
+	return writeUDPConnMetadata(r.conn, nil, metadata)
+}
+
+// replyUDPBindChallenge sends the challenge of UDP bind to addr, which client
+// should answer to bind its UDP conn.
+func replyUDPBindChallenge(conn UDPConn, binder *udpBinder, addr *net.UDPAddr, connKey string) {
+	err := writeUDPConnMetadata(conn, addr, &pb.ConnectionMetadata{UdpBindChallenge: binder.challenge(addr, connKey)})
+	if err != nil {
+		log.Println("Couldn't send udp bind challenge:", err)
+	}
+}
@@ -0,0 +1,160 @@
+package tuna
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/patrickmn/go-cache"
+)
+
+func TestUDPBinder(t *testing.T) {
+	binder := newUDPBinder()
+	key := new([encryptKeySize]byte)
+	copy(key[:], "encrypt key")
+	connKey := "conn"
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	otherAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	challenge := binder.challenge(addr, connKey)
+	if !binder.checkChallenge(addr, connKey, challenge) {
+		t.Fatal("challenge should be valid for the address it's issued to")
+	}
+	if binder.checkChallenge(otherAddr, connKey, challenge) || binder.checkChallenge(addr, "other", challenge) {
+		t.Fatal("challenge should only be valid for its address and conn")
+	}
+
+	algo := pb.EncryptionAlgo_ENCRYPTION_AES_GCM
+	proof := computeUDPBindProof(key, connKey, algo, 1, challenge)
+	if err := binder.verify(otherAddr, connKey, key, algo, 1, challenge, proof); err != errInvalidUDPBindChallenge {
+		t.Fatalf("proof sent from another address should be rejected, got %v", err)
+	}
+	if err := binder.verify(addr, connKey, key, algo, 1, binder.challenge(addr, "other"), proof); err != errInvalidUDPBindChallenge {
+		t.Fatalf("challenge of another conn should be rejected, got %v", err)
+	}
+	if err := binder.verify(addr, connKey, key, algo, 2, challenge, proof); err != errInvalidUDPBind {
+		t.Fatalf("proof of another sequence should be rejected, got %v", err)
+	}
+	if err := binder.verify(addr, connKey, key, pb.EncryptionAlgo_ENCRYPTION_NONE, 1, challenge, proof); err != errInvalidUDPBind {
+		t.Fatalf("proof of another encryption algo should be rejected, got %v", err)
+	}
+	if err := binder.verify(addr, connKey, key, algo, 1, challenge, proof); err != nil {
+		t.Fatal(err)
+	}
+	if err := binder.verify(addr, connKey, key, algo, 1, challenge, proof); err != errReplayedPacket {
+		t.Fatalf("replayed proof should be rejected, got %v", err)
+	}
+
+	// sequence is forgotten once challenges it could be replayed with expire
+	if binder.sequences.ItemCount() != 1 {
+		t.Fatalf("%d sequences tracked, expected 1", binder.sequences.ItemCount())
+	}
+	binder.sequences = cache.New(10*time.Millisecond, time.Millisecond)
+	if err := binder.verify(addr, connKey, key, algo, 2, challenge, computeUDPBindProof(key, connKey, algo, 2, challenge)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if binder.sequences.ItemCount() != 0 {
+		t.Fatalf("%d sequences tracked after expiration, expected none", binder.sequences.ItemCount())
+	}
+
+	// a new binder doesn't accept challenges issued by another one
+	if newUDPBinder().checkChallenge(addr, connKey, challenge) {
+		t.Fatal("challenge should be bound to binder secret")
+	}
+}
+
+func TestIsUDPBindChallenge(t *testing.T) {
+	conn := &testUDPConn{}
+	binder := newUDPBinder()
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	replyUDPBindChallenge(conn, binder, addr, "conn")
+	if len(conn.written) != 1 {
+		t.Fatalf("%d packets written, expected 1", len(conn.written))
+	}
+	challenge := isUDPBindChallenge(conn.written[0])
+	if !binder.checkChallenge(addr, "conn", challenge) {
+		t.Fatal("reply should carry the challenge of address")
+	}
+
+	request := &udpBindRequest{
+		conn:       conn,
+		metadata:   &pb.ConnectionMetadata{PublicKey: []byte("client"), EncryptionAlgo: pb.EncryptionAlgo_ENCRYPTION_AES_GCM},
+		encryptKey: new([encryptKeySize]byte),
+		connKey:    "conn",
+	}
+	if err := request.answer(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if isUDPBindChallenge(conn.written[1]) != nil {
+		t.Fatal("answer of client should not be taken as challenge")
+	}
+	answer, err := parseUDPConnMetadata(conn.written[1][PrefixLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = binder.verify(addr, "conn", request.encryptKey, pb.EncryptionAlgo_ENCRYPTION_AES_GCM, answer.UdpBindSequence, answer.UdpBindChallenge, answer.UdpBindProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddCodecReusesKey(t *testing.T) {
+	ec := &EncryptUDPConn{}
+	key := new([encryptKeySize]byte)
+	copy(key[:], "encrypt key")
+	algo := pb.EncryptionAlgo_ENCRYPTION_AES_GCM
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	otherAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	if err := ec.AddCodec(addr, key, algo, false, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	encoder, _ := ec.encoders.Load(addr.String())
+	decoder, _ := ec.decoders.Load(addr.String())
+
+	// binding again, from the same or another address, should keep nonces and
+	// replay window of the key
+	for _, a := range []*net.UDPAddr{addr, otherAddr} {
+		if err := ec.AddCodec(a, key, algo, false, nil, true); err != nil {
+			t.Fatal(err)
+		}
+		if e, _ := ec.encoders.Load(a.String()); e != encoder {
+			t.Fatal("encoder of the same key should be reused")
+		}
+		if d, _ := ec.decoders.Load(a.String()); d != decoder {
+			t.Fatal("decoder of the same key should be reused")
+		}
+	}
+
+	if err := ec.AddCodec(addr, key, pb.EncryptionAlgo_ENCRYPTION_NONE, false, nil, true); err == nil {
+		t.Fatal("codec of the same key with another encryption algo should be rejected")
+	}
+}
+
+func TestWaitConnReady(t *testing.T) {
+	c := &Common{}
+	if c.waitConnReady("unknown", 0) {
+		t.Fatal("unknown conn should not be ready")
+	}
+	if c.waitConnReady("unknown", 10*time.Millisecond) {
+		t.Fatal("unknown conn should not be ready after timeout")
+	}
+	if _, ok := c.connReadyChan.Load("unknown"); ok {
+		t.Fatal("ready channel of unknown conn should be removed after timeout")
+	}
+
+	rc, _ := c.connReadyChan.LoadOrStore("conn", make(chan struct{}, 1))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rc.(chan struct{}) <- struct{}{}
+	}()
+	if !c.waitConnReady("conn", time.Second) {
+		t.Fatal("conn should be ready once handshake is finished")
+	}
+	// metadata is received again when client answers bind challenge
+	if !c.waitConnReady("conn", 0) {
+		t.Fatal("conn should stay ready")
+	}
+}
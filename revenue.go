@@ -0,0 +1,536 @@
+package tuna
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/api/common/errcode"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/nkn/v2/program"
+	"github.com/nknorg/nkn/v2/transaction"
+	"github.com/nknorg/tuna/storage"
+)
+
+// Beneficiary is a wallet address that receives a share of exit revenue.
+// Shares are relative to the sum of shares of all beneficiaries, e.g. 70 and
+// 30 for a 70/30 split.
+type Beneficiary struct {
+	Address string  `json:"address"`
+	Share   float64 `json:"share"`
+}
+
+func validateBeneficiaries(beneficiaries []Beneficiary) error {
+	for _, b := range beneficiaries {
+		err := nkn.VerifyWalletAddress(b.Address)
+		if err != nil {
+			return fmt.Errorf("invalid beneficiary address %s: %v", b.Address, err)
+		}
+		if b.Share <= 0 {
+			return fmt.Errorf("share of beneficiary %s should be positive", b.Address)
+		}
+	}
+	return nil
+}
+
+// splitAmount splits amount by shares of beneficiaries. The rounding remainder
+// goes to the last beneficiary so that portions add up to amount.
+func splitAmount(amount common.Fixed64, beneficiaries []Beneficiary) []common.Fixed64 {
+	var totalShare float64
+	for _, b := range beneficiaries {
+		totalShare += b.Share
+	}
+	portions := make([]common.Fixed64, len(beneficiaries))
+	if totalShare <= 0 {
+		return portions
+	}
+	remaining := amount
+	for i, b := range beneficiaries {
+		if i == len(beneficiaries)-1 {
+			portions[i] = remaining
+			break
+		}
+		portions[i] = common.Fixed64(float64(amount) * b.Share / totalShare)
+		remaining -= portions[i]
+	}
+	return portions
+}
+
+// getBeneficiaries returns the revenue split of a service, which is the one of
+// exit if service doesn't have its own.
+func (te *TunaExit) getBeneficiaries(service string) []Beneficiary {
+	if serviceInfo, ok := te.config.Services[service]; ok && len(serviceInfo.Beneficiaries) > 0 {
+		return serviceInfo.Beneficiaries
+	}
+	return te.config.Beneficiaries
+}
+
+// appendShares records the portion of each beneficiary of an earning record.
+func (c *Common) appendShares(record *storage.UsageRecord, beneficiaries []Beneficiary) {
+	amount, err := common.StringToFixed64(record.Amount)
+	if err != nil || amount <= 0 {
+		return
+	}
+	for i, portion := range splitAmount(amount, beneficiaries) {
+		c.appendLedger(&storage.UsageRecord{
+			SessionStart: record.SessionStart,
+			Role:         storage.LedgerRoleShare,
+			PeerKey:      record.PeerKey,
+			Recipient:    beneficiaries[i].Address,
+			Service:      record.Service,
+			Amount:       portion.String(),
+			TxnID:        record.TxnID,
+			Channel:      record.Channel,
+		})
+	}
+}
+
+// startForwardRevenue transfers the allocated but not yet forwarded revenue to
+// each beneficiary every RevenueForwardInterval until exit is closed.
+func (te *TunaExit) startForwardRevenue() {
+	rf := newRevenueForwarder(te.ledger)
+	for {
+		select {
+		case <-time.After(time.Duration(te.config.RevenueForwardInterval) * time.Second):
+		case <-te.closeChan:
+			return
+		}
+		err := te.forwardRevenue(rf)
+		if err != nil {
+			log.Println("Couldn't forward revenue:", err)
+		}
+	}
+}
+
+type revenueRPCClient interface {
+	PubKey() []byte
+	SignTransaction(tx *transaction.Transaction) error
+	Balance() (*nkn.Amount, error)
+	GetNonce(txPool bool) (int64, error)
+	SendRawTransaction(txn *transaction.Transaction) (string, error)
+	IsTxnOnChain(txnID string) (bool, error)
+}
+
+// exitRevenueRPCClient is the RPC client of exit wallet that also looks up
+// txns on chain.
+type exitRevenueRPCClient struct {
+	*nkn.MultiClient
+	rpcConfig *nkn.RPCConfig
+}
+
+// IsTxnOnChain returns whether a txn is packed in a block.
+func (c *exitRevenueRPCClient) IsTxnOnChain(txnID string) (bool, error) {
+	var txn map[string]interface{}
+	err := nkn.RPCCall(context.Background(), "gettransaction", map[string]interface{}{"hash": txnID}, &txn, c.rpcConfig)
+	if err != nil {
+		if rpcErrorCode(err) == errcode.UNKNOWN_TRANSACTION {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// rpcErrorCode returns the code of an RPC error, or errcode.SUCCESS if err
+// has no code.
+func rpcErrorCode(err error) errcode.ErrCode {
+	if e, ok := err.(nkn.ErrorWithCode); ok {
+		return errcode.ErrCode(e.Code())
+	}
+	return errcode.SUCCESS
+}
+
+func (te *TunaExit) forwardRevenue(rf *revenueForwarder) error {
+	if rf.ledger == nil {
+		return errors.New("ledger is not enabled")
+	}
+
+	minAmount, err := common.StringToFixed64(te.config.MinRevenueForwardAmount)
+	if err != nil {
+		return err
+	}
+
+	var fee common.Fixed64
+	if len(te.config.RevenueForwardFee) > 0 {
+		fee, err = common.StringToFixed64(te.config.RevenueForwardFee)
+		if err != nil {
+			return err
+		}
+	}
+
+	rpcConfig := nkn.GetDefaultRPCConfig()
+	if len(te.config.SeedRPCServerAddr) > 0 {
+		rpcConfig.SeedRPCServerAddr = nkn.NewStringArray(te.config.SeedRPCServerAddr...)
+	}
+	rpcConfig.HttpDialContext = te.config.HttpDialContext
+	rpcClient := &exitRevenueRPCClient{MultiClient: te.Client, rpcConfig: rpcConfig}
+
+	return rf.forward(rpcClient, te.Wallet.Address(), minAmount, fee)
+}
+
+// revenueForwarder forwards revenue shares to beneficiaries once the claim
+// txns covering them are on chain. It keeps what it has read from ledger, so
+// each run only reads records appended since the previous one.
+type revenueForwarder struct {
+	ledger *storage.Ledger
+	offset int64
+
+	channels  map[string]*revenueChannel
+	allocated map[string]common.Fixed64 // settled shares of each recipient
+	forwards  []*storage.UsageRecord
+}
+
+// revenueChannel is the revenue of a nanopay channel not yet settled.
+type revenueChannel struct {
+	shares  []*storage.UsageRecord // in ledger order
+	settled int                    // number of shares settled before shares
+	flushed []flushedClaim
+}
+
+// flushedClaim is a claim txn sent to chain, which covers the shares of its
+// channel written before it.
+type flushedClaim struct {
+	txnID  string
+	shares int
+}
+
+func newRevenueForwarder(ledger *storage.Ledger) *revenueForwarder {
+	return &revenueForwarder{
+		ledger:    ledger,
+		channels:  make(map[string]*revenueChannel),
+		allocated: make(map[string]common.Fixed64),
+	}
+}
+
+func (rf *revenueForwarder) channel(channel string) *revenueChannel {
+	ch, ok := rf.channels[channel]
+	if !ok {
+		ch = &revenueChannel{}
+		rf.channels[channel] = ch
+	}
+	return ch
+}
+
+// read reads records appended to ledger since the previous call.
+func (rf *revenueForwarder) read() error {
+	records, offset, err := rf.ledger.QueryFrom(rf.offset, nil)
+	if err != nil {
+		return err
+	}
+	rf.offset = offset
+
+	for _, r := range records {
+		switch r.Role {
+		case storage.LedgerRoleShare:
+			if len(r.Channel) == 0 {
+				// written before channel was recorded, there is no claim txn
+				// to look up
+				rf.allocate(r)
+				continue
+			}
+			ch := rf.channel(r.Channel)
+			ch.shares = append(ch.shares, r)
+		case storage.LedgerRoleFlushed:
+			ch := rf.channel(r.Channel)
+			ch.flushed = append(ch.flushed, flushedClaim{txnID: r.TxnID, shares: ch.settled + len(ch.shares)})
+		case storage.LedgerRoleSettled:
+			rf.settle(r.Channel, r.TxnID)
+		case storage.LedgerRoleForward:
+			rf.forwards = append(rf.forwards, r)
+		}
+	}
+
+	return nil
+}
+
+func (rf *revenueForwarder) allocate(share *storage.UsageRecord) {
+	amount, err := common.StringToFixed64(share.Amount)
+	if err != nil {
+		log.Printf("Invalid share amount %s: %v", share.Amount, err)
+		return
+	}
+	rf.allocated[share.Recipient] += amount
+}
+
+// settle allocates the shares of channel covered by a flushed claim txn, and
+// drops the flushed txns before it.
+func (rf *revenueForwarder) settle(channel, txnID string) {
+	ch, ok := rf.channels[channel]
+	if !ok {
+		return
+	}
+	for i, f := range ch.flushed {
+		if f.txnID != txnID {
+			continue
+		}
+		if n := f.shares - ch.settled; n > 0 {
+			for _, r := range ch.shares[:n] {
+				rf.allocate(r)
+			}
+			ch.shares = ch.shares[n:]
+			ch.settled = f.shares
+		}
+		ch.flushed = ch.flushed[i+1:]
+		break
+	}
+	if len(ch.shares) == 0 && len(ch.flushed) == 0 {
+		delete(rf.channels, channel)
+	}
+}
+
+// lookupSettled looks up flushed claim txns on chain from the newest one of
+// each channel, and writes a settled record for the first one found.
+func (rf *revenueForwarder) lookupSettled(rpcClient revenueRPCClient) error {
+	for channel, ch := range rf.channels {
+		if len(ch.shares) == 0 {
+			// flushed txns cover no shares
+			delete(rf.channels, channel)
+			continue
+		}
+		for i := len(ch.flushed) - 1; i >= 0; i-- {
+			f := ch.flushed[i]
+			if f.shares <= ch.settled {
+				break
+			}
+			onChain, err := rpcClient.IsTxnOnChain(f.txnID)
+			if err != nil {
+				return err
+			}
+			if !onChain {
+				continue
+			}
+			err = rf.ledger.Append(&storage.UsageRecord{
+				Role:    storage.LedgerRoleSettled,
+				TxnID:   f.txnID,
+				Channel: channel,
+			})
+			if err != nil {
+				return fmt.Errorf("append settled record error: %v", err)
+			}
+			rf.settle(channel, f.txnID)
+			break
+		}
+	}
+	return nil
+}
+
+// forward transfers the settled share not yet forwarded to each beneficiary,
+// minus txn fee. A pending forward record with the signed txn is written
+// before the txn is sent, so that a txn whose result is unknown (e.g. process
+// exits or RPC fails after txn is sent) is counted as forwarded and resent as
+// is by the next call instead of being paid again. A forward whose txn is
+// rejected (e.g. its nonce is taken by another txn) and not on chain is
+// recorded as failed with a negative amount, so the amount is forwarded again
+// by a new txn.
+func (rf *revenueForwarder) forward(rpcClient revenueRPCClient, ownAddr string, minAmount, fee common.Fixed64) error {
+	err := rf.read()
+	if err != nil {
+		return err
+	}
+
+	err = rf.lookupSettled(rpcClient)
+	if err != nil {
+		return err
+	}
+
+	// status of forward txns that are no longer pending
+	status := make(map[string]string)
+	for _, r := range rf.forwards {
+		if r.ForwardStatus != storage.LedgerForwardPending {
+			status[r.TxnID] = r.ForwardStatus
+		}
+	}
+	known := make(map[string]bool)
+	for _, r := range rf.forwards {
+		if r.ForwardStatus != storage.LedgerForwardPending || status[r.TxnID] == storage.LedgerForwardFailed {
+			continue
+		}
+		known[r.ForwardID] = true
+		if len(status[r.TxnID]) > 0 {
+			continue
+		}
+		err = sendForward(rpcClient, rf.ledger, r)
+		if err != nil {
+			log.Printf("Couldn't resend forward %s of %s to %s: %v", r.ForwardID, r.Amount, r.Recipient, err)
+			continue
+		}
+	}
+
+	summaries, err := storage.Summarize(rf.forwards, storage.LedgerGroupByRecipient)
+	if err != nil {
+		return err
+	}
+	forwarded := make(map[string]common.Fixed64, len(summaries))
+	for _, s := range summaries {
+		forwarded[s.Key] = s.Forwarded
+	}
+	recipients := make([]string, 0, len(rf.allocated))
+	for recipient := range rf.allocated {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+
+	balance, err := rpcClient.Balance()
+	if err != nil {
+		return err
+	}
+	available := balance.ToFixed64()
+
+	for _, recipient := range recipients {
+		if recipient == ownAddr {
+			continue
+		}
+		amount := rf.allocated[recipient] - forwarded[recipient]
+		if amount <= 0 || amount < minAmount || amount <= fee {
+			continue
+		}
+		if amount > available {
+			log.Printf("Balance %s is not enough to forward %s to %s", available.String(), amount.String(), recipient)
+			continue
+		}
+
+		record, err := newForwardRecord(rpcClient, recipient, forwarded[recipient], amount, fee)
+		if err != nil {
+			log.Printf("Couldn't create forward of %s to %s: %v", amount.String(), recipient, err)
+			continue
+		}
+		if known[record.ForwardID] {
+			continue
+		}
+		err = rf.ledger.Append(record)
+		if err != nil {
+			return fmt.Errorf("append forward record error: %v", err)
+		}
+		available -= amount
+
+		err = sendForward(rpcClient, rf.ledger, record)
+		if err != nil {
+			log.Printf("Couldn't forward %s to %s: %v", amount.String(), recipient, err)
+			continue
+		}
+		log.Printf("Forwarded revenue %s to %s", (amount - fee).String(), recipient)
+	}
+
+	return nil
+}
+
+// newForwardRecord signs a txn that transfers amount minus fee to recipient.
+// Forward ID is derived from recipient and the amount forwarded to it before,
+// so the same forward always gets the same ID, while a forward issued again
+// after failure gets a new txn.
+func newForwardRecord(rpcClient revenueRPCClient, recipient string, forwarded, amount, fee common.Fixed64) (*storage.UsageRecord, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", recipient, forwarded, amount)))
+	forwardID := hex.EncodeToString(h[:16])
+
+	sender, err := program.CreateProgramHash(rpcClient.PubKey())
+	if err != nil {
+		return nil, err
+	}
+	recipientProgramHash, err := common.ToScriptHash(recipient)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := rpcClient.GetNonce(true)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := transaction.NewTransferAssetTransaction(sender, recipientProgramHash, uint64(nonce), amount-fee, fee)
+	if err != nil {
+		return nil, err
+	}
+	tx.UnsignedTx.Attributes = []byte(forwardID)
+	err = rpcClient.SignTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := tx.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	txHash := tx.Hash()
+
+	return &storage.UsageRecord{
+		Role:          storage.LedgerRoleForward,
+		Recipient:     recipient,
+		Amount:        amount.String(),
+		Fee:           fee.String(),
+		TxnID:         txHash.ToHexString(),
+		ForwardID:     forwardID,
+		ForwardStatus: storage.LedgerForwardPending,
+		Txn:           hex.EncodeToString(txBytes),
+	}, nil
+}
+
+// sendForward sends the txn of a pending forward record and records it as
+// sent once it's accepted or already on chain. If txn is rejected and not on
+// chain, forward is recorded as failed.
+func sendForward(rpcClient revenueRPCClient, ledger *storage.Ledger, record *storage.UsageRecord) error {
+	txBytes, err := hex.DecodeString(record.Txn)
+	if err != nil {
+		return err
+	}
+	tx := &transaction.Transaction{}
+	err = tx.Unmarshal(txBytes)
+	if err != nil {
+		return err
+	}
+	if tx.UnsignedTx == nil {
+		return errors.New("nil txn body")
+	}
+	_, err = rpcClient.SendRawTransaction(tx)
+	if err != nil {
+		switch rpcErrorCode(err) {
+		case errcode.ErrDuplicatedTx:
+		case errcode.ErrAppendTxnPool, errcode.INVALID_TRANSACTION:
+			onChain, lookupErr := rpcClient.IsTxnOnChain(record.TxnID)
+			if lookupErr != nil {
+				return fmt.Errorf("%v, and couldn't look up txn: %v", err, lookupErr)
+			}
+			if !onChain {
+				return failForward(ledger, record, err)
+			}
+		default:
+			return err
+		}
+	}
+	err = ledger.Append(&storage.UsageRecord{
+		Role:          storage.LedgerRoleForward,
+		Recipient:     record.Recipient,
+		TxnID:         record.TxnID,
+		ForwardID:     record.ForwardID,
+		ForwardStatus: storage.LedgerForwardSent,
+	})
+	if err != nil {
+		// forward stays pending and its txn will be resent, which is rejected
+		// by chain as duplicated
+		log.Println("Couldn't append forward record:", err)
+	}
+	return nil
+}
+
+// failForward records a forward as failed with the negative of its amount, so
+// that the amount no longer counts as forwarded.
+func failForward(ledger *storage.Ledger, record *storage.UsageRecord, sendErr error) error {
+	amount, err := common.StringToFixed64(record.Amount)
+	if err != nil {
+		return err
+	}
+	err = ledger.Append(&storage.UsageRecord{
+		Role:          storage.LedgerRoleForward,
+		Recipient:     record.Recipient,
+		Amount:        (-amount).String(),
+		TxnID:         record.TxnID,
+		ForwardID:     record.ForwardID,
+		ForwardStatus: storage.LedgerForwardFailed,
+	})
+	if err != nil {
+		return fmt.Errorf("append failed forward record error: %v", err)
+	}
+	return fmt.Errorf("txn is rejected and will be forwarded again: %v", sendErr)
+}
@@ -0,0 +1,340 @@
+package tuna
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/api/common/errcode"
+	"github.com/nknorg/nkn/v2/common"
+	nknPb "github.com/nknorg/nkn/v2/pb"
+	"github.com/nknorg/nkn/v2/transaction"
+	"github.com/nknorg/tuna/storage"
+)
+
+type testRevenueRPCClient struct {
+	account *nkn.Account
+	balance common.Fixed64
+	nonce   int64
+	sendErr error
+	sent    []*transaction.Transaction
+	// txns sent are on chain
+	onChain bool
+	// claim txns on chain
+	settled map[string]bool
+	lookups int
+}
+
+type testRPCError struct {
+	code errcode.ErrCode
+}
+
+func (e testRPCError) Error() string {
+	return errcode.ErrMessage[e.code]
+}
+
+func (e testRPCError) Code() int32 {
+	return int32(e.code)
+}
+
+func (c *testRevenueRPCClient) PubKey() []byte {
+	return c.account.PubKey()
+}
+
+func (c *testRevenueRPCClient) SignTransaction(tx *transaction.Transaction) error {
+	return nil
+}
+
+func (c *testRevenueRPCClient) Balance() (*nkn.Amount, error) {
+	return nkn.NewAmount(c.balance.String())
+}
+
+func (c *testRevenueRPCClient) GetNonce(txPool bool) (int64, error) {
+	return c.nonce, nil
+}
+
+func (c *testRevenueRPCClient) SendRawTransaction(txn *transaction.Transaction) (string, error) {
+	c.sent = append(c.sent, txn)
+	if c.sendErr != nil {
+		return "", c.sendErr
+	}
+	c.nonce++
+	txHash := txn.Hash()
+	return txHash.ToHexString(), nil
+}
+
+func (c *testRevenueRPCClient) IsTxnOnChain(txnID string) (bool, error) {
+	c.lookups++
+	if c.onChain {
+		for _, txn := range c.sent {
+			if txHash := txn.Hash(); txHash.ToHexString() == txnID {
+				return true, nil
+			}
+		}
+	}
+	return c.settled[txnID], nil
+}
+
+func TestForwardRevenue(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beneficiary, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := beneficiary.WalletAddress()
+
+	ledger := storage.NewLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	records := []*storage.UsageRecord{
+		{Role: storage.LedgerRoleShare, Recipient: recipient, Amount: "1", TxnID: "t1", Channel: "a/1"},
+		{Role: storage.LedgerRoleShare, Recipient: wallet.Address(), Amount: "1", TxnID: "t1", Channel: "a/1"},
+		{Role: storage.LedgerRoleFlushed, TxnID: "t1", Channel: "a/1"},
+		{Role: storage.LedgerRoleShare, Recipient: recipient, Amount: "5", TxnID: "t2", Channel: "a/1"},
+	}
+	for _, r := range records {
+		if err := ledger.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fee := common.Fixed64(0.01 * common.StorageFactor)
+	client := &testRevenueRPCClient{account: account, balance: common.Fixed64(10 * common.StorageFactor), sendErr: errors.New("timeout")}
+	client.settled = map[string]bool{"t1": true}
+	rf := newRevenueForwarder(ledger)
+
+	// txn result is unknown, forward is counted but not sent
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 1 {
+		t.Fatalf("%d txns sent, expected 1", len(client.sent))
+	}
+	transfer, err := transaction.Unpack(client.sent[0].UnsignedTx.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount := common.Fixed64(transfer.(*nknPb.TransferAsset).Amount); amount != common.Fixed64(common.StorageFactor)-fee {
+		t.Fatalf("forwarded %s, expected settled share minus fee", amount.String())
+	}
+	settled, err := ledger.Query(&storage.LedgerQuery{Role: storage.LedgerRoleSettled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settled) != 1 || settled[0].Channel != "a/1" || settled[0].TxnID != "t1" {
+		t.Fatalf("unexpected settled records %+v", settled)
+	}
+
+	// pending forward is resent as is instead of creating a new one
+	client.sendErr = nil
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 2 || client.sent[1].Hash() != client.sent[0].Hash() {
+		t.Fatal("pending forward should be resent with the same txn")
+	}
+
+	// nothing is sent once forward is recorded as sent
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 2 {
+		t.Fatalf("%d txns sent, expected 2", len(client.sent))
+	}
+
+	forwards, err := ledger.Query(&storage.LedgerQuery{Role: storage.LedgerRoleForward})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries, err := storage.Summarize(forwards, storage.LedgerGroupByRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Forwarded != common.Fixed64(common.StorageFactor) {
+		t.Fatalf("unexpected forward summaries %+v", summaries)
+	}
+
+	// forward rejected because its nonce is taken is forwarded again by a new
+	// txn once it's known not to be on chain
+	if err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleShare, Recipient: recipient, Amount: "2", TxnID: "t3", Channel: "b/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleFlushed, TxnID: "t3", Channel: "b/1"}); err != nil {
+		t.Fatal(err)
+	}
+	client.settled["t3"] = true
+	client.sendErr = testRPCError{errcode.ErrAppendTxnPool}
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 3 {
+		t.Fatalf("%d txns sent, expected 3", len(client.sent))
+	}
+	client.sendErr = nil
+	client.nonce++ // taken by another txn
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 4 || client.sent[3].Hash() == client.sent[2].Hash() {
+		t.Fatal("failed forward should be forwarded again with a new txn")
+	}
+
+	// rejected forward that is on chain is recorded as sent, share written
+	// before channel was recorded is forwarded without lookup
+	if err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleShare, Recipient: recipient, Amount: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	client.sendErr = testRPCError{errcode.ErrAppendTxnPool}
+	client.onChain = true
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 5 {
+		t.Fatalf("%d txns sent, expected 5", len(client.sent))
+	}
+
+	forwards, err = ledger.Query(&storage.LedgerQuery{Role: storage.LedgerRoleForward})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries, err = storage.Summarize(forwards, storage.LedgerGroupByRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Forwarded != common.Fixed64(4*common.StorageFactor) {
+		t.Fatalf("unexpected forward summaries %+v", summaries)
+	}
+
+	// balance caps the amount forwarded
+	client.balance = 0
+	client.settled["t2"] = true
+	if err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleFlushed, TxnID: "t2", Channel: "a/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.forward(client, wallet.Address(), 0, fee); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 5 {
+		t.Fatal("forward should be skipped when balance is not enough")
+	}
+}
+
+func TestRevenueForwarderSettlement(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beneficiary, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := beneficiary.WalletAddress()
+
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	ledger := storage.NewLedger(path)
+	appendShares := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleShare, Recipient: recipient, Amount: "1", TxnID: fmt.Sprintf("t%d", i), Channel: "a/1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	appendFlushed := func(i int) {
+		err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleFlushed, TxnID: fmt.Sprintf("t%d", i), Channel: "a/1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	forwarded := func() common.Fixed64 {
+		forwards, err := ledger.Query(&storage.LedgerQuery{Role: storage.LedgerRoleForward})
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries, err := storage.Summarize(forwards, storage.LedgerGroupByRecipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(summaries) == 0 {
+			return 0
+		}
+		return summaries[0].Forwarded
+	}
+
+	appendShares(0, 10)
+	appendFlushed(9)
+	appendShares(10, 20)
+	appendFlushed(19)
+	appendShares(20, 30)
+
+	// claims not on chain are not forwarded
+	client := &testRevenueRPCClient{account: account, balance: common.Fixed64(1000 * common.StorageFactor), settled: make(map[string]bool)}
+	rf := newRevenueForwarder(ledger)
+	if err := rf.forward(client, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 0 {
+		t.Fatalf("%d txns sent, expected none before claims are on chain", len(client.sent))
+	}
+	if client.lookups != 2 {
+		t.Fatalf("%d lookups, expected one per flushed txn", client.lookups)
+	}
+
+	// flushed claim on chain settles shares written before it
+	client.settled["t9"] = true
+	if err := rf.forward(client, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded() != common.Fixed64(10*common.StorageFactor) {
+		t.Fatalf("forwarded %s, expected 10", forwarded().String())
+	}
+	client.settled["t19"] = true
+	if err := rf.forward(client, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded() != common.Fixed64(20*common.StorageFactor) {
+		t.Fatalf("forwarded %s, expected 20", forwarded().String())
+	}
+
+	// ledger is read from cursor
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.read(); err != nil {
+		t.Fatal(err)
+	}
+	if rf.offset != fi.Size() {
+		t.Fatalf("offset %d, expected ledger size %d", rf.offset, fi.Size())
+	}
+	appendFlushed(29)
+	client.settled["t29"] = true
+	if err := rf.forward(client, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded() != common.Fixed64(30*common.StorageFactor) {
+		t.Fatalf("forwarded %s, expected 30", forwarded().String())
+	}
+
+	// settled records are resumed without lookup
+	client.settled = nil
+	client.lookups = 0
+	sent := len(client.sent)
+	if err := newRevenueForwarder(ledger).forward(client, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if client.lookups != 0 || len(client.sent) != sent {
+		t.Fatalf("%d lookups and %d txns sent after restart, expected none", client.lookups, len(client.sent)-sent)
+	}
+}
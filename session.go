@@ -0,0 +1,58 @@
+package tuna
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// Session multiplexes streams between entry and exit. It's either a smux
+// session over TCP conn, or a QUIC connection.
+type Session interface {
+	OpenStream() (Stream, error)
+	AcceptStream() (Stream, error)
+	SetDeadline(t time.Time) error
+	IsClosed() bool
+	Close() error
+}
+
+// Stream is a stream of Session.
+type Stream = net.Conn
+
+type smuxSession struct {
+	*smux.Session
+}
+
+// newSmuxSession creates a smux session over conn, as client side if client
+// is true.
+func newSmuxSession(conn io.ReadWriteCloser, config *smux.Config, client bool) (Session, error) {
+	var session *smux.Session
+	var err error
+	if client {
+		session, err = smux.Client(conn, config)
+	} else {
+		session, err = smux.Server(conn, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &smuxSession{session}, nil
+}
+
+func (s *smuxSession) OpenStream() (Stream, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *smuxSession) AcceptStream() (Stream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,292 @@
+package tuna
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/crypto"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Counters of two sides are never read at exactly the same time, so
+	// difference within this number of bytes is always accepted.
+	usageStatementSlack = 64 << 10
+)
+
+// usageStatements exchanges signed usage statements of one session with peer.
+// Each side signs its own view of bytes per service and direction. When a
+// statement is received, it's compared with local counters and acknowledged
+// with the local signed statement, so that both sides keep both views.
+type usageStatements struct {
+	*Common
+	isEntry   bool
+	peerKey   func() string
+	tolerance float64
+	getUsages func() []*pb.ServiceUsage
+	send      func(*pb.ControlMessage) error
+}
+
+func (c *Common) newUsageStatements(isEntry bool, peerKey func() string, tolerance float64, getUsages func() []*pb.ServiceUsage, send func(*pb.ControlMessage) error) *usageStatements {
+	return &usageStatements{
+		Common:    c,
+		isEntry:   isEntry,
+		peerKey:   peerKey,
+		tolerance: tolerance,
+		getUsages: getUsages,
+		send:      send,
+	}
+}
+
+// start sends a statement every interval until isClosed returns true. It
+// should only be called if peer supports CapabilityControlMessages.
+func (us *usageStatements) start(interval time.Duration, isClosed func() bool) {
+	for {
+		time.Sleep(interval)
+		if isClosed() {
+			return
+		}
+		statement, err := us.newStatement()
+		if err != nil {
+			log.Println("Couldn't create usage statement:", err)
+			continue
+		}
+		err = us.send(&pb.ControlMessage{Message: &pb.ControlMessage_UsageStatement{UsageStatement: statement}})
+		if err != nil {
+			log.Println("Couldn't send usage statement:", err)
+			continue
+		}
+		us.appendStatement(statement, true, false, false)
+	}
+}
+
+// handle processes a statement or acknowledgement from peer, and returns false
+// if msg is neither of them.
+func (us *usageStatements) handle(msg *pb.ControlMessage) bool {
+	switch m := msg.Message.(type) {
+	case *pb.ControlMessage_UsageStatement:
+		us.handleStatement(m.UsageStatement)
+	case *pb.ControlMessage_UsageStatementAck:
+		us.handleAck(m.UsageStatementAck)
+	default:
+		return false
+	}
+	return true
+}
+
+func (us *usageStatements) handleStatement(statement *pb.UsageStatement) {
+	err := us.verify(statement)
+	if err != nil {
+		log.Println("Invalid usage statement:", err)
+		return
+	}
+
+	us.appendStatement(statement, false, false, false)
+
+	own, err := us.newStatement()
+	if err != nil {
+		log.Println("Couldn't create usage statement:", err)
+		return
+	}
+
+	discrepancies := compareUsages(own.Usages, statement.Usages, us.tolerance)
+	agreed := len(discrepancies) == 0
+	if !agreed {
+		log.Printf("Usage statement of %s differs from local counters: %s", us.peerRole(), strings.Join(discrepancies, "; "))
+	}
+
+	ack := &pb.UsageStatementAck{
+		StatementHash: usageStatementHash(statement),
+		Agreed:        agreed,
+		Statement:     own,
+	}
+	err = us.send(&pb.ControlMessage{Message: &pb.ControlMessage_UsageStatementAck{UsageStatementAck: ack}})
+	if err != nil {
+		log.Println("Couldn't send usage statement ack:", err)
+		return
+	}
+	us.appendStatement(own, true, true, agreed)
+}
+
+func (us *usageStatements) handleAck(ack *pb.UsageStatementAck) {
+	if ack.Statement == nil {
+		log.Println("Invalid usage statement ack: no statement")
+		return
+	}
+	err := us.verify(ack.Statement)
+	if err != nil {
+		log.Println("Invalid usage statement ack:", err)
+		return
+	}
+
+	us.appendStatement(ack.Statement, false, true, ack.Agreed)
+
+	if !ack.Agreed {
+		log.Printf("Usage statement %x is disputed by %s, its view: %s", ack.StatementHash, us.peerRole(), formatUsages(ack.Statement.Usages))
+	}
+}
+
+func (us *usageStatements) peerRole() string {
+	if us.isEntry {
+		return "exit"
+	}
+	return "entry"
+}
+
+// newStatement returns local usage statement signed by wallet key.
+func (us *usageStatements) newStatement() (*pb.UsageStatement, error) {
+	statement := &pb.UsageStatement{
+		PublicKey: us.Wallet.PubKey(),
+		Timestamp: time.Now().Unix(),
+		IsEntry:   us.isEntry,
+		Usages:    us.getUsages(),
+	}
+	err := SignUsageStatement(statement, us.Wallet)
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// SignUsageStatement sets the signature of a usage statement signed by wallet
+// key.
+func SignUsageStatement(statement *pb.UsageStatement, wallet *nkn.Wallet) error {
+	b, err := usageStatementSigningBytes(statement)
+	if err != nil {
+		return err
+	}
+	statement.Signature, err = crypto.Sign(crypto.GetPrivateKeyFromSeed(wallet.Seed()), b)
+	return err
+}
+
+// verify checks that statement is signed by peer of the session.
+func (us *usageStatements) verify(statement *pb.UsageStatement) error {
+	if statement.IsEntry == us.isEntry {
+		return fmt.Errorf("statement is not from %s", us.peerRole())
+	}
+	if peerKey := us.peerKey(); len(peerKey) > 0 && hex.EncodeToString(statement.PublicKey) != peerKey {
+		return fmt.Errorf("statement public key %x is not %s", statement.PublicKey, peerKey)
+	}
+	return VerifyUsageStatement(statement)
+}
+
+// VerifyUsageStatement checks that the signature of a usage statement is
+// valid for its public key.
+func VerifyUsageStatement(statement *pb.UsageStatement) error {
+	if err := crypto.CheckPublicKey(statement.PublicKey); err != nil {
+		return err
+	}
+	if len(statement.Signature) == 0 {
+		return errors.New("statement is not signed")
+	}
+	b, err := usageStatementSigningBytes(statement)
+	if err != nil {
+		return err
+	}
+	return crypto.Verify(statement.PublicKey, b, statement.Signature)
+}
+
+// usageStatementSigningBytes is the deterministic encoding of statement
+// without signature.
+func usageStatementSigningBytes(statement *pb.UsageStatement) ([]byte, error) {
+	unsigned := proto.Clone(statement).(*pb.UsageStatement)
+	unsigned.Signature = nil
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+func usageStatementHash(statement *pb.UsageStatement) []byte {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(statement)
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(b)
+	return hash[:]
+}
+
+func (us *usageStatements) appendStatement(statement *pb.UsageStatement, sent, isAck, agreed bool) {
+	if us.statementLog == nil {
+		return
+	}
+	b, err := proto.Marshal(statement)
+	if err != nil {
+		log.Println("Couldn't encode usage statement:", err)
+		return
+	}
+	err = us.statementLog.Append(&storage.StatementRecord{
+		PeerKey:   us.peerKey(),
+		Sent:      sent,
+		IsAck:     isAck,
+		Agreed:    agreed,
+		Hash:      hex.EncodeToString(usageStatementHash(statement)),
+		Statement: base64.StdEncoding.EncodeToString(b),
+	})
+	if err != nil {
+		log.Println("Couldn't append usage statement:", err)
+	}
+}
+
+// compareUsages returns the differences between two views of usage that are
+// larger than tolerance (ratio of the larger one) and usageStatementSlack.
+func compareUsages(a, b []*pb.ServiceUsage, tolerance float64) []string {
+	type counters struct {
+		a, b [2]uint64
+	}
+	byService := make(map[uint32]*counters)
+	get := func(serviceID uint32) *counters {
+		if _, ok := byService[serviceID]; !ok {
+			byService[serviceID] = &counters{}
+		}
+		return byService[serviceID]
+	}
+	for _, u := range a {
+		c := get(u.ServiceId)
+		c.a[0] += u.BytesEntryToExit
+		c.a[1] += u.BytesExitToEntry
+	}
+	for _, u := range b {
+		c := get(u.ServiceId)
+		c.b[0] += u.BytesEntryToExit
+		c.b[1] += u.BytesExitToEntry
+	}
+
+	serviceIDs := make([]uint32, 0, len(byService))
+	for serviceID := range byService {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Slice(serviceIDs, func(i, j int) bool { return serviceIDs[i] < serviceIDs[j] })
+
+	var discrepancies []string
+	for _, serviceID := range serviceIDs {
+		c := byService[serviceID]
+		for i, direction := range []string{"entry to exit", "exit to entry"} {
+			x, y := c.a[i], c.b[i]
+			diff, max := x-y, x
+			if y > x {
+				diff, max = y-x, y
+			}
+			if diff <= usageStatementSlack || float64(diff) <= tolerance*float64(max) {
+				continue
+			}
+			discrepancies = append(discrepancies, fmt.Sprintf("service %d %s local %d bytes, peer %d bytes", serviceID, direction, x, y))
+		}
+	}
+	return discrepancies
+}
+
+func formatUsages(usages []*pb.ServiceUsage) string {
+	s := make([]string, 0, len(usages))
+	for _, u := range usages {
+		s = append(s, fmt.Sprintf("service %d %d/%d bytes", u.ServiceId, u.BytesEntryToExit, u.BytesExitToEntry))
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+)
+
+const (
+	LedgerRoleSpend   = "spend"
+	LedgerRoleEarn    = "earn"
+	LedgerRoleFree    = "free"    // traffic served without payment
+	LedgerRoleShare   = "share"   // portion of earning allocated to a beneficiary
+	LedgerRoleForward = "forward" // earning transferred to a beneficiary
+	LedgerRoleFlushed = "flushed" // claim txn of a nanopay channel is sent to chain
+	LedgerRoleSettled = "settled" // flushed claim txn is on chain
+
+	LedgerForwardPending = "pending" // forward txn is signed but may not be sent
+	LedgerForwardSent    = "sent"    // forward txn is accepted by chain
+	LedgerForwardFailed  = "failed"  // forward txn is rejected and not on chain
+
+	LedgerGroupByDay       = "day"
+	LedgerGroupByPeer      = "peer"
+	LedgerGroupByRecipient = "recipient"
+
+	ledgerDayFormat   = "2006-01-02"
+	maxLedgerLineSize = 1 << 20
+)
+
+// UsageRecord is a single entry of the usage ledger. A record is written every
+// time a payment is sent or claimed, and once more when a session ends so that
+// traffic which was never paid for is accounted as well.
+type UsageRecord struct {
+	Time             int64  `json:"time"`
+	SessionStart     int64  `json:"sessionStart"`
+	Role             string `json:"role"`
+	PeerKey          string `json:"peerKey"`
+	Recipient        string `json:"recipient,omitempty"`
+	Service          string `json:"service"`
+	BytesEntryToExit uint64 `json:"bytesEntryToExit"`
+	BytesExitToEntry uint64 `json:"bytesExitToEntry"`
+	Price            string `json:"price"`
+	Amount           string `json:"amount"`
+	TxnID            string `json:"txnID,omitempty"`
+	Channel          string `json:"channel,omitempty"`
+	ForwardID        string `json:"forwardID,omitempty"`
+	ForwardStatus    string `json:"forwardStatus,omitempty"`
+	Fee              string `json:"fee,omitempty"`
+	Txn              string `json:"txn,omitempty"`
+}
+
+// LedgerQuery selects usage records. Zero values match everything.
+type LedgerQuery struct {
+	From      time.Time
+	To        time.Time
+	Role      string
+	PeerKey   string
+	Service   string
+	Recipient string
+}
+
+// LedgerSummary is the aggregation of usage records sharing the same key.
+type LedgerSummary struct {
+	Key              string
+	Records          int
+	BytesEntryToExit uint64
+	BytesExitToEntry uint64
+	Spent            common.Fixed64
+	Earned           common.Fixed64
+	FreeBytes        uint64
+	Allocated        common.Fixed64
+	Forwarded        common.Fixed64
+}
+
+// Ledger is an append-only local file of usage records, one JSON object per
+// line.
+type Ledger struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewLedger(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+func (l *Ledger) Path() string {
+	return l.path
+}
+
+func (l *Ledger) Append(record *UsageRecord) error {
+	if record.Time == 0 {
+		record.Time = time.Now().Unix()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return appendJSONLine(l.path, record)
+}
+
+// appendJSONLine appends v as one JSON line to file and syncs it to disk.
+func appendJSONLine(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (l *Ledger) Query(q *LedgerQuery) ([]*UsageRecord, error) {
+	records, _, err := l.QueryFrom(0, q)
+	return records, err
+}
+
+// QueryFrom selects usage records from byte offset of ledger file, and returns
+// the offset after the last complete line read, so that a caller can read only
+// records appended since then.
+func (l *Ledger) QueryFrom(offset int64, q *LedgerQuery) ([]*UsageRecord, int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, nil
+		}
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	if q == nil {
+		q = &LedgerQuery{}
+	}
+
+	var records []*UsageRecord
+	reader := bufio.NewReaderSize(f, 4096)
+	for {
+		b, err := readLedgerLine(reader)
+		if err == io.EOF {
+			// last line may be partially written
+			break
+		}
+		if err != nil {
+			return nil, offset, fmt.Errorf("read ledger at offset %d error: %v", offset, err)
+		}
+		lineOffset := offset
+		offset += int64(len(b))
+		if len(bytes.TrimSpace(b)) == 0 {
+			continue
+		}
+		record := &UsageRecord{}
+		err = json.Unmarshal(b, record)
+		if err != nil {
+			return nil, lineOffset, fmt.Errorf("parse ledger at offset %d error: %v", lineOffset, err)
+		}
+		if q.match(record) {
+			records = append(records, record)
+		}
+	}
+
+	return records, offset, nil
+}
+
+// readLedgerLine returns the next line including newline, or io.EOF if there
+// is no complete line.
+func readLedgerLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxLedgerLineSize {
+			return nil, bufio.ErrTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+func (q *LedgerQuery) match(record *UsageRecord) bool {
+	if !q.From.IsZero() && record.Time < q.From.Unix() {
+		return false
+	}
+	if !q.To.IsZero() && record.Time >= q.To.Unix() {
+		return false
+	}
+	if len(q.Role) > 0 && record.Role != q.Role {
+		return false
+	}
+	if len(q.PeerKey) > 0 && record.PeerKey != q.PeerKey {
+		return false
+	}
+	if len(q.Service) > 0 && record.Service != q.Service {
+		return false
+	}
+	if len(q.Recipient) > 0 && record.Recipient != q.Recipient {
+		return false
+	}
+	return true
+}
+
+// Summarize aggregates records by UTC day, peer key or recipient. Results are
+// sorted by key.
+func Summarize(records []*UsageRecord, groupBy string) ([]*LedgerSummary, error) {
+	summaries := make(map[string]*LedgerSummary)
+	for _, record := range records {
+		var key string
+		switch groupBy {
+		case LedgerGroupByDay:
+			key = time.Unix(record.Time, 0).UTC().Format(ledgerDayFormat)
+		case LedgerGroupByPeer:
+			key = record.PeerKey
+		case LedgerGroupByRecipient:
+			key = record.Recipient
+		default:
+			return nil, fmt.Errorf("unknown ledger group %v", groupBy)
+		}
+
+		amount := common.Fixed64(0)
+		if len(record.Amount) > 0 {
+			var err error
+			amount, err = common.StringToFixed64(record.Amount)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if record.Role == LedgerRoleFlushed || record.Role == LedgerRoleSettled {
+			continue
+		}
+
+		s, ok := summaries[key]
+		if !ok {
+			s = &LedgerSummary{Key: key}
+			summaries[key] = s
+		}
+		s.Records++
+		s.BytesEntryToExit += record.BytesEntryToExit
+		s.BytesExitToEntry += record.BytesExitToEntry
+		switch record.Role {
+		case LedgerRoleSpend:
+			s.Spent += amount
+		case LedgerRoleEarn:
+			s.Earned += amount
+		case LedgerRoleFree:
+			s.FreeBytes += record.BytesEntryToExit + record.BytesExitToEntry
+		case LedgerRoleShare:
+			s.Allocated += amount
+		case LedgerRoleForward:
+			s.Forwarded += amount
+		}
+	}
+
+	results := make([]*LedgerSummary, 0, len(summaries))
+	for _, s := range summaries {
+		results = append(results, s)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	return results, nil
+}
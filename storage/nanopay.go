@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/nknorg/tuna/util"
+)
+
+const (
+	// maxNanoPayJournalEntries is the number of journal entries after which
+	// state is written to file and journal is cleared.
+	maxNanoPayJournalEntries = 1000
+)
+
+// PayerChannel is the state of a nanopay channel on payer side. Each service
+// uses its own channel to a recipient.
+type PayerChannel struct {
+	Sender     string `json:"sender"`
+	Service    string `json:"service"`
+	Recipient  string `json:"recipient"`
+	ID         uint64 `json:"id"`
+	Amount     string `json:"amount"`
+	Expiration uint32 `json:"expiration"`
+}
+
+// PendingClaim is the latest nanopay txn received on a channel on claimer side.
+// Flushed is set and Txn is dropped once the txn is sent to chain, Amount is
+// kept after that until the channel expires so that a resumed channel is not
+// paid twice.
+type PendingClaim struct {
+	Sender     string `json:"sender"`
+	ID         uint64 `json:"id"`
+	Amount     string `json:"amount"`
+	Expiration uint32 `json:"expiration"`
+	Txn        string `json:"txn"`
+	Flushed    bool   `json:"flushed"`
+}
+
+var (
+	// nanopay storage is shared among tuna instances in the same process that
+	// use the same path, so that they don't overwrite each other.
+	nanoPayStoragesLock sync.Mutex
+	nanoPayStorages     = make(map[string]*NanoPayStorage)
+)
+
+type nanoPayData struct {
+	Payers map[string]*PayerChannel `json:"payers"`
+	Claims map[string]*PendingClaim `json:"claims"`
+}
+
+// nanoPayJournalEntry is one change of state, either a payer channel or a
+// claim is set.
+type nanoPayJournalEntry struct {
+	Payer *PayerChannel `json:"payer,omitempty"`
+	Claim *PendingClaim `json:"claim,omitempty"`
+}
+
+// NanoPayStorage persists nanopay channel state to a JSON file so that it
+// survives restarts. Each change is appended to a journal file next to it
+// (path with ".journal" suffix), which is merged into the JSON file once it
+// has maxNanoPayJournalEntries entries or expired state is cleared. If path
+// is empty, state is only kept in memory.
+type NanoPayStorage struct {
+	path string
+
+	lock           sync.Mutex
+	data           nanoPayData
+	journalEntries int
+}
+
+// OpenNanoPayStorage returns the loaded storage of path, which is shared by all
+// callers with the same path.
+func OpenNanoPayStorage(path string) (*NanoPayStorage, error) {
+	nanoPayStoragesLock.Lock()
+	defer nanoPayStoragesLock.Unlock()
+
+	if s, ok := nanoPayStorages[path]; ok {
+		return s, nil
+	}
+
+	s := NewNanoPayStorage(path)
+	err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	nanoPayStorages[path] = s
+
+	return s, nil
+}
+
+func NewNanoPayStorage(path string) *NanoPayStorage {
+	return &NanoPayStorage{
+		path: path,
+		data: nanoPayData{
+			Payers: make(map[string]*PayerChannel),
+			Claims: make(map[string]*PendingClaim),
+		},
+	}
+}
+
+func payerKey(service, recipient string) string {
+	return service + "/" + recipient
+}
+
+func claimKey(sender string, id uint64) string {
+	return sender + "/" + strconv.FormatUint(id, 10)
+}
+
+func (s *NanoPayStorage) journalPath() string {
+	return s.path + ".journal"
+}
+
+// Load must be called before all other methods
+func (s *NanoPayStorage) Load() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if util.Exists(s.path) {
+		err := util.ReadJSON(s.path, &s.data)
+		if err != nil {
+			return err
+		}
+	}
+	if s.data.Payers == nil {
+		s.data.Payers = make(map[string]*PayerChannel)
+	}
+	if s.data.Claims == nil {
+		s.data.Claims = make(map[string]*PendingClaim)
+	}
+
+	return s.loadJournal()
+}
+
+// loadJournal applies changes in journal to state. The last entry is removed
+// if it's not complete, which happens if process exits while writing it.
+// Should be called with lock held.
+func (s *NanoPayStorage) loadJournal() error {
+	b, err := os.ReadFile(s.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	lines := bytes.Split(b, []byte{'\n'})
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		entry := &nanoPayJournalEntry{}
+		err = json.Unmarshal(line, entry)
+		if err != nil {
+			if i == len(lines)-1 {
+				// Later entries would be appended to the incomplete one.
+				return os.Truncate(s.journalPath(), int64(len(b)-len(line)))
+			}
+			return fmt.Errorf("parse nanopay journal line %d error: %v", i+1, err)
+		}
+		s.apply(entry)
+		s.journalEntries++
+	}
+
+	return nil
+}
+
+func (s *NanoPayStorage) apply(entry *nanoPayJournalEntry) {
+	if entry.Payer != nil {
+		s.data.Payers[payerKey(entry.Payer.Service, entry.Payer.Recipient)] = entry.Payer
+	}
+	if entry.Claim != nil {
+		s.data.Claims[claimKey(entry.Claim.Sender, entry.Claim.ID)] = entry.Claim
+	}
+}
+
+// set applies a change to state and appends it to journal, or saves state
+// once journal is full. Should be called with lock held.
+func (s *NanoPayStorage) set(entry *nanoPayJournalEntry) error {
+	s.apply(entry)
+	if len(s.path) == 0 {
+		return nil
+	}
+	if s.journalEntries >= maxNanoPayJournalEntries {
+		return s.save()
+	}
+	err := appendJSONLine(s.journalPath(), entry)
+	if err != nil {
+		return err
+	}
+	s.journalEntries++
+	return nil
+}
+
+// save writes state to a temp file first and renames it so that the file is
+// never left half written, and then clears journal. Should be called with
+// lock held.
+func (s *NanoPayStorage) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s.data, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return err
+	}
+
+	// Journal entries are already in state file, applying them again after a
+	// crash before journal is removed doesn't change state.
+	err = os.Remove(s.journalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.journalEntries = 0
+
+	return nil
+}
+
+func (s *NanoPayStorage) GetPayerChannel(service, recipient string) *PayerChannel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch, ok := s.data.Payers[payerKey(service, recipient)]
+	if !ok {
+		return nil
+	}
+	c := *ch
+	return &c
+}
+
+func (s *NanoPayStorage) SetPayerChannel(ch *PayerChannel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := *ch
+	return s.set(&nanoPayJournalEntry{Payer: &c})
+}
+
+func (s *NanoPayStorage) GetClaim(sender string, id uint64) *PendingClaim {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	claim, ok := s.data.Claims[claimKey(sender, id)]
+	if !ok {
+		return nil
+	}
+	c := *claim
+	return &c
+}
+
+func (s *NanoPayStorage) SetClaim(claim *PendingClaim) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := *claim
+	return s.set(&nanoPayJournalEntry{Claim: &c})
+}
+
+// SetClaimFlushed marks the claim of a channel as flushed and drops its txn,
+// if it's still the one of amount.
+func (s *NanoPayStorage) SetClaimFlushed(sender string, id uint64, amount string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	claim, ok := s.data.Claims[claimKey(sender, id)]
+	if !ok || claim.Flushed || claim.Amount != amount {
+		return nil
+	}
+	c := *claim
+	c.Flushed = true
+	c.Txn = ""
+	return s.set(&nanoPayJournalEntry{Claim: &c})
+}
+
+func (s *NanoPayStorage) GetClaims() []*PendingClaim {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	claims := make([]*PendingClaim, 0, len(s.data.Claims))
+	for _, claim := range s.data.Claims {
+		c := *claim
+		claims = append(claims, &c)
+	}
+	return claims
+}
+
+// ClearExpired removes channels and claims that expire at or before height,
+// and saves state if it's changed since last saved.
+func (s *NanoPayStorage) ClearExpired(height uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := s.journalEntries > 0
+	for k, ch := range s.data.Payers {
+		if ch.Expiration <= height {
+			delete(s.data.Payers, k)
+			changed = true
+		}
+	}
+	for k, claim := range s.data.Claims {
+		if claim.Expiration <= height {
+			delete(s.data.Claims, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// StatementRecord is a usage statement (or acknowledgement of one) sent to or
+// received from a peer. Statement is the base64 encoded signed statement so
+// that it can be verified again later.
+type StatementRecord struct {
+	Time      int64  `json:"time"`
+	PeerKey   string `json:"peerKey"`
+	Sent      bool   `json:"sent"`
+	IsAck     bool   `json:"isAck"`
+	Agreed    bool   `json:"agreed,omitempty"`
+	Hash      string `json:"hash"`
+	Statement string `json:"statement"`
+}
+
+// StatementLog is an append-only local file of usage statements, one JSON
+// object per line, kept for audit.
+type StatementLog struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewStatementLog(path string) *StatementLog {
+	return &StatementLog{path: path}
+}
+
+func (l *StatementLog) Append(record *StatementRecord) error {
+	if record.Time == 0 {
+		record.Time = time.Now().Unix()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return appendJSONLine(l.path, record)
+}
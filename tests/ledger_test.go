@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/storage"
+)
+
+func TestLedger(t *testing.T) {
+	ledger := storage.NewLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+
+	day1 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+	day2 := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC).Unix()
+	records := []*storage.UsageRecord{
+		{Time: day1, Role: storage.LedgerRoleSpend, PeerKey: "a", Service: "httpproxy", BytesEntryToExit: 100, BytesExitToEntry: 200, Amount: "0.1"},
+		{Time: day1, Role: storage.LedgerRoleSpend, PeerKey: "b", Service: "httpproxy", BytesEntryToExit: 10, Amount: "0.2"},
+		{Time: day2, Role: storage.LedgerRoleEarn, PeerKey: "a", Service: "httpproxy", BytesExitToEntry: 1, Amount: "0.05"},
+		{Time: day2, Role: storage.LedgerRoleFree, PeerKey: "c", Service: "httpproxy", BytesEntryToExit: 5, BytesExitToEntry: 5, Amount: "0"},
+	}
+	for _, r := range records {
+		if err := ledger.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := ledger.Query(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(records) {
+		t.Fatalf("expect %d records, got %d", len(records), len(all))
+	}
+
+	byDay, err := storage.Summarize(all, storage.LedgerGroupByDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent, _ := common.StringToFixed64("0.3")
+	earned, _ := common.StringToFixed64("0.05")
+	if len(byDay) != 2 || byDay[0].Key != "2024-01-01" || byDay[0].Spent != spent || byDay[0].BytesEntryToExit != 110 {
+		t.Fatalf("unexpected day summary: %+v", byDay[0])
+	}
+	if byDay[1].Earned != earned || byDay[1].FreeBytes != 10 {
+		t.Fatalf("unexpected day summary: %+v", byDay[1])
+	}
+
+	peerA, err := ledger.Query(&storage.LedgerQuery{PeerKey: "a", From: time.Unix(day2, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerA) != 1 || peerA[0].Role != storage.LedgerRoleEarn {
+		t.Fatalf("unexpected query result: %+v", peerA)
+	}
+}
+
+func TestLedgerRevenueShares(t *testing.T) {
+	records := []*storage.UsageRecord{
+		{Role: storage.LedgerRoleShare, Recipient: "x", Amount: "0.7"},
+		{Role: storage.LedgerRoleShare, Recipient: "y", Amount: "0.3"},
+		{Role: storage.LedgerRoleShare, Recipient: "x", Amount: "0.07"},
+		{Role: storage.LedgerRoleForward, Recipient: "x", Amount: "0.7"},
+	}
+	byRecipient, err := storage.Summarize(records, storage.LedgerGroupByRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated, _ := common.StringToFixed64("0.77")
+	forwarded, _ := common.StringToFixed64("0.7")
+	if len(byRecipient) != 2 || byRecipient[0].Key != "x" || byRecipient[0].Allocated != allocated || byRecipient[0].Forwarded != forwarded {
+		t.Fatalf("unexpected recipient summary: %+v", byRecipient)
+	}
+}
+
+func TestLedgerQueryFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	ledger := storage.NewLedger(path)
+	if err := ledger.Append(&storage.UsageRecord{Role: storage.LedgerRoleShare, Recipient: "x", Amount: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, offset, err := ledger.QueryFrom(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expect 1 record, got %d", len(records))
+	}
+
+	// partially written line is read once it's complete
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(`{"role":"share","recipient":"y",`); err != nil {
+		t.Fatal(err)
+	}
+	records, next, err := ledger.QueryFrom(offset, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 || next != offset {
+		t.Fatalf("expect no record before line is complete, got %d at offset %d", len(records), next)
+	}
+	if _, err := f.WriteString(`"amount":"2"}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	records, next, err = ledger.QueryFrom(offset, &storage.LedgerQuery{Role: storage.LedgerRoleShare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Recipient != "y" || next <= offset {
+		t.Fatalf("unexpected records %+v at offset %d", records, next)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestServiceMetadataSignature(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber := hex.EncodeToString(wallet.PubKey())
+	topic := tuna.DefaultSubscriptionPrefix + "httpproxy"
+
+	metadata := &pb.ServiceMetadata{
+		Ip:              "127.0.0.1",
+		TcpPort:         30020,
+		UdpPort:         30021,
+		Price:           "0.001",
+		BeneficiaryAddr: wallet.Address(),
+	}
+	unsigned, err := proto.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tuna.VerifyServiceMetadata(unsigned, topic, subscriber, time.Hour); err == nil {
+		t.Fatal("unsigned metadata should not be valid")
+	}
+	metadataRaw, err := tuna.SignServiceMetadata(metadata, topic, wallet.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := tuna.VerifyServiceMetadata(metadataRaw, topic, subscriber, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Ip != metadata.Ip || verified.BeneficiaryAddr != metadata.BeneficiaryAddr || verified.IssuedAt == 0 {
+		t.Fatalf("unexpected verified metadata %v", verified)
+	}
+	if _, err := tuna.VerifyServiceMetadata(metadataRaw, topic, "identifier."+subscriber, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tuna.VerifyServiceMetadata(metadataRaw, topic+"2", subscriber, time.Hour); err == nil {
+		t.Fatal("metadata of another topic should not be valid")
+	}
+
+	other, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tuna.VerifyServiceMetadata(metadataRaw, topic, hex.EncodeToString(other.PubKey()), time.Hour); err == nil {
+		t.Fatal("metadata of another subscriber should not be valid")
+	}
+
+	tampered := bytes.Replace(metadataRaw, []byte(metadata.Ip), []byte("127.0.0.2"), 1)
+	if _, err := tuna.VerifyServiceMetadata(tampered, topic, subscriber, time.Hour); err == nil {
+		t.Fatal("tampered metadata should not be valid")
+	}
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nknorg/tuna/storage"
+)
+
+func TestNanoPayStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nanopay.json")
+
+	s := storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	err := s.SetPayerChannel(&storage.PayerChannel{Sender: "a", Service: "httpproxy", Recipient: "b", ID: 1, Amount: "0.1", Expiration: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetClaim(&storage.PendingClaim{Sender: "a", ID: 1, Amount: "0.1", Expiration: 100, Txn: "00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetClaim(&storage.PendingClaim{Sender: "a", ID: 2, Amount: "0.2", Expiration: 200, Txn: "00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ch := s.GetPayerChannel("httpproxy", "b")
+	if ch == nil || ch.ID != 1 || ch.Amount != "0.1" {
+		t.Fatalf("unexpected payer channel: %+v", ch)
+	}
+	if claim := s.GetClaim("a", 2); claim == nil || claim.Amount != "0.2" {
+		t.Fatalf("unexpected claim: %+v", claim)
+	}
+
+	if err := s.ClearExpired(150); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetPayerChannel("httpproxy", "b") != nil || s.GetClaim("a", 1) != nil || len(s.GetClaims()) != 1 {
+		t.Fatal("expired state is not cleared")
+	}
+}
+
+func TestNanoPayStorageJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nanopay.json")
+	journalPath := path + ".journal"
+
+	s := storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		err := s.SetClaim(&storage.PendingClaim{Sender: "a", ID: i, Amount: "0.1", Expiration: 100 * uint32(i), Txn: "00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.SetClaim(&storage.PendingClaim{Sender: "a", ID: 1, Amount: "0.2", Expiration: 100, Txn: "01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("claims should only be appended to journal")
+	}
+
+	// process exits while writing the last journal entry
+	f, err := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"claim":{"sender":"a","id":4`))
+	f.Close()
+
+	s = storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if claim := s.GetClaim("a", 1); claim == nil || claim.Amount != "0.2" || claim.Txn != "01" {
+		t.Fatalf("unexpected claim: %+v", claim)
+	}
+	if len(s.GetClaims()) != 3 {
+		t.Fatalf("%d claims loaded, expected 3", len(s.GetClaims()))
+	}
+	err = s.SetClaim(&storage.PendingClaim{Sender: "a", ID: 5, Amount: "0.1", Expiration: 500, Txn: "00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.GetClaims()) != 4 {
+		t.Fatalf("%d claims loaded, expected 4", len(s.GetClaims()))
+	}
+
+	if err := s.ClearExpired(150); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatal("journal should be cleared after state is saved")
+	}
+	s = storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetClaim("a", 1) != nil || len(s.GetClaims()) != 3 {
+		t.Fatal("saved state is not loaded")
+	}
+}
+
+func TestNanoPayStorageClaimFlushed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nanopay.json")
+
+	s := storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	err := s.SetClaim(&storage.PendingClaim{Sender: "a", ID: 1, Amount: "0.2", Expiration: 100, Txn: "01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an older txn flushed doesn't clear the newer claim
+	if err := s.SetClaimFlushed("a", 1, "0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if claim := s.GetClaim("a", 1); claim.Flushed || claim.Txn != "01" {
+		t.Fatalf("unexpected claim: %+v", claim)
+	}
+
+	if err := s.SetClaimFlushed("a", 1, "0.2"); err != nil {
+		t.Fatal(err)
+	}
+	s = storage.NewNanoPayStorage(path)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if claim := s.GetClaim("a", 1); claim == nil || !claim.Flushed || len(claim.Txn) > 0 || claim.Amount != "0.2" {
+		t.Fatalf("flushed claim should keep amount without txn, got %+v", claim)
+	}
+}
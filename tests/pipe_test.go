@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nknorg/tuna"
+	"github.com/xtaci/smux"
+)
+
+const benchmarkChunkSize = 64 << 10
+
+// copy4K is how pipes copied before, with a 4KB buffer and no fast path.
+func copy4K(dest io.Writer, src io.Reader, written *uint64) error {
+	buf := make([]byte, 4096)
+	n, err := io.CopyBuffer(struct{ io.Writer }{dest}, struct{ io.Reader }{src}, buf)
+	*written = uint64(n)
+	return err
+}
+
+func newTCPConnPair(b *testing.B) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := listener.AcceptTCP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// newStreamPair returns both ends of a stream of smux session over loopback
+// TCP, as streams between entry and exit.
+func newStreamPair(b *testing.B) (net.Conn, net.Conn) {
+	client, server := newTCPConnPair(b)
+	clientSession, err := smux.Client(client, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverSession, err := smux.Server(server, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+
+	clientStream, err := clientSession.OpenStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Stream is accepted after its first frame is received.
+	if _, err := clientStream.Write([]byte{0}); err != nil {
+		b.Fatal(err)
+	}
+	serverStream, err := serverSession.AcceptStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.ReadFull(serverStream, make([]byte, 1)); err != nil {
+		b.Fatal(err)
+	}
+	return clientStream, serverStream
+}
+
+// benchmarkCopy copies from src to dest, while data is written to the other
+// end of src and read from the other end of dest.
+func benchmarkCopy(b *testing.B, copyFunc func(io.Writer, io.Reader, *uint64) error, srcPeer io.WriteCloser, src io.Reader, dest io.Writer, destPeer io.Reader) {
+	chunk := make([]byte, benchmarkChunkSize)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := srcPeer.Write(chunk); err != nil {
+				break
+			}
+		}
+		srcPeer.Close()
+	}()
+
+	done := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, destPeer)
+		done <- n
+	}()
+
+	b.SetBytes(benchmarkChunkSize)
+	b.ResetTimer()
+
+	var written uint64
+	if err := copyFunc(dest, src, &written); err != nil {
+		b.Fatal(err)
+	}
+	if written != uint64(b.N)*benchmarkChunkSize {
+		b.Fatalf("copied %d bytes, expected %d", written, b.N*benchmarkChunkSize)
+	}
+	if closer, ok := dest.(io.Closer); ok {
+		closer.Close()
+	}
+	<-done
+}
+
+func copyFuncs() map[string]func(io.Writer, io.Reader, *uint64) error {
+	return map[string]func(io.Writer, io.Reader, *uint64) error{
+		"Buffer4K": copy4K,
+		"Copy": func(dest io.Writer, src io.Reader, written *uint64) error {
+			return tuna.Copy(dest, src, written)
+		},
+	}
+}
+
+// BenchmarkCopyStreamToTCP copies from stream to TCP conn, as exit to service
+// and entry to client, which is written directly from the buffers of stream.
+func BenchmarkCopyStreamToTCP(b *testing.B) {
+	for name, copyFunc := range copyFuncs() {
+		b.Run(name, func(b *testing.B) {
+			srcPeer, src := newStreamPair(b)
+			dest, destPeer := newTCPConnPair(b)
+			benchmarkCopy(b, copyFunc, srcPeer, src, dest, destPeer)
+		})
+	}
+}
+
+// BenchmarkCopyTCPToStream copies from TCP conn to stream, as service to exit
+// and client to entry.
+func BenchmarkCopyTCPToStream(b *testing.B) {
+	for name, copyFunc := range copyFuncs() {
+		b.Run(name, func(b *testing.B) {
+			srcPeer, src := newTCPConnPair(b)
+			dest, destPeer := newStreamPair(b)
+			benchmarkCopy(b, copyFunc, srcPeer, src, dest, destPeer)
+		})
+	}
+}
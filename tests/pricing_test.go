@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestPricingModel(t *testing.T) {
+	m, err := tuna.NewPricingModel("0.002,0.001", "0.01", 1<<20, []*pb.PriceTier{
+		{ThresholdBytes: 3 << 20, Price: "0.001,0.0005"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1MB free, 2MB at base price, 1MB at tier price, all entry to exit
+	cost := m.Cost(4<<20, 0, 2*time.Minute)
+	expected, _ := common.StringToFixed64("0.025")
+	if cost != expected {
+		t.Fatalf("expect cost %s, got %s", expected.String(), cost.String())
+	}
+
+	if cost := m.Cost(1<<20, 0, 0); cost != 0 {
+		t.Fatalf("expect free traffic, got cost %s", cost.String())
+	}
+
+	entryToExitPrice, exitToEntryPrice := m.MaxTrafficPrice()
+	maxEntryToExit, _ := common.StringToFixed64("0.002")
+	maxExitToEntry, _ := common.StringToFixed64("0.001")
+	if entryToExitPrice != maxEntryToExit || exitToEntryPrice != maxExitToEntry {
+		t.Fatalf("unexpected max traffic price %s,%s", entryToExitPrice.String(), exitToEntryPrice.String())
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+)
+
+func newLoopbackEncryptUDPConn(t *testing.T) (*tuna.EncryptUDPConn, *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := tuna.NewEncryptUDPConn(conn)
+	t.Cleanup(func() { ec.Close() })
+	return ec, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPRekey(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	client, clientAddr := newLoopbackEncryptUDPConn(t)
+	server, serverAddr := newLoopbackEncryptUDPConn(t)
+
+	policy := &tuna.RekeyPolicy{Bytes: 100}
+	algo := pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305
+	if err := client.AddCodec(serverAddr, key, algo, true, policy, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddCodec(clientAddr, key, algo, false, policy, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 2 packets of 64 bytes exceed policy, so the key switches several
+	// times during the test.
+	buf := make([]byte, tuna.MaxUDPBufferSize)
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 64)
+		if _, _, err := client.WriteMsgUDP(msg, nil, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, encrypted, err := server.ReadFromUDPEncrypted(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !encrypted || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("packet %d mismatch", i)
+		}
+	}
+}
+
+func TestUDPRekeyReordered(t *testing.T) {
+	key := &[32]byte{4, 5, 6}
+	client, _ := newLoopbackEncryptUDPConn(t)
+	server, serverAddr := newLoopbackEncryptUDPConn(t)
+	relay, relayAddr := newLoopbackEncryptUDPConn(t)
+
+	policy := &tuna.RekeyPolicy{Bytes: 64}
+	algo := pb.EncryptionAlgo_ENCRYPTION_AES_GCM
+	if err := client.AddCodec(relayAddr, key, algo, true, policy, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddCodec(relayAddr, key, algo, false, policy, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relay captures packets of two epochs and delivers them in reverse order.
+	buf := make([]byte, tuna.MaxUDPBufferSize)
+	var packets [][]byte
+	for i := 0; i < 2; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 64)
+		if _, _, err := client.WriteMsgUDP(msg, nil, relayAddr); err != nil {
+			t.Fatal(err)
+		}
+		relay.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte(nil), buf[:n]...))
+	}
+
+	for i := len(packets) - 1; i >= 0; i-- {
+		if _, _, err := relay.WriteMsgUDP(packets[i], nil, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _, err := server.ReadFromUDPEncrypted(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], bytes.Repeat([]byte{byte(i)}, 64)) {
+			t.Fatalf("packet %d mismatch", i)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestUDPReplayProtection(t *testing.T) {
+	key := &[32]byte{7, 8, 9}
+	client, _ := newLoopbackEncryptUDPConn(t)
+	server, serverAddr := newLoopbackEncryptUDPConn(t)
+	relay, relayAddr := newLoopbackEncryptUDPConn(t)
+
+	algo := pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305
+	if err := client.AddCodec(relayAddr, key, algo, true, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddCodec(relayAddr, key, algo, false, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, tuna.MaxUDPBufferSize)
+	if _, _, err := client.WriteMsgUDP([]byte("hello"), nil, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	relay.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := relay.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := append([]byte(nil), buf[:n]...)
+
+	read := func(packet []byte) error {
+		if _, _, err := relay.WriteMsgUDP(packet, nil, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, _, err := server.ReadFromUDPEncrypted(buf)
+		return err
+	}
+
+	if err := read(packet); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(packet); err == nil {
+		t.Fatal("replayed packet should be rejected")
+	}
+}
+
+func TestUDPReflectedPacket(t *testing.T) {
+	key := &[32]byte{10, 11, 12}
+	a, _ := newLoopbackEncryptUDPConn(t)
+	b, bAddr := newLoopbackEncryptUDPConn(t)
+
+	// A packet sent back to its sender has the nonce direction of sender, and
+	// should be rejected even though it's encrypted by the same key.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mirrorAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	algo := pb.EncryptionAlgo_ENCRYPTION_AES_GCM
+	if err := a.AddCodec(mirrorAddr, key, algo, true, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddCodec(mirrorAddr, key, algo, true, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.WriteMsgUDP([]byte("hello"), nil, mirrorAddr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, tuna.MaxUDPBufferSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP(buf[:n], bAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, _, err := b.ReadFromUDPEncrypted(buf); err == nil {
+		t.Fatal("reflected packet should be rejected")
+	}
+}
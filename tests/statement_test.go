@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
+)
+
+func TestUsageStatementSignature(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement := &pb.UsageStatement{
+		PublicKey: wallet.PubKey(),
+		Timestamp: 1,
+		IsEntry:   true,
+		Usages:    []*pb.ServiceUsage{{ServiceId: 1, BytesEntryToExit: 100, BytesExitToEntry: 200}},
+	}
+	if err := tuna.VerifyUsageStatement(statement); err == nil {
+		t.Fatal("unsigned statement should not be valid")
+	}
+	if err := tuna.SignUsageStatement(statement, wallet); err != nil {
+		t.Fatal(err)
+	}
+	if err := tuna.VerifyUsageStatement(statement); err != nil {
+		t.Fatal(err)
+	}
+
+	statement.Usages[0].BytesExitToEntry = 100
+	if err := tuna.VerifyUsageStatement(statement); err == nil {
+		t.Fatal("tampered statement should not be valid")
+	}
+}
+
+func TestStatementLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statements.jsonl")
+	l := storage.NewStatementLog(path)
+	for _, sent := range []bool{true, false} {
+		err := l.Append(&storage.StatementRecord{PeerKey: "a", Sent: sent, Hash: "00", Statement: "AA=="})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(lines))
+	}
+	record := &storage.StatementRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), record); err != nil {
+		t.Fatal(err)
+	}
+	if !record.Sent || record.PeerKey != "a" || record.Time == 0 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func TestMeasureStorage(t *testing.T) {
-	measureStorage := storage.NewMeasureStorage(".", "test")
+	measureStorage := storage.NewMeasureStorage(t.TempDir(), "test")
 	err := measureStorage.Load()
 	if err != nil {
 		log.Println(err)
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestUDPBatch(t *testing.T) {
+	key := &[32]byte{4, 5, 6}
+	client, clientAddr := newLoopbackEncryptUDPConn(t)
+	server, serverAddr := newLoopbackEncryptUDPConn(t)
+
+	algo := pb.EncryptionAlgo_ENCRYPTION_AES_GCM
+	if err := client.AddCodec(serverAddr, key, algo, true, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddCodec(clientAddr, key, algo, false, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 100
+	msgs := make([]tuna.UDPMessage, count)
+	for i := range msgs {
+		b := []byte(fmt.Sprintf("packet %d", i))
+		msgs[i] = tuna.UDPMessage{Buffer: b, N: len(b), Addr: serverAddr}
+	}
+	written, err := client.WriteBatchEncrypted(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != count {
+		t.Fatalf("wrote %d packets, expected %d", written, count)
+	}
+
+	read := make([]tuna.UDPMessage, 16)
+	for i := range read {
+		read[i].Buffer = make([]byte, tuna.MaxUDPBufferSize)
+	}
+	received := 0
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for received < count {
+		n, err := server.ReadBatchEncrypted(read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if read[i].Err != nil {
+				t.Fatal(read[i].Err)
+			}
+			if !read[i].Encrypted {
+				t.Fatal("packet should be encrypted")
+			}
+			expected := fmt.Sprintf("packet %d", received)
+			if string(read[i].Buffer[:read[i].N]) != expected {
+				t.Fatalf("got %q, expected %q", read[i].Buffer[:read[i].N], expected)
+			}
+			received++
+		}
+	}
+}
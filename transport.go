@@ -0,0 +1,396 @@
+package tuna
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nknorg/tuna/pb"
+)
+
+// Transports of the tunnel between entry and exit. TLS and WebSocket (over
+// TLS) look like HTTPS to firewalls that only allow it.
+const (
+	TransportTCP       = "tcp" // raw TCP, falls back to TLS if TCP port is unreachable
+	TransportTLS       = "tls"
+	TransportWebSocket = "websocket"
+)
+
+const (
+	webSocketPath        = "/"
+	transportSniffLen    = 4
+	transportSniffPrefix = "GET "
+)
+
+var errPublicKeyMismatch = errors.New("peer public key mismatch")
+
+func verifyTransport(transport string) error {
+	switch transport {
+	case TransportTCP, TransportTLS, TransportWebSocket:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+// tunnelServerName returns the host name of server with publicKey, which is
+// used as SNI by client and as subject of server certificate, so that the
+// handshake looks like one of an ordinary HTTPS site.
+func tunnelServerName(publicKey []byte) string {
+	if len(publicKey) > 8 {
+		publicKey = publicKey[:8]
+	}
+	return hex.EncodeToString(publicKey) + ".net"
+}
+
+// walletCertificate returns a self-signed certificate of wallet key, so that
+// peers authenticate each other by NKN public key instead of CA.
+func walletCertificate(seed []byte) (tls.Certificate, error) {
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serverName := tunnelServerName(privateKey.Public().(ed25519.PublicKey))
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: privateKey}, nil
+}
+
+// peerPublicKey returns the wallet public key in peer certificate.
+func peerPublicKey(rawCerts [][]byte) ([]byte, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("peer certificate is not ed25519")
+	}
+	return publicKey, nil
+}
+
+// tunnelTLSConfig returns the TLS config of camouflaged tunnel. Client verifies
+// that server has a certificate of remotePublicKey, and entry is authenticated
+// by connection metadata inside the tunnel as over TCP.
+func (c *Common) tunnelTLSConfig(remotePublicKey []byte) (*tls.Config, error) {
+	cert, err := walletCertificate(c.Wallet.Seed())
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	if len(remotePublicKey) > 0 {
+		config.ServerName = tunnelServerName(remotePublicKey)
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			publicKey, err := peerPublicKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(publicKey, remotePublicKey) {
+				return errPublicKeyMismatch
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+func (c *Common) dialContext() (context.Context, context.CancelFunc) {
+	if c.DialTimeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(c.DialTimeout)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (c *Common) dialTCPContext(ctx context.Context, addr string) (net.Conn, error) {
+	if c.TcpDialContext != nil {
+		return c.TcpDialContext(ctx, tcp4, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, tcp4, addr)
+}
+
+// dialServer dials the tunnel to server of metadata with configured
+// transport, and returns the conn and the address dialed.
+func (c *Common) dialServer(metadata *pb.ServiceMetadata, remotePublicKey []byte) (net.Conn, string, error) {
+	if c.transport == TransportTLS || c.transport == TransportWebSocket {
+		return c.dialCamouflaged(metadata, remotePublicKey, c.transport)
+	}
+
+	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
+	ctx, cancel := c.dialContext()
+	defer cancel()
+	conn, err := c.dialTCPContext(ctx, addr)
+	if err != nil && c.transport == TransportTCP && metadata.TlsPort > 0 {
+		log.Println("Couldn't connect to TCP at", addr, "falling back to TLS:", err)
+		return c.dialCamouflaged(metadata, remotePublicKey, TransportTLS)
+	}
+	return conn, addr, err
+}
+
+// dialCamouflaged dials the TLS port of server of metadata, and starts a
+// WebSocket connection over it if transport is WebSocket.
+func (c *Common) dialCamouflaged(metadata *pb.ServiceMetadata, remotePublicKey []byte, transport string) (net.Conn, string, error) {
+	if metadata.TlsPort == 0 {
+		return nil, "", fmt.Errorf("server doesn't support %s transport", transport)
+	}
+
+	tlsConfig, err := c.tunnelTLSConfig(remotePublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dialTLS := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := c.dialTCPContext(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TlsPort))
+	ctx, cancel := c.dialContext()
+	defer cancel()
+
+	if transport == TransportTLS {
+		conn, err := dialTLS(ctx, tcp4, addr)
+		return conn, addr, err
+	}
+
+	dialer := &websocket.Dialer{NetDialTLSContext: dialTLS}
+	header := http.Header{}
+	if len(tlsConfig.ServerName) > 0 {
+		header.Set("Host", tlsConfig.ServerName)
+	}
+	ws, _, err := dialer.DialContext(ctx, "wss://"+addr+webSocketPath, header)
+	if err != nil {
+		return nil, "", err
+	}
+	return newWebSocketConn(ws), addr, nil
+}
+
+// webSocketConn is a net.Conn of binary WebSocket messages.
+type webSocketConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func newWebSocketConn(ws *websocket.Conn) *webSocketConn {
+	return &webSocketConn{Conn: ws}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	err := c.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// sniffedConn is a conn whose first bytes are already read by reader.
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connListener is a net.Listener of conns accepted by another listener, so
+// that HTTP server serves only conns that start with an HTTP request.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:      addr,
+		conns:     make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closeChan:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenTLS accepts camouflaged tunnels from entries. Conns that start with an
+// HTTP request are served as WebSocket, and others as TLS tunnel.
+func (te *TunaExit) listenTLS(port int) error {
+	tlsConfig, err := te.tunnelTLSConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", ":"+strconv.Itoa(port), tlsConfig)
+	if err != nil {
+		log.Println("Couldn't bind tls listener:", err)
+		return err
+	}
+	te.tlsListener = listener
+
+	webSocketListener := newConnListener(listener.Addr())
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != webSocketPath || !websocket.IsWebSocketUpgrade(r) {
+				http.NotFound(w, r)
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				log.Println("Couldn't upgrade to websocket:", err)
+				return
+			}
+			err = te.handleConn(newWebSocketConn(ws))
+			if err != nil {
+				log.Println(err)
+			}
+		}),
+	}
+	go server.Serve(webSocketListener)
+
+	go func() {
+		defer webSocketListener.Close()
+		for {
+			conn, err := listener.Accept()
+			if te.IsClosed() {
+				return
+			}
+			if err != nil {
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					te.Close()
+					return
+				}
+				log.Println("Couldn't accept tls connection:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			go func() {
+				reader := bufio.NewReader(conn)
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				b, err := reader.Peek(transportSniffLen)
+				if err != nil {
+					Close(conn)
+					return
+				}
+				conn.SetReadDeadline(time.Time{})
+
+				sniffed := &sniffedConn{Conn: conn, reader: reader}
+				if string(b) == transportSniffPrefix {
+					webSocketListener.push(sniffed)
+					return
+				}
+
+				err = te.handleConn(sniffed)
+				if err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
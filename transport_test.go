@@ -0,0 +1,143 @@
+package tuna
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/nknorg/tuna/pb"
+)
+
+func TestWalletCertificate(t *testing.T) {
+	c := newTestCommon(t)
+	serialNumbers := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		cert, err := walletCertificate(c.Wallet.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverName := tunnelServerName(c.Wallet.PubKey())
+		if x509Cert.Subject.CommonName != serverName || len(x509Cert.DNSNames) != 1 || x509Cert.DNSNames[0] != serverName {
+			t.Fatalf("certificate has subject %v and names %v, expected %s", x509Cert.Subject, x509Cert.DNSNames, serverName)
+		}
+		serialNumbers[x509Cert.SerialNumber.String()] = true
+	}
+	if len(serialNumbers) != 2 {
+		t.Fatal("certificate serial number should be random")
+	}
+}
+
+// listenTestTunnel accepts camouflaged tunnels as exit of c, and echoes data
+// back. Server names sent by clients are sent to serverNames.
+func listenTestTunnel(t *testing.T, c *Common, serverNames chan string) *pb.ServiceMetadata {
+	tlsConfig, err := c.tunnelTLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	webSocketListener := newConnListener(listener.Addr())
+	t.Cleanup(func() { webSocketListener.Close() })
+	upgrader := &websocket.Upgrader{}
+	go http.Serve(webSocketListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverNames <- r.Host
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := newWebSocketConn(ws)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				serverNames <- tlsConn.ConnectionState().ServerName
+				reader := bufio.NewReader(conn)
+				b, err := reader.Peek(transportSniffLen)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				sniffed := &sniffedConn{Conn: conn, reader: reader}
+				if string(b) == transportSniffPrefix {
+					webSocketListener.push(sniffed)
+					return
+				}
+				defer conn.Close()
+				io.Copy(conn, sniffed)
+			}()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	return &pb.ServiceMetadata{Ip: "127.0.0.1", TlsPort: uint32(port)}
+}
+
+func TestCamouflagedTransport(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	entry.DialTimeout = 5
+	serverNames := make(chan string, 4)
+	metadata := listenTestTunnel(t, exit, serverNames)
+	serverName := tunnelServerName(exit.Wallet.PubKey())
+
+	for _, transport := range []string{TransportTLS, TransportWebSocket} {
+		conn, addr, err := entry.dialCamouflaged(metadata, exit.Wallet.PubKey(), transport)
+		if err != nil {
+			t.Fatal(transport, err)
+		}
+		if addr != "127.0.0.1:"+strconv.Itoa(int(metadata.TlsPort)) {
+			t.Fatalf("%s dialed %s", transport, addr)
+		}
+		if name := <-serverNames; name != serverName {
+			t.Fatalf("%s sent SNI %q, expected %q", transport, name, serverName)
+		}
+		if transport == TransportWebSocket {
+			if host := <-serverNames; host != serverName {
+				t.Fatalf("websocket sent host %q, expected %q", host, serverName)
+			}
+		}
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(transport, err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(transport, err)
+		}
+		if !bytes.Equal(b, []byte("hello")) {
+			t.Fatalf("%s got %q, expected hello", transport, b)
+		}
+		conn.Close()
+	}
+
+	// server of another key is rejected
+	if _, _, err := entry.dialCamouflaged(metadata, entry.Wallet.PubKey(), TransportTLS); err == nil {
+		t.Fatal("server with mismatched public key should be rejected")
+	}
+}
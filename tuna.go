@@ -34,7 +34,7 @@ import (
 	"github.com/nknorg/tuna/storage"
 	"github.com/nknorg/tuna/types"
 	tunaUtil "github.com/nknorg/tuna/util"
-	"github.com/xtaci/smux"
+	"github.com/quic-go/quic-go"
 	"golang.org/x/crypto/nacl/box"
 	"google.golang.org/protobuf/proto"
 
@@ -53,12 +53,13 @@ const (
 	minTrafficCoverage            = 0.9
 	trafficDelay                  = 10 * time.Second
 	maxNanoPayDelay               = 30 * time.Second
+	paymentEscalationInterval     = 10 * time.Second
 	subscribeDurationRandomFactor = 0.1
 	measureBandwidthTopCount      = 8
 	measureDelayTopDelayCount     = 32
-	pipeBufferSize                = 4096 // should be <= 4096 to be compatible with c++ smux
 	maxConnMetadataSize           = 1024
 	maxStreamMetadataSize         = 1024
+	maxControlMessageSize         = 64 * 1024
 	maxServiceMetadataSize        = 4096
 	maxNanoPayTxnSize             = 4096
 	numRPCClients                 = 4
@@ -73,10 +74,11 @@ var (
 )
 
 type ServiceInfo struct {
-	MaxPrice  string            `json:"maxPrice"`
-	ListenIP  string            `json:"listenIP"`
-	IPFilter  *geo.IPFilter     `json:"ipFilter"`
-	NknFilter *filter.NknFilter `json:"nknFilter"`
+	MaxPrice          string            `json:"maxPrice"`
+	MaxPricePerMinute string            `json:"maxPricePerMinute"`
+	ListenIP          string            `json:"listenIP"`
+	IPFilter          *geo.IPFilter     `json:"ipFilter"`
+	NknFilter         *filter.NknFilter `json:"nknFilter"`
 }
 
 type Service struct {
@@ -85,6 +87,7 @@ type Service struct {
 	UDP           []uint32 `json:"udp"`
 	UDPBufferSize int      `json:"udpBufferSize"`
 	Encryption    string   `json:"encryption"`
+	Compression   string   `json:"compression"`
 }
 
 type Common struct {
@@ -117,6 +120,8 @@ type Common struct {
 	tcpListener                       *net.TCPListener
 	curveSecretKey                    *[sharedKeySize]byte
 	encryptionAlgo                    pb.EncryptionAlgo
+	encryptionAlgos                   []pb.EncryptionAlgo // accepted by client, in order of preference
+	rekeyPolicy                       RekeyPolicy
 	closeChan                         chan struct{}
 	measureStorage                    *storage.MeasureStorage
 	sortMeasuredNodes                 func(types.Nodes)
@@ -129,6 +134,7 @@ type Common struct {
 	paymentReceiver      string
 	entryToExitPrice     common.Fixed64
 	exitToEntryPrice     common.Fixed64
+	pricing              *PricingModel
 	metadata             *pb.ServiceMetadata
 	connected            bool
 	tcpConn              net.Conn
@@ -136,16 +142,56 @@ type Common struct {
 	isClosed             bool
 	sharedKeys           map[string]*[sharedKeySize]byte
 	encryptKeys          sync.Map
+	encryptionAlgosUsed  sync.Map // negotiated encryption algo of each conn
+	connCapabilities     sync.Map // negotiated capabilities of each conn
+	udpBinder            *udpBinder
+	udpBindRequest       *udpBindRequest // bind metadata of client UDP conn
 	remoteNknAddress     string
 	activeSessions       int
 	linger               time.Duration
 	presetNode           *types.Node
 	connReadyChan        sync.Map
 
+	sessionBytesLock        sync.RWMutex
 	reverseBytesExitToEntry map[string][]uint64
 	reverseBytesEntryToExit map[string][]uint64
 
 	minBalance common.Fixed64 // minimum wallet balance requirement for connecting
+
+	ledger      *storage.Ledger
+	connectedAt time.Time // session start, before dialing service provider
+	bytesUsed   func() (uint64, uint64)
+	// bytes used before current session, as baseline of session cost
+	sessionBytesEntryToExit uint64
+	sessionBytesExitToEntry uint64
+	nanoPayStorage          *storage.NanoPayStorage
+	statementLog            *storage.StatementLog
+
+	paymentStreamLock  sync.Mutex // guards writes to payment stream
+	servedFree         bool       // service provider serves without payment
+	remoteCapabilities uint64     // capabilities negotiated with server
+	muxConfig          MuxConfig
+	remoteMuxConfig    *pb.MuxConfig // mux config of server, nil if not negotiated
+
+	compressionAlgo        pb.CompressionAlgo   // compression of service streams to server
+	remoteCompressionAlgos []pb.CompressionAlgo // compression algos supported by server
+
+	budget                  *budget
+	onBudget                func(pending common.Fixed64, session time.Time)
+	rateLimiter             *tunaUtil.RateLimiter
+	entryToExitPriceCeiling common.Fixed64
+	exitToEntryPriceCeiling common.Fixed64
+	hasPriceCeiling         bool
+	requireEphemeralKey     bool          // reject peers that don't support ephemeral key exchange
+	strictMetadata          bool          // reject subscriber metadata that is not signed
+	metadataMaxAge          time.Duration // max age of subscriber metadata, 0 if not checked
+	udpFlows                *udpFlowTable // flows of all entries, only used by exit
+	udpFallback             *udpFallback  // UDP over TCP fallback, only used by entry
+	udpQueues               *udpQueues    // per-flow queues of UDP packets to local endpoints
+	preferQUIC              bool          // connect to exit over QUIC if it's advertised
+	transport               string        // transport of tunnel to exit, only used by entry
+	quicConn                quic.Connection
+	quicEncryption          *quicEncryption
 }
 
 func NewCommon(
@@ -172,11 +218,28 @@ func NewCommon(
 	sortMeasuredNodes func(types.Nodes),
 	reverseMetadata *pb.ServiceMetadata,
 	minBalance string,
+	ledgerPath string,
+	nanoPayStatePath string,
+	usageStatementPath string,
+	rekeyBytes int64,
+	rekeyInterval int32,
 ) (*Common, error) {
 	encryptionAlgo := defaultEncryptionAlgo
+	var encryptionAlgos []pb.EncryptionAlgo
 	var err error
 	if service != nil && len(service.Encryption) > 0 {
-		encryptionAlgo, err = ParseEncryptionAlgo(service.Encryption)
+		encryptionAlgo, encryptionAlgos, err = parseServiceEncryption(service.Encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if encryptionAlgos == nil {
+		encryptionAlgos = []pb.EncryptionAlgo{encryptionAlgo}
+	}
+
+	compressionAlgo := pb.CompressionAlgo_COMPRESSION_ALGO_NONE
+	if service != nil && len(service.Compression) > 0 {
+		compressionAlgo, err = ParseCompressionAlgo(service.Compression)
 		if err != nil {
 			return nil, err
 		}
@@ -237,9 +300,14 @@ func NewCommon(
 
 		curveSecretKey:                    curveSecretKey,
 		encryptionAlgo:                    encryptionAlgo,
+		encryptionAlgos:                   encryptionAlgos,
+		compressionAlgo:                   compressionAlgo,
+		rekeyPolicy:                       newRekeyPolicy(rekeyBytes, rekeyInterval),
 		closeChan:                         make(chan struct{}),
 		udpCloseChan:                      make(chan struct{}),
 		sharedKeys:                        make(map[string]*[sharedKeySize]byte),
+		udpBinder:                         newUDPBinder(),
+		muxConfig:                         defaultMuxConfig,
 		measureDelayConcurrentWorkers:     measureDelayConcurrentWorkers,
 		measureBandwidthConcurrentWorkers: measureBandwidthConcurrentWorkers,
 		sortMeasuredNodes:                 sortMeasuredNodes,
@@ -256,6 +324,19 @@ func NewCommon(
 		return nil, err
 	}
 
+	if len(ledgerPath) > 0 {
+		c.ledger = storage.NewLedger(ledgerPath)
+	}
+
+	if len(usageStatementPath) > 0 {
+		c.statementLog = storage.NewStatementLog(usageStatementPath)
+	}
+
+	c.nanoPayStorage, err = storage.OpenNanoPayStorage(nanoPayStatePath)
+	if err != nil {
+		return nil, fmt.Errorf("load nanopay state error: %v", err)
+	}
+
 	if !c.IsServer && c.ServiceInfo.IPFilter.NeedGeoInfo() {
 		c.ServiceInfo.IPFilter.AddProvider(c.DownloadGeoDB, c.GeoDBPath)
 	}
@@ -375,6 +456,20 @@ func (c *Common) SetRemoteNknAddress(nknAddr string) {
 	c.Unlock()
 }
 
+// isServedFree returns whether service provider of current session serves
+// without payment.
+func (c *Common) isServedFree() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.servedFree
+}
+
+func (c *Common) setServedFree(servedFree bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.servedFree = servedFree
+}
+
 func (c *Common) GetPaymentReceiver() string {
 	c.RLock()
 	defer c.RUnlock()
@@ -399,75 +494,127 @@ func (c *Common) GetPrice() (common.Fixed64, common.Fixed64) {
 	return c.entryToExitPrice, c.exitToEntryPrice
 }
 
-func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr, in *uint64, out *uint64) {
+func (c *Common) getRemoteCapabilities() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.remoteCapabilities
+}
+
+// RemoteHasCapability returns whether the capability is supported by both this
+// client and the server it connects to.
+func (c *Common) RemoteHasCapability(capability uint64) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return hasCapability(c.remoteCapabilities, capability)
+}
+
+func (c *Common) GetPricingModel() *PricingModel {
+	c.RLock()
+	defer c.RUnlock()
+	return c.pricing
+}
+
+func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr, in *uint64, out *uint64, stopChan <-chan struct{}) {
 	from := new(net.UDPAddr)
 	n := 0
 	encrypted := false
-	var err error
 	addrToKey := new(sync.Map)
+	pendingBinds := make(chan struct{}, maxPendingUDPBinds)
 
 	go func() {
-		buffer := make([]byte, MaxUDPBufferSize)
+		msgs := make([]UDPMessage, udpBatchSize)
+		for i := range msgs {
+			msgs[i].Buffer = make([]byte, MaxUDPBufferSize)
+		}
 		for {
 			if c.isClosed {
 				return
 			}
-			n, from, encrypted, err = conn.ReadFromUDPEncrypted(buffer)
+			count, err := conn.ReadBatchEncrypted(msgs)
 			if err != nil {
 				log.Println("Couldn't receive data:", err)
 				if errors.Is(err, io.ErrClosedPipe) {
 					return
 				}
+				continue
 			}
-			if bytes.Equal(buffer[:PrefixLen], []byte{PrefixLen - 1: 0}) && c.IsServer && n > PrefixLen {
-				connMetadata, err := parseUDPConnMetadata(buffer[PrefixLen:n])
-				if err != nil {
-					log.Println("Couldn't read udp metadata from client:", err)
+			for i := 0; i < count; i++ {
+				buffer := msgs[i].Buffer
+				n, from, encrypted = msgs[i].N, msgs[i].Addr, msgs[i].Encrypted
+				if msgs[i].Err != nil {
+					log.Println("Couldn't receive data:", msgs[i].Err)
 					continue
 				}
-				if connMetadata.IsPing || encrypted {
+				if bytes.Equal(buffer[:PrefixLen], []byte{PrefixLen - 1: 0}) && c.IsServer && n > PrefixLen {
+					connMetadata, err := parseUDPConnMetadata(buffer[PrefixLen:n])
+					if err != nil {
+						log.Println("Couldn't read udp metadata from client:", err)
+						continue
+					}
+					if connMetadata.IsPing && encrypted {
+						c.replyUDPPing(conn, from, addrToKey)
+						continue
+					}
+					if connMetadata.IsPing || encrypted {
+						continue
+					}
+					connKey := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
+					if c.waitConnReady(connKey, 0) {
+						c.bindUDPConn(conn, from, connMetadata, connKey, in, out, addrToKey)
+						continue
+					}
+					// TCP handshake of conn is not finished yet, wait for it
+					// without blocking packets of other conns
+					select {
+					case pendingBinds <- struct{}{}:
+					default:
+						log.Println("Too many pending udp binds, dropping udp metadata from", from)
+						continue
+					}
+					go func(from *net.UDPAddr, connMetadata *pb.ConnectionMetadata, connKey string) {
+						defer func() { <-pendingBinds }()
+						if c.waitConnReady(connKey, udpBindReadyTimeout) {
+							c.bindUDPConn(conn, from, connMetadata, connKey, in, out, addrToKey)
+						}
+					}(from, connMetadata, connKey)
 					continue
 				}
-				connKey := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
-
-				readyChan, _ := c.connReadyChan.LoadOrStore(connKey, make(chan struct{}, 1))
-				<-readyChan.(chan struct{})
 
-				encryptKey, ok := c.encryptKeys.Load(connKey)
-				if !ok {
-					log.Println("no encrypt key found")
-					continue
+				if !c.IsServer {
+					if challenge := isUDPBindChallenge(buffer[:n]); len(challenge) > 0 {
+						c.answerUDPBindChallenge(challenge)
+						continue
+					}
 				}
-				k := encryptKey.(*[encryptKeySize]byte)
-				err = conn.AddCodec(from, k, connMetadata.EncryptionAlgo, false)
-				if err != nil {
-					log.Println(err)
+
+				if !encrypted {
+					log.Println("Unencrypted udp packet received")
 					continue
 				}
 
-				if in == nil && out == nil {
-					k := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
-					addrToKey.Store(from.String(), k)
+				if c.udpFallback != nil && isUDPPing(buffer[:n]) {
+					c.udpFallback.pong()
+					continue
 				}
-				continue
-			}
 
-			if !encrypted {
-				log.Println("Unencrypted udp packet received")
-				continue
-			}
-
-			if n > 0 {
-				b := make([]byte, n)
-				copy(b, buffer[:n])
-				c.udpReadChan <- b
+				if n > 0 {
+					c.rateLimiter.Wait(n)
+					b := make([]byte, n)
+					copy(b, buffer[:n])
+					b, err = c.udpPacketFromPeer(b, from, addrToKey)
+					if err != nil {
+						log.Println("Couldn't read udp packet:", err)
+						continue
+					}
+					c.udpReadChan <- b
 
-				if in != nil {
-					atomic.AddUint64(in, uint64(n))
-				} else {
-					k, ok := addrToKey.Load(from.String())
-					if ok {
-						atomic.AddUint64(&c.reverseBytesEntryToExit[k.(string)][b[2]], uint64(n))
+					if in != nil {
+						atomic.AddUint64(in, uint64(n))
+					} else {
+						k, ok := addrToKey.Load(from.String())
+						if ok {
+							c.addSessionBytes(k.(string), b[2], n, true)
+						}
 					}
 				}
 			}
@@ -475,36 +622,150 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 	}()
 
 	go func() {
-		for {
-			if c.isClosed {
+		msgs := make([]UDPMessage, 0, udpBatchSize)
+		connKeys := make([]string, 0, udpBatchSize)
+
+		count := func(data []byte, connKey string, n int) {
+			if out != nil {
+				atomic.AddUint64(out, uint64(n))
+			} else if len(connKey) > 0 {
+				c.addSessionBytes(connKey, data[2], n, false)
+			}
+		}
+
+		// add sends data over session if UDP falls back to it, or adds data to
+		// msgs that are sent over UDP in batch.
+		add := func(data []byte) {
+			if len(data) < udpHeaderSize {
+				log.Println("empty udp packet to send")
 				return
 			}
 			to := toAddr
-			select {
-			case data := <-c.udpWriteChan:
+			version := udpHeaderVersionOf(c.getRemoteCapabilities())
+			var writer udpPacketWriter
+			var connKey string
+			if c.udpFlows != nil {
+				flow, ok := c.udpFlows.get(udpPacketFlowID(data))
+				if !ok {
+					log.Println("Couldn't get udp flow:", udpPacketFlowID(data))
+					return
+				}
+				to, writer = flow.path()
+				version = flow.version
+				connKey = flow.connKey
+				setUDPPacketFlowID(data, flow.remoteID)
+			} else {
 				if conn.RemoteAddr() == nil && from != nil && toAddr == nil {
 					to = from
 				}
-				n, _, err := conn.WriteMsgUDP(data, nil, to)
+				if c.udpFallback != nil {
+					writer = c.udpFallback.getWriter()
+				}
+			}
+			data = udpPacketToWire(data, version)
+			c.rateLimiter.Wait(len(data))
+			if writer != nil {
+				err := writer.writeUDPPacket(data)
 				if err != nil {
 					log.Println("Couldn't send data to server:", err)
+					return
+				}
+				count(data, connKey, len(data))
+				return
+			}
+			msgs = append(msgs, UDPMessage{Buffer: data, N: len(data), Addr: to})
+			connKeys = append(connKeys, connKey)
+		}
+
+		for {
+			if c.isClosed {
+				return
+			}
+			select {
+			case data := <-c.udpWriteChan:
+				add(data)
+				// Packets that are already waiting are sent in the same batch.
+			drain:
+				for len(msgs) < udpBatchSize {
+					select {
+					case data = <-c.udpWriteChan:
+						add(data)
+					default:
+						break drain
+					}
+				}
+				if len(msgs) == 0 {
 					continue
 				}
-				if out != nil {
-					atomic.AddUint64(out, uint64(n))
-				} else {
-					k, ok := addrToKey.Load(from.String())
-					if ok {
-						atomic.AddUint64(&c.reverseBytesExitToEntry[k.(string)][data[2]], uint64(n))
+
+				written, err := conn.WriteBatchEncrypted(msgs)
+				for i := 0; i < written; i++ {
+					count(msgs[i].Buffer, connKeys[i], msgs[i].N)
+				}
+				for i := range msgs {
+					msgs[i] = UDPMessage{}
+				}
+				msgs, connKeys = msgs[:0], connKeys[:0]
+				if err != nil {
+					log.Println("Couldn't send data to server:", err)
+					if errors.Is(err, io.ErrClosedPipe) {
+						return
 					}
 				}
 			case <-c.udpCloseChan:
 				return
+			case <-stopChan:
+				return
 			}
 		}
 	}()
 }
 
+// udpPacketFromPeer converts a packet received from peer to internal packet.
+// On exit, flow ID allocated by entry is mapped to a local flow ID that is
+// unique across entries.
+func (c *Common) udpPacketFromPeer(b []byte, from *net.UDPAddr, addrToKey *sync.Map) ([]byte, error) {
+	if c.udpFlows == nil {
+		return udpPacketFromWire(b, udpHeaderVersionOf(c.getRemoteCapabilities()))
+	}
+
+	var connKey string
+	if k, ok := addrToKey.Load(from.String()); ok {
+		connKey = k.(string)
+	}
+	addr := *from
+	return c.mapUDPFlow(b, connKey, udpHeaderVersionOf(c.getConnCapabilities(connKey)), &addr, nil)
+}
+
+// mapUDPFlow converts a packet received from entry of connKey to internal
+// packet with local flow ID, and sends later packets of the flow to where it's
+// received from, which is either addr or writer of session path.
+func (c *Common) mapUDPFlow(b []byte, connKey string, version byte, addr *net.UDPAddr, writer udpPacketWriter) ([]byte, error) {
+	b, err := udpPacketFromWire(b, version)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteID := udpPacketFlowID(b)
+	peer := connKey
+	if len(peer) == 0 {
+		peer = addr.String()
+	}
+	key := peer + "/" + strconv.FormatUint(uint64(remoteID), 10)
+	flow, err := c.udpFlows.getOrCreate(key, func(flow *udpFlow) {
+		flow.remoteID = remoteID
+		flow.version = version
+		flow.connKey = connKey
+	})
+	if err != nil {
+		return nil, err
+	}
+	flow.setPath(addr, writer)
+	setUDPPacketFlowID(b, flow.id)
+
+	return b, nil
+}
+
 func (c *Common) getOrComputeSharedKey(remotePublicKey []byte) (*[sharedKeySize]byte, error) {
 	c.RLock()
 	sharedKey, ok := c.sharedKeys[string(remotePublicKey)]
@@ -534,11 +795,11 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 	var connNonce []byte
 	var encryptionAlgo pb.EncryptionAlgo
 	var remoteConnMetadata *pb.ConnectionMetadata
+	initiator := len(remotePublicKey) > 0
 	if localConnMetadata == nil {
 		localConnMetadata = &pb.ConnectionMetadata{}
 	} else {
-		connMetadataCopy := *localConnMetadata
-		localConnMetadata = &connMetadataCopy
+		localConnMetadata = proto.Clone(localConnMetadata).(*pb.ConnectionMetadata)
 	}
 
 	err := conn.SetDeadline(time.Now().Add(10 * time.Second))
@@ -548,9 +809,19 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 
 	defer conn.SetDeadline(time.Time{})
 
-	if len(remotePublicKey) > 0 {
+	setProtocol(localConnMetadata)
+	localConnMetadata.MuxConfig = c.muxConfig.metadata()
+	localConnMetadata.CompressionAlgos = supportedCompressionAlgos()
+	ephemeral, err := newEphemeralKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	localConnMetadata.EphemeralPublicKey = ephemeral.publicKey
+
+	if initiator {
 		encryptionAlgo = c.encryptionAlgo
 		localConnMetadata.EncryptionAlgo = encryptionAlgo
+		localConnMetadata.EncryptionAlgos = c.encryptionAlgos
 		localConnMetadata.PublicKey = c.Wallet.PubKey()
 
 		err := writeConnMetadata(conn, localConnMetadata)
@@ -570,6 +841,7 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 		connNonce = util.RandomBytes(connNonceSize)
 		localConnMetadata.Nonce = connNonce
 		localConnMetadata.PublicKey = c.Wallet.PubKey()
+		localConnMetadata.EncryptionAlgos = supportedEncryptionAlgos()
 
 		err := writeConnMetadata(conn, localConnMetadata)
 		if err != nil {
@@ -590,6 +862,26 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 		remotePublicKey = remoteConnMetadata.PublicKey
 	}
 
+	capabilities := negotiateCapabilities(remoteConnMetadata)
+	if hasCapability(capabilities, CapabilityCipherNegotiation) {
+		if initiator {
+			encryptionAlgo = negotiateEncryptionAlgo(localConnMetadata.EncryptionAlgos, remoteConnMetadata.EncryptionAlgos, encryptionAlgo)
+		} else {
+			encryptionAlgo = negotiateEncryptionAlgo(remoteConnMetadata.EncryptionAlgos, localConnMetadata.EncryptionAlgos, encryptionAlgo)
+		}
+	}
+	if hasCapability(capabilities, CapabilityEphemeralKey) {
+		err = c.exchangeEphemeralKeySignature(conn, initiator, connNonce, localConnMetadata, remoteConnMetadata, encryptionAlgo)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if c.requireEphemeralKey {
+		return nil, nil, errors.New("remote peer doesn't support ephemeral key exchange")
+	} else if remoteConnMetadata.ProtocolVersion >= ephemeralKeyProtocolVersion {
+		return nil, nil, fmt.Errorf("remote peer of protocol version %d doesn't advertise ephemeral key exchange, handshake may be tampered", remoteConnMetadata.ProtocolVersion)
+	} else {
+		log.Printf("Ephemeral key exchange is not used with %x of protocol version %d, connection is not forward secret and may be downgraded by a man in the middle, set requireEphemeralKey to refuse it", remotePublicKey, remoteConnMetadata.ProtocolVersion)
+	}
 	k := string(append(remotePublicKey, connNonce...))
 	encryptKey := new([encryptKeySize]byte)
 	if encryptionAlgo != pb.EncryptionAlgo_ENCRYPTION_NONE {
@@ -598,9 +890,19 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 			return nil, nil, err
 		}
 
-		encryptKey = computeEncryptKey(connNonce, sharedKey[:])
+		if hasCapability(capabilities, CapabilityEphemeralKey) {
+			ephemeralSharedKey, err := ephemeral.sharedKey(remoteConnMetadata.EphemeralPublicKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			encryptKey = computeEncryptKey(connNonce, append(sharedKey[:], ephemeralSharedKey...))
+		} else {
+			encryptKey = computeEncryptKey(connNonce, sharedKey[:])
+		}
 	}
 	c.encryptKeys.Store(k, encryptKey)
+	c.encryptionAlgosUsed.Store(k, encryptionAlgo)
+	c.connCapabilities.Store(k, capabilities)
 
 	if c.IsServer {
 		readyChan, _ := c.connReadyChan.LoadOrStore(k, make(chan struct{}, 1))
@@ -614,7 +916,7 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 		return conn, remoteConnMetadata, nil
 	}
 
-	encryptedConn, err := encryptConn(conn, encryptKey, encryptionAlgo, len(remotePublicKey) > 0)
+	encryptedConn, err := encryptConn(conn, encryptKey, encryptionAlgo, initiator, hasCapability(capabilities, CapabilityNonceVerification), c.getRekeyPolicy(capabilities))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -622,7 +924,216 @@ func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetada
 	return encryptedConn, remoteConnMetadata, nil
 }
 
-func (c *Common) wrapUDPConn(conn UDPConn, addr *net.UDPAddr, remotePublicKey []byte, connNonce []byte) (*EncryptUDPConn, error) {
+// exchangeEphemeralKeySignature sends the signature of handshake transcript
+// after both sides have sent their metadata and selected encryption algo, and
+// verifies the one of remote peer.
+func (c *Common) exchangeEphemeralKeySignature(conn net.Conn, initiator bool, connNonce []byte, localConnMetadata, remoteConnMetadata *pb.ConnectionMetadata, encryptionAlgo pb.EncryptionAlgo) error {
+	initiatorMetadata, responderMetadata := localConnMetadata, remoteConnMetadata
+	localSigner, remoteSigner := ephemeralKeySignerInitiator, ephemeralKeySignerResponder
+	if !initiator {
+		initiatorMetadata, responderMetadata = remoteConnMetadata, localConnMetadata
+		localSigner, remoteSigner = ephemeralKeySignerResponder, ephemeralKeySignerInitiator
+	}
+
+	signature, err := signEphemeralKey(c.Wallet.Seed(), ephemeralKeyTranscript(localSigner, connNonce, initiatorMetadata, responderMetadata, encryptionAlgo))
+	if err != nil {
+		return err
+	}
+	err = writeConnMetadata(conn, &pb.ConnectionMetadata{EphemeralSignature: signature})
+	if err != nil {
+		return err
+	}
+
+	remoteSignature, err := readConnMetadata(conn)
+	if err != nil {
+		return err
+	}
+	return verifyEphemeralKey(remoteConnMetadata.PublicKey, remoteConnMetadata.EphemeralPublicKey, ephemeralKeyTranscript(remoteSigner, connNonce, initiatorMetadata, responderMetadata, encryptionAlgo), remoteSignature.EphemeralSignature)
+}
+
+// waitConnReady returns whether TCP handshake of conn is finished, waiting for
+// it up to timeout. The ready channel of an unknown conn is removed on timeout,
+// so that spoofed UDP metadata doesn't leave it behind.
+func (c *Common) waitConnReady(connKey string, timeout time.Duration) bool {
+	rc, _ := c.connReadyChan.LoadOrStore(connKey, make(chan struct{}, 1))
+	readyChan := rc.(chan struct{})
+
+	// metadata of the same conn is received again when it answers bind
+	// challenge, so ready signal is put back after it's taken
+	ready := func() bool {
+		select {
+		case readyChan <- struct{}{}:
+		default:
+		}
+		return true
+	}
+
+	select {
+	case <-readyChan:
+		return ready()
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-readyChan:
+		return ready()
+	case <-timer.C:
+		if _, ok := c.encryptKeys.Load(connKey); !ok {
+			c.connReadyChan.CompareAndDelete(connKey, rc)
+		}
+		return false
+	}
+}
+
+// bindUDPConn handles the UDP metadata that client sends to bind its UDP conn
+// from addr, after TCP handshake of the conn is finished.
+func (c *Common) bindUDPConn(conn *EncryptUDPConn, from *net.UDPAddr, connMetadata *pb.ConnectionMetadata, connKey string, in, out *uint64, addrToKey *sync.Map) {
+	encryptKey, ok := c.encryptKeys.Load(connKey)
+	if !ok {
+		log.Println("no encrypt key found")
+		return
+	}
+	k := encryptKey.(*[encryptKeySize]byte)
+	encryptionAlgo, ok := c.getConnEncryptionAlgo(connKey)
+	if !ok {
+		log.Println("no encryption algo found")
+		return
+	}
+	if connMetadata.EncryptionAlgo != encryptionAlgo {
+		log.Println("Couldn't bind udp conn from", from, "error:", errUDPEncryptionAlgo)
+		return
+	}
+	capabilities := c.getConnCapabilities(connKey)
+	replayProtection := hasCapability(capabilities, CapabilityUDPReplayProtection)
+	if replayProtection {
+		if len(connMetadata.UdpBindChallenge) == 0 {
+			replyUDPBindChallenge(conn, c.udpBinder, from, connKey)
+			return
+		}
+		err := c.udpBinder.verify(from, connKey, k, encryptionAlgo, connMetadata.UdpBindSequence, connMetadata.UdpBindChallenge, connMetadata.UdpBindProof)
+		if err == errInvalidUDPBindChallenge {
+			replyUDPBindChallenge(conn, c.udpBinder, from, connKey)
+			return
+		}
+		if err != nil {
+			log.Println("Couldn't bind udp conn from", from, "error:", err)
+			return
+		}
+	}
+	err := conn.AddCodec(from, k, encryptionAlgo, false, c.getRekeyPolicy(capabilities), replayProtection)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if in == nil && out == nil {
+		addrToKey.Store(from.String(), connKey)
+	}
+}
+
+func (c *Common) setUDPBindRequest(request *udpBindRequest) {
+	c.Lock()
+	c.udpBindRequest = request
+	c.Unlock()
+}
+
+// sendUDPBindRequest sends the bind metadata of current UDP conn again, which
+// starts over bind handshake.
+func (c *Common) sendUDPBindRequest() error {
+	c.RLock()
+	request := c.udpBindRequest
+	c.RUnlock()
+	if request == nil {
+		return nil
+	}
+	return request.send()
+}
+
+// answerUDPBindChallenge answers the challenge of server to bind current UDP
+// conn.
+func (c *Common) answerUDPBindChallenge(challenge []byte) {
+	c.RLock()
+	request := c.udpBindRequest
+	c.RUnlock()
+	if request == nil {
+		return
+	}
+	err := request.answer(challenge)
+	if err != nil {
+		log.Println("Couldn't answer udp bind challenge:", err)
+	}
+}
+
+// getConnCapabilities returns the capabilities negotiated in TCP handshake of
+// a conn, which are trusted over the ones in UDP metadata that is not
+// authenticated.
+// setSessionBytes sets the bytes counters by service of the session of conn
+// key.
+func (c *Common) setSessionBytes(connKey string, bytesEntryToExit, bytesExitToEntry []uint64) {
+	c.sessionBytesLock.Lock()
+	defer c.sessionBytesLock.Unlock()
+	c.reverseBytesEntryToExit[connKey] = bytesEntryToExit
+	c.reverseBytesExitToEntry[connKey] = bytesExitToEntry
+}
+
+// getSessionBytes returns the bytes counters by service of the session of conn
+// key, which are updated atomically.
+func (c *Common) getSessionBytes(connKey string) ([]uint64, []uint64, bool) {
+	c.sessionBytesLock.RLock()
+	defer c.sessionBytesLock.RUnlock()
+	bytesEntryToExit, ok := c.reverseBytesEntryToExit[connKey]
+	return bytesEntryToExit, c.reverseBytesExitToEntry[connKey], ok
+}
+
+// addSessionBytes adds n to bytes counter of service in the given direction of
+// the session of conn key, if the session exists.
+func (c *Common) addSessionBytes(connKey string, serviceID byte, n int, entryToExit bool) {
+	bytesEntryToExit, bytesExitToEntry, ok := c.getSessionBytes(connKey)
+	if !ok {
+		return
+	}
+	if entryToExit {
+		atomic.AddUint64(&bytesEntryToExit[serviceID], uint64(n))
+	} else {
+		atomic.AddUint64(&bytesExitToEntry[serviceID], uint64(n))
+	}
+}
+
+func (c *Common) getConnCapabilities(connKey string) uint64 {
+	if capabilities, ok := c.connCapabilities.Load(connKey); ok {
+		return capabilities.(uint64)
+	}
+	return 0
+}
+
+// getConnEncryptionAlgo returns the encryption algo negotiated in TCP
+// handshake of a conn, which is trusted over the one in UDP metadata that is
+// not authenticated.
+func (c *Common) getConnEncryptionAlgo(connKey string) (pb.EncryptionAlgo, bool) {
+	if algo, ok := c.encryptionAlgosUsed.Load(connKey); ok {
+		return algo.(pb.EncryptionAlgo), true
+	}
+	return pb.EncryptionAlgo_ENCRYPTION_NONE, false
+}
+
+// getRekeyPolicy returns the rekey policy to use on a conn with negotiated
+// capabilities, or nil if peer doesn't support rekey.
+func (c *Common) getRekeyPolicy(capabilities uint64) *RekeyPolicy {
+	if !hasCapability(capabilities, CapabilityRekey) {
+		return nil
+	}
+	policy := c.rekeyPolicy
+	return &policy
+}
+
+// wrapUDPConn adds the codec of server to client UDP conn. Capabilities are the
+// ones negotiated in TCP handshake.
+func (c *Common) wrapUDPConn(conn UDPConn, addr *net.UDPAddr, remotePublicKey []byte, connNonce []byte, capabilities uint64) (*EncryptUDPConn, error) {
 	localConnMetadata := new(pb.ConnectionMetadata)
 	var err error
 	var encryptionAlgo pb.EncryptionAlgo
@@ -639,22 +1150,40 @@ func (c *Common) wrapUDPConn(conn UDPConn, addr *net.UDPAddr, remotePublicKey []
 	}
 
 	if len(remotePublicKey) > 0 {
-		localConnMetadata.EncryptionAlgo = c.encryptionAlgo
+		if algo, ok := c.encryptionAlgosUsed.Load(string(append(remotePublicKey, connNonce...))); ok {
+			encryptionAlgo = algo.(pb.EncryptionAlgo)
+		}
+		localConnMetadata.EncryptionAlgo = encryptionAlgo
 		localConnMetadata.PublicKey = c.Wallet.PubKey()
 		localConnMetadata.Nonce = connNonce
+		connKey := string(append(remotePublicKey, connNonce...))
+		encryptKey, ok := c.encryptKeys.Load(connKey)
+		if !ok || encryptKey == nil {
+			return nil, fmt.Errorf("encrypted key for UDP conn not found")
+		}
+		k := encryptKey.(*[encryptKeySize]byte)
+
+		// Metadata is sent several times in case of packet loss, and again
+		// when UDP falls back to TCP session. With replay protection, server
+		// replies with a challenge bound to the source address it observes,
+		// and only binds the conn when metadata is sent again with proof over
+		// the challenge.
+		replayProtection := hasCapability(capabilities, CapabilityUDPReplayProtection)
+		request := &udpBindRequest{
+			conn:       conn,
+			metadata:   localConnMetadata,
+			encryptKey: k,
+			connKey:    string(append(c.Wallet.PubKey(), connNonce...)),
+		}
+		c.setUDPBindRequest(request)
 		for i := 0; i < 3; i++ {
-			err = writeUDPConnMetadata(conn, nil, localConnMetadata)
+			err = request.send()
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		encryptKey, ok := c.encryptKeys.Load(string(append(remotePublicKey, connNonce...)))
-		if !ok || encryptKey == nil {
-			return nil, fmt.Errorf("encrypted key for UDP conn not found")
-		}
-		k := encryptKey.(*[encryptKeySize]byte)
-		err = encConn.AddCodec(addr, k, encryptionAlgo, true)
+		err = encConn.AddCodec(addr, k, encryptionAlgo, true, c.getRekeyPolicy(capabilities), replayProtection)
 		if err != nil {
 			return nil, err
 		}
@@ -664,34 +1193,66 @@ func (c *Common) wrapUDPConn(conn UDPConn, addr *net.UDPAddr, remotePublicKey []
 }
 
 func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
-	hasUDP := len(c.Service.UDP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceUdp) > 0)
 	metadata := c.GetMetadata()
 
 	Close(c.GetTCPConn())
+	c.closeQUICConn()
 
-	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
-	var tcpConn net.Conn
+	// Session starts before dialing the conn that is used, so that it's no
+	// later than the session start of service provider, which is when the conn
+	// is accepted.
+	var connectedAt time.Time
+	var remoteMetadata *pb.ConnectionMetadata
 	var err error
-	if c.TcpDialContext != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.DialTimeout)*time.Second)
-		defer cancel()
-		tcpConn, err = c.TcpDialContext(ctx, tcp4, addr)
-	} else {
-		tcpConn, err = net.DialTimeout(
-			tcp4,
-			addr,
-			time.Duration(c.DialTimeout)*time.Second,
-		)
+	if c.preferQUIC && metadata.QuicPort > 0 {
+		connectedAt = time.Now()
+		remoteMetadata, err = c.dialQUIC(metadata, remotePublicKey)
+		if err != nil {
+			log.Println("Couldn't connect to QUIC, falling back to TCP:", err)
+		}
 	}
+	if remoteMetadata == nil {
+		connectedAt = time.Now()
+		remoteMetadata, err = c.dialTCP(metadata, remotePublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	c.connectedAt = connectedAt
+	c.servedFree = false
+	if c.bytesUsed != nil {
+		c.sessionBytesEntryToExit, c.sessionBytesExitToEntry = c.bytesUsed()
+	}
+	c.remoteCapabilities = negotiateCapabilities(remoteMetadata)
+	c.remoteMuxConfig = remoteMuxConfig(remoteMetadata)
+	c.remoteCompressionAlgos = remoteMetadata.CompressionAlgos
+	c.Unlock()
+
+	c.SetConnected(true)
+
+	c.OnConnect.receive()
+
+	return nil
+}
+
+// dialTCP connects to server of metadata over TCP, and UDP if there are UDP
+// services.
+func (c *Common) dialTCP(metadata *pb.ServiceMetadata, remotePublicKey []byte) (*pb.ConnectionMetadata, error) {
+	hasUDP := len(c.Service.UDP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceUdp) > 0)
+
+	tcpConn, addr, err := c.dialServer(metadata, remotePublicKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	encryptedConn, remoteMetadata, err := c.wrapConn(tcpConn, remotePublicKey, nil)
 	if err != nil {
 		Close(tcpConn)
-		return err
+		return nil, err
 	}
+	capabilities := negotiateCapabilities(remoteMetadata)
 
 	c.SetServerTCPConn(encryptedConn)
 
@@ -708,21 +1269,17 @@ func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
 			addr,
 		)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		uConn, err := c.wrapUDPConn(udpConn, addr, remotePublicKey, remoteMetadata.Nonce)
+		uConn, err := c.wrapUDPConn(udpConn, addr, remotePublicKey, remoteMetadata.Nonce, capabilities)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		c.SetServerUDPConn(uConn)
 		log.Println("Connected to UDP at", addr.String())
 	}
 
-	c.SetConnected(true)
-
-	c.OnConnect.receive()
-
-	return nil
+	return remoteMetadata, nil
 }
 
 func (c *Common) CreateServerConn(force bool) error {
@@ -766,12 +1323,12 @@ func (c *Common) CreateServerConn(force bool) error {
 				if c.presetNode == nil {
 					subscription, err := c.Client.GetSubscription(c.SubscriptionPrefix+c.Service.Name, subscriber.Address)
 					if err == nil {
-						latestMeta, err := ReadMetadata(subscription.Meta)
-						if err == nil {
-							metadata = latestMeta
-						} else {
+						latestMeta, err := c.readSubscriberMetadata(subscription.Meta, subscriber.Address)
+						if err != nil {
 							log.Println(err)
+							continue
 						}
+						metadata = latestMeta
 					} else {
 						log.Println(err)
 					}
@@ -781,7 +1338,7 @@ func (c *Common) CreateServerConn(force bool) error {
 
 				log.Printf("IP: %s, address: %s, delay: %.3f ms, bandwidth: %f KB/s", metadata.Ip, subscriber.Address, subscriber.Delay, subscriber.Bandwidth/1024)
 
-				entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+				pricing, err := ParsePricingModel(metadata)
 				if err != nil {
 					log.Println(err)
 					continue
@@ -808,8 +1365,9 @@ func (c *Common) CreateServerConn(force bool) error {
 				}
 				c.Lock()
 				c.remoteNknAddress = subscriber.Address
-				c.entryToExitPrice = entryToExitPrice
-				c.exitToEntryPrice = exitToEntryPrice
+				c.entryToExitPrice = pricing.EntryToExitPrice
+				c.exitToEntryPrice = pricing.ExitToEntryPrice
+				c.pricing = pricing
 				if c.ReverseMetadata != nil {
 					c.metadata.ServiceTcp = c.ReverseMetadata.ServiceTcp
 					c.metadata.ServiceUdp = c.ReverseMetadata.ServiceUdp
@@ -997,11 +1555,60 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 	return allSubscribers, subscriberRaw, nil
 }
 
-func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[string]string) types.Nodes {
+// getMaxPrice returns the max accepted price of service, lowered by price
+// ceiling if one is set.
+func (c *Common) getMaxPrice() (common.Fixed64, common.Fixed64, error) {
 	entryToExitMaxPrice, exitToEntryMaxPrice, err := ParsePrice(c.ServiceInfo.MaxPrice)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	if c.hasPriceCeiling {
+		if c.entryToExitPriceCeiling < entryToExitMaxPrice {
+			entryToExitMaxPrice = c.entryToExitPriceCeiling
+		}
+		if c.exitToEntryPriceCeiling < exitToEntryMaxPrice {
+			exitToEntryMaxPrice = c.exitToEntryPriceCeiling
+		}
+	}
+
+	return entryToExitMaxPrice, exitToEntryMaxPrice, nil
+}
+
+// SetPriceCeiling sets an upper bound on the price of service providers to be
+// selected in addition to max price of service.
+func (c *Common) SetPriceCeiling(entryToExitPrice, exitToEntryPrice common.Fixed64) {
+	c.setPriceCeiling(entryToExitPrice, exitToEntryPrice, true)
+}
+
+func (c *Common) getPriceCeiling() (common.Fixed64, common.Fixed64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.entryToExitPriceCeiling, c.exitToEntryPriceCeiling, c.hasPriceCeiling
+}
+
+func (c *Common) setPriceCeiling(entryToExitPrice, exitToEntryPrice common.Fixed64, hasPriceCeiling bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.entryToExitPriceCeiling = entryToExitPrice
+	c.exitToEntryPriceCeiling = exitToEntryPrice
+	c.hasPriceCeiling = hasPriceCeiling
+}
+
+func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[string]string) types.Nodes {
+	entryToExitMaxPrice, exitToEntryMaxPrice, err := c.getMaxPrice()
 	if err != nil {
 		log.Fatalf("Parse price of service error: %v", err)
 	}
+	var maxPricePerMinute common.Fixed64
+	if len(c.ServiceInfo.MaxPricePerMinute) > 0 {
+		maxPricePerMinute, err = common.StringToFixed64(c.ServiceInfo.MaxPricePerMinute)
+		if err != nil {
+			log.Fatalf("Parse price per minute of service error: %v", err)
+		}
+	}
 	filterSubs := make(types.Nodes, 0, len(allSubscribers))
 
 	var nodes []*net.IPNet
@@ -1011,19 +1618,23 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 
 	for _, subscriber := range allSubscribers {
 		metadataString := subscriberRaw[subscriber]
-		metadata, err := ReadMetadata(metadataString)
+		metadata, err := c.readSubscriberMetadata(metadataString, subscriber)
 		if err != nil {
-			log.Println("Couldn't unmarshal metadata:", err)
+			log.Println("Couldn't read metadata:", err)
 			continue
 		}
-		entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+		pricing, err := ParsePricingModel(metadata)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
+		entryToExitPrice, exitToEntryPrice := pricing.MaxTrafficPrice()
 		if entryToExitPrice > entryToExitMaxPrice || exitToEntryPrice > exitToEntryMaxPrice {
 			continue
 		}
+		if pricing.PricePerMinute > maxPricePerMinute {
+			continue
+		}
 
 		if !c.ServiceInfo.NknFilter.IsAllow(&filter.NknClient{Address: subscriber}) {
 			continue
@@ -1233,20 +1844,104 @@ func (c *Common) startPayment(
 	nanoPayFee string,
 	minNanoPayFee string,
 	nanoPayFeePercentage float64,
-	getPaymentStreamRecipient func() (*smux.Stream, string, error),
+	getPaymentStreamRecipient func() (Stream, string, error),
 ) {
-	var np *nkn.NanoPay
+	var np *nanoPay
 	var bytesEntryToExit, bytesExitToEntry uint64
 	var cost, lastCost common.Fixed64
-	entryToExitPrice, exitToEntryPrice := c.GetPrice()
 	lastPaymentTime := time.Now()
 
+	c.Lock()
+	c.bytesUsed = func() (uint64, uint64) {
+		return atomic.LoadUint64(bytesEntryToExitUsed), atomic.LoadUint64(bytesExitToEntryUsed)
+	}
+	c.Unlock()
+
+	// Cost is computed for each session (connection to a service provider) as
+	// pricing model may charge by session volume and duration. Session starts
+	// when connecting to service provider, with bytes used at that time as
+	// baseline.
+	var sessionStart time.Time
+	var sessionBytesEntryToExit, sessionBytesExitToEntry uint64
+	var sessionPaid common.Fixed64
+	getCost := func(bytesEntryToExit, bytesExitToEntry uint64) common.Fixed64 {
+		c.RLock()
+		connectedAt := c.connectedAt
+		baseEntryToExit, baseExitToEntry := c.sessionBytesEntryToExit, c.sessionBytesExitToEntry
+		pricing := c.pricing
+		c.RUnlock()
+		if !connectedAt.Equal(sessionStart) {
+			// Bytes of previous session that are not paid are not charged to
+			// the new session.
+			if unpaid := baseEntryToExit + baseExitToEntry - *bytesEntryToExitPaid - *bytesExitToEntryPaid; unpaid > 0 {
+				log.Printf("%d bytes of previous session are not paid", unpaid)
+			}
+			*bytesEntryToExitPaid, *bytesExitToEntryPaid = baseEntryToExit, baseExitToEntry
+			sessionStart = connectedAt
+			sessionBytesEntryToExit, sessionBytesExitToEntry = baseEntryToExit, baseExitToEntry
+			sessionPaid = 0
+		}
+		if pricing == nil {
+			return 0
+		}
+		return pricing.Cost(bytesEntryToExit-sessionBytesEntryToExit, bytesExitToEntry-sessionBytesExitToEntry, time.Since(sessionStart)) - sessionPaid
+	}
+
+	checkBudget := func() {
+		if c.budget == nil || c.onBudget == nil || c.isServedFree() {
+			return
+		}
+		pending := getCost(atomic.LoadUint64(bytesEntryToExitUsed), atomic.LoadUint64(bytesExitToEntryUsed))
+		c.onBudget(pending, sessionStart)
+	}
+
+	// Traffic served without payment is recorded with free role.
+	recordPayment := func(bytesEntryToExit, bytesExitToEntry uint64, amount common.Fixed64, recipient, txnID string) {
+		if c.ledger == nil || (bytesEntryToExit == 0 && bytesExitToEntry == 0 && amount == 0) {
+			return
+		}
+		role := storage.LedgerRoleSpend
+		if c.isServedFree() {
+			role = storage.LedgerRoleFree
+		}
+		c.RLock()
+		sessionStart := c.connectedAt.Unix()
+		peerKey := peerKeyFromClientAddr(c.remoteNknAddress)
+		var price string
+		if c.metadata != nil {
+			price = c.metadata.Price
+		}
+		c.RUnlock()
+		var service string
+		if c.Service != nil {
+			service = c.Service.Name
+		}
+		c.appendLedger(&storage.UsageRecord{
+			SessionStart:     sessionStart,
+			Role:             role,
+			PeerKey:          peerKey,
+			Recipient:        recipient,
+			Service:          service,
+			BytesEntryToExit: bytesEntryToExit,
+			BytesExitToEntry: bytesExitToEntry,
+			Price:            price,
+			Amount:           amount.String(),
+			TxnID:            txnID,
+		})
+	}
+
 	for {
 		for {
 			time.Sleep(100 * time.Millisecond)
 			if c.isClosed {
+				recordPayment(
+					atomic.LoadUint64(bytesEntryToExitUsed)-*bytesEntryToExitPaid,
+					atomic.LoadUint64(bytesExitToEntryUsed)-*bytesExitToEntryPaid,
+					0, "", "",
+				)
 				return
 			}
+			checkBudget()
 			bytesEntryToExit = atomic.LoadUint64(bytesEntryToExitUsed)
 			bytesExitToEntry = atomic.LoadUint64(bytesExitToEntryUsed)
 			if (bytesEntryToExit+bytesExitToEntry)-(*bytesEntryToExitPaid+*bytesExitToEntryPaid) > trafficPaymentThreshold*TrafficUnit {
@@ -1259,7 +1954,16 @@ func (c *Common) startPayment(
 
 		bytesEntryToExit = atomic.LoadUint64(bytesEntryToExitUsed)
 		bytesExitToEntry = atomic.LoadUint64(bytesExitToEntryUsed)
-		cost = entryToExitPrice*common.Fixed64(bytesEntryToExit-*bytesEntryToExitPaid)/TrafficUnit + exitToEntryPrice*common.Fixed64(bytesExitToEntry-*bytesExitToEntryPaid)/TrafficUnit
+		cost = getCost(bytesEntryToExit, bytesExitToEntry)
+		if c.isServedFree() {
+			recordPayment(bytesEntryToExit-*bytesEntryToExitPaid, bytesExitToEntry-*bytesExitToEntryPaid, 0, "", "")
+			*bytesEntryToExitPaid = bytesEntryToExit
+			*bytesExitToEntryPaid = bytesExitToEntry
+			sessionPaid += cost
+			lastCost = 0
+			lastPaymentTime = time.Now()
+			continue
+		}
 		if cost == lastCost || cost <= common.Fixed64(0) {
 			continue
 		}
@@ -1276,7 +1980,7 @@ func (c *Common) startPayment(
 		}
 
 		if np == nil || np.Recipient() != paymentReceiver {
-			np, err = c.Client.NewNanoPay(paymentReceiver, nanoPayFee, defaultNanoPayDuration)
+			np, err = c.getNanoPay(paymentReceiver, nanoPayFee, defaultNanoPayDuration)
 			if err != nil {
 				log.Printf("Create nanopay err: %v", err)
 				continue
@@ -1297,13 +2001,23 @@ func (c *Common) startPayment(
 			nanoPayFee = fee.String()
 		}
 
-		err = sendNanoPay(np, paymentStream, cost, nanoPayFee)
+		c.paymentStreamLock.Lock()
+		tx, err := sendNanoPay(np, paymentStream, cost, nanoPayFee)
+		c.paymentStreamLock.Unlock()
 		if err != nil {
 			log.Printf("Send nanopay err: %v", err)
 			return
 		}
 		log.Printf("send nanopay success: %s", cost.String())
 
+		sessionPaid += cost
+		if c.budget != nil {
+			c.budget.add(cost, sessionStart)
+		}
+
+		txnHash := tx.Hash()
+		recordPayment(bytesEntryToExit-*bytesEntryToExitPaid, bytesExitToEntry-*bytesExitToEntryPaid, cost, paymentReceiver, txnHash.ToHexString())
+
 		*bytesEntryToExitPaid = bytesEntryToExit
 		*bytesExitToEntryPaid = bytesExitToEntry
 		lastCost = cost
@@ -1311,16 +2025,18 @@ func (c *Common) startPayment(
 	}
 }
 
-func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) {
+// pipe copies src to dest, and then closes them by closer, which is shared by
+// the pipe of the opposite direction.
+func (c *Common) pipe(dest io.Writer, src io.Reader, written *uint64, closer *pipeCloser, limiters ...*tunaUtil.RateLimiter) {
 	c.sessionsWaitGroup.Add(1)
 
 	c.Lock()
 	c.activeSessions++
 	c.Unlock()
 
+	var err error
 	defer func() {
-		dest.Close()
-		src.Close()
+		closer.done(dest, err)
 
 		c.Lock()
 		c.activeSessions--
@@ -1329,7 +2045,7 @@ func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) {
 		c.sessionsWaitGroup.Done()
 	}()
 
-	copyBuffer(dest, src, written)
+	err = Copy(dest, src, written, append(limiters, c.rateLimiter)...)
 }
 
 func (c *Common) GetNumActiveSessions() int {
@@ -1406,7 +2122,7 @@ func CreateRawMetadata(
 	price string,
 	beneficiaryAddr string,
 ) []byte {
-	metadata := &pb.ServiceMetadata{
+	return createRawMetadata(&pb.ServiceMetadata{
 		Ip:              ip,
 		TcpPort:         tcpPort,
 		UdpPort:         udpPort,
@@ -1415,7 +2131,10 @@ func CreateRawMetadata(
 		ServiceUdp:      serviceUDP,
 		Price:           price,
 		BeneficiaryAddr: beneficiaryAddr,
-	}
+	})
+}
+
+func createRawMetadata(metadata *pb.ServiceMetadata) []byte {
 	metadataRaw, err := proto.Marshal(metadata)
 	if err != nil {
 		log.Fatalln(err)
@@ -1440,9 +2159,33 @@ func UpdateMetadata(
 	client *nkn.MultiClient,
 	closeChan chan struct{},
 ) {
-	metadataRaw := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, price, beneficiaryAddr)
+	metadata := &pb.ServiceMetadata{
+		Ip:              ip,
+		TcpPort:         tcpPort,
+		UdpPort:         udpPort,
+		ServiceId:       uint32(serviceID),
+		ServiceTcp:      serviceTCP,
+		ServiceUdp:      serviceUDP,
+		Price:           price,
+		BeneficiaryAddr: beneficiaryAddr,
+	}
+	updateMetadata(serviceName, metadata, subscriptionPrefix, subscriptionDuration, subscriptionFee, subscriptionReplaceTxPool, serviceMetadataMaxAge(defaultMetadataMaxAge), client, closeChan)
+}
+
+func updateMetadata(
+	serviceName string,
+	metadata *pb.ServiceMetadata,
+	subscriptionPrefix string,
+	subscriptionDuration uint32,
+	subscriptionFee string,
+	subscriptionReplaceTxPool bool,
+	metadataMaxAge time.Duration,
+	client *nkn.MultiClient,
+	closeChan chan struct{},
+) {
 	topic := subscriptionPrefix + serviceName
 	identifier := ""
+	subscriber := address.MakeAddressString(client.PubKey(), identifier)
 	subInterval := config.ConsensusDuration
 	if subscriptionDuration > 3 {
 		subInterval = time.Duration(subscriptionDuration-3) * config.ConsensusDuration
@@ -1454,7 +2197,7 @@ func UpdateMetadata(
 			nextSub = time.After(0)
 
 			func() {
-				sub, err := client.GetSubscription(topic, address.MakeAddressString(client.PubKey(), identifier))
+				sub, err := client.GetSubscription(topic, subscriber)
 				if err != nil {
 					log.Println("Get existing subscription error:", err)
 					return
@@ -1464,7 +2207,7 @@ func UpdateMetadata(
 					return
 				}
 
-				if sub.Meta != string(metadataRaw) {
+				if !isSubscribedMetadataFresh(sub.Meta, metadata, topic, subscriber, metadataMaxAge) {
 					log.Println("Existing subscription meta need update.")
 					return
 				}
@@ -1482,8 +2225,14 @@ func UpdateMetadata(
 
 				log.Println("Existing subscription expires after", sub.ExpiresAt-height, "blocks")
 
+				// check again at least every maxCheckSubscribeInterval so that
+				// metadata is signed again before it's too old
 				maxSubDuration := float64(sub.ExpiresAt-height) * float64(config.ConsensusDuration)
-				nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * maxSubDuration))
+				subDuration := time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * maxSubDuration)
+				if metadataMaxAge > 0 && subDuration > maxCheckSubscribeInterval {
+					subDuration = maxCheckSubscribeInterval
+				}
+				nextSub = time.After(subDuration)
 			}()
 
 			select {
@@ -1508,6 +2257,15 @@ func UpdateMetadata(
 				}
 			}
 
+			var metadataRaw []byte
+			signedMetadata, err := SignServiceMetadata(metadata, topic, client.Seed())
+			if err == nil {
+				metadataRaw = []byte(base64.StdEncoding.EncodeToString(signedMetadata))
+			} else {
+				log.Println("Couldn't sign metadata:", err)
+				metadataRaw = createRawMetadata(metadata)
+			}
+
 			addToSubscribeQueue(client, identifier, topic, int(subscriptionDuration), string(metadataRaw), &nkn.TransactionConfig{Fee: subFee.String()}, subscriptionReplaceTxPool)
 
 			nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * float64(subInterval)))
@@ -1522,33 +2280,6 @@ func UpdateMetadata(
 	}()
 }
 
-func copyBuffer(dest io.Writer, src io.Reader, written *uint64) error {
-	buf := make([]byte, pipeBufferSize)
-	for {
-		nr, err := src.Read(buf)
-		if nr > 0 {
-			nw, err := dest.Write(buf[0:nr])
-			if nw > 0 {
-				if written != nil {
-					atomic.AddUint64(written, uint64(nw))
-				}
-			}
-			if err != nil {
-				return err
-			}
-			if nr != nw {
-				return io.ErrShortWrite
-			}
-		}
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			return nil
-		}
-	}
-}
-
 func Close(conn io.Closer) {
 	if conn == nil || reflect.ValueOf(conn).IsNil() {
 		return
@@ -1609,7 +2340,7 @@ func LoadOrCreateAccount(walletFile, passwordFile string) (*vault.Account, error
 	return wallet.GetDefaultAccount()
 }
 
-func openPaymentStream(session *smux.Session) (*smux.Stream, error) {
+func openPaymentStream(session Session) (Stream, error) {
 	stream, err := session.OpenStream()
 	if err != nil {
 		session.Close()
@@ -1628,7 +2359,7 @@ func openPaymentStream(session *smux.Session) (*smux.Stream, error) {
 	return stream, nil
 }
 
-func sendNanoPay(np *nkn.NanoPay, paymentStream *smux.Stream, cost common.Fixed64, nanoPayFee string) error {
+func sendNanoPay(np *nanoPay, paymentStream Stream, cost common.Fixed64, nanoPayFee string) (*transaction.Transaction, error) {
 	var tx *transaction.Transaction
 	var err error
 	for i := 0; i < 3; i++ {
@@ -1641,40 +2372,48 @@ func sendNanoPay(np *nkn.NanoPay, paymentStream *smux.Stream, cost common.Fixed6
 		}
 	}
 	if err != nil || tx == nil || tx.GetSize() == 0 {
-		return fmt.Errorf("send nanopay tx failed: %v", err)
+		return nil, fmt.Errorf("send nanopay tx failed: %v", err)
 	}
 
 	txBytes, err := tx.Marshal()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = WriteVarBytes(paymentStream, txBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return tx, nil
 }
 
-func nanoPayClaim(txBytes []byte, npc *nkn.NanoPayClaimer) (*nkn.Amount, error) {
+// nanoPayClaim claims a nanopay txn and returns the amount paid in current
+// session, txn hash and nanopay channel of txn.
+func nanoPayClaim(txBytes []byte, npc *nkn.NanoPayClaimer, claims *nanoPayClaims) (*nkn.Amount, string, string, error) {
 	if len(txBytes) == 0 {
-		return nil, errors.New("empty txn bytes")
+		return nil, "", "", errors.New("empty txn bytes")
 	}
 
 	tx := &transaction.Transaction{}
 	if err := tx.Unmarshal(txBytes); err != nil {
-		return nil, fmt.Errorf("couldn't unmarshal payment stream data: %v", err)
+		return nil, "", "", fmt.Errorf("couldn't unmarshal payment stream data: %v", err)
 	}
 
 	if tx.UnsignedTx == nil {
-		return nil, errors.New("nil txn body")
+		return nil, "", "", errors.New("nil txn body")
 	}
 
-	return npc.Claim(tx)
+	txnHash := tx.Hash()
+	amount, err := npc.Claim(tx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	paid, channel := claims.add(tx, amount.ToFixed64())
+	return &nkn.Amount{Fixed64: paid}, txnHash.ToHexString(), channel, nil
 }
 
-func checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nkn.OnError, isClosed *bool) {
+func checkNanoPayClaim(session Session, npc *nkn.NanoPayClaimer, onErr *nkn.OnError, isClosed *bool) {
 	for {
 		err, ok := <-onErr.C
 		if !ok {
@@ -1691,8 +2430,13 @@ func checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nk
 	}
 }
 
-func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, isClosed *bool, getTotalCost func() (common.Fixed64, common.Fixed64)) {
+// checkPayment escalates the session by payment policy when payment lags
+// behind cost, and closes the session eventually. Each escalation (and reset
+// once payment catches up) is passed to enforce if it's not nil.
+func checkPayment(session Session, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, isClosed *bool, getTotalCost func() (common.Fixed64, common.Fixed64), getPolicy func() *PaymentPolicy, enforce func(*pb.PaymentNotice)) {
 	var totalCost, totalBytes, totalCostDelayed, totalBytesDelayed common.Fixed64
+	sessionStart := time.Now()
+	action := pb.PaymentAction_PAYMENT_OK
 
 	go func() {
 		for {
@@ -1701,12 +2445,27 @@ func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPayment
 				return
 			}
 			totalCostNow, totalBytesNow := getTotalCost()
-			time.AfterFunc(trafficDelay, func() {
+			time.AfterFunc(getPolicy().trafficDelay(), func() {
 				totalCostDelayed, totalBytesDelayed = totalCostNow, totalBytesNow
 			})
 		}
 	}()
 
+	notify := func(policy *PaymentPolicy, reason string) {
+		notice := &pb.PaymentNotice{
+			Action:   action,
+			Reason:   reason,
+			Paid:     lastPaymentAmount.String(),
+			Expected: totalCost.String(),
+		}
+		if action == pb.PaymentAction_PAYMENT_THROTTLE {
+			notice.ThrottleRate = uint32(*policy.ThrottleRate)
+		}
+		if enforce != nil {
+			enforce(notice)
+		}
+	}
+
 	for {
 		for {
 			time.Sleep(100 * time.Millisecond)
@@ -1717,6 +2476,10 @@ func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPayment
 
 			totalCost, totalBytes = totalCostDelayed, totalBytesDelayed
 			if totalCost <= *lastPaymentAmount {
+				if action != pb.PaymentAction_PAYMENT_OK {
+					action = pb.PaymentAction_PAYMENT_OK
+					notify(getPolicy(), "payment caught up")
+				}
 				continue
 			}
 
@@ -1729,22 +2492,85 @@ func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPayment
 			}
 		}
 
-		time.Sleep(maxNanoPayDelay)
+		policy := getPolicy()
+		if action == pb.PaymentAction_PAYMENT_OK {
+			time.Sleep(policy.maxNanoPayDelay())
+		} else {
+			time.Sleep(policy.escalationInterval())
+		}
 
-		if *lastPaymentAmount < common.Fixed64(minTrafficCoverage*float64(totalCost)) && totalCost-*lastPaymentAmount > common.Fixed64(maxTrafficUnpaid*TrafficUnit*float64(totalCost)/float64(totalBytes)) {
-			Close(session)
-			*isClosed = true
-			log.Printf("Not enough payment. Since last payment: %s. Last claimed: %v, expected: %v", time.Since(*lastPaymentTime).String(), *lastPaymentAmount, totalCost)
-			return
+		if time.Since(sessionStart) < policy.gracePeriod() {
+			continue
+		}
+
+		if policy.isUnderpaid(*lastPaymentAmount, totalCost, totalBytes) {
+			reason := fmt.Sprintf("not enough payment since %s, paid %s, expected %s", time.Since(*lastPaymentTime).Round(time.Second).String(), lastPaymentAmount.String(), totalCost.String())
+			if action < pb.PaymentAction_PAYMENT_CLOSE {
+				action++
+			}
+			log.Printf("Payment %s: %s", action.String(), reason)
+			notify(policy, reason)
+			if action == pb.PaymentAction_PAYMENT_CLOSE {
+				Close(session)
+				*isClosed = true
+				return
+			}
+		} else if action != pb.PaymentAction_PAYMENT_OK {
+			action = pb.PaymentAction_PAYMENT_OK
+			notify(policy, "payment caught up")
 		}
 	}
 }
 
-func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64)) error {
+// readPaymentStream reads the next nanopay txn from payment stream. Entry may
+// also send control messages on payment stream, each of which follows an empty
+// frame, and they are passed to handleControlMessage if it's not nil.
+func readPaymentStream(stream Stream, handleControlMessage func(*pb.ControlMessage)) ([]byte, error) {
 	for {
 		tx, err := ReadVarBytes(stream, maxNanoPayTxnSize)
 		if err != nil {
-			return fmt.Errorf("couldn't read payment stream: %v", err)
+			return nil, fmt.Errorf("couldn't read payment stream: %v", err)
+		}
+		if len(tx) > 0 {
+			return tx, nil
+		}
+
+		msg, err := readControlMessage(stream)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read control message: %v", err)
+		}
+		if handleControlMessage != nil {
+			handleControlMessage(msg)
+		}
+	}
+}
+
+// writePaymentControlMessage writes a control message to payment stream after
+// an empty frame so that it's not taken as nanopay txn.
+func writePaymentControlMessage(stream Stream, msg *pb.ControlMessage) error {
+	err := WriteVarBytes(stream, nil)
+	if err != nil {
+		return err
+	}
+	return writeControlMessage(stream, msg)
+}
+
+// discardPaymentStream reads and drops payments of a session that is served
+// without payment, until the stream is closed.
+func discardPaymentStream(stream Stream, handleControlMessage func(*pb.ControlMessage)) error {
+	for {
+		_, err := readPaymentStream(stream, handleControlMessage)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handlePaymentStream(stream Stream, npc *nkn.NanoPayClaimer, claims *nanoPayClaims, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64), recordClaim func(common.Fixed64, string, string), handleControlMessage func(*pb.ControlMessage)) error {
+	for {
+		tx, err := readPaymentStream(stream, handleControlMessage)
+		if err != nil {
+			return err
 		}
 
 		totalCost, totalBytes := getTotalCost()
@@ -1753,11 +2579,12 @@ func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPayme
 		}
 
 		var amount *nkn.Amount
+		var txnID, channel string
 		for i := 0; i < 3; i++ {
 			if i > 0 {
 				time.Sleep(3 * time.Second)
 			}
-			amount, err = nanoPayClaim(tx, npc)
+			amount, txnID, channel, err = nanoPayClaim(tx, npc, claims)
 			if err == nil {
 				break
 			} else {
@@ -1774,6 +2601,10 @@ func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPayme
 
 		*lastPaymentAmount = amount.ToFixed64()
 		*lastPaymentTime = time.Now()
-		*bytesPaid = totalBytes * (npc.Amount().Fixed64 / totalCost)
+		*bytesPaid = totalBytes * (amount.ToFixed64() / totalCost)
+
+		if recordClaim != nil {
+			recordClaim(amount.ToFixed64(), txnID, channel)
+		}
 	}
 }
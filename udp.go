@@ -37,6 +37,11 @@ type EncryptUDPConn struct {
 	encoders sync.Map
 	decoders sync.Map
 
+	// codecs are the codecs added by encrypt key, so that binding the same key
+	// again reuses them instead of restarting nonces under the same key.
+	codecLock sync.Mutex
+	codecs    map[[32]byte]*udpCodec
+
 	lock     sync.RWMutex
 	isClosed bool
 
@@ -45,6 +50,16 @@ type EncryptUDPConn struct {
 
 	readBuffer  []byte
 	writeBuffer []byte
+
+	// batch reads and writes raw datagrams, buffers of which are allocated on
+	// first batch read or write.
+	batch        udpBatchIO
+	readBuffers  [][]byte
+	readSizes    []int
+	readAddrs    []*net.UDPAddr
+	writeBuffers [][]byte
+	writePackets [][]byte
+	writeAddrs   []*net.UDPAddr
 }
 
 func NewEncryptUDPConn(conn *net.UDPConn) *EncryptUDPConn {
@@ -52,39 +67,72 @@ func NewEncryptUDPConn(conn *net.UDPConn) *EncryptUDPConn {
 		conn:        conn,
 		readBuffer:  make([]byte, MaxUDPBufferSize),
 		writeBuffer: make([]byte, MaxUDPBufferSize),
+		batch:       newUDPBatchIO(conn),
 	}
 	conn.SetReadBuffer(MaxUDPBufferSize)
 	conn.SetWriteBuffer(MaxUDPBufferSize)
 	return ec
 }
 
-func (ec *EncryptUDPConn) AddCodec(addr *net.UDPAddr, encryptKey *[32]byte, encryptionAlgo pb.EncryptionAlgo, initiator bool) error {
-	var cipher stream.Cipher
-	var err error
-	switch encryptionAlgo {
-	case pb.EncryptionAlgo_ENCRYPTION_NONE:
-		cipher = nil
-	case pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305:
-		cipher = stream.NewXSalsa20Poly1305Cipher(encryptKey)
-	case pb.EncryptionAlgo_ENCRYPTION_AES_GCM:
-		cipher, err = stream.NewAESGCMCipher(encryptKey[:])
-		if err != nil {
-			return err
+// udpDecoder is the decoder of packets from one address. If replay is not nil,
+// packets should have sequential nonces and each one is only accepted once.
+type udpDecoder struct {
+	decoder   *stream.Decoder
+	nonceSize int
+	replay    *replayWindow
+}
+
+// udpCodec is the encoder and decoder created for an encrypt key.
+type udpCodec struct {
+	encryptionAlgo pb.EncryptionAlgo
+	encoder        *stream.Encoder
+	decoder        *udpDecoder
+}
+
+// AddCodec sets the encryption of packets from and to addr. If rekey is not
+// nil, the key is ratcheted forward by rekey policy. If replayProtection is
+// true, packets are sent with sequential nonces and replayed or reflected
+// packets are dropped. Both should only be used when peer supports them.
+// Adding the same encrypt key again, e.g. when UDP conn is bound again, reuses
+// the codec of it, as a new one would start nonces and replay window over.
+func (ec *EncryptUDPConn) AddCodec(addr *net.UDPAddr, encryptKey *[32]byte, encryptionAlgo pb.EncryptionAlgo, initiator bool, rekey *RekeyPolicy, replayProtection bool) error {
+	ec.codecLock.Lock()
+	defer ec.codecLock.Unlock()
+
+	if codec, ok := ec.codecs[*encryptKey]; ok {
+		if codec.encryptionAlgo != encryptionAlgo {
+			return fmt.Errorf("udp codec of encrypt key already added with encryption algo %v", codec.encryptionAlgo)
 		}
-	default:
-		return fmt.Errorf("unsupported encryption algo %v", encryptionAlgo)
+		ec.encoders.Store(addr.String(), codec.encoder)
+		ec.decoders.Store(addr.String(), codec.decoder)
+		return nil
 	}
-	encoder, err := stream.NewEncoder(cipher, initiator, false)
+
+	cipher, err := newConnCipher(encryptKey, encryptionAlgo, rekey)
+	if err != nil {
+		return err
+	}
+	encoder, err := stream.NewEncoder(cipher, initiator, replayProtection)
 	if err != nil {
 		return err
 	}
-	decoder, err := stream.NewDecoder(cipher, initiator, false, true)
+	decoder, err := stream.NewDecoder(cipher, initiator, false, !replayProtection)
 	if err != nil {
 		return err
 	}
 
+	d := &udpDecoder{decoder: decoder}
+	if cipher != nil && replayProtection {
+		d.nonceSize = cipher.NonceSize()
+		d.replay = &replayWindow{}
+	}
+
+	if ec.codecs == nil {
+		ec.codecs = make(map[[32]byte]*udpCodec)
+	}
+	ec.codecs[*encryptKey] = &udpCodec{encryptionAlgo: encryptionAlgo, encoder: encoder, decoder: d}
 	ec.encoders.Store(addr.String(), encoder)
-	ec.decoders.Store(addr.String(), decoder)
+	ec.decoders.Store(addr.String(), d)
 	return nil
 }
 
@@ -110,18 +158,37 @@ func (ec *EncryptUDPConn) ReadFromUDPEncrypted(b []byte) (n int, addr *net.UDPAd
 		return 0, addr, false, err
 	}
 
-	d, ok := ec.decoders.Load(addr.String())
-	if !ok {
-		copy(b, ec.readBuffer[:n])
-		return n, addr, false, nil
+	var decoder *udpDecoder
+	if d, ok := ec.decoders.Load(addr.String()); ok {
+		decoder = d.(*udpDecoder)
 	}
-	decoder := d.(*stream.Decoder)
 
-	plain, err := decoder.Decode(b, ec.readBuffer[:n])
+	n, encrypted, err = decodeUDPPacket(decoder, b, ec.readBuffer[:n])
 	if err != nil {
 		return 0, addr, false, err
 	}
-	return len(plain), addr, true, nil
+	if encrypted && decoder.replay != nil && !decoder.replay.check(nonceSequence(ec.readBuffer[:decoder.nonceSize])) {
+		return 0, addr, false, errReplayedPacket
+	}
+	return n, addr, encrypted, nil
+}
+
+// decodeUDPPacket decrypts packet into b, or copies it if decoder is nil. The
+// replay window is not checked.
+func decodeUDPPacket(decoder *udpDecoder, b, packet []byte) (n int, encrypted bool, err error) {
+	if decoder == nil {
+		return copy(b, packet), false, nil
+	}
+	plain, err := decoder.decoder.Decode(b, packet)
+	if err != nil {
+		// server sends UDP bind challenge before it has the codec of client,
+		// and client sends bind metadata again after server has its codec
+		if isUDPConnMetadata(packet) {
+			return copy(b, packet), false, nil
+		}
+		return 0, false, err
+	}
+	return len(plain), true, nil
 }
 
 func (ec *EncryptUDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
@@ -141,25 +208,9 @@ func (ec *EncryptUDPConn) WriteMsgUDPEncrypted(b, oob []byte, addr *net.UDPAddr)
 	ec.writeLock.Lock()
 	defer ec.writeLock.Unlock()
 
-	var k string
-	var ciphertext []byte
-	encrypted = false
-
-	if addr == nil {
-		k = ec.RemoteUDPAddr().String()
-	} else {
-		k = addr.String()
-	}
-	e, ok := ec.encoders.Load(k)
-	if !ok {
-		ciphertext = b
-	} else {
-		encoder := e.(*stream.Encoder)
-		ciphertext, err = encoder.Encode(ec.writeBuffer, b)
-		if err != nil {
-			return 0, 0, false, err
-		}
-		encrypted = true
+	ciphertext, encrypted, err := ec.encode(ec.writeBuffer, b, addr)
+	if err != nil {
+		return 0, 0, false, err
 	}
 
 	n, oobn, err = ec.conn.WriteMsgUDP(ciphertext, oob, addr)
@@ -173,6 +224,26 @@ func (ec *EncryptUDPConn) WriteMsgUDPEncrypted(b, oob []byte, addr *net.UDPAddr)
 	return len(b), oobn, encrypted, err
 }
 
+// encode encrypts b to addr into buffer, or returns b as is if there is no
+// encoder of addr. Should be called with write lock held.
+func (ec *EncryptUDPConn) encode(buffer, b []byte, addr *net.UDPAddr) ([]byte, bool, error) {
+	var k string
+	if addr == nil {
+		k = ec.RemoteUDPAddr().String()
+	} else {
+		k = addr.String()
+	}
+	e, ok := ec.encoders.Load(k)
+	if !ok {
+		return b, false, nil
+	}
+	ciphertext, err := e.(*stream.Encoder).Encode(buffer, b)
+	if err != nil {
+		return nil, false, err
+	}
+	return ciphertext, true, nil
+}
+
 func (ec *EncryptUDPConn) SetWriteBuffer(size int) error {
 	return ec.conn.SetWriteBuffer(size)
 }
@@ -0,0 +1,197 @@
+package tuna
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+)
+
+const (
+	// udpBatchSize is the max number of datagrams read or written in one
+	// syscall.
+	udpBatchSize = 32
+	// minParallelItems is the min number of packets decrypted by each
+	// goroutine, below which it's not worth starting one.
+	minParallelItems = 4
+)
+
+// UDPMessage is a datagram read from or written to EncryptUDPConn in a batch.
+type UDPMessage struct {
+	Buffer    []byte       // plaintext, should be large enough when reading
+	N         int          // length of plaintext
+	Addr      *net.UDPAddr // source address when reading, destination when writing
+	Encrypted bool
+	Err       error // error of decoding when reading
+}
+
+// udpBatchIO reads and writes raw datagrams in batches. On Linux it uses
+// recvmmsg and sendmmsg, and on other platforms one datagram per call.
+type udpBatchIO interface {
+	readBatch(bufs [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error)
+	writeBatch(bufs [][]byte, addrs []*net.UDPAddr) (int, error)
+}
+
+// udpSingleIO is the portable udpBatchIO that reads one datagram per call
+// and writes datagrams one by one.
+type udpSingleIO struct {
+	conn UDPConn
+}
+
+func (s *udpSingleIO) readBatch(bufs [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	n, addr, err := s.conn.ReadFromUDP(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0], addrs[0] = n, addr
+	return 1, nil
+}
+
+func (s *udpSingleIO) writeBatch(bufs [][]byte, addrs []*net.UDPAddr) (int, error) {
+	for i := range bufs {
+		_, _, err := s.conn.WriteMsgUDP(bufs[i], nil, addrs[i])
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+// parallelDo calls f for 0 <= i < n on up to GOMAXPROCS goroutines, each of
+// which takes at least minParallelItems items.
+func parallelDo(n int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n/minParallelItems {
+		workers = n / minParallelItems
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// ReadBatchEncrypted reads up to len(msgs) datagrams with as few syscalls as
+// possible, and decrypts them in parallel. It returns the number of messages
+// read, each of which has its own decoding error.
+func (ec *EncryptUDPConn) ReadBatchEncrypted(msgs []UDPMessage) (int, error) {
+	if ec == nil {
+		return 0, fmt.Errorf("unconnected udp conn")
+	}
+
+	if ec.IsClosed() {
+		return 0, io.ErrClosedPipe
+	}
+
+	ec.readLock.Lock()
+	defer ec.readLock.Unlock()
+
+	if ec.readBuffers == nil {
+		ec.readBuffers = make([][]byte, udpBatchSize)
+		for i := range ec.readBuffers {
+			ec.readBuffers[i] = make([]byte, MaxUDPBufferSize)
+		}
+		ec.readSizes = make([]int, udpBatchSize)
+		ec.readAddrs = make([]*net.UDPAddr, udpBatchSize)
+	}
+
+	size := len(msgs)
+	if size > udpBatchSize {
+		size = udpBatchSize
+	}
+
+	count, err := ec.batch.readBatch(ec.readBuffers[:size], ec.readSizes[:size], ec.readAddrs[:size])
+	if err != nil {
+		return 0, err
+	}
+
+	decoders := make([]*udpDecoder, count)
+	for i := 0; i < count; i++ {
+		msgs[i].Addr = ec.readAddrs[i]
+		if d, ok := ec.decoders.Load(ec.readAddrs[i].String()); ok {
+			decoders[i] = d.(*udpDecoder)
+		}
+	}
+
+	parallelDo(count, func(i int) {
+		msgs[i].N, msgs[i].Encrypted, msgs[i].Err = decodeUDPPacket(decoders[i], msgs[i].Buffer, ec.readBuffers[i][:ec.readSizes[i]])
+	})
+
+	// Replay window is checked in order after all packets are decrypted, so
+	// that it's only updated by authentic packets.
+	for i := 0; i < count; i++ {
+		d := decoders[i]
+		if d == nil || d.replay == nil || msgs[i].Err != nil || !msgs[i].Encrypted {
+			continue
+		}
+		if !d.replay.check(nonceSequence(ec.readBuffers[i][:d.nonceSize])) {
+			msgs[i].N, msgs[i].Encrypted, msgs[i].Err = 0, false, errReplayedPacket
+		}
+	}
+
+	return count, nil
+}
+
+// WriteBatchEncrypted encrypts and writes datagrams with as few syscalls as
+// possible. It returns the number of messages written.
+func (ec *EncryptUDPConn) WriteBatchEncrypted(msgs []UDPMessage) (int, error) {
+	if ec == nil {
+		return 0, fmt.Errorf("unconnected udp conn")
+	}
+
+	if ec.IsClosed() {
+		return 0, io.ErrClosedPipe
+	}
+
+	ec.writeLock.Lock()
+	defer ec.writeLock.Unlock()
+
+	if ec.writeBuffers == nil {
+		ec.writeBuffers = make([][]byte, udpBatchSize)
+		for i := range ec.writeBuffers {
+			ec.writeBuffers[i] = make([]byte, MaxUDPBufferSize)
+		}
+		ec.writePackets = make([][]byte, udpBatchSize)
+		ec.writeAddrs = make([]*net.UDPAddr, udpBatchSize)
+	}
+
+	written := 0
+	for written < len(msgs) {
+		size := len(msgs) - written
+		if size > udpBatchSize {
+			size = udpBatchSize
+		}
+
+		for i := 0; i < size; i++ {
+			msg := &msgs[written+i]
+			var err error
+			ec.writePackets[i], msg.Encrypted, err = ec.encode(ec.writeBuffers[i], msg.Buffer[:msg.N], msg.Addr)
+			if err != nil {
+				return written, err
+			}
+			ec.writeAddrs[i] = msg.Addr
+		}
+
+		n, err := ec.batch.writeBatch(ec.writePackets[:size], ec.writeAddrs[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,67 @@
+package tuna
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// udpMmsgIO reads and writes datagrams with recvmmsg and sendmmsg.
+type udpMmsgIO struct {
+	conn      *ipv4.PacketConn
+	readMsgs  []ipv4.Message
+	writeMsgs []ipv4.Message
+}
+
+func newUDPBatchIO(conn UDPConn) udpBatchIO {
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		return &udpSingleIO{conn: conn}
+	}
+	m := &udpMmsgIO{
+		conn:      ipv4.NewPacketConn(c),
+		readMsgs:  make([]ipv4.Message, udpBatchSize),
+		writeMsgs: make([]ipv4.Message, udpBatchSize),
+	}
+	for i := range m.readMsgs {
+		m.readMsgs[i].Buffers = make([][]byte, 1)
+		m.writeMsgs[i].Buffers = make([][]byte, 1)
+	}
+	return m
+}
+
+func (m *udpMmsgIO) readBatch(bufs [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	msgs := m.readMsgs[:len(bufs)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = bufs[i]
+	}
+	n, err := m.conn.ReadBatch(msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		sizes[i] = msgs[i].N
+		addrs[i], _ = msgs[i].Addr.(*net.UDPAddr)
+	}
+	return n, nil
+}
+
+func (m *udpMmsgIO) writeBatch(bufs [][]byte, addrs []*net.UDPAddr) (int, error) {
+	msgs := m.writeMsgs[:len(bufs)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = bufs[i]
+		msgs[i].Addr = nil
+		if addrs[i] != nil {
+			msgs[i].Addr = addrs[i]
+		}
+	}
+	written := 0
+	for written < len(msgs) {
+		n, err := m.conn.WriteBatch(msgs[written:], 0)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
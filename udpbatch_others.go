@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tuna
+
+func newUDPBatchIO(conn UDPConn) udpBatchIO {
+	return &udpSingleIO{conn: conn}
+}
@@ -0,0 +1,239 @@
+package tuna
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+const (
+	udpProbeInterval      = 5 * time.Second
+	udpProbeTimeout       = 3 * udpProbeInterval
+	maxUDPStreamFrameSize = udpHeaderSize + MaxUDPBufferSize
+)
+
+// udpPacketWriter sends UDP packets to peer over session instead of UDP conn,
+// either as frames on a UDP stream or as QUIC datagrams.
+type udpPacketWriter interface {
+	writeUDPPacket(b []byte) error
+}
+
+// udpStreamWriter sends UDP packets as length-prefixed frames on UDP stream.
+type udpStreamWriter struct {
+	stream Stream
+}
+
+func (w udpStreamWriter) writeUDPPacket(b []byte) error {
+	return WriteVarBytes(w.stream, b)
+}
+
+// udpFallback tracks whether exit is reachable over UDP, which is probed by
+// pings that exit replies to. When it's not, UDP packets are sent as frames on
+// a UDP stream of the TCP session instead, until UDP is reachable again.
+type udpFallback struct {
+	lock     sync.RWMutex
+	lastPong time.Time
+	stream   Stream
+}
+
+func (f *udpFallback) pong() {
+	f.lock.Lock()
+	f.lastPong = time.Now()
+	f.lock.Unlock()
+}
+
+func (f *udpFallback) reachable() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return time.Since(f.lastPong) < udpProbeTimeout
+}
+
+// getStream returns the UDP stream, or nil if UDP packets should be sent over
+// UDP.
+func (f *udpFallback) getStream() Stream {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.stream
+}
+
+// getWriter returns the writer of UDP stream, or nil if UDP packets should be
+// sent over UDP.
+func (f *udpFallback) getWriter() udpPacketWriter {
+	stream := f.getStream()
+	if stream == nil {
+		return nil
+	}
+	return udpStreamWriter{stream}
+}
+
+// setStream replaces the UDP stream if it's old, and closes old one.
+func (f *udpFallback) setStream(old, stream Stream) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stream != old {
+		return
+	}
+	if old != nil {
+		old.Close()
+	}
+	f.stream = stream
+}
+
+// reset assumes UDP is reachable for a new connection.
+func (f *udpFallback) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	f.lastPong = time.Now()
+}
+
+func isUDPPing(b []byte) bool {
+	if len(b) <= PrefixLen || !bytes.Equal(b[:PrefixLen], []byte{PrefixLen - 1: 0}) {
+		return false
+	}
+	connMetadata, err := parseUDPConnMetadata(b[PrefixLen:])
+	return err == nil && connMetadata.IsPing
+}
+
+// replyUDPPing replies to an encrypted ping from entry that probes whether UDP
+// is reachable.
+func (c *Common) replyUDPPing(conn *EncryptUDPConn, from *net.UDPAddr, addrToKey *sync.Map) {
+	k, ok := addrToKey.Load(from.String())
+	if !ok || !hasCapability(c.getConnCapabilities(k.(string)), CapabilityUDPOverTCP) {
+		return
+	}
+	err := writeUDPConnMetadata(conn, from, &pb.ConnectionMetadata{IsPing: true})
+	if err != nil {
+		log.Println("Couldn't reply udp ping:", err)
+	}
+}
+
+// monitorUDP probes whether exit is reachable over conn every
+// udpProbeInterval. It returns when entry is closed or reconnected to another
+// conn.
+func (te *TunaEntry) monitorUDP(conn *EncryptUDPConn) {
+	te.udpFallback.reset()
+	for {
+		select {
+		case <-time.After(udpProbeInterval):
+		case <-te.closeChan:
+			te.udpFallback.reset()
+			return
+		}
+		if te.GetUDPConn() != conn {
+			return
+		}
+		te.probeUDP(conn)
+	}
+}
+
+// probeUDP pings exit over conn, and switches UDP packets to UDP stream when
+// there is no reply for a while, or back to conn when there is. While exit is
+// not reachable over UDP, UDP conn is bound again before ping, as exit never
+// receives the bind metadata if UDP is blocked from the start.
+func (te *TunaEntry) probeUDP(conn *EncryptUDPConn) {
+	stream := te.udpFallback.getStream()
+	reachable := te.udpFallback.reachable()
+
+	if !reachable || stream != nil {
+		err := te.sendUDPBindRequest()
+		if err != nil {
+			log.Println("Couldn't send udp bind metadata:", err)
+		}
+	}
+
+	err := writeUDPConnMetadata(conn, nil, &pb.ConnectionMetadata{IsPing: true})
+	if err != nil {
+		log.Println("write udp ping msg error:", err)
+	}
+
+	if !reachable && stream == nil {
+		stream, err = te.openUDPStream()
+		if err != nil {
+			log.Println("Couldn't open udp stream:", err)
+			return
+		}
+		log.Println("UDP is unreachable, sending UDP packets over TCP")
+		te.udpFallback.setStream(nil, stream)
+		go te.readUDPStream(stream)
+	} else if reachable && stream != nil {
+		log.Println("UDP is reachable again")
+		te.udpFallback.setStream(stream, nil)
+	}
+}
+
+func (te *TunaEntry) openUDPStream() (Stream, error) {
+	session, err := te.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeStreamMetadata(stream, &pb.StreamMetadata{
+		ServiceId: te.GetMetadata().ServiceId,
+		IsUdp:     true,
+	})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (te *TunaEntry) readUDPStream(stream Stream) {
+	defer te.udpFallback.setStream(stream, nil)
+	for {
+		b, err := ReadVarBytes(stream, maxUDPStreamFrameSize)
+		if err != nil {
+			return
+		}
+		n := len(b)
+		b, err = udpPacketFromWire(b, udpHeaderVersion)
+		if err != nil {
+			log.Println("Couldn't read udp packet:", err)
+			continue
+		}
+		te.udpReadChan <- b
+		atomic.AddUint64(&te.bytesExitToEntry, uint64(n))
+	}
+}
+
+// handleUDPStream reads UDP packets sent by entry of connKey over UDP stream,
+// and sends packets of the same flows back over the stream.
+func (te *TunaExit) handleUDPStream(stream Stream, connKey string) error {
+	if te.udpFlows == nil {
+		return errors.New("udp stream is not supported in reverse mode")
+	}
+	for {
+		b, err := ReadVarBytes(stream, maxUDPStreamFrameSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		n := len(b)
+		b, err = te.mapUDPFlow(b, connKey, udpHeaderVersion, nil, udpStreamWriter{stream})
+		if err != nil {
+			log.Println("Couldn't read udp packet:", err)
+			continue
+		}
+		te.addSessionBytes(connKey, b[2], n, true)
+		te.udpReadChan <- b
+	}
+}
@@ -0,0 +1,123 @@
+package tuna
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+)
+
+// testUDPProxy forwards datagrams between a client and server, and drops them
+// while blocked.
+type testUDPProxy struct {
+	conn    *net.UDPConn
+	server  *net.UDPAddr
+	blocked int32
+
+	lock   sync.Mutex
+	client *net.UDPAddr
+}
+
+func newTestUDPProxy(t *testing.T, server *net.UDPAddr) *testUDPProxy {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testUDPProxy{conn: conn, server: server}
+	go p.forward()
+	t.Cleanup(func() { conn.Close() })
+	return p
+}
+
+func (p *testUDPProxy) setBlocked(blocked bool) {
+	var b int32
+	if blocked {
+		b = 1
+	}
+	atomic.StoreInt32(&p.blocked, b)
+}
+
+func (p *testUDPProxy) forward() {
+	b := make([]byte, MaxUDPBufferSize)
+	for {
+		n, from, err := p.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&p.blocked) == 1 {
+			continue
+		}
+		p.lock.Lock()
+		to := p.server
+		if from.String() == p.server.String() {
+			to = p.client
+		} else {
+			p.client = from
+		}
+		p.lock.Unlock()
+		if to != nil {
+			p.conn.WriteToUDP(b[:n], to)
+		}
+	}
+}
+
+func TestUDPFallbackRebind(t *testing.T) {
+	entry, exit := newTestCommon(t), newTestCommon(t)
+	exit.IsServer = true
+	exit.udpBinder = newUDPBinder()
+
+	_, _, remoteMetadata := newTestWrappedConnPair(t, entry, exit)
+	capabilities := negotiateCapabilities(remoteMetadata)
+	if !hasCapability(capabilities, CapabilityUDPOverTCP) || !hasCapability(capabilities, CapabilityUDPReplayProtection) {
+		t.Fatal("udp over tcp and replay protection should be negotiated")
+	}
+
+	serverUDPConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := NewEncryptUDPConn(serverUDPConn)
+	defer serverConn.Close()
+	exit.startUDPReaderWriter(serverConn, nil, nil, nil, nil)
+
+	// UDP is blocked from the start, so exit never receives bind metadata
+	proxy := newTestUDPProxy(t, serverUDPConn.LocalAddr().(*net.UDPAddr))
+	proxy.setBlocked(true)
+
+	proxyAddr := proxy.conn.LocalAddr().(*net.UDPAddr)
+	clientUDPConn, err := net.DialUDP("udp4", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := entry.wrapUDPConn(clientUDPConn, proxyAddr, exit.Wallet.PubKey(), remoteMetadata.Nonce, capabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	entry.udpConn = udpConn
+	entry.metadata = &pb.ServiceMetadata{}
+	entry.udpFallback = new(udpFallback)
+	te := &TunaEntry{Common: entry, session: newTestSession(t)}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	te.startUDPReaderWriter(udpConn, nil, new(uint64), new(uint64), stopChan)
+
+	te.probeUDP(udpConn)
+	if te.udpFallback.getStream() == nil {
+		t.Fatal("udp packets should fall back to stream when udp is unreachable")
+	}
+
+	proxy.setBlocked(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for te.udpFallback.getStream() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("udp should be used again once it's unblocked")
+		}
+		time.Sleep(100 * time.Millisecond)
+		te.probeUDP(udpConn)
+	}
+}
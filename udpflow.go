@@ -0,0 +1,210 @@
+package tuna
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// UDP packets between entry and exit start with a header identifying the flow
+// and the service port it belongs to. Version 0 header (PrefixLen bytes) is
+// the source port of local client followed by service ID and port ID:
+//
+//	| conn ID (2, little endian) | service ID | port ID |
+//
+// Version 1 header is used when both sides have CapabilityUDPFlowID. Flow ID
+// is allocated by entry for each (client address, port ID), so clients with
+// the same source port on different IPs don't collide:
+//
+//	| version | reserved | service ID | port ID | flow ID (4, big endian) |
+//
+// Service ID and port ID are at the same offset in both versions. Packets are
+// always passed around internally with version 1 header, and only converted
+// from and to version 0 when sent to or received from peers of old version.
+const (
+	udpHeaderVersion = 1
+	udpHeaderSize    = 8
+
+	// maxEntryUDPFlowID keeps flow IDs allocated by entry within the conn ID
+	// of version 0 header, so that they are still unique with old exits.
+	maxEntryUDPFlowID = math.MaxUint16
+	maxExitUDPFlowID  = math.MaxUint32
+
+	defaultUDPFlowTimeout = 10 * time.Minute
+)
+
+var errShortUDPPacket = errors.New("udp packet is shorter than header")
+
+func newUDPPacket(flowID uint32, serviceID, portID byte, payload []byte) []byte {
+	b := make([]byte, udpHeaderSize+len(payload))
+	b[0] = udpHeaderVersion
+	b[2] = serviceID
+	b[3] = portID
+	binary.BigEndian.PutUint32(b[4:udpHeaderSize], flowID)
+	copy(b[udpHeaderSize:], payload)
+	return b
+}
+
+func udpPacketFlowID(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[4:udpHeaderSize])
+}
+
+func setUDPPacketFlowID(b []byte, flowID uint32) {
+	binary.BigEndian.PutUint32(b[4:udpHeaderSize], flowID)
+}
+
+func udpPacketPayload(b []byte) []byte {
+	return b[udpHeaderSize:]
+}
+
+// udpHeaderVersionOf returns the header version to use with peer of given
+// capabilities.
+func udpHeaderVersionOf(capabilities uint64) byte {
+	if hasCapability(capabilities, CapabilityUDPFlowID) {
+		return udpHeaderVersion
+	}
+	return 0
+}
+
+// udpPacketFromWire converts a packet received from peer using header version
+// to internal packet.
+func udpPacketFromWire(b []byte, version byte) ([]byte, error) {
+	if version == 0 {
+		if len(b) < PrefixLen {
+			return nil, errShortUDPPacket
+		}
+		return newUDPPacket(uint32(ConnIDToPort(b)), b[2], b[3], b[PrefixLen:]), nil
+	}
+	if len(b) < udpHeaderSize {
+		return nil, errShortUDPPacket
+	}
+	if b[0] != udpHeaderVersion {
+		return nil, fmt.Errorf("unsupported udp header version %d", b[0])
+	}
+	return b, nil
+}
+
+// udpPacketToWire converts an internal packet to be sent to peer using header
+// version.
+func udpPacketToWire(b []byte, version byte) []byte {
+	if version == 0 {
+		connID := PortToConnID(uint16(udpPacketFlowID(b)))
+		return append([]byte{connID[0], connID[1], b[2], b[3]}, udpPacketPayload(b)...)
+	}
+	return b
+}
+
+// udpFlow is a UDP flow between a local address and a service port.
+type udpFlow struct {
+	id  uint32
+	key string
+	// remoteID, version and connKey are the flow ID and header version used by
+	// entry and the key of its conn, only set on exit where flows of different
+	// entries are mapped to local flow IDs.
+	remoteID uint32
+	version  byte
+	connKey  string
+
+	lock   sync.RWMutex
+	addr   *net.UDPAddr
+	writer udpPacketWriter // set on exit if entry sends the flow over session
+}
+
+// setPath sets where packets of flow are sent to, which is the address or
+// session path that the latest packet of flow is received from.
+func (f *udpFlow) setPath(addr *net.UDPAddr, writer udpPacketWriter) {
+	f.lock.Lock()
+	f.addr, f.writer = addr, writer
+	f.lock.Unlock()
+}
+
+func (f *udpFlow) path() (*net.UDPAddr, udpPacketWriter) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.addr, f.writer
+}
+
+// udpFlowTable allocates flow IDs to UDP flows identified by key, and forgets
+// flows that are idle for timeout.
+type udpFlowTable struct {
+	lock   sync.Mutex
+	maxID  uint32
+	nextID uint32
+	byKey  *cache.Cache
+	byID   *cache.Cache
+}
+
+// newUDPFlowTable creates a flow table. Flows expire after default timeout if
+// timeout is not positive.
+func newUDPFlowTable(timeout time.Duration, maxID uint32) *udpFlowTable {
+	if timeout <= 0 {
+		timeout = defaultUDPFlowTimeout
+	}
+	return &udpFlowTable{
+		maxID: maxID,
+		byKey: cache.New(timeout, time.Second),
+		byID:  cache.New(timeout, time.Second),
+	}
+}
+
+func udpFlowKey(addr *net.UDPAddr, portID byte) string {
+	return addr.String() + "/" + strconv.Itoa(int(portID))
+}
+
+// getOrCreate returns the flow of key, or creates one with an unused ID by
+// calling init. It should be called for every packet of flow to keep it
+// alive.
+func (t *udpFlowTable) getOrCreate(key string, init func(flow *udpFlow)) (*udpFlow, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if x, ok := t.byKey.Get(key); ok {
+		flow := x.(*udpFlow)
+		t.touch(flow)
+		return flow, nil
+	}
+
+	for i := uint32(0); i < t.maxID; i++ {
+		t.nextID++
+		if t.nextID == 0 || t.nextID > t.maxID {
+			t.nextID = 1
+		}
+		idKey := strconv.FormatUint(uint64(t.nextID), 10)
+		if _, ok := t.byID.Get(idKey); ok {
+			continue
+		}
+		flow := &udpFlow{id: t.nextID, key: key}
+		init(flow)
+		t.touch(flow)
+		return flow, nil
+	}
+
+	return nil, errors.New("no udp flow ID available")
+}
+
+// get returns the flow of ID and keeps it alive.
+func (t *udpFlowTable) get(id uint32) (*udpFlow, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	x, ok := t.byID.Get(strconv.FormatUint(uint64(id), 10))
+	if !ok {
+		return nil, false
+	}
+	flow := x.(*udpFlow)
+	t.touch(flow)
+	return flow, true
+}
+
+// touch resets the idle timeout of flow. Should be called with lock held.
+func (t *udpFlowTable) touch(flow *udpFlow) {
+	t.byKey.SetDefault(flow.key, flow)
+	t.byID.SetDefault(strconv.FormatUint(uint64(flow.id), 10), flow)
+}
@@ -0,0 +1,154 @@
+package tuna
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUDPPacketWire(t *testing.T) {
+	payload := []byte("payload")
+	b := newUDPPacket(0x1234, 2, 3, payload)
+
+	v1 := udpPacketToWire(b, udpHeaderVersion)
+	if !bytes.Equal(v1, b) {
+		t.Fatal("version 1 packet should be sent as is")
+	}
+	p, err := udpPacketFromWire(v1, udpHeaderVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udpPacketFlowID(p) != 0x1234 || p[2] != 2 || p[3] != 3 || !bytes.Equal(udpPacketPayload(p), payload) {
+		t.Fatalf("unexpected packet %v", p)
+	}
+
+	v0 := udpPacketToWire(b, 0)
+	if len(v0) != PrefixLen+len(payload) || ConnIDToPort(v0) != 0x1234 || v0[2] != 2 || v0[3] != 3 {
+		t.Fatalf("unexpected version 0 packet %v", v0)
+	}
+	p, err = udpPacketFromWire(v0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, b) {
+		t.Fatalf("version 0 packet converted to %v, expected %v", p, b)
+	}
+
+	if _, err := udpPacketFromWire(v0[:PrefixLen-1], 0); err != errShortUDPPacket {
+		t.Fatalf("expected short packet error, got %v", err)
+	}
+	if _, err := udpPacketFromWire(b[:udpHeaderSize-1], udpHeaderVersion); err != errShortUDPPacket {
+		t.Fatalf("expected short packet error, got %v", err)
+	}
+	unknown := append([]byte{}, b...)
+	unknown[0] = udpHeaderVersion + 1
+	if _, err := udpPacketFromWire(unknown, udpHeaderVersion); err == nil {
+		t.Fatal("unknown header version should be rejected")
+	}
+}
+
+func TestUDPFlowTableAllocation(t *testing.T) {
+	table := newUDPFlowTable(time.Minute, 3)
+	var flows []*udpFlow
+	for i := 0; i < 3; i++ {
+		flow, err := table.getOrCreate(strconv.Itoa(i), func(*udpFlow) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flow.id != uint32(i+1) {
+			t.Fatalf("flow %d got ID %d", i, flow.id)
+		}
+		flows = append(flows, flow)
+	}
+
+	flow, err := table.getOrCreate("1", func(*udpFlow) { t.Fatal("existing flow should not be created again") })
+	if err != nil || flow != flows[1] {
+		t.Fatal("existing flow should be returned")
+	}
+	if flow, ok := table.get(3); !ok || flow != flows[2] {
+		t.Fatal("flow should be found by ID")
+	}
+	if _, err := table.getOrCreate("3", func(*udpFlow) {}); err == nil {
+		t.Fatal("allocation should fail when all IDs are in use")
+	}
+
+	// ID wraps around to the one no longer used
+	table.byKey.Delete(flows[1].key)
+	table.byID.Delete(strconv.FormatUint(uint64(flows[1].id), 10))
+	flow, err = table.getOrCreate("3", func(*udpFlow) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.id != 2 {
+		t.Fatalf("got ID %d after wraparound, expected 2", flow.id)
+	}
+}
+
+func TestUDPFlowTableExpire(t *testing.T) {
+	table := newUDPFlowTable(50*time.Millisecond, 1)
+	if _, err := table.getOrCreate("a", func(*udpFlow) {}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := table.get(1); ok {
+		t.Fatal("idle flow should expire")
+	}
+	flow, err := table.getOrCreate("b", func(*udpFlow) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.id != 1 {
+		t.Fatalf("got ID %d, expected ID of expired flow", flow.id)
+	}
+}
+
+func TestUDPFlowSamePortDifferentIP(t *testing.T) {
+	// entry allocates a flow for each client address
+	entryFlows := newUDPFlowTable(time.Minute, maxEntryUDPFlowID)
+	addr1 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5000}
+	flow1, err := entryFlows.getOrCreate(udpFlowKey(addr1, 0), func(flow *udpFlow) { flow.addr = addr1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow2, err := entryFlows.getOrCreate(udpFlowKey(addr2, 0), func(flow *udpFlow) { flow.addr = addr2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow1.id == flow2.id {
+		t.Fatal("clients with the same port on different IPs should get different flows")
+	}
+
+	// exit maps flows of different entries with the same flow ID to different
+	// local flows, and replies to where each one comes from
+	c := &Common{udpFlows: newUDPFlowTable(time.Minute, maxExitUDPFlowID)}
+	entryAddr1 := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 6000}
+	entryAddr2 := &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 6000}
+	p1, err := c.mapUDPFlow(newUDPPacket(flow1.id, 0, 0, []byte("a")), "entry1", udpHeaderVersion, entryAddr1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := c.mapUDPFlow(newUDPPacket(flow1.id, 0, 0, []byte("b")), "entry2", 0, entryAddr2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, id2 := udpPacketFlowID(p1), udpPacketFlowID(p2)
+	if id1 == id2 {
+		t.Fatal("flows of different entries should get different local IDs")
+	}
+	for _, tc := range []struct {
+		id      uint32
+		addr    *net.UDPAddr
+		version byte
+	}{{id1, entryAddr1, udpHeaderVersion}, {id2, entryAddr2, 0}} {
+		flow, ok := c.udpFlows.get(tc.id)
+		if !ok {
+			t.Fatalf("flow %d not found", tc.id)
+		}
+		if addr, _ := flow.path(); addr.String() != tc.addr.String() || flow.remoteID != flow1.id || flow.version != tc.version {
+			t.Fatalf("flow %d has path %v, remote ID %d and version %d", tc.id, addr, flow.remoteID, flow.version)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package tuna
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// UDPDropTail drops new packets of a flow when its queue is full.
+	UDPDropTail = "tail"
+	// UDPDropOldest drops the oldest queued packet of a flow to make room for
+	// new one, which suits real-time traffic where late packets are useless.
+	UDPDropOldest = "oldest"
+
+	defaultUDPQueueSize = 64
+)
+
+// UDPFlowStats are the packet counters of a UDP flow.
+type UDPFlowStats struct {
+	FlowID    uint32
+	Queued    int    // packets waiting to be delivered to local endpoint
+	Delivered uint64 // packets delivered to local endpoint
+	Forwarded uint64 // packets forwarded to remote peer
+	Dropped   uint64 // packets dropped because queue or tunnel is full
+}
+
+// udpQueue is a bounded queue of packets to be delivered to the local endpoint
+// of a flow.
+type udpQueue struct {
+	flowID     uint32
+	size       int
+	dropOldest bool
+
+	lock    sync.Mutex
+	packets [][]byte
+	notify  chan struct{}
+	done    chan struct{}
+	closed  bool
+
+	delivered uint64
+	forwarded uint64
+	dropped   uint64
+}
+
+func newUDPQueue(flowID uint32, size int, dropOldest bool) *udpQueue {
+	return &udpQueue{
+		flowID:     flowID,
+		size:       size,
+		dropOldest: dropOldest,
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// push adds packet to queue without blocking, and drops a packet according to
+// drop policy if queue is full.
+func (q *udpQueue) push(b []byte) {
+	q.lock.Lock()
+	if len(q.packets) >= q.size {
+		atomic.AddUint64(&q.dropped, 1)
+		if !q.dropOldest {
+			q.lock.Unlock()
+			return
+		}
+		q.packets[0] = nil
+		q.packets = q.packets[1:]
+	}
+	q.packets = append(q.packets, b)
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop blocks until a packet is available or queue is closed.
+func (q *udpQueue) pop() ([]byte, bool) {
+	for {
+		q.lock.Lock()
+		if len(q.packets) > 0 {
+			b := q.packets[0]
+			q.packets[0] = nil
+			q.packets = q.packets[1:]
+			q.lock.Unlock()
+			return b, true
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-q.done:
+			return nil, false
+		}
+	}
+}
+
+func (q *udpQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.packets = nil
+	close(q.done)
+}
+
+func (q *udpQueue) isClosed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.closed
+}
+
+func (q *udpQueue) stats() UDPFlowStats {
+	q.lock.Lock()
+	queued := len(q.packets)
+	q.lock.Unlock()
+	return UDPFlowStats{
+		FlowID:    q.flowID,
+		Queued:    queued,
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Forwarded: atomic.LoadUint64(&q.forwarded),
+		Dropped:   atomic.LoadUint64(&q.dropped),
+	}
+}
+
+// udpQueues keeps a queue for each flow, so that a flow whose local endpoint
+// is slow or stuck only drops its own packets instead of blocking the shared
+// UDP read loop. Each queue is drained by its own goroutine that calls
+// deliver, and is closed after flow is idle for timeout.
+type udpQueues struct {
+	size       int
+	dropOldest bool
+	deliver    func(b []byte) error
+
+	lock   sync.Mutex
+	queues *cache.Cache
+}
+
+func newUDPQueues(size int, policy string, timeout time.Duration, deliver func(b []byte) error) (*udpQueues, error) {
+	dropOldest := false
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", UDPDropTail:
+	case UDPDropOldest:
+		dropOldest = true
+	default:
+		return nil, fmt.Errorf("unknown udp drop policy %v", policy)
+	}
+	if size <= 0 {
+		size = defaultUDPQueueSize
+	}
+	if timeout <= 0 {
+		timeout = defaultUDPFlowTimeout
+	}
+
+	queues := cache.New(timeout, time.Second)
+	queues.OnEvicted(func(_ string, x interface{}) {
+		x.(*udpQueue).close()
+	})
+
+	return &udpQueues{
+		size:       size,
+		dropOldest: dropOldest,
+		deliver:    deliver,
+		queues:     queues,
+	}, nil
+}
+
+// get returns the queue of flow and keeps it alive, or starts a new one.
+func (qs *udpQueues) get(flowID uint32) *udpQueue {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	key := strconv.FormatUint(uint64(flowID), 10)
+	if x, ok := qs.queues.Get(key); ok {
+		q := x.(*udpQueue)
+		if !q.isClosed() {
+			qs.queues.SetDefault(key, q)
+			return q
+		}
+	}
+	// Get misses a queue that is expired but not yet removed by janitor, which
+	// would be replaced without being closed. Delete closes it by OnEvicted.
+	qs.queues.Delete(key)
+
+	q := newUDPQueue(flowID, qs.size, qs.dropOldest)
+	qs.queues.SetDefault(key, q)
+	go qs.drain(q)
+	return q
+}
+
+// push queues an internal packet received from peer to be delivered to the
+// local endpoint of its flow.
+func (qs *udpQueues) push(b []byte) {
+	qs.get(udpPacketFlowID(b)).push(b)
+}
+
+// forward sends an internal packet to peer through ch without blocking, and
+// counts it as dropped if ch is full.
+func (qs *udpQueues) forward(ch chan []byte, b []byte) {
+	q := qs.get(udpPacketFlowID(b))
+	select {
+	case ch <- b:
+		atomic.AddUint64(&q.forwarded, 1)
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (qs *udpQueues) drain(q *udpQueue) {
+	for {
+		b, ok := q.pop()
+		if !ok {
+			return
+		}
+		err := qs.deliver(b)
+		if err != nil {
+			log.Println("Couldn't deliver udp packet:", err)
+			continue
+		}
+		atomic.AddUint64(&q.delivered, 1)
+	}
+}
+
+func (qs *udpQueues) stats() []UDPFlowStats {
+	items := qs.queues.Items()
+	stats := make([]UDPFlowStats, 0, len(items))
+	for _, item := range items {
+		stats = append(stats, item.Object.(*udpQueue).stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FlowID < stats[j].FlowID
+	})
+	return stats
+}
+
+func (qs *udpQueues) close() {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	for key, item := range qs.queues.Items() {
+		qs.queues.Delete(key)
+		item.Object.(*udpQueue).close()
+	}
+}
+
+// GetUDPFlowStats returns the packet counters of active UDP flows.
+func (c *Common) GetUDPFlowStats() []UDPFlowStats {
+	if c.udpQueues == nil {
+		return nil
+	}
+	return c.udpQueues.stats()
+}
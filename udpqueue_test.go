@@ -0,0 +1,110 @@
+package tuna
+
+import (
+	"testing"
+	"time"
+)
+
+// newBlockedUDPQueues returns queues whose deliver blocks until release is
+// closed, and the channel of packets delivered.
+func newBlockedUDPQueues(t *testing.T, size int, policy string, timeout time.Duration) (*udpQueues, chan []byte, chan struct{}) {
+	delivered := make(chan []byte, 16)
+	release := make(chan struct{})
+	qs, err := newUDPQueues(size, policy, timeout, func(b []byte) error {
+		<-release
+		delivered <- b
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(qs.close)
+	return qs, delivered, release
+}
+
+func receiveUDPPayloads(t *testing.T, delivered chan []byte, n int) []string {
+	payloads := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case b := <-delivered:
+			payloads = append(payloads, string(udpPacketPayload(b)))
+		case <-time.After(time.Second):
+			t.Fatalf("%d packets delivered, expected %d", len(payloads), n)
+		}
+	}
+	return payloads
+}
+
+func TestUDPQueueDropPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{UDPDropTail, []string{"0", "1", "2"}},
+		{UDPDropOldest, []string{"0", "3", "4"}},
+	} {
+		qs, delivered, release := newBlockedUDPQueues(t, 2, tc.policy, time.Minute)
+
+		// first packet is popped and blocks in deliver, the next two fill the
+		// queue and the last two are dropped by policy
+		qs.push(newUDPPacket(1, 0, 0, []byte("0")))
+		deadline := time.Now().Add(time.Second)
+		for qs.get(1).stats().Queued > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("first packet should be popped")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, payload := range []string{"1", "2", "3", "4"} {
+			qs.push(newUDPPacket(1, 0, 0, []byte(payload)))
+		}
+		close(release)
+
+		payloads := receiveUDPPayloads(t, delivered, len(tc.expected))
+		for i := range payloads {
+			if payloads[i] != tc.expected[i] {
+				t.Fatalf("policy %s delivered %v, expected %v", tc.policy, payloads, tc.expected)
+			}
+		}
+		stats := qs.stats()
+		if len(stats) != 1 || stats[0].Dropped != 2 {
+			t.Fatalf("policy %s has stats %+v, expected 2 packets dropped", tc.policy, stats)
+		}
+	}
+
+	if _, err := newUDPQueues(0, "random", 0, nil); err == nil {
+		t.Fatal("unknown drop policy should be rejected")
+	}
+}
+
+func TestUDPQueueExpiry(t *testing.T) {
+	qs, delivered, release := newBlockedUDPQueues(t, 2, UDPDropTail, 50*time.Millisecond)
+	close(release)
+
+	q := qs.get(1)
+	qs.push(newUDPPacket(1, 0, 0, []byte("a")))
+	receiveUDPPayloads(t, delivered, 1)
+
+	// flow comes back after it's expired but before janitor removes it
+	time.Sleep(100 * time.Millisecond)
+	q2 := qs.get(1)
+	if q2 == q {
+		t.Fatal("expired queue should be replaced")
+	}
+	if !q.isClosed() {
+		t.Fatal("expired queue should be closed when replaced")
+	}
+	qs.push(newUDPPacket(1, 0, 0, []byte("b")))
+	if payloads := receiveUDPPayloads(t, delivered, 1); payloads[0] != "b" {
+		t.Fatalf("got %v, expected b", payloads)
+	}
+
+	// janitor closes queue of idle flow
+	deadline := time.Now().Add(3 * time.Second)
+	for !q2.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("idle queue should be closed by janitor")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -17,7 +17,6 @@ import (
 	nknPb "github.com/nknorg/nkn/v2/pb"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/storage"
-	"github.com/xtaci/smux"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -29,9 +28,11 @@ const (
 )
 
 var encryptionAlgoMap = map[string]pb.EncryptionAlgo{
-	"none":              pb.EncryptionAlgo_ENCRYPTION_NONE,
-	"xsalsa20-poly1305": pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305,
-	"aes-gcm":           pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+	"none":               pb.EncryptionAlgo_ENCRYPTION_NONE,
+	"xsalsa20-poly1305":  pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305,
+	"aes-gcm":            pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+	"chacha20-poly1305":  pb.EncryptionAlgo_ENCRYPTION_CHACHA20_POLY1305,
+	"xchacha20-poly1305": pb.EncryptionAlgo_ENCRYPTION_XCHACHA20_POLY1305,
 }
 
 // OnConnectFunc is a wrapper type for gomobile compatibility.
@@ -200,20 +201,19 @@ func sendPingMsg(conn UDPConn, closeChan chan struct{}) {
 	for {
 		select {
 		case <-closeChan:
-			break
+			return
 		default:
 		}
 		err := writeUDPConnMetadata(conn, nil, pingMsg)
 		if err != nil {
 			log.Println("write udp ping msg error:", err)
-			break
+			return
 		}
 		time.Sleep(heartbeatInterval)
 	}
-	return
 }
 
-func readStreamMetadata(stream *smux.Stream) (*pb.StreamMetadata, error) {
+func readStreamMetadata(stream Stream) (*pb.StreamMetadata, error) {
 	b, err := ReadVarBytes(stream, maxStreamMetadataSize)
 	if err != nil {
 		return nil, err
@@ -228,7 +228,7 @@ func readStreamMetadata(stream *smux.Stream) (*pb.StreamMetadata, error) {
 	return streamMetadata, nil
 }
 
-func writeStreamMetadata(stream *smux.Stream, streamMetadata *pb.StreamMetadata) error {
+func writeStreamMetadata(stream Stream, streamMetadata *pb.StreamMetadata) error {
 	b, err := proto.Marshal(streamMetadata)
 	if err != nil {
 		return err
@@ -242,6 +242,30 @@ func writeStreamMetadata(stream *smux.Stream, streamMetadata *pb.StreamMetadata)
 	return nil
 }
 
+func readControlMessage(stream Stream) (*pb.ControlMessage, error) {
+	b, err := ReadVarBytes(stream, maxControlMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	controlMessage := &pb.ControlMessage{}
+	err = proto.Unmarshal(b, controlMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlMessage, nil
+}
+
+func writeControlMessage(stream Stream, controlMessage *pb.ControlMessage) error {
+	b, err := proto.Marshal(controlMessage)
+	if err != nil {
+		return err
+	}
+
+	return WriteVarBytes(stream, b)
+}
+
 // GetFavoriteSeedRPCServer wraps GetFavoriteSeedRPCServerContext with
 // background context.
 func GetFavoriteSeedRPCServer(path, filenamePrefix string, timeout int32, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) ([]string, error) {
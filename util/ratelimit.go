@@ -0,0 +1,70 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits throughput in bytes per second with
+// a burst of one second worth of traffic. A rate of zero means unlimited. It's
+// safe to change the rate while the limiter is in use.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	r := &RateLimiter{}
+	r.SetRate(rate)
+	return r
+}
+
+func (r *RateLimiter) SetRate(rate int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	r.rate = float64(rate)
+	r.tokens = r.rate
+	r.last = time.Now()
+}
+
+func (r *RateLimiter) Rate() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return int(r.rate)
+}
+
+// Wait blocks until n bytes are allowed to pass, and returns how long it has
+// blocked.
+func (r *RateLimiter) Wait(n int) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.lock.Lock()
+	if r.rate == 0 {
+		r.lock.Unlock()
+		return 0
+	}
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return delay
+}
@@ -0,0 +1,196 @@
+// Tests in this package are white-box tests of unexported internals, such as
+// conn handshake, stream wrappers, UDP binding and payment checks, which
+// tests/ can't reach without exporting them. Tests that only need the public
+// API live in tests/. Fixtures shared by tests of this package are here.
+
+package tuna
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/crypto/ed25519"
+	"github.com/nknorg/tuna/pb"
+	"github.com/xtaci/smux"
+)
+
+// newTestCommon returns a Common with a new wallet that can wrap conns.
+func newTestCommon(t *testing.T) *Common {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sk [ed25519.PrivateKeySize]byte
+	copy(sk[:], ed25519.GetPrivateKeyFromSeed(wallet.Seed()))
+	return &Common{
+		Wallet:         wallet,
+		encryptionAlgo: pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+		curveSecretKey: ed25519.PrivateKeyToCurve25519PrivateKey(&sk),
+		sharedKeys:     make(map[string]*[sharedKeySize]byte),
+		muxConfig:      defaultMuxConfig,
+	}
+}
+
+// newTestConnPair returns both ends of a loopback TCP conn. Unlike net.Pipe,
+// writes are buffered so that both sides can write metadata first.
+func newTestConnPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, acceptedConn
+}
+
+// wrapConnResult is the result of wrapConn run in background.
+type wrapConnResult struct {
+	conn net.Conn
+	err  error
+}
+
+// acceptTestConn wraps conn as exit side in background, and returns the
+// channel of result.
+func acceptTestConn(exit *Common, conn net.Conn) chan wrapConnResult {
+	results := make(chan wrapConnResult, 1)
+	go func() {
+		conn, _, err := exit.wrapConn(conn, nil, nil)
+		results <- wrapConnResult{conn, err}
+	}()
+	return results
+}
+
+// newTestWrappedConnPair returns both ends of a loopback TCP conn wrapped by
+// entry and exit, and the conn metadata entry received from exit.
+func newTestWrappedConnPair(t *testing.T, entry, exit *Common) (net.Conn, net.Conn, *pb.ConnectionMetadata) {
+	entryConn, exitConn := newTestConnPair(t)
+	t.Cleanup(func() {
+		entryConn.Close()
+		exitConn.Close()
+	})
+	results := acceptTestConn(exit, exitConn)
+	conn, remoteMetadata, err := entry.wrapConn(entryConn, exit.Wallet.PubKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	return conn, result.conn, remoteMetadata
+}
+
+// newTestStreamPair returns both ends of a smux stream, which is closed in
+// both directions by Close.
+func newTestStreamPair(t *testing.T) (Stream, Stream) {
+	conn1, conn2 := newTestConnPair(t)
+	session1, err := smux.Client(conn1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session2, err := smux.Server(conn2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session1.Close()
+		session2.Close()
+	})
+	stream1, err := session1.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream2, err := session2.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream1, stream2
+}
+
+// newTestSession returns a smux session of entry, streams of which are
+// accepted and discarded by exit side.
+func newTestSession(t *testing.T) Session {
+	entryConn, exitConn := newTestConnPair(t)
+	session, err := newSmuxSession(entryConn, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitSession, err := smux.Server(exitConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := exitSession.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		session.Close()
+		exitSession.Close()
+	})
+	return session
+}
+
+// closerFunc adapts a function to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// testSession is a session without streams that only tracks whether it is
+// closed.
+type testSession struct {
+	lock   sync.Mutex
+	closed bool
+}
+
+func (s *testSession) OpenStream() (Stream, error)   { return nil, ErrClosed }
+func (s *testSession) AcceptStream() (Stream, error) { return nil, ErrClosed }
+func (s *testSession) SetDeadline(time.Time) error   { return nil }
+
+func (s *testSession) IsClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *testSession) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+// testUDPConn records packets written to it.
+type testUDPConn struct {
+	written [][]byte
+}
+
+func (c *testUDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), 0, nil
+}
+
+func (c *testUDPConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) { return 0, nil, net.ErrClosed }
+func (c *testUDPConn) Close() error                                    { return nil }
+func (c *testUDPConn) LocalAddr() net.Addr                             { return nil }
+func (c *testUDPConn) RemoteAddr() net.Addr                            { return nil }
+func (c *testUDPConn) SetWriteBuffer(bytes int) error                  { return nil }
+func (c *testUDPConn) SetReadBuffer(bytes int) error                   { return nil }